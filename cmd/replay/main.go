@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	syncv3 "github.com/matrix-org/sliding-sync"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// Replays a sync v2 recording made with SYNCV3_V2_RECORD into a fresh database, by feeding the
+// recorded responses through the same pollers and handlers as the proxy uses.
+
+const (
+	// Required fields
+	EnvDB      = "SYNCV3_DB"
+	EnvSecret  = "SYNCV3_SECRET"
+	EnvArchive = "SYNCV3_REPLAY_ARCHIVE"
+
+	// Optional fields
+	EnvTimeout = "SYNCV3_REPLAY_TIMEOUT"
+)
+
+var helpMsg = fmt.Sprintf(`
+Environment var
+%s                 Required. The postgres connection string of a fresh database to replay into.
+%s             Required. A secret to use to encrypt access tokens.
+%s     Required. The path to a recording made with SYNCV3_V2_RECORD.
+%s     Default: unset. How long to wait for all devices to finish replaying e.g '10m'. If unset, waits until every poller has finished or stopped.
+`, EnvDB, EnvSecret, EnvArchive, EnvTimeout)
+
+func main() {
+	args := map[string]string{
+		EnvDB:      os.Getenv(EnvDB),
+		EnvSecret:  os.Getenv(EnvSecret),
+		EnvArchive: os.Getenv(EnvArchive),
+		EnvTimeout: os.Getenv(EnvTimeout),
+	}
+	requiredEnvVars := []string{EnvDB, EnvSecret, EnvArchive}
+	for _, requiredEnvVar := range requiredEnvVars {
+		if args[requiredEnvVar] == "" {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be set\n", strings.Join(requiredEnvVars, ", "))
+			os.Exit(1)
+		}
+	}
+
+	client, startSince, err := sync2.NewFixtureClientFromRecording(args[EnvArchive])
+	if err != nil {
+		panic(err)
+	}
+	// we don't want to wait around once a device has replayed everything
+	client.ExhaustedTimeout = time.Second
+	fmt.Printf("Loaded recording with %d devices\n", len(startSince))
+
+	h2, _ := syncv3.Setup("", args[EnvDB], args[EnvSecret], syncv3.Opts{
+		V2Client: client,
+	})
+
+	// Pretend each recorded device has logged in to the proxy, starting from the first recorded
+	// since token. StartV2Pollers will then poll them as it does at startup.
+	v2Store := sync2.NewStore(args[EnvDB], args[EnvSecret])
+	err = sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		for pid := range startSince {
+			if _, err := v2Store.TokensTable.Insert(txn, sync2.FixtureAccessToken(pid), pid.UserID, pid.DeviceID, time.Now()); err != nil {
+				return err
+			}
+			if err := v2Store.DevicesTable.InsertDevice(txn, pid.UserID, pid.DeviceID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	for pid, since := range startSince {
+		if err = v2Store.DevicesTable.UpdateDeviceSince(pid.UserID, pid.DeviceID, since); err != nil {
+			panic(err)
+		}
+	}
+
+	var timeout <-chan time.Time
+	if args[EnvTimeout] != "" {
+		d, err := time.ParseDuration(args[EnvTimeout])
+		if err != nil || d <= 0 {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be a positive duration e.g '10m'\n", EnvTimeout)
+			os.Exit(1)
+		}
+		timeout = time.After(d)
+	}
+
+	start := time.Now()
+	pollersStarted := make(chan struct{})
+	go func() {
+		h2.StartV2Pollers()
+		close(pollersStarted)
+	}()
+	// Wait until every device has replayed its recording. Once all pollers have been started, a device
+	// which isn't polling will never finish e.g because its poller was terminated by a 401.
+	var unfinished []string
+	started := false
+	timedOut := false
+	for {
+		select {
+		case <-pollersStarted:
+			started = true
+			pollersStarted = nil
+		case <-timeout:
+			timedOut = true
+		case <-time.After(100 * time.Millisecond):
+		}
+		unfinished = unfinished[:0]
+		numStopped := 0
+		for pid := range startSince {
+			if client.Exhausted(pid) {
+				continue
+			}
+			status := "still polling"
+			if !started {
+				status = "poller not started"
+			} else if !h2.IsPolling(pid.UserID, pid.DeviceID) {
+				status = "poller stopped"
+				numStopped++
+			}
+			unfinished = append(unfinished, fmt.Sprintf("%s %s: %s", pid.UserID, pid.DeviceID, status))
+		}
+		if len(unfinished) == 0 || timedOut || (started && numStopped == len(unfinished)) {
+			break
+		}
+	}
+	h2.Teardown()
+	v2Store.Teardown()
+	if len(unfinished) > 0 {
+		fmt.Printf("Replayed %d/%d devices in %s. These devices did not finish:\n", len(startSince)-len(unfinished), len(startSince), time.Since(start))
+		sort.Strings(unfinished)
+		for _, device := range unfinished {
+			fmt.Printf("  %s\n", device)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("Replayed %d devices in %s\n", len(startSince), time.Since(start))
+}
@@ -6,6 +6,7 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -15,6 +16,7 @@ import (
 	syncv3 "github.com/matrix-org/sliding-sync"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/handler"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -40,12 +42,28 @@ const (
 	EnvJaeger     = "SYNCV3_JAEGER_URL"
 	EnvSentryDsn  = "SYNCV3_SENTRY_DSN"
 	EnvLogLevel   = "SYNCV3_LOG_LEVEL"
+	EnvV2Adapter  = "SYNCV3_V2_ADAPTER"
+	EnvSyncWorker = "SYNCV3_SYNAPSE_SYNC_WORKER"
+	EnvFixtures   = "SYNCV3_V2_FIXTURES"
+	EnvRecord     = "SYNCV3_V2_RECORD"
+	EnvCoalesce   = "SYNCV3_COALESCE_SHARED_ROOMS"
+	EnvUserLimit  = "SYNCV3_RATE_LIMIT_USER"
+	EnvIPLimit    = "SYNCV3_RATE_LIMIT_IP"
+	EnvTrustXFF   = "SYNCV3_TRUST_X_FORWARDED_FOR"
+	EnvPushRules  = "SYNCV3_EVALUATE_PUSH_RULES"
+	EnvCacheTTL   = "SYNCV3_USER_CACHE_IDLE_TTL"
+	EnvMaxRooms   = "SYNCV3_MAX_CACHED_ROOMS"
+	EnvCheckpoint = "SYNCV3_CHECKPOINT_INTERVAL"
+	EnvConnMem    = "SYNCV3_MAX_CONN_MEMORY_MB"
+	EnvTotalMem   = "SYNCV3_MAX_TOTAL_CONN_MEMORY_MB"
+	EnvPartitions = "SYNCV3_EVENTS_PARTITIONS"
 )
 
 var helpMsg = fmt.Sprintf(`
 Environment var
 %s     Required. The destination homeserver to talk to (CS API HTTPS URL) e.g 'https://matrix-client.matrix.org'
 %s         Required. The postgres connection string: https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
+            or 'sqlite:' followed by the path to a SQLite database file e.g 'sqlite:/var/lib/syncv3/syncv3.db', for small deployments.
 %s     Required. A secret to use to encrypt access tokens. Must remain the same for the lifetime of the database.
 %s   Default: 0.0.0.0:8008.  The interface and port to listen on.
 %s   Default: unset. Path to a certificate file to serve to HTTPS clients. Specifying this enables TLS on the bound address.
@@ -55,7 +73,26 @@ Environment var
 %s Default: unset. The Jaeger URL to send spans to e.g http://localhost:14268/api/traces - if unset does not send OTLP traces.
 %s Default: unset. The Sentry DSN to report events to e.g https://sliding-sync@sentry.example.com/123 - if unset does not send sentry events.
 %s  Default: info. The level of verbosity for messages logged. Available values are trace, debug, info, warn, error and fatal
-`, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvJaeger, EnvSentryDsn, EnvLogLevel)
+%s Default: csapi. How to talk to the homeserver. Available values are csapi, synapse and fixture
+%s Default: unset. With the synapse adapter, the URL of a Synapse sync worker to send /sync requests to directly. Other requests are sent to the homeserver as with the csapi adapter.
+%s Default: unset. With the fixture adapter, the directory containing captured sync v2 responses to replay.
+%s   Default: unset. Path to a file to record all sync v2 responses to, for replaying with cmd/replay. Contains sensitive data!
+%s Default: unset. If 1, only one poller fetches the timeline of each shared room. Reduces load, but transaction IDs and unread counts may be less accurate.
+%s Default: unset. Rate limit for sliding sync requests per user, as 'requests_per_sec:burst' e.g '5:20'.
+%s   Default: unset. Rate limit for sliding sync requests per client IP, as 'requests_per_sec:burst' e.g '10:50'.
+%s Default: unset. The number of reverse proxies in front of the proxy which append to X-Forwarded-For, used to identify client IPs. Only set this behind reverse proxies.
+%s Default: unset. If 1, evaluate push rules to calculate notification counts for unencrypted rooms without waiting for the homeserver.
+%s Default: unset. How long to keep a user's cache in memory after their last connection closes e.g '1h'. If unset, caches are kept forever.
+%s Default: unset. If set, load room metadata on demand and keep roughly this many rooms in memory, rather than loading every room at startup.
+%s Default: unset. How often to checkpoint in-memory state to the database e.g '10m', so restarts only process events since the last checkpoint. If unset, checkpoints are not used.
+%s Default: unset. The approximate memory in MB a single connection may use before it is expired, forcing the client to start a new connection.
+%s Default: unset. The approximate memory in MB all connections may use. When exceeded, the largest connections are expired first.
+%s Default: unset. If set, partition new or empty events tables by room into this many partitions. Existing events are partitioned with 'syncv3 migrate partition-events' whilst the proxy is stopped. Postgres only.
+
+Database migrations are applied on startup. To inspect or apply them without starting the proxy, run 'syncv3 migrate -h'.
+`, EnvServer, EnvDB, EnvSecret, EnvBindAddr, EnvTLSCert, EnvTLSKey, EnvPPROF, EnvPrometheus, EnvJaeger, EnvSentryDsn, EnvLogLevel,
+	EnvV2Adapter, EnvSyncWorker, EnvFixtures, EnvRecord, EnvCoalesce, EnvUserLimit, EnvIPLimit, EnvTrustXFF, EnvPushRules, EnvCacheTTL, EnvMaxRooms, EnvCheckpoint,
+	EnvConnMem, EnvTotalMem, EnvPartitions)
 
 func defaulting(in, dft string) string {
 	if in == "" {
@@ -81,6 +118,21 @@ func main() {
 		EnvJaeger:     os.Getenv(EnvJaeger),
 		EnvSentryDsn:  os.Getenv(EnvSentryDsn),
 		EnvLogLevel:   os.Getenv(EnvLogLevel),
+		EnvV2Adapter:  defaulting(os.Getenv(EnvV2Adapter), "csapi"),
+		EnvSyncWorker: os.Getenv(EnvSyncWorker),
+		EnvFixtures:   os.Getenv(EnvFixtures),
+		EnvRecord:     os.Getenv(EnvRecord),
+		EnvCoalesce:   os.Getenv(EnvCoalesce),
+		EnvUserLimit:  os.Getenv(EnvUserLimit),
+		EnvIPLimit:    os.Getenv(EnvIPLimit),
+		EnvTrustXFF:   os.Getenv(EnvTrustXFF),
+		EnvPushRules:  os.Getenv(EnvPushRules),
+		EnvCacheTTL:   os.Getenv(EnvCacheTTL),
+		EnvMaxRooms:   os.Getenv(EnvMaxRooms),
+		EnvCheckpoint: os.Getenv(EnvCheckpoint),
+		EnvConnMem:    os.Getenv(EnvConnMem),
+		EnvTotalMem:   os.Getenv(EnvTotalMem),
+		EnvPartitions: os.Getenv(EnvPartitions),
 	}
 	requiredEnvVars := []string{EnvServer, EnvDB, EnvSecret, EnvBindAddr}
 	for _, requiredEnvVar := range requiredEnvVars {
@@ -157,15 +209,112 @@ func main() {
 		}
 	}
 
-	err := sync2.MigrateDeviceIDs(args[EnvServer], args[EnvDB], args[EnvSecret], true)
+	v2Client, err := v2ClientAdapter(args)
 	if err != nil {
-		panic(err)
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s\n", err)
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate(args, os.Args[2:], v2Client))
+	}
+	var recorder *sync2.RecordingClient
+	if args[EnvRecord] != "" {
+		fmt.Printf("Recording sync v2 responses to %s\n", args[EnvRecord])
+		recorder, err = sync2.NewRecordingClient(v2Client, args[EnvRecord])
+		if err != nil {
+			panic(err)
+		}
+		v2Client = recorder
+	}
+
+	var rateLimits handler.RateLimits
+	if args[EnvTrustXFF] != "" {
+		rateLimits.TrustedProxies, err = strconv.Atoi(args[EnvTrustXFF])
+		if err != nil || rateLimits.TrustedProxies < 0 {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be a number of reverse proxies e.g '1'\n", EnvTrustXFF)
+			os.Exit(1)
+		}
+	}
+	rateLimits.UserRequestsPerSec, rateLimits.UserBurst, err = parseRateLimit(args[EnvUserLimit])
+	if err == nil {
+		rateLimits.IPRequestsPerSec, rateLimits.IPBurst, err = parseRateLimit(args[EnvIPLimit])
+	}
+	if err != nil {
+		fmt.Print(helpMsg)
+		fmt.Printf("\n%s\n", err)
+		os.Exit(1)
+	}
+
+	var userCacheIdleTTL time.Duration
+	if args[EnvCacheTTL] != "" {
+		userCacheIdleTTL, err = time.ParseDuration(args[EnvCacheTTL])
+		if err != nil || userCacheIdleTTL < 0 {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be a positive duration e.g '1h'\n", EnvCacheTTL)
+			os.Exit(1)
+		}
+	}
+
+	var maxCachedRooms int
+	if args[EnvMaxRooms] != "" {
+		maxCachedRooms, err = strconv.Atoi(args[EnvMaxRooms])
+		if err != nil || maxCachedRooms <= 0 {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be a positive number of rooms\n", EnvMaxRooms)
+			os.Exit(1)
+		}
+	}
+
+	var checkpointInterval time.Duration
+	if args[EnvCheckpoint] != "" {
+		checkpointInterval, err = time.ParseDuration(args[EnvCheckpoint])
+		if err != nil || checkpointInterval <= 0 {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be a positive duration e.g '10m'\n", EnvCheckpoint)
+			os.Exit(1)
+		}
+	}
+
+	var maxConnMemoryBytes, maxTotalConnMemoryBytes int64
+	for envVar, limit := range map[string]*int64{EnvConnMem: &maxConnMemoryBytes, EnvTotalMem: &maxTotalConnMemoryBytes} {
+		if args[envVar] == "" {
+			continue
+		}
+		mb, err := strconv.ParseInt(args[envVar], 10, 64)
+		if err != nil || mb <= 0 {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be a positive number of MB\n", envVar)
+			os.Exit(1)
+		}
+		*limit = mb * 1024 * 1024
+	}
+
+	var eventPartitions int
+	if args[EnvPartitions] != "" {
+		eventPartitions, err = strconv.Atoi(args[EnvPartitions])
+		if err != nil || eventPartitions <= 0 {
+			fmt.Print(helpMsg)
+			fmt.Printf("\n%s must be a positive number of partitions\n", EnvPartitions)
+			os.Exit(1)
+		}
 	}
 
 	h2, h3 := syncv3.Setup(args[EnvServer], args[EnvDB], args[EnvSecret], syncv3.Opts{
-		AddPrometheusMetrics: args[EnvPrometheus] != "",
-		DBMaxConns:           100,
-		DBConnMaxIdleTime:    time.Hour,
+		AddPrometheusMetrics:    args[EnvPrometheus] != "",
+		DBMaxConns:              100,
+		DBConnMaxIdleTime:       time.Hour,
+		V2Client:                v2Client,
+		CoalesceSharedRooms:     args[EnvCoalesce] == "1",
+		RateLimits:              rateLimits,
+		EvaluatePushRules:       args[EnvPushRules] == "1",
+		UserCacheIdleTTL:        userCacheIdleTTL,
+		MaxCachedRooms:          maxCachedRooms,
+		CheckpointInterval:      checkpointInterval,
+		MaxConnMemoryBytes:      maxConnMemoryBytes,
+		MaxTotalConnMemoryBytes: maxTotalConnMemoryBytes,
+		EventPartitions:         eventPartitions,
 	})
 
 	go h2.StartV2Pollers()
@@ -183,6 +332,55 @@ func main() {
 
 	syncv3.RunSyncV3Server(h3, args[EnvBindAddr], args[EnvServer], args[EnvTLSCert], args[EnvTLSKey])
 	WaitForShutdown(args[EnvSentryDsn] != "")
+	if recorder != nil {
+		if err = recorder.Close(); err != nil {
+			fmt.Printf("Failed to close recording: %s", err)
+		}
+	}
+}
+
+// v2ClientAdapter returns the sync2.Client to use when talking to the homeserver.
+func v2ClientAdapter(args map[string]string) (sync2.Client, error) {
+	httpClient := &http.Client{
+		Timeout: 5 * time.Minute,
+	}
+	switch args[EnvV2Adapter] {
+	case "csapi":
+		return &sync2.HTTPClient{
+			Client:            httpClient,
+			DestinationServer: args[EnvServer],
+		}, nil
+	case "synapse":
+		return sync2.NewSynapseClient(httpClient, args[EnvServer], args[EnvSyncWorker]), nil
+	case "fixture":
+		if args[EnvFixtures] == "" {
+			return nil, fmt.Errorf("%s must be set when using the fixture adapter", EnvFixtures)
+		}
+		return sync2.NewFixtureClientFromDir(args[EnvFixtures])
+	default:
+		return nil, fmt.Errorf("unknown %s: %s", EnvV2Adapter, args[EnvV2Adapter])
+	}
+}
+
+// parseRateLimit parses a rate limit of the form 'requests_per_sec:burst'. An empty string
+// disables the limit. If the burst is omitted, it defaults to the rate rounded up.
+func parseRateLimit(in string) (float64, int, error) {
+	if in == "" {
+		return 0, 0, nil
+	}
+	rateStr, burstStr, hasBurst := strings.Cut(in, ":")
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil || rate <= 0 {
+		return 0, 0, fmt.Errorf("invalid rate limit '%s': rate must be a positive number", in)
+	}
+	burst := int(rate + 0.999)
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return 0, 0, fmt.Errorf("invalid rate limit '%s': burst must be a positive integer", in)
+		}
+	}
+	return rate, burst, nil
 }
 
 // WaitForShutdown blocks until the process receives a SIGINT or SIGTERM signal
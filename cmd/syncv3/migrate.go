@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/migrations"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+const migrateUsage = `Usage: syncv3 migrate [-dry-run] [-batch-size N] COMMAND
+
+Migrates the database at %s. Migrations are also applied when the proxy starts.
+
+Commands:
+  status            List migrations and whether they have been applied. The default.
+  up                Apply all migrations which have not been applied.
+  down VERSION      Revert all applied migrations after VERSION.
+  partition-events  Partition the events table into %s partitions. Events are copied
+                    in batches, so this can be interrupted and run again to resume.
+                    The proxy must not be running. Postgres only.
+
+`
+
+// migrate runs the migrate subcommand, returning the exit code.
+func migrate(args map[string]string, cmdArgs []string, v2Client sync2.Client) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "run migrations then roll them back, rather than committing them")
+	batchSize := flags.Int("batch-size", 10000, "the number of events to copy at a time for partition-events")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), migrateUsage, EnvDB, EnvPartitions)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(cmdArgs); err != nil {
+		return 2
+	}
+	command := flags.Arg(0)
+	if command == "" {
+		command = "status"
+	}
+	var downVersion int64
+	switch {
+	case command == "down" && flags.NArg() == 2:
+		var err error
+		downVersion, err = strconv.ParseInt(flags.Arg(1), 10, 64)
+		if err != nil || downVersion < 0 {
+			fmt.Fprintf(os.Stderr, "VERSION must be a migration version, or 0 to revert all migrations\n")
+			return 2
+		}
+	case (command == "status" || command == "up") && flags.NArg() <= 1:
+	case command == "partition-events" && flags.NArg() == 1:
+		if *dryRun {
+			fmt.Fprintf(os.Stderr, "-dry-run is not supported by partition-events\n")
+			return 2
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	db, err := sqlutil.Open(args[EnvDB])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open SQL DB: %s\n", err)
+		return 1
+	}
+	defer db.Close()
+	var numPartitions int
+	if args[EnvPartitions] != "" {
+		numPartitions, err = strconv.Atoi(args[EnvPartitions])
+		if err != nil || numPartitions <= 0 {
+			fmt.Fprintf(os.Stderr, "%s must be a positive number of partitions\n", EnvPartitions)
+			return 2
+		}
+	}
+	if command == "partition-events" {
+		if numPartitions == 0 || *batchSize <= 0 {
+			fmt.Fprintf(os.Stderr, "%s must be set and -batch-size must be positive\n", EnvPartitions)
+			return 2
+		}
+		if err = state.PartitionEventTable(db, numPartitions, *batchSize); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to partition the events table, run again to resume: %s\n", err)
+			return 1
+		}
+		return 0
+	}
+	migrator, err := migrations.NewMigrator(db, migrations.All(migrations.Config{
+		Secret:          args[EnvSecret],
+		WhoAmIClient:    v2Client,
+		EventPartitions: numPartitions,
+	}))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	migrator.DryRun = *dryRun
+
+	var changed []migrations.Migration
+	verb := "Applied"
+	switch command {
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to get migration status: %s\n", err)
+			return 1
+		}
+		for _, status := range statuses {
+			applied := "not applied"
+			if !status.AppliedAt.IsZero() {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d %-30s %s\n", status.Version, status.Name, applied)
+		}
+		return 0
+	case "up":
+		changed, err = migrator.Up()
+	case "down":
+		verb = "Reverted"
+		changed, err = migrator.Down(downVersion)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration failed, no changes were made: %s\n", err)
+		return 1
+	}
+	if *dryRun {
+		verb += " then rolled back (dry run)"
+	}
+	fmt.Printf("%s %d migrations\n", verb, len(changed))
+	for _, m := range changed {
+		fmt.Printf("%4d %s\n", m.Version, m.Name)
+	}
+	return 0
+}
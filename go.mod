@@ -12,6 +12,7 @@ require (
 	github.com/lib/pq v1.10.1
 	github.com/matrix-org/gomatrixserverlib v0.0.0-20230105074811-965b10ae73ab
 	github.com/matrix-org/util v0.0.0-20200807132607-55161520e1d4
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/prometheus/client_golang v1.13.0
 	github.com/rs/zerolog v1.29.0
 	github.com/tidwall/gjson v1.14.3
@@ -28,8 +28,6 @@ type DeviceData struct {
 	// Set whenever this field arrives down the v2 poller, and it replaces what was previously there.
 	FallbackKeyTypes []string `json:"fallback"`
 
-	DeviceLists DeviceLists `json:"dl"`
-
 	// bitset for which device data changes are present. They accumulate until they get swapped over
 	// when they get reset
 	ChangedBits int `json:"c"`
@@ -113,7 +111,6 @@ func (d *DeviceDataMap) Update(dd DeviceData) DeviceData {
 	if dd.FallbackKeyTypes != nil {
 		existing.FallbackKeyTypes = dd.FallbackKeyTypes
 	}
-	existing.DeviceLists = existing.DeviceLists.Combine(dd.DeviceLists)
 
 	d.deviceDataMap[key] = existing
 
@@ -5,33 +5,6 @@ const (
 	DeviceListLeft    = 2
 )
 
-type DeviceLists struct {
-	// map user_id -> DeviceList enum
-	New  map[string]int `json:"n"`
-	Sent map[string]int `json:"s"`
-}
-
-func (dl DeviceLists) Combine(newer DeviceLists) DeviceLists {
-	n := dl.New
-	if n == nil {
-		n = make(map[string]int)
-	}
-	for k, v := range newer.New {
-		n[k] = v
-	}
-	s := dl.Sent
-	if s == nil {
-		s = make(map[string]int)
-	}
-	for k, v := range newer.Sent {
-		s[k] = v
-	}
-	return DeviceLists{
-		New:  n,
-		Sent: s,
-	}
-}
-
 func ToDeviceListChangesMap(changed, left []string) map[string]int {
 	if len(changed) == 0 && len(left) == 0 {
 		return nil
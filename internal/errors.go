@@ -7,6 +7,7 @@ import (
 	"github.com/getsentry/sentry-go"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/rs/zerolog"
 )
@@ -20,6 +21,8 @@ type HandlerError struct {
 	StatusCode int
 	Err        error
 	ErrCode    string
+	// Set when ErrCode is M_LIMIT_EXCEEDED
+	RetryAfterMs int64
 }
 
 func (e *HandlerError) Error() string {
@@ -31,14 +34,16 @@ func (e *HandlerError) Unwrap() error {
 }
 
 type jsonError struct {
-	Err  string `json:"error"`
-	Code string `json:"errcode,omitempty"`
+	Err          string `json:"error"`
+	Code         string `json:"errcode,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
 }
 
 func (e HandlerError) JSON() []byte {
 	je := jsonError{
-		Err:  e.Error(),
-		Code: e.ErrCode,
+		Err:          e.Error(),
+		Code:         e.ErrCode,
+		RetryAfterMs: e.RetryAfterMs,
 	}
 	b, _ := json.Marshal(je)
 	return b
@@ -52,6 +57,17 @@ func ExpiredSessionError() *HandlerError {
 	}
 }
 
+// RateLimitedError is returned when a client has made too many requests. The client should wait
+// retryAfter before trying again.
+func RateLimitedError(retryAfter time.Duration) *HandlerError {
+	return &HandlerError{
+		StatusCode:   429,
+		Err:          fmt.Errorf("too many requests"),
+		ErrCode:      "M_LIMIT_EXCEEDED",
+		RetryAfterMs: retryAfter.Milliseconds(),
+	}
+}
+
 // Assert that the expression is true, similar to assert() in C. If expr is false, print or panic.
 //
 // If expr is false and SYNCV3_DEBUG=1 then the program panics.
@@ -1,8 +1,10 @@
 package internal
 
 import (
+	"encoding/json"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestAssertion(t *testing.T) {
@@ -44,3 +46,20 @@ func try(t *testing.T, shouldPanic bool, fn func()) {
 	}()
 	fn()
 }
+
+func TestRateLimitedErrorJSON(t *testing.T) {
+	herr := RateLimitedError(1500 * time.Millisecond)
+	if herr.StatusCode != 429 {
+		t.Fatalf("got status %d want 429", herr.StatusCode)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(herr.JSON(), &got); err != nil {
+		t.Fatalf("failed to unmarshal JSON: %s", err)
+	}
+	if got["errcode"] != "M_LIMIT_EXCEEDED" {
+		t.Errorf("got errcode %v want M_LIMIT_EXCEEDED", got["errcode"])
+	}
+	if got["retry_after_ms"] != float64(1500) {
+		t.Errorf("got retry_after_ms %v want 1500", got["retry_after_ms"])
+	}
+}
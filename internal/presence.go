@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Presence is the latest known presence of a user, extracted from an m.presence event.
+type Presence struct {
+	UserID          string `db:"user_id"`
+	Presence        string `db:"presence"`
+	StatusMsg       string `db:"status_msg"`
+	CurrentlyActive bool   `db:"currently_active"`
+	// The unix timestamp in milliseconds when the user was last active, or 0 if unknown. Presence
+	// events use relative times, so we store absolute times and convert when sending to clients.
+	LastActiveTS int64 `db:"last_active_ts"`
+}
+
+// NewPresenceFromEvent parses an m.presence event received at `now`.
+func NewPresenceFromEvent(ev json.RawMessage, now time.Time) (Presence, error) {
+	parsed := gjson.ParseBytes(ev)
+	if parsed.Get("type").Str != "m.presence" {
+		return Presence{}, fmt.Errorf("not an m.presence event: %s", parsed.Get("type").Str)
+	}
+	p := Presence{
+		UserID:          parsed.Get("sender").Str,
+		Presence:        parsed.Get("content.presence").Str,
+		StatusMsg:       parsed.Get("content.status_msg").Str,
+		CurrentlyActive: parsed.Get("content.currently_active").Bool(),
+	}
+	if p.UserID == "" || p.Presence == "" {
+		return Presence{}, fmt.Errorf("m.presence event missing sender or presence")
+	}
+	if lastActiveAgo := parsed.Get("content.last_active_ago"); lastActiveAgo.Exists() {
+		p.LastActiveTS = now.UnixMilli() - lastActiveAgo.Int()
+	}
+	return p, nil
+}
+
+// Event returns this presence as an m.presence event to send to clients at `now`.
+func (p Presence) Event(now time.Time) json.RawMessage {
+	content := map[string]interface{}{
+		"presence": p.Presence,
+	}
+	if p.StatusMsg != "" {
+		content["status_msg"] = p.StatusMsg
+	}
+	if p.CurrentlyActive {
+		content["currently_active"] = true
+	}
+	if p.LastActiveTS > 0 {
+		lastActiveAgo := now.UnixMilli() - p.LastActiveTS
+		if lastActiveAgo < 0 {
+			lastActiveAgo = 0
+		}
+		content["last_active_ago"] = lastActiveAgo
+	}
+	ev, _ := json.Marshal(map[string]interface{}{
+		"type":    "m.presence",
+		"sender":  p.UserID,
+		"content": content,
+	})
+	return ev
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPresenceRoundTrip(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	ev := json.RawMessage(`{"type":"m.presence","sender":"@alice:localhost","content":{"presence":"online","status_msg":"hi","currently_active":true,"last_active_ago":5000}}`)
+	p, err := NewPresenceFromEvent(ev, now)
+	if err != nil {
+		t.Fatalf("NewPresenceFromEvent: %s", err)
+	}
+	want := Presence{
+		UserID:          "@alice:localhost",
+		Presence:        "online",
+		StatusMsg:       "hi",
+		CurrentlyActive: true,
+		LastActiveTS:    now.UnixMilli() - 5000,
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Fatalf("got %+v want %+v", p, want)
+	}
+
+	// 2s later, last_active_ago should have increased
+	var got struct {
+		Type    string `json:"type"`
+		Sender  string `json:"sender"`
+		Content struct {
+			Presence        string `json:"presence"`
+			StatusMsg       string `json:"status_msg"`
+			CurrentlyActive bool   `json:"currently_active"`
+			LastActiveAgo   int64  `json:"last_active_ago"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(p.Event(now.Add(2*time.Second)), &got); err != nil {
+		t.Fatalf("failed to unmarshal event: %s", err)
+	}
+	if got.Type != "m.presence" || got.Sender != want.UserID || got.Content.Presence != "online" ||
+		got.Content.StatusMsg != "hi" || !got.Content.CurrentlyActive || got.Content.LastActiveAgo != 7000 {
+		t.Fatalf("unexpected event: %+v", got)
+	}
+}
+
+func TestPresenceFromInvalidEvent(t *testing.T) {
+	testCases := []string{
+		`{"type":"m.typing","sender":"@alice:localhost","content":{"presence":"online"}}`,
+		`{"type":"m.presence","content":{"presence":"online"}}`,
+		`{"type":"m.presence","sender":"@alice:localhost","content":{}}`,
+	}
+	for _, tc := range testCases {
+		if _, err := NewPresenceFromEvent(json.RawMessage(tc), time.Now()); err == nil {
+			t.Errorf("expected error for %s", tc)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// PushRuleContext provides the information about the room and user needed to evaluate push rule
+// conditions which cannot be worked out from the event alone. Functions are only called if a
+// rule needs them, as they may be expensive.
+type PushRuleContext struct {
+	// The number of joined members in the room.
+	RoomMemberCount int
+	// Returns the display name of the user the push rules belong to, in this room.
+	UserDisplayName func() string
+	// Returns true if the sender of the event has permission to trigger notifications of this
+	// kind e.g "room" for @room notifications.
+	SenderCanNotify func(notificationKey string) bool
+}
+
+// PushRules are the push rules for a user, parsed from the m.push_rules account data event. Only
+// the `global` ruleset is used as per the spec.
+//
+// See https://spec.matrix.org/v1.7/client-server-api/#push-rules
+type PushRules struct {
+	// rules in priority order: override, content, room, sender, underride
+	rules []pushRule
+}
+
+type pushRule struct {
+	kind       string
+	ruleID     string
+	enabled    bool
+	conditions []pushCondition
+	notify     bool
+	highlight  bool
+}
+
+type pushCondition struct {
+	kind    string
+	key     string
+	pattern *regexp.Regexp
+	value   gjson.Result
+	is      string
+}
+
+var pushRuleKinds = []string{"override", "content", "room", "sender", "underride"}
+
+// NewPushRulesFromEvent parses the m.push_rules account data event. Rules with unknown
+// conditions never match, as per the spec.
+func NewPushRulesFromEvent(ev json.RawMessage) *PushRules {
+	global := gjson.GetBytes(ev, "content.global")
+	var pr PushRules
+	for _, kind := range pushRuleKinds {
+		for _, r := range global.Get(kind).Array() {
+			rule := pushRule{
+				kind:    kind,
+				ruleID:  r.Get("rule_id").Str,
+				enabled: !r.Get("enabled").Exists() || r.Get("enabled").Bool(),
+			}
+			switch kind {
+			case "content":
+				// content rules are a shorthand for matching the body against the pattern
+				rule.conditions = []pushCondition{
+					newEventMatchCondition("content.body", r.Get("pattern").Str),
+				}
+			case "room":
+				rule.conditions = []pushCondition{{
+					kind:  "event_property_is",
+					key:   "room_id",
+					value: gjson.Parse(strconv.Quote(rule.ruleID)),
+				}}
+			case "sender":
+				rule.conditions = []pushCondition{{
+					kind:  "event_property_is",
+					key:   "sender",
+					value: gjson.Parse(strconv.Quote(rule.ruleID)),
+				}}
+			default:
+				for _, c := range r.Get("conditions").Array() {
+					rule.conditions = append(rule.conditions, newPushCondition(c))
+				}
+			}
+			for _, action := range r.Get("actions").Array() {
+				if action.Str == "notify" {
+					rule.notify = true
+				} else if action.Get("set_tweak").Str == "highlight" {
+					// the value defaults to true if it is missing
+					rule.highlight = !action.Get("value").Exists() || action.Get("value").Bool()
+				}
+			}
+			pr.rules = append(pr.rules, rule)
+		}
+	}
+	return &pr
+}
+
+func newPushCondition(c gjson.Result) pushCondition {
+	kind := c.Get("kind").Str
+	switch kind {
+	case "event_match":
+		return newEventMatchCondition(c.Get("key").Str, c.Get("pattern").Str)
+	case "event_property_is", "event_property_contains":
+		return pushCondition{
+			kind:  kind,
+			key:   c.Get("key").Str,
+			value: c.Get("value"),
+		}
+	case "room_member_count":
+		return pushCondition{
+			kind: kind,
+			is:   c.Get("is").Str,
+		}
+	case "sender_notification_permission":
+		return pushCondition{
+			kind: kind,
+			key:  c.Get("key").Str,
+		}
+	default:
+		// includes contains_display_name, which has no fields
+		return pushCondition{
+			kind: kind,
+		}
+	}
+}
+
+func newEventMatchCondition(key, pattern string) pushCondition {
+	// The pattern is a case-insensitive glob. Bodies are matched on word boundaries, every other
+	// key must match the entire value.
+	var sb strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*?")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	glob := sb.String()
+	var expr string
+	if key == "content.body" {
+		expr = `(?i)(^|\W)` + glob + `(\W|$)`
+	} else {
+		expr = `(?is)^` + glob + `$`
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return pushCondition{kind: "invalid"}
+	}
+	return pushCondition{
+		kind:    "event_match",
+		key:     key,
+		pattern: re,
+	}
+}
+
+// Evaluate the push rules against this event, returning whether it should increment the
+// notification count and/or highlight count.
+func (p *PushRules) Evaluate(ev json.RawMessage, ctx PushRuleContext) (notify, highlight bool) {
+	if p == nil {
+		return false, false
+	}
+	parsed := gjson.ParseBytes(ev)
+	for _, rule := range p.rules {
+		if !rule.enabled || !rule.matches(parsed, ctx) {
+			continue
+		}
+		// the first matching rule wins
+		return rule.notify, rule.notify && rule.highlight
+	}
+	return false, false
+}
+
+func (r *pushRule) matches(ev gjson.Result, ctx PushRuleContext) bool {
+	for _, c := range r.conditions {
+		if !c.matches(ev, ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *pushCondition) matches(ev gjson.Result, ctx PushRuleContext) bool {
+	switch c.kind {
+	case "event_match":
+		val := ev.Get(c.key)
+		return val.Type == gjson.String && c.pattern.MatchString(val.Str)
+	case "event_property_is":
+		val := ev.Get(c.key)
+		return val.Exists() && val.Type == c.value.Type && val.Raw == c.value.Raw
+	case "event_property_contains":
+		for _, val := range ev.Get(c.key).Array() {
+			if val.Type == c.value.Type && val.Raw == c.value.Raw {
+				return true
+			}
+		}
+		return false
+	case "contains_display_name":
+		if ctx.UserDisplayName == nil {
+			return false
+		}
+		displayName := ctx.UserDisplayName()
+		body := ev.Get("content.body")
+		if displayName == "" || body.Type != gjson.String {
+			return false
+		}
+		re, err := regexp.Compile(`(?i)(^|\W)` + regexp.QuoteMeta(displayName) + `(\W|$)`)
+		return err == nil && re.MatchString(body.Str)
+	case "room_member_count":
+		return memberCountMatches(c.is, ctx.RoomMemberCount)
+	case "sender_notification_permission":
+		return ctx.SenderCanNotify != nil && ctx.SenderCanNotify(c.key)
+	default:
+		return false
+	}
+}
+
+func memberCountMatches(is string, count int) bool {
+	op := strings.TrimRight(is, "0123456789")
+	want, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false
+	}
+	switch op {
+	case "", "==":
+		return count == want
+	case "<":
+		return count < want
+	case ">":
+		return count > want
+	case "<=":
+		return count <= want
+	case ">=":
+		return count >= want
+	default:
+		return false
+	}
+}
+
+// PowerLevelCanNotify returns true if the sender has a high enough power level in the given
+// m.room.power_levels event to send notifications of this kind e.g "room".
+func PowerLevelCanNotify(powerLevelsEvent json.RawMessage, sender, notificationKey string) bool {
+	content := gjson.GetBytes(powerLevelsEvent, "content")
+	if !content.Exists() {
+		// only the room creator can do anything, but we don't know who that is here.
+		return false
+	}
+	senderLevel := content.Get("users_default").Int()
+	// user IDs and keys contain '.' so we can't use them in gjson paths
+	if userLevel, ok := content.Get("users").Map()[sender]; ok {
+		senderLevel = userLevel.Int()
+	}
+	requiredLevel := int64(50)
+	if level, ok := content.Get("notifications").Map()[notificationKey]; ok {
+		requiredLevel = level.Int()
+	}
+	return senderLevel >= requiredLevel
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// A cut down version of the default push rules from the spec.
+var testPushRules = json.RawMessage(`{
+	"type": "m.push_rules",
+	"content": {
+		"global": {
+			"override": [
+				{"rule_id": ".m.rule.master", "default": true, "enabled": false, "conditions": [], "actions": []},
+				{"rule_id": ".m.rule.suppress_notices", "default": true, "enabled": true,
+					"conditions": [{"kind": "event_match", "key": "content.msgtype", "pattern": "m.notice"}], "actions": []},
+				{"rule_id": ".m.rule.is_user_mention", "default": true, "enabled": true,
+					"conditions": [{"kind": "event_property_contains", "key": "content.m\\.mentions.user_ids", "value": "@alice:localhost"}],
+					"actions": ["notify", {"set_tweak": "highlight"}]},
+				{"rule_id": ".m.rule.contains_display_name", "default": true, "enabled": true,
+					"conditions": [{"kind": "contains_display_name"}],
+					"actions": ["notify", {"set_tweak": "sound", "value": "default"}, {"set_tweak": "highlight"}]},
+				{"rule_id": ".m.rule.roomnotif", "default": true, "enabled": true,
+					"conditions": [
+						{"kind": "event_match", "key": "content.body", "pattern": "@room"},
+						{"kind": "sender_notification_permission", "key": "room"}
+					],
+					"actions": ["notify", {"set_tweak": "highlight"}]}
+			],
+			"content": [
+				{"rule_id": "keyword", "default": false, "enabled": true, "pattern": "cake*",
+					"actions": ["notify", {"set_tweak": "highlight", "value": false}]}
+			],
+			"room": [
+				{"rule_id": "!muted:localhost", "default": false, "enabled": true, "actions": []}
+			],
+			"sender": [],
+			"underride": [
+				{"rule_id": ".m.rule.room_one_to_one", "default": true, "enabled": true,
+					"conditions": [
+						{"kind": "room_member_count", "is": "2"},
+						{"kind": "event_match", "key": "type", "pattern": "m.room.message"}
+					],
+					"actions": ["notify"]},
+				{"rule_id": ".m.rule.message", "default": true, "enabled": true,
+					"conditions": [{"kind": "event_match", "key": "type", "pattern": "m.room.message"}],
+					"actions": []},
+				{"rule_id": "unknown", "default": false, "enabled": true,
+					"conditions": [{"kind": "org.example.unknown"}],
+					"actions": ["notify"]}
+			]
+		}
+	}
+}`)
+
+func TestPushRulesEvaluate(t *testing.T) {
+	rules := NewPushRulesFromEvent(testPushRules)
+	testCases := []struct {
+		name          string
+		event         string
+		memberCount   int
+		canNotify     bool
+		wantNotify    bool
+		wantHighlight bool
+	}{
+		{
+			name:        "plain message in a group room",
+			event:       `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 5,
+		},
+		{
+			name:        "plain message in a DM",
+			event:       `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 2,
+			wantNotify:  true,
+		},
+		{
+			name:        "notices are suppressed",
+			event:       `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.notice","body":"Alice"}}`,
+			memberCount: 2,
+		},
+		{
+			name:          "display name is case-insensitive and matches on word boundaries",
+			event:         `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hi ALICE!"}}`,
+			memberCount:   5,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:        "display name does not match inside words",
+			event:       `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"malicefully"}}`,
+			memberCount: 5,
+		},
+		{
+			name:          "intentional mentions",
+			event:         `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hi","m.mentions":{"user_ids":["@alice:localhost"]}}}`,
+			memberCount:   5,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:          "@room with permission",
+			event:         `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"@room hi"}}`,
+			memberCount:   5,
+			canNotify:     true,
+			wantNotify:    true,
+			wantHighlight: true,
+		},
+		{
+			name:        "@room without permission",
+			event:       `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"@room hi"}}`,
+			memberCount: 5,
+		},
+		{
+			name:        "content rule with a glob and highlight disabled",
+			event:       `{"type":"m.room.message","room_id":"!a:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"who wants cakes?"}}`,
+			memberCount: 5,
+			wantNotify:  true,
+		},
+		{
+			name:        "room rule",
+			event:       `{"type":"m.room.message","room_id":"!muted:localhost","sender":"@bob:localhost","content":{"msgtype":"m.text","body":"hello"}}`,
+			memberCount: 2,
+		},
+		{
+			name:        "unknown conditions never match",
+			event:       `{"type":"m.reaction","room_id":"!a:localhost","sender":"@bob:localhost","content":{}}`,
+			memberCount: 5,
+		},
+	}
+	for _, tc := range testCases {
+		notify, highlight := rules.Evaluate(json.RawMessage(tc.event), PushRuleContext{
+			RoomMemberCount: tc.memberCount,
+			UserDisplayName: func() string {
+				return "Alice"
+			},
+			SenderCanNotify: func(key string) bool {
+				return tc.canNotify && key == "room"
+			},
+		})
+		if notify != tc.wantNotify || highlight != tc.wantHighlight {
+			t.Errorf("%s: got notify=%v highlight=%v, want notify=%v highlight=%v", tc.name, notify, highlight, tc.wantNotify, tc.wantHighlight)
+		}
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	testCases := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{"2", 2, true},
+		{"==2", 3, false},
+		{"<3", 2, true},
+		{">3", 3, false},
+		{">=3", 3, true},
+		{"<=1", 2, false},
+		{"!2", 3, false},
+		{"", 0, false},
+	}
+	for _, tc := range testCases {
+		if got := memberCountMatches(tc.is, tc.count); got != tc.want {
+			t.Errorf("memberCountMatches(%q, %d) got %v want %v", tc.is, tc.count, got, tc.want)
+		}
+	}
+}
+
+func TestPowerLevelCanNotify(t *testing.T) {
+	pl := json.RawMessage(`{"type":"m.room.power_levels","content":{"users":{"@mod:localhost":50,"@admin:localhost":100},"users_default":0,"notifications":{"room":100}}}`)
+	if PowerLevelCanNotify(pl, "@mod:localhost", "room") {
+		t.Errorf("mod should not be able to @room")
+	}
+	if !PowerLevelCanNotify(pl, "@admin:localhost", "room") {
+		t.Errorf("admin should be able to @room")
+	}
+	// defaults to 50
+	pl = json.RawMessage(`{"type":"m.room.power_levels","content":{"users":{"@mod:localhost":50}}}`)
+	if !PowerLevelCanNotify(pl, "@mod:localhost", "room") {
+		t.Errorf("mod should be able to @room with default notification levels")
+	}
+	if PowerLevelCanNotify(pl, "@bob:localhost", "room") {
+		t.Errorf("bob should not be able to @room")
+	}
+	if PowerLevelCanNotify(nil, "@bob:localhost", "room") {
+		t.Errorf("missing power levels should not allow @room")
+	}
+}
@@ -0,0 +1,306 @@
+// Package migrations upgrades the schema of databases created by older versions of the proxy.
+//
+// Tables are created with their current schema by their constructors e.g state.NewEventTable, so
+// migrations only need to change databases which were created before the migration was written.
+// Every migration has a version number, and the versions which have been applied to a database are
+// stored in the syncv3_migrations table. When the proxy first runs against an empty database, every
+// migration is recorded as applied without being run.
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
+	Out:        os.Stderr,
+	TimeFormat: "15:04:05",
+})
+
+// The key of the Postgres advisory lock held whilst migrating, so that only one process migrates
+// the database at a time. SQLite only allows one transaction to write at a time, so needs no lock.
+const advisoryLockID = 0x73796e637633 // "syncv3"
+
+var errDryRun = errors.New("dry run")
+
+// Migration changes the database schema from the previous version to this version.
+type Migration struct {
+	// Versions must be unique and increase with each new migration.
+	Version int64
+	// A short description of the migration, for logging.
+	Name string
+	// Up migrates the database to this version. It is called within the same transaction as all other
+	// migrations being applied at the same time.
+	Up func(txn *sqlx.Tx) error
+	// Down reverts Up. Nil if the migration cannot be reverted.
+	Down func(txn *sqlx.Tx) error
+}
+
+// Config holds what migrations need besides the database.
+type Config struct {
+	// The secret used to encrypt access tokens.
+	Secret string
+	// The client used to look up the user and device for access tokens.
+	WhoAmIClient sync2.Client
+	// The number of partitions to partition an existing empty events table into, or 0 to leave it as it is.
+	EventPartitions int
+}
+
+// All returns every migration, in version order.
+func All(cfg Config) []Migration {
+	return []Migration{
+		{
+			Version: 1,
+			Name:    "device_ids",
+			Up: func(txn *sqlx.Tx) error {
+				return sync2.MigrateDeviceIDs(txn, cfg.Secret, cfg.WhoAmIClient)
+			},
+		},
+		{
+			Version: 2,
+			Name:    "device_lists",
+			Up:      state.MigrateDeviceLists,
+		},
+		{
+			Version: 3,
+			Name:    "partition_events",
+			Up: func(txn *sqlx.Tx) error {
+				return state.MigrateEventPartitions(txn, cfg.EventPartitions)
+			},
+		},
+	}
+}
+
+// Status is whether a migration has been applied to the database.
+type Status struct {
+	Version int64
+	Name    string
+	// When the migration was applied, or the zero time if it has not been applied.
+	AppliedAt time.Time
+}
+
+// Migrator applies and reverts migrations. Each call to a Migrator runs in a single transaction, so
+// either all or none of the migrations are applied.
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []Migration
+	// If true, migrations are run but rolled back rather than committed.
+	DryRun bool
+}
+
+// NewMigrator makes a Migrator for these migrations. Returns an error if their versions are not unique
+// and positive.
+func NewMigrator(db *sqlx.DB, migrations []Migration) (*Migrator, error) {
+	migrations = append([]Migration(nil), migrations...)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("migration %s has version %d, must be positive", m.Name, m.Version)
+		}
+		if i > 0 && migrations[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migrations %s and %s have the same version %d", migrations[i-1].Name, m.Name, m.Version)
+		}
+		if m.Up == nil {
+			return nil, fmt.Errorf("migration %d %s has no Up function", m.Version, m.Name)
+		}
+	}
+	return &Migrator{
+		db:         db,
+		migrations: migrations,
+	}, nil
+}
+
+// Up applies every migration which has not been applied yet, in version order. Returns the applied
+// migrations.
+func (m *Migrator) Up() (applied []Migration, err error) {
+	err = m.transaction(func(txn *sqlx.Tx, appliedAt map[int64]time.Time) error {
+		for _, migration := range m.migrations {
+			if _, ok := appliedAt[migration.Version]; ok {
+				continue
+			}
+			logger.Info().Int64("version", migration.Version).Str("name", migration.Name).Bool("dry_run", m.DryRun).Msg("applying migration")
+			start := time.Now()
+			if err := migration.Up(txn); err != nil {
+				return fmt.Errorf("failed to apply migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			if err := insertMigration(txn, migration); err != nil {
+				return err
+			}
+			logger.Info().Int64("version", migration.Version).Dur("duration", time.Since(start)).Msg("applied migration")
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+// Down reverts every applied migration with a version higher than this version, in reverse version
+// order. Returns the reverted migrations. Nothing is reverted if any of them cannot be reverted.
+func (m *Migrator) Down(version int64) (reverted []Migration, err error) {
+	err = m.transaction(func(txn *sqlx.Tx, appliedAt map[int64]time.Time) error {
+		var toRevert []Migration
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if _, ok := appliedAt[migration.Version]; !ok || migration.Version <= version {
+				continue
+			}
+			if migration.Down == nil {
+				return fmt.Errorf("migration %d %s cannot be reverted", migration.Version, migration.Name)
+			}
+			toRevert = append(toRevert, migration)
+		}
+		for _, migration := range toRevert {
+			logger.Info().Int64("version", migration.Version).Str("name", migration.Name).Bool("dry_run", m.DryRun).Msg("reverting migration")
+			if err := migration.Down(txn); err != nil {
+				return fmt.Errorf("failed to revert migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+			if _, err := txn.Exec(`DELETE FROM syncv3_migrations WHERE version = $1`, migration.Version); err != nil {
+				return err
+			}
+		}
+		reverted = toRevert
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// Status returns whether each migration has been applied, in version order.
+func (m *Migrator) Status() (statuses []Status, err error) {
+	err = m.transaction(func(txn *sqlx.Tx, appliedAt map[int64]time.Time) error {
+		for _, migration := range m.migrations {
+			statuses = append(statuses, Status{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: appliedAt[migration.Version],
+			})
+		}
+		return nil
+	})
+	return
+}
+
+// transaction calls fn with the time each migration was applied, whilst holding the migration lock.
+// The transaction is rolled back if this is a dry run.
+func (m *Migrator) transaction(fn func(txn *sqlx.Tx, appliedAt map[int64]time.Time) error) error {
+	err := sqlutil.WithTransaction(m.db, func(txn *sqlx.Tx) error {
+		if err := sqlutil.DialectOf(txn).LockTransaction(txn, advisoryLockID); err != nil {
+			return fmt.Errorf("failed to lock: %w", err)
+		}
+		if err := m.prepare(txn); err != nil {
+			return err
+		}
+		rows := []struct {
+			Version   int64 `db:"version"`
+			AppliedTS int64 `db:"applied_ts"`
+		}{}
+		if err := txn.Select(&rows, `SELECT version, applied_ts FROM syncv3_migrations`); err != nil {
+			return err
+		}
+		appliedAt := make(map[int64]time.Time, len(rows))
+		for _, row := range rows {
+			appliedAt[row.Version] = time.UnixMilli(row.AppliedTS)
+		}
+		if err := fn(txn, appliedAt); err != nil {
+			return err
+		}
+		if m.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return nil
+	}
+	return err
+}
+
+// prepare creates the syncv3_migrations table if it does not exist. If the database is empty, every
+// migration is recorded as applied, as tables are created with the current schema.
+func (m *Migrator) prepare(txn *sqlx.Tx) error {
+	exists, err := sqlutil.DialectOf(txn).TableExists(txn, "syncv3_migrations")
+	if err != nil || exists {
+		return err
+	}
+	isEmpty, err := isEmptyDatabase(txn)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(`
+	CREATE TABLE syncv3_migrations (
+		version BIGINT NOT NULL PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_ts BIGINT NOT NULL
+	);`)
+	if err != nil || !isEmpty {
+		return err
+	}
+	logger.Info().Int("migrations", len(m.migrations)).Msg("new database, recording all migrations as applied")
+	for _, migration := range m.migrations {
+		if err = insertMigration(txn, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertMigration(txn *sqlx.Tx, migration Migration) error {
+	_, err := txn.Exec(
+		`INSERT INTO syncv3_migrations(version, name, applied_ts) VALUES($1, $2, $3)`,
+		migration.Version, migration.Name, time.Now().UnixMilli(),
+	)
+	return err
+}
+
+// isEmptyDatabase returns true if the proxy has never created any tables in this database.
+func isEmptyDatabase(txn *sqlx.Tx) (bool, error) {
+	tables, err := sqlutil.DialectOf(txn).Tables(txn)
+	if err != nil {
+		return false, err
+	}
+	for _, table := range tables {
+		if strings.HasPrefix(table, "syncv3_") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Up applies every migration which has not been applied yet to the database at postgresURI.
+func Up(postgresURI string, cfg Config) error {
+	db, err := sqlutil.Open(postgresURI)
+	if err != nil {
+		return fmt.Errorf("failed to open SQL DB: %w", err)
+	}
+	defer db.Close()
+	migrator, err := NewMigrator(db, All(cfg))
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up()
+	if err != nil {
+		return err
+	}
+	if len(applied) > 0 {
+		logger.Info().Int("migrations", len(applied)).Msg("migrated database")
+	}
+	return nil
+}
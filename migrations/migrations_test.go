@@ -0,0 +1,559 @@
+package migrations
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/sliding-sync/sqlutil"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+var postgresConnectionString = "user=xxxxx dbname=syncv3_test sslmode=disable"
+
+func TestMain(m *testing.M) {
+	postgresConnectionString = testutils.PrepareDBConnectionString()
+	exitCode := m.Run()
+	os.Exit(exitCode)
+}
+
+// newEmptyDB returns a database without any tables, separate from the database used by other tests.
+func newEmptyDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlutil.Open(postgresConnectionString)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	if sqlutil.DialectOf(db).Name() == sqlutil.SQLite {
+		db.Close()
+		db, err = sqlutil.Open(sqlutil.SQLitePrefix + filepath.Join(t.TempDir(), "migrations.db"))
+		if err != nil {
+			t.Fatalf("failed to open SQL db: %s", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	// use a separate schema, which Postgres treats much like a separate database
+	schema := "syncv3_" + strings.ToLower(t.Name())
+	db.MustExec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE; CREATE SCHEMA ` + schema + `;`)
+	t.Cleanup(func() {
+		db.MustExec(`DROP SCHEMA ` + schema + ` CASCADE;`)
+		db.Close()
+	})
+	schemaDB, err := sqlutil.Open(postgresConnectionString + " search_path=" + schema)
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	t.Cleanup(func() { schemaDB.Close() })
+	return schemaDB
+}
+
+func newMigrator(t *testing.T, db *sqlx.DB, migrations []Migration) *Migrator {
+	t.Helper()
+	migrator, err := NewMigrator(db, migrations)
+	if err != nil {
+		t.Fatalf("NewMigrator: %s", err)
+	}
+	return migrator
+}
+
+func versions(migrations []Migration) []int64 {
+	result := []int64{}
+	for _, m := range migrations {
+		result = append(result, m.Version)
+	}
+	return result
+}
+
+func assertApplied(t *testing.T, migrator *Migrator, want []int64) {
+	t.Helper()
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatalf("Status: %s", err)
+	}
+	got := []int64{}
+	for _, status := range statuses {
+		if !status.AppliedAt.IsZero() {
+			got = append(got, status.Version)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("applied migrations are %v, want %v", got, want)
+	}
+}
+
+// whoAmIClient looks up access tokens in a map. Tokens which are not in the map have expired.
+type whoAmIClient struct {
+	sync2.Client
+	devices map[string]userDevice
+}
+
+func (c *whoAmIClient) WhoAmI(accessToken string) (string, string, error) {
+	device, ok := c.devices[accessToken]
+	if !ok {
+		return "", "", sync2.HTTP401
+	}
+	return device.UserID, device.DeviceID, nil
+}
+
+type userDevice struct {
+	UserID   string `db:"user_id"`
+	DeviceID string `db:"device_id"`
+}
+
+func selectUserDevices(t *testing.T, db *sqlx.DB, table string) []userDevice {
+	t.Helper()
+	var devices []userDevice
+	if err := db.Select(&devices, `SELECT user_id, device_id FROM `+table+` ORDER BY user_id, device_id`); err != nil {
+		t.Fatalf("failed to select devices from %s: %s", table, err)
+	}
+	return devices
+}
+
+// seedOldDeviceIDs reverts the device tables to their schema from before devices were identified by
+// their device ID rather than a hash of their access token, then stores a to-device message,
+// acknowledged position and transaction for each device.
+func seedOldDeviceIDs(t *testing.T, db *sqlx.DB, tokens []*sync2.Token) {
+	t.Helper()
+	db.MustExec(`
+	ALTER TABLE syncv3_sync2_devices DROP CONSTRAINT syncv3_sync2_devices_pkey, ADD COLUMN v2_token_encrypted TEXT;
+	UPDATE syncv3_sync2_devices SET device_id = tokens.token_hash, v2_token_encrypted = tokens.token_encrypted
+		FROM syncv3_sync2_tokens AS tokens
+		WHERE tokens.user_id = syncv3_sync2_devices.user_id AND tokens.device_id = syncv3_sync2_devices.device_id;
+	ALTER TABLE syncv3_sync2_devices ALTER COLUMN v2_token_encrypted SET NOT NULL, ADD PRIMARY KEY (device_id);
+	DROP TABLE syncv3_sync2_tokens;
+	ALTER TABLE syncv3_to_device_messages DROP COLUMN user_id;
+	ALTER TABLE syncv3_to_device_ack_pos DROP CONSTRAINT syncv3_to_device_ack_pos_pkey, DROP COLUMN user_id, ADD PRIMARY KEY (device_id);
+	ALTER TABLE syncv3_txns DROP COLUMN device_id, ADD UNIQUE (user_id, event_id);`)
+	for _, token := range tokens {
+		db.MustExec(
+			`INSERT INTO syncv3_to_device_messages(device_id, event_type, sender, message) VALUES($1, 'm.room_key', $2, '{}')`,
+			token.AccessTokenHash, token.UserID,
+		)
+		db.MustExec(`INSERT INTO syncv3_to_device_ack_pos(device_id, unack_pos) VALUES($1, 1)`, token.AccessTokenHash)
+		// the transactions table stored the access token hash in the user_id column
+		db.MustExec(
+			`INSERT INTO syncv3_txns(user_id, event_id, txn_id, ts) VALUES($1, $2, $3, 0)`,
+			token.AccessTokenHash, "$event_"+token.DeviceID, "txn_"+token.DeviceID,
+		)
+	}
+}
+
+// Apply each migration to a database which is populated with data, then revert and reapply each
+// migration which can be reverted. On Postgres, the database starts with the schema from before devices
+// were identified by their device ID, which is migrated.
+func TestMigrationsOnPopulatedDB(t *testing.T) {
+	secret := "secret"
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	v2Store := sync2.NewStore(postgresConnectionString, secret)
+	defer v2Store.Teardown()
+
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	roomID := "!migrations:localhost"
+	events := []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	}
+	timeline := []json.RawMessage{
+		testutils.NewMessageEvent(t, alice, "hello"),
+	}
+	if _, err := store.Initialise(roomID, events); err != nil {
+		t.Fatalf("Initialise: %s", err)
+	}
+	if _, _, err := store.Accumulate(roomID, "", timeline); err != nil {
+		t.Fatalf("Accumulate: %s", err)
+	}
+	var tokens []*sync2.Token
+	err := sqlutil.WithTransaction(v2Store.DB, func(txn *sqlx.Tx) error {
+		for _, device := range []userDevice{{alice, "ALICE"}, {bob, "BOB"}} {
+			if err := v2Store.DevicesTable.InsertDevice(txn, device.UserID, device.DeviceID); err != nil {
+				return err
+			}
+			token, err := v2Store.TokensTable.Insert(txn, device.DeviceID+"_token", device.UserID, device.DeviceID, time.Now())
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to insert device: %s", err)
+	}
+	isPostgres := sqlutil.DialectOf(store.DB).Name() == sqlutil.Postgres
+	if isPostgres {
+		// SQLite databases were never used with the old schema
+		seedOldDeviceIDs(t, store.DB, tokens)
+	}
+	// pretend the database was created before migrations were recorded, so all of them are applied
+	store.DB.MustExec(`DROP TABLE IF EXISTS syncv3_migrations`)
+
+	// bob's access token has expired
+	all := All(Config{
+		Secret: secret,
+		WhoAmIClient: &whoAmIClient{
+			devices: map[string]userDevice{"ALICE_token": {alice, "ALICE"}},
+		},
+		EventPartitions: 4,
+	})
+	migrator := newMigrator(t, store.DB, all)
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up: %s", err)
+	}
+	if !reflect.DeepEqual(versions(applied), versions(all)) {
+		t.Fatalf("Up applied %v, want %v", versions(applied), versions(all))
+	}
+	for i := len(all) - 1; i >= 0; i-- {
+		if all[i].Down == nil {
+			continue
+		}
+		reverted, err := migrator.Down(all[i].Version - 1)
+		if err != nil {
+			t.Fatalf("Down(%d): %s", all[i].Version-1, err)
+		}
+		if !reflect.DeepEqual(versions(reverted), versions(all[i:])) {
+			t.Fatalf("Down(%d) reverted %v, want %v", all[i].Version-1, versions(reverted), versions(all[i:]))
+		}
+		if _, err = migrator.Up(); err != nil {
+			t.Fatalf("Up after Down(%d): %s", all[i].Version-1, err)
+		}
+	}
+	assertApplied(t, migrator, versions(all))
+
+	// the data is still readable with the current schema
+	store2 := state.NewStorage(postgresConnectionString)
+	defer store2.Teardown()
+	v2Store2 := sync2.NewStore(postgresConnectionString, secret)
+	defer v2Store2.Teardown()
+	var eventIDs []string
+	for _, ev := range append(events, timeline...) {
+		eventIDs = append(eventIDs, gjson.GetBytes(ev, "event_id").Str)
+	}
+	if _, err = store2.EventsTable.SelectByIDs(nil, true, roomID, eventIDs); err != nil {
+		t.Errorf("failed to select events after migrating: %s", err)
+	}
+	token, err := v2Store2.TokensTable.Token("ALICE_token")
+	if err != nil {
+		t.Fatalf("failed to select token after migrating: %s", err)
+	}
+	if token.UserID != alice || token.DeviceID != "ALICE" {
+		t.Errorf("token after migrating is for %s %s, want %s ALICE", token.UserID, token.DeviceID, alice)
+	}
+	if !isPostgres {
+		return
+	}
+
+	// alice's rows now use her device ID, and bob's rows were dropped along with his expired token
+	if _, err = v2Store2.TokensTable.Token("BOB_token"); err == nil {
+		t.Errorf("expired token was migrated")
+	}
+	want := []userDevice{{alice, "ALICE"}}
+	for _, table := range []string{"syncv3_sync2_devices", "syncv3_to_device_messages", "syncv3_to_device_ack_pos", "syncv3_txns"} {
+		if got := selectUserDevices(t, store2.DB, table); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s after migrating has devices %+v, want %+v", table, got, want)
+		}
+	}
+	txnIDs, err := store2.TransactionsTable.Select(alice, "ALICE", []string{"$event_ALICE"})
+	if err != nil || txnIDs["$event_ALICE"] != "txn_ALICE" {
+		t.Errorf("got transaction IDs %v, %v after migrating, want txn_ALICE", txnIDs, err)
+	}
+
+	// the events table holds events, so it is left for 'syncv3 migrate partition-events' to partition
+	if got := numEventPartitions(t, store2.DB); got != 0 {
+		t.Errorf("events table has %d partitions after migrating, want 0", got)
+	}
+}
+
+func numEventPartitions(t *testing.T, db *sqlx.DB) (numPartitions int) {
+	t.Helper()
+	err := db.QueryRow(`SELECT count(*) FROM pg_inherits WHERE inhparent = to_regclass('syncv3_events')`).Scan(&numPartitions)
+	if err != nil {
+		t.Fatalf("failed to count event partitions: %s", err)
+	}
+	return numPartitions
+}
+
+func partitionEventsMigration(eventPartitions int) []Migration {
+	for _, m := range All(Config{EventPartitions: eventPartitions}) {
+		if m.Name == "partition_events" {
+			return []Migration{m}
+		}
+	}
+	return nil
+}
+
+// Enabling partitioning after the partition_events migration was applied without it should still
+// partition an empty events table on startup.
+func TestPartitionEventsAfterMigration(t *testing.T) {
+	testPartitionEventsAfterMigration(t, false)
+}
+
+// Enabling partitioning after the partition_events migration was applied without it should leave an
+// events table which holds events to PartitionEventTable, rather than copying them all on startup.
+func TestPartitionEventsAfterMigrationWithEvents(t *testing.T) {
+	testPartitionEventsAfterMigration(t, true)
+}
+
+func testPartitionEventsAfterMigration(t *testing.T, hasEvents bool) {
+	db := newEmptyDB(t)
+	if !sqlutil.DialectOf(db).SupportsPartitioning() {
+		t.Skip("partitioning is not supported on SQLite")
+	}
+	table := state.NewEventTable(db)
+	if hasEvents {
+		err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+			_, err := table.Insert(txn, []state.Event{{
+				RoomID: "!partitions:localhost",
+				JSON:   testutils.NewMessageEvent(t, "@alice:localhost", "hello"),
+			}}, true)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+	}
+	applied, err := newMigrator(t, db, partitionEventsMigration(0)).Up()
+	if err != nil || len(applied) != 1 {
+		t.Fatalf("Up applied %v, %v without partitions, want the partition_events migration", versions(applied), err)
+	}
+
+	// partitions are enabled on the next startup
+	applied, err = newMigrator(t, db, partitionEventsMigration(4)).Up()
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("Up applied %v, %v with partitions, want none", versions(applied), err)
+	}
+	state.NewPartitionedEventTable(db, 4)
+	wantPartitions := 4
+	if hasEvents {
+		wantPartitions = 0
+	}
+	if got := numEventPartitions(t, db); got != wantPartitions {
+		t.Fatalf("events table has %d partitions on startup, want %d", got, wantPartitions)
+	}
+	if err = state.PartitionEventTable(db, 4, 10); err != nil {
+		t.Fatalf("PartitionEventTable: %s", err)
+	}
+	if got := numEventPartitions(t, db); got != 4 {
+		t.Fatalf("events table has %d partitions after PartitionEventTable, want 4", got)
+	}
+}
+
+func TestMigratorNewDatabase(t *testing.T) {
+	db := newEmptyDB(t)
+	migrations := []Migration{
+		{
+			Version: 1,
+			Name:    "unused",
+			Up: func(txn *sqlx.Tx) error {
+				t.Errorf("migration applied to a new database")
+				return nil
+			},
+		},
+	}
+	migrator := newMigrator(t, db, migrations)
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up: %s", err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("Up applied %v to a new database, want none", versions(applied))
+	}
+	assertApplied(t, migrator, []int64{1})
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	db := newEmptyDB(t)
+	db.MustExec(`CREATE TABLE syncv3_existing (id BIGINT NOT NULL)`)
+	exec := func(query string) func(txn *sqlx.Tx) error {
+		return func(txn *sqlx.Tx) error {
+			_, err := txn.Exec(query)
+			return err
+		}
+	}
+	migrations := []Migration{
+		{
+			Version: 1,
+			Name:    "create_widgets",
+			Up:      exec(`CREATE TABLE syncv3_widgets (id BIGINT NOT NULL PRIMARY KEY)`),
+			Down:    exec(`DROP TABLE syncv3_widgets`),
+		},
+		{
+			Version: 2,
+			Name:    "name_widgets",
+			Up:      exec(`ALTER TABLE syncv3_widgets ADD COLUMN name TEXT NOT NULL DEFAULT ''`),
+			Down:    exec(`ALTER TABLE syncv3_widgets DROP COLUMN name`),
+		},
+		{
+			Version: 3,
+			Name:    "insert_widget",
+			Up:      exec(`INSERT INTO syncv3_widgets(id, name) VALUES(1, 'first')`),
+		},
+	}
+	migrator := newMigrator(t, db, migrations)
+
+	// a dry run applies nothing
+	migrator.DryRun = true
+	applied, err := migrator.Up()
+	if err != nil {
+		t.Fatalf("Up dry run: %s", err)
+	}
+	if !reflect.DeepEqual(versions(applied), []int64{1, 2, 3}) {
+		t.Fatalf("Up dry run applied %v, want [1 2 3]", versions(applied))
+	}
+	migrator.DryRun = false
+	assertApplied(t, migrator, []int64{})
+
+	applied, err = migrator.Up()
+	if err != nil {
+		t.Fatalf("Up: %s", err)
+	}
+	if !reflect.DeepEqual(versions(applied), []int64{1, 2, 3}) {
+		t.Fatalf("Up applied %v, want [1 2 3]", versions(applied))
+	}
+	var name string
+	if err = db.QueryRow(`SELECT name FROM syncv3_widgets WHERE id = 1`).Scan(&name); err != nil || name != "first" {
+		t.Fatalf("got widget name %q, %v want first", name, err)
+	}
+	applied, err = migrator.Up()
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("Up applied %v, %v when already up to date", versions(applied), err)
+	}
+
+	// migration 3 cannot be reverted, so nothing is reverted
+	if _, err = migrator.Down(1); err == nil {
+		t.Fatalf("Down reverted a migration which cannot be reverted")
+	}
+	assertApplied(t, migrator, []int64{1, 2, 3})
+
+	migrations[2].Down = exec(`DELETE FROM syncv3_widgets WHERE id = 1`)
+	migrator = newMigrator(t, db, migrations)
+	reverted, err := migrator.Down(1)
+	if err != nil {
+		t.Fatalf("Down: %s", err)
+	}
+	if !reflect.DeepEqual(versions(reverted), []int64{3, 2}) {
+		t.Fatalf("Down reverted %v, want [3 2]", versions(reverted))
+	}
+	assertApplied(t, migrator, []int64{1})
+	if _, err = db.Exec(`SELECT name FROM syncv3_widgets`); err == nil {
+		t.Errorf("column added by migration 2 still exists after reverting it")
+	}
+
+	// new migrations are applied after existing ones
+	migrations = append(migrations, Migration{
+		Version: 4,
+		Name:    "insert_another_widget",
+		Up:      exec(`INSERT INTO syncv3_widgets(id, name) VALUES(2, 'second')`),
+	})
+	migrator = newMigrator(t, db, migrations)
+	applied, err = migrator.Up()
+	if err != nil {
+		t.Fatalf("Up: %s", err)
+	}
+	if !reflect.DeepEqual(versions(applied), []int64{2, 3, 4}) {
+		t.Fatalf("Up applied %v, want [2 3 4]", versions(applied))
+	}
+	assertApplied(t, migrator, []int64{1, 2, 3, 4})
+}
+
+func TestMigratorFailedMigrationAppliesNothing(t *testing.T) {
+	db := newEmptyDB(t)
+	db.MustExec(`CREATE TABLE syncv3_existing (id BIGINT NOT NULL)`)
+	migrator := newMigrator(t, db, []Migration{
+		{
+			Version: 1,
+			Name:    "ok",
+			Up: func(txn *sqlx.Tx) error {
+				_, err := txn.Exec(`INSERT INTO syncv3_existing(id) VALUES(1)`)
+				return err
+			},
+		},
+		{
+			Version: 2,
+			Name:    "broken",
+			Up: func(txn *sqlx.Tx) error {
+				_, err := txn.Exec(`INSERT INTO syncv3_missing(id) VALUES(1)`)
+				return err
+			},
+		},
+	})
+	if _, err := migrator.Up(); err == nil {
+		t.Fatalf("Up succeeded with a broken migration")
+	}
+	assertApplied(t, migrator, []int64{})
+	var count int
+	if err := db.QueryRow(`SELECT count(*) FROM syncv3_existing`).Scan(&count); err != nil || count != 0 {
+		t.Fatalf("got %d rows, %v after failed migration, want 0", count, err)
+	}
+}
+
+// Concurrent processes should not apply the same migration twice.
+func TestMigratorConcurrentUp(t *testing.T) {
+	db := newEmptyDB(t)
+	db.MustExec(`CREATE TABLE syncv3_existing (id BIGINT NOT NULL)`)
+	var calls int32
+	migrations := []Migration{
+		{
+			Version: 1,
+			Name:    "slow",
+			Up: func(txn *sqlx.Tx) error {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(100 * time.Millisecond)
+				_, err := txn.Exec(`INSERT INTO syncv3_existing(id) VALUES(1)`)
+				return err
+			},
+		},
+	}
+	var wg sync.WaitGroup
+	var numApplied int32
+	for i := 0; i < 3; i++ {
+		migrator := newMigrator(t, db, migrations)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			applied, err := migrator.Up()
+			if err != nil {
+				t.Errorf("Up: %s", err)
+			}
+			atomic.AddInt32(&numApplied, int32(len(applied)))
+		}()
+	}
+	wg.Wait()
+	if calls != 1 || numApplied != 1 {
+		t.Errorf("migration was run %d times and applied %d times, want 1", calls, numApplied)
+	}
+}
+
+func TestNewMigratorValidates(t *testing.T) {
+	up := func(txn *sqlx.Tx) error { return nil }
+	testCases := []struct {
+		name       string
+		migrations []Migration
+	}{
+		{name: "duplicate", migrations: []Migration{{Version: 2, Up: up}, {Version: 1, Up: up}, {Version: 2, Up: up}}},
+		{name: "zero", migrations: []Migration{{Version: 0, Up: up}}},
+		{name: "no up", migrations: []Migration{{Version: 1}}},
+	}
+	for _, tc := range testCases {
+		if _, err := NewMigrator(nil, tc.migrations); err == nil {
+			t.Errorf("%s: NewMigrator accepted invalid migrations", tc.name)
+		}
+	}
+	if _, err := NewMigrator(nil, All(Config{})); err != nil {
+		t.Errorf("NewMigrator rejected All: %s", err)
+	}
+}
@@ -16,12 +16,14 @@ type V2Listener interface {
 	OnTransactionID(p *V2TransactionID)
 	OnAccountData(p *V2AccountData)
 	OnInvite(p *V2InviteRoom)
+	OnKnock(p *V2KnockRoom)
 	OnLeftRoom(p *V2LeaveRoom)
 	OnUnreadCounts(p *V2UnreadCounts)
 	OnInitialSyncComplete(p *V2InitialSyncComplete)
 	OnDeviceData(p *V2DeviceData)
 	OnTyping(p *V2Typing)
 	OnReceipt(p *V2Receipt)
+	OnPresence(p *V2Presence)
 	OnDeviceMessages(p *V2DeviceMessages)
 	OnExpiredToken(p *V2ExpiredToken)
 }
@@ -83,6 +85,13 @@ type V2InviteRoom struct {
 
 func (*V2InviteRoom) Type() string { return "V2InviteRoom" }
 
+type V2KnockRoom struct {
+	UserID string
+	RoomID string
+}
+
+func (*V2KnockRoom) Type() string { return "V2KnockRoom" }
+
 type V2InitialSyncComplete struct {
 	UserID   string
 	DeviceID string
@@ -112,6 +121,12 @@ type V2Receipt struct {
 
 func (*V2Receipt) Type() string { return "V2Receipt" }
 
+type V2Presence struct {
+	Presence []internal.Presence
+}
+
+func (*V2Presence) Type() string { return "V2Presence" }
+
 type V2DeviceMessages struct {
 	UserID   string
 	DeviceID string
@@ -156,6 +171,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnAccountData(pl)
 	case *V2InviteRoom:
 		v.receiver.OnInvite(pl)
+	case *V2KnockRoom:
+		v.receiver.OnKnock(pl)
 	case *V2LeaveRoom:
 		v.receiver.OnLeftRoom(pl)
 	case *V2UnreadCounts:
@@ -166,6 +183,8 @@ func (v *V2Sub) onMessage(p Payload) {
 		v.receiver.OnDeviceData(pl)
 	case *V2Typing:
 		v.receiver.OnTyping(pl)
+	case *V2Presence:
+		v.receiver.OnPresence(pl)
 	case *V2DeviceMessages:
 		v.receiver.OnDeviceMessages(pl)
 	case *V2ExpiredToken:
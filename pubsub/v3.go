@@ -6,6 +6,7 @@ const ChanV3 = "v3ch"
 // V3Listener describes the messages that incoming sliding sync requests will publish.
 type V3Listener interface {
 	EnsurePolling(p *V3EnsurePolling)
+	OnSetPresence(p *V3SetPresence)
 }
 
 type V3EnsurePolling struct {
@@ -18,6 +19,15 @@ type V3EnsurePolling struct {
 
 func (*V3EnsurePolling) Type() string { return "V3EnsurePolling" }
 
+// V3SetPresence is emitted when a device asks for its presence to be set via a sliding sync request.
+type V3SetPresence struct {
+	UserID   string
+	DeviceID string
+	Presence string
+}
+
+func (*V3SetPresence) Type() string { return "V3SetPresence" }
+
 type V3Sub struct {
 	listener Listener
 	receiver V3Listener
@@ -38,6 +48,8 @@ func (v *V3Sub) onMessage(p Payload) {
 	switch pl := p.(type) {
 	case *V3EnsurePolling:
 		v.receiver.EnsurePolling(pl)
+	case *V3SetPresence:
+		v.receiver.OnSetPresence(pl)
 	default:
 		logger.Warn().Str("type", p.Type()).Msg("V3Sub: unhandled payload type")
 	}
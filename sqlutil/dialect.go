@@ -0,0 +1,235 @@
+package sqlutil
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The names of the supported dialects, as returned by Dialect.Name.
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// Dialect writes the parts of SQL which differ between Postgres and SQLite. Every query is written
+// once using a Dialect for these parts, and the database runs exactly the SQL which is written:
+// queries are never translated. The few queries which need entirely different SQL on each database
+// are kept in per-dialect query sets, chosen by Name.
+//
+// Arrays are passed as lib/pq array types e.g pq.StringArray in both dialects. SQLite stores them in
+// Postgres' text format, and provides the Postgres functions array_to_json and array_cat.
+type Dialect interface {
+	// Name returns Postgres or SQLite.
+	Name() string
+	// MaxParameters returns the maximum number of parameters allowed in a single SQL command, for
+	// use with Chunkify.
+	MaxParameters() int
+	// SupportsPartitioning returns true if tables can be partitioned.
+	SupportsPartitioning() bool
+
+	// ArrayType returns the column type of an array of elemType, e.g ArrayType("BIGINT").
+	ArrayType(elemType string) string
+	// TimestampType returns the column type of a time.Time, including its time zone.
+	TimestampType() string
+	// OrderByTimestamp returns an expression which orders the values of a TimestampType column.
+	OrderByTimestamp(column string) string
+	// CreateSequence returns the SQL to create this sequence if it does not exist, for use with
+	// SerialPrimaryKey and NextVals.
+	CreateSequence(sequence string) string
+	// SerialPrimaryKey returns the definition of a BIGINT primary key column, which defaults to the
+	// next value of this sequence.
+	SerialPrimaryKey(column, sequence string) string
+
+	// InArray returns a condition which is true if column is an element of the array expression,
+	// e.g InArray("room_id", "$1") is the equivalent of `room_id = ANY($1)`.
+	InArray(column, array string) string
+	// ArrayElements returns a FROM item with a row for each element of the array expression, in a
+	// column called value, e.g `FROM syncv3_snapshots CROSS JOIN ` + ArrayElements("events", "nids")
+	// selects nids.value. The array expression can refer to columns of earlier FROM items.
+	ArrayElements(array, alias string) string
+	// ZipArrays returns a FROM item with a row for each index of these array parameters, which have
+	// the same length, and a column holding the element at that index of each of them.
+	ZipArrays(alias string, columns ...ArrayColumn) string
+
+	// NextVals reserves n values of this sequence, in ascending order.
+	NextVals(txn *sqlx.Tx, sequence string, n int) ([]int64, error)
+	// LockTransaction takes a lock which is held until the transaction ends, so that only one
+	// transaction at a time holding this key runs.
+	LockTransaction(txn *sqlx.Tx, key int64) error
+	// TableExists returns true if this table exists.
+	TableExists(q sqlx.Queryer, table string) (bool, error)
+	// ColumnExists returns true if this table exists and has this column.
+	ColumnExists(q sqlx.Queryer, table, column string) (bool, error)
+	// Tables returns the names of all tables in the database, besides any used internally by the
+	// Dialect.
+	Tables(q sqlx.Queryer) ([]string, error)
+}
+
+// ArrayColumn is a column of Dialect.ZipArrays.
+type ArrayColumn struct {
+	// The column name.
+	Name string
+	// The array parameter, e.g $1.
+	Array string
+	// The type of the elements, e.g TEXT.
+	ElemType string
+}
+
+// DialectOf returns the dialect of this database.
+func DialectOf(db DriverNamer) Dialect {
+	if isSQLite(db) {
+		return sqliteDialect{}
+	}
+	return postgresDialect{}
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string                     { return Postgres }
+func (postgresDialect) MaxParameters() int               { return 65535 }
+func (postgresDialect) SupportsPartitioning() bool       { return true }
+func (postgresDialect) ArrayType(elemType string) string { return elemType + "[]" }
+func (postgresDialect) TimestampType() string            { return "TIMESTAMP WITH TIME ZONE" }
+func (postgresDialect) OrderByTimestamp(column string) string {
+	return column
+}
+func (postgresDialect) CreateSequence(sequence string) string {
+	return `CREATE SEQUENCE IF NOT EXISTS ` + sequence + `;`
+}
+func (postgresDialect) SerialPrimaryKey(column, sequence string) string {
+	return column + ` BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('` + sequence + `')`
+}
+
+func (postgresDialect) InArray(column, array string) string {
+	return column + ` = ANY(` + array + `)`
+}
+
+func (postgresDialect) ArrayElements(array, alias string) string {
+	return `unnest(` + array + `) AS ` + alias + `(value)`
+}
+
+func (postgresDialect) ZipArrays(alias string, columns ...ArrayColumn) string {
+	arrays := make([]string, len(columns))
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		arrays[i] = c.Array + `::` + c.ElemType + `[]`
+		names[i] = c.Name
+	}
+	return `unnest(` + strings.Join(arrays, ", ") + `) AS ` + alias + `(` + strings.Join(names, ", ") + `)`
+}
+
+func (postgresDialect) NextVals(txn *sqlx.Tx, sequence string, n int) (vals []int64, err error) {
+	err = txn.Select(&vals, `SELECT nextval($1) FROM generate_series(1, $2) ORDER BY 1`, sequence, n)
+	return
+}
+
+func (postgresDialect) LockTransaction(txn *sqlx.Tx, key int64) error {
+	_, err := txn.Exec(`SELECT pg_advisory_xact_lock($1)`, key)
+	return err
+}
+
+func (postgresDialect) TableExists(q sqlx.Queryer, table string) (exists bool, err error) {
+	err = q.QueryRowx(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+	return
+}
+
+func (postgresDialect) ColumnExists(q sqlx.Queryer, table, column string) (exists bool, err error) {
+	err = q.QueryRowx(`SELECT EXISTS(SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2)`, table, column,
+	).Scan(&exists)
+	return
+}
+
+func (postgresDialect) Tables(q sqlx.Queryer) (tables []string, err error) {
+	err = sqlx.Select(q, &tables, `SELECT tablename FROM pg_tables WHERE schemaname = current_schema()`)
+	return
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string               { return SQLite }
+func (sqliteDialect) MaxParameters() int         { return maxSQLiteParameters }
+func (sqliteDialect) SupportsPartitioning() bool { return false }
+
+// Arrays are stored in Postgres' text format.
+func (sqliteDialect) ArrayType(elemType string) string { return "TEXT" }
+
+// go-sqlite3 only converts columns declared as TIMESTAMP to and from time.Time.
+func (sqliteDialect) TimestampType() string { return "TIMESTAMP" }
+
+// Timestamps are stored as text with a time zone offset, so are compared with julianday.
+func (sqliteDialect) OrderByTimestamp(column string) string {
+	return `julianday(` + column + `)`
+}
+
+// SQLite has no sequences: NextVals keeps them in the sequences table instead.
+func (sqliteDialect) CreateSequence(sequence string) string { return "" }
+
+// AUTOINCREMENT never reuses values, like a sequence.
+func (sqliteDialect) SerialPrimaryKey(column, sequence string) string {
+	return column + ` INTEGER PRIMARY KEY AUTOINCREMENT`
+}
+
+func (sqliteDialect) InArray(column, array string) string {
+	return column + ` IN (SELECT value FROM json_each(array_to_json(` + array + `)))`
+}
+
+func (sqliteDialect) ArrayElements(array, alias string) string {
+	return `json_each(array_to_json(` + array + `)) AS ` + alias
+}
+
+func (sqliteDialect) ZipArrays(alias string, columns ...ArrayColumn) string {
+	selects := make([]string, len(columns))
+	var from strings.Builder
+	for i, c := range columns {
+		elems := "a" + strconv.Itoa(i)
+		selects[i] = elems + `.value AS ` + c.Name
+		if i == 0 {
+			from.WriteString(`json_each(array_to_json(` + c.Array + `)) AS ` + elems)
+		} else {
+			from.WriteString(` JOIN json_each(array_to_json(` + c.Array + `)) AS ` + elems + ` ON ` + elems + `.key = a0.key`)
+		}
+	}
+	return `(SELECT ` + strings.Join(selects, ", ") + ` FROM ` + from.String() + `) AS ` + alias
+}
+
+// NextVals reserves n consecutive values of this sequence. Sequences are created the first time
+// they are used, and start at 1. SQLite only allows one transaction to write at a time, so values
+// are handed out in the same order as transactions commit.
+func (sqliteDialect) NextVals(txn *sqlx.Tx, sequence string, n int) ([]int64, error) {
+	var last int64
+	err := txn.QueryRow(`
+	INSERT INTO syncv3_sqlite_sequences(name, value) VALUES($1, $2)
+	ON CONFLICT (name) DO UPDATE SET value = value + $2 RETURNING value`, sequence, n,
+	).Scan(&last)
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]int64, n)
+	for i := range vals {
+		vals[i] = last - int64(n) + 1 + int64(i)
+	}
+	return vals, nil
+}
+
+// WithTransaction takes the write lock when a transaction begins, so only one transaction runs at a
+// time anyway.
+func (sqliteDialect) LockTransaction(txn *sqlx.Tx, key int64) error { return nil }
+
+func (sqliteDialect) TableExists(q sqlx.Queryer, table string) (exists bool, err error) {
+	err = q.QueryRowx(`SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1)`, table).Scan(&exists)
+	return
+}
+
+func (sqliteDialect) ColumnExists(q sqlx.Queryer, table, column string) (exists bool, err error) {
+	err = q.QueryRowx(`SELECT EXISTS(SELECT 1 FROM pragma_table_info($1) WHERE name = $2)`, table, column).Scan(&exists)
+	return
+}
+
+func (sqliteDialect) Tables(q sqlx.Queryer) (tables []string, err error) {
+	err = sqlx.Select(q, &tables, `SELECT name FROM sqlite_master WHERE type = 'table'
+		AND name != 'syncv3_sqlite_sequences' AND name NOT LIKE 'sqlite\_%' ESCAPE '\'`)
+	return
+}
@@ -2,15 +2,42 @@ package sqlutil
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/rs/zerolog"
 	"os"
 	"runtime/debug"
+	"strings"
 
 	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
 )
 
+// SQLitePrefix is the prefix of database connection strings which refer to a SQLite database file
+// rather than a Postgres database, e.g "sqlite:/var/lib/syncv3/syncv3.db".
+const SQLitePrefix = "sqlite:"
+
+// Open opens the database with this connection string, which is either a Postgres connection
+// string or SQLitePrefix followed by the path to a SQLite database file.
+func Open(connStr string) (*sqlx.DB, error) {
+	if strings.HasPrefix(connStr, SQLitePrefix) {
+		return openSQLite(strings.TrimPrefix(connStr, SQLitePrefix))
+	}
+	return sqlx.Open("postgres", connStr)
+}
+
+// DriverNamer is implemented by *sqlx.DB and *sqlx.Tx.
+type DriverNamer interface {
+	DriverName() string
+}
+
+// isSQLite returns true if this database is a SQLite database. Queries use DialectOf rather than
+// checking this directly.
+func isSQLite(db DriverNamer) bool {
+	return db.DriverName() == driverSQLite
+}
+
 var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.ConsoleWriter{
 	Out:        os.Stderr,
 	TimeFormat: "15:04:05",
@@ -20,7 +47,14 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 // If the code returns an error or panics then the transactions is rolled back
 // Otherwise the transaction is committed.
 func WithTransaction(db *sqlx.DB, fn func(txn *sqlx.Tx) error) (err error) {
-	txn, err := db.Beginx()
+	var txn *sqlx.Tx
+	if isSQLite(db) {
+		// Take the write lock up front, as SQLite fails transactions which read and then write if
+		// another transaction has written in the meantime.
+		txn, err = db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelSerializable})
+	} else {
+		txn, err = db.Beginx()
+	}
 	if err != nil {
 		return fmt.Errorf("WithTransaction.Begin: %w", err)
 	}
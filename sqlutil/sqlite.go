@@ -0,0 +1,336 @@
+package sqlutil
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// The name of the database/sql driver for SQLite databases. This wraps the go-sqlite3 driver to
+// register the Postgres array functions used by Dialect, and so that transactions and statements
+// behave as they do on Postgres. Queries are run exactly as written: the differences between
+// Postgres and SQLite are written by Dialect.
+const driverSQLite = "syncv3_sqlite3"
+
+// SQLite has a lower limit than Postgres on the number of parameters in a single SQL command.
+const maxSQLiteParameters = 32766
+
+func init() {
+	sql.Register(driverSQLite, &sqliteDriver{
+		SQLiteDriver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				if err := conn.RegisterFunc("array_to_json", arrayToJSON, true); err != nil {
+					return err
+				}
+				return conn.RegisterFunc("array_cat", arrayCat, true)
+			},
+		},
+	})
+	// SQLite takes time quadratic in the number of $1 style placeholders to prepare a statement,
+	// which is slow for the large batch inserts built by sqlx, so use ? placeholders for those.
+	sqlx.BindDriver(driverSQLite, sqlx.QUESTION)
+}
+
+func openSQLite(path string) (*sqlx.DB, error) {
+	// Wait for other connections to finish writing rather than failing immediately. WAL mode lets
+	// readers carry on whilst another connection is writing.
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	db, err := sqlx.Open(driverSQLite, path+sep+"_busy_timeout=10000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS syncv3_sqlite_sequences (
+		name TEXT NOT NULL PRIMARY KEY,
+		value BIGINT NOT NULL
+	);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// checkPlaceholders returns an error if the $1 style placeholders in this query would not be bound
+// to the same arguments as in Postgres. SQLite treats them as named parameters, which are numbered
+// in the order they first appear, so each placeholder must first appear after $1 to $N-1.
+func checkPlaceholders(query string) error {
+	next := 1
+	for i := 0; i < len(query); i++ {
+		switch query[i] {
+		case '\'':
+			// skip string literals, where '' is an escaped quote
+			end := strings.IndexByte(query[i+1:], '\'')
+			if end == -1 {
+				return nil
+			}
+			i += end + 1
+		case '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j == i+1 {
+				continue
+			}
+			n, err := strconv.Atoi(query[i+1 : j])
+			if err != nil {
+				return err
+			}
+			if n > next {
+				return fmt.Errorf("placeholder $%d appears before $%d: %s", n, next, query)
+			}
+			if n == next {
+				next++
+			}
+			i = j - 1
+		}
+	}
+	return nil
+}
+
+type sqliteDriver struct {
+	*sqlite3.SQLiteDriver
+}
+
+func (d *sqliteDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqliteConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type sqliteConn struct {
+	*sqlite3.SQLiteConn
+}
+
+// BeginTx begins a transaction which takes the write lock immediately if a serializable
+// transaction is requested. Otherwise the transaction only takes the write lock when it first
+// writes, which fails if another connection has written since the transaction first read.
+func (c *sqliteConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if sql.IsolationLevel(opts.Isolation) != sql.LevelSerializable {
+		return c.SQLiteConn.BeginTx(ctx, opts)
+	}
+	if _, err := c.SQLiteConn.ExecContext(ctx, "BEGIN IMMEDIATE", nil); err != nil {
+		return nil, err
+	}
+	return &sqliteTx{c.SQLiteConn}, nil
+}
+
+type sqliteTx struct {
+	conn *sqlite3.SQLiteConn
+}
+
+func (tx *sqliteTx) Commit() error {
+	_, err := tx.conn.ExecContext(context.Background(), "COMMIT", nil)
+	if err != nil {
+		// the transaction may still be open, but database/sql considers it finished
+		tx.conn.ExecContext(context.Background(), "ROLLBACK", nil)
+	}
+	return err
+}
+
+func (tx *sqliteTx) Rollback() error {
+	_, err := tx.conn.ExecContext(context.Background(), "ROLLBACK", nil)
+	return err
+}
+
+func (c *sqliteConn) Prepare(query string) (driver.Stmt, error) {
+	if err := checkPlaceholders(query); err != nil {
+		return nil, err
+	}
+	return c.SQLiteConn.Prepare(query)
+}
+
+func (c *sqliteConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := checkPlaceholders(query); err != nil {
+		return nil, err
+	}
+	return c.SQLiteConn.PrepareContext(ctx, query)
+}
+
+func (c *sqliteConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := checkPlaceholders(query); err != nil {
+		return nil, err
+	}
+	return c.SQLiteConn.ExecContext(ctx, query, translateArgs(args))
+}
+
+func (c *sqliteConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := checkPlaceholders(query); err != nil {
+		return nil, err
+	}
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, translateArgs(args))
+	if err != nil || len(rows.Columns()) > 0 {
+		return rows, err
+	}
+	// SQLite only executes a statement when its rows are read, whereas Postgres executes it straight
+	// away, so a statement without results such as an INSERT is run here in case the rows are closed
+	// without being read.
+	for err == nil {
+		err = rows.Next(nil)
+	}
+	rows.Close()
+	if err != io.EOF {
+		return nil, err
+	}
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+// Exec and Query are only called by database/sql for drivers without ExecContext and QueryContext,
+// but are overridden so that placeholders are always checked.
+func (c *sqliteConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.ExecContext(context.Background(), query, namedValues(args))
+}
+
+func (c *sqliteConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.QueryContext(context.Background(), query, namedValues(args))
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+// translateArgs converts nil byte slices to empty byte slices, as lib/pq writes them as empty BYTEA
+// whereas go-sqlite3 writes them as NULL.
+func translateArgs(args []driver.NamedValue) []driver.NamedValue {
+	for i := range args {
+		if b, ok := args[i].Value.([]byte); ok && b == nil {
+			args[i].Value = []byte{}
+		}
+	}
+	return args
+}
+
+// parseArray parses a one dimensional array in Postgres' text format, as written by the lib/pq
+// array types. Quoted elements are returned as strings, NULL as nil, and other elements as their
+// text.
+func parseArray(arr interface{}) (elems []interface{}, isNull bool, err error) {
+	var s string
+	switch a := arr.(type) {
+	case nil:
+		return nil, true, nil
+	case string:
+		s = a
+	case []byte:
+		if a == nil {
+			// go-sqlite3 passes NULL to functions as a nil byte slice
+			return nil, true, nil
+		}
+		s = string(a)
+	default:
+		return nil, false, fmt.Errorf("not an array: %T", arr)
+	}
+	if len(s) < 2 || s[0] != '{' || s[len(s)-1] != '}' {
+		return nil, false, fmt.Errorf("malformed array: %q", s)
+	}
+	s = s[1 : len(s)-1]
+	elems = []interface{}{}
+	for len(s) > 0 {
+		if s[0] == '"' {
+			var elem strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				elem.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, false, fmt.Errorf("malformed array: unterminated element")
+			}
+			elems = append(elems, elem.String())
+			s = s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end == -1 {
+				end = len(s)
+			}
+			if strings.EqualFold(s[:end], "NULL") {
+				elems = append(elems, nil)
+			} else {
+				elems = append(elems, json.Number(s[:end]))
+			}
+			s = s[end:]
+		}
+		s = strings.TrimPrefix(s, ",")
+	}
+	return elems, false, nil
+}
+
+// arrayToJSON implements array_to_json for SQLite, returning the array as a JSON array.
+// Unquoted elements which are integers are returned as JSON numbers.
+func arrayToJSON(arr interface{}) (interface{}, error) {
+	elems, isNull, err := parseArray(arr)
+	if err != nil || isNull {
+		return nil, err
+	}
+	for i, elem := range elems {
+		if n, ok := elem.(json.Number); ok {
+			if _, err := strconv.ParseInt(string(n), 10, 64); err != nil {
+				elems[i] = string(n)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(elems); err != nil {
+		return nil, err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// arrayCat implements array_cat for SQLite, concatenating arrays. NULL arrays are ignored.
+func arrayCat(arrays ...interface{}) (interface{}, error) {
+	var result []string
+	allNull := true
+	for _, arr := range arrays {
+		elems, isNull, err := parseArray(arr)
+		if err != nil {
+			return nil, err
+		}
+		if isNull {
+			continue
+		}
+		allNull = false
+		for _, elem := range elems {
+			switch e := elem.(type) {
+			case nil:
+				result = append(result, "NULL")
+			case json.Number:
+				result = append(result, string(e))
+			case string:
+				result = append(result, `"`+strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(e)+`"`)
+			}
+		}
+	}
+	if allNull {
+		return nil, nil
+	}
+	return "{" + strings.Join(result, ",") + "}", nil
+}
@@ -0,0 +1,176 @@
+package sqlutil
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+func TestCheckPlaceholders(t *testing.T) {
+	testCases := []struct {
+		query   string
+		wantErr bool
+	}{
+		{query: `SELECT a FROM t WHERE b=$1 AND c=$2`},
+		{query: `INSERT INTO t(a, b) VALUES($1, $2) ON CONFLICT (a) DO UPDATE SET b=$2, a=$1`},
+		{query: `SELECT a FROM t WHERE b=? AND c=?`},
+		{query: `SELECT '$2' FROM t WHERE b=$1`},
+		{query: `SELECT 'it''s $3' FROM t WHERE b=$1`},
+		{query: `INSERT INTO t(a, b) VALUES($2, $1)`, wantErr: true},
+		{query: `SELECT a FROM t WHERE b=$1 AND c=$3`, wantErr: true},
+	}
+	for _, tc := range testCases {
+		err := checkPlaceholders(tc.query)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("checkPlaceholders(%q) got err %v want error %v", tc.query, err, tc.wantErr)
+		}
+	}
+}
+
+func TestArrayFunctions(t *testing.T) {
+	testCases := []struct {
+		arr      interface{}
+		wantJSON interface{}
+	}{
+		{arr: nil, wantJSON: nil},
+		{arr: []byte(nil), wantJSON: nil},
+		{arr: "{}", wantJSON: "[]"},
+		{arr: "{1,2,-3}", wantJSON: "[1,2,-3]"},
+		{arr: []byte(`{"a b","c\"d",e,NULL}`), wantJSON: `["a b","c\"d","e",null]`},
+		{arr: `{"\\",<&>}`, wantJSON: `["\\","<&>"]`},
+	}
+	for _, tc := range testCases {
+		got, err := arrayToJSON(tc.arr)
+		if err != nil {
+			t.Fatalf("arrayToJSON(%v): %s", tc.arr, err)
+		}
+		if got != tc.wantJSON {
+			t.Errorf("arrayToJSON(%v) got %v want %v", tc.arr, got, tc.wantJSON)
+		}
+	}
+	if _, err := arrayToJSON("[1,2]"); err == nil {
+		t.Errorf("arrayToJSON accepted a malformed array")
+	}
+
+	got, err := arrayCat("{1,2}", nil, `{"a,b",NULL}`)
+	if err != nil {
+		t.Fatalf("arrayCat: %s", err)
+	}
+	if want := `{1,2,"a,b",NULL}`; got != want {
+		t.Errorf("arrayCat got %v want %v", got, want)
+	}
+	got, err = arrayCat(nil, nil)
+	if err != nil || got != nil {
+		t.Errorf("arrayCat of NULLs got %v, %v want nil", got, err)
+	}
+}
+
+func TestSQLite(t *testing.T) {
+	db, err := Open(SQLitePrefix + filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer db.Close()
+	dialect := DialectOf(db)
+	if dialect.Name() != SQLite {
+		t.Fatalf("DialectOf got %s want %s", dialect.Name(), SQLite)
+	}
+	if got := dialect.MaxParameters(); got != maxSQLiteParameters {
+		t.Errorf("MaxParameters got %d want %d", got, maxSQLiteParameters)
+	}
+	db.MustExec(`CREATE TABLE IF NOT EXISTS arrays (name TEXT NOT NULL, nids ` + dialect.ArrayType("BIGINT") + ` NOT NULL, data BYTEA NOT NULL)`)
+	// this runs an INSERT as a query without reading the rows
+	rows, err := db.Query(`INSERT INTO arrays(name, nids, data) VALUES($1, $2, $3), ($4, $5, $6)`,
+		"a", pq.Int64Array{1, 2, 3}, []byte(nil), "b", pq.Int64Array{}, []byte("b"),
+	)
+	if err != nil {
+		t.Fatalf("failed to insert: %s", err)
+	}
+	rows.Close()
+
+	var names []string
+	if err = db.Select(&names, `SELECT name FROM arrays WHERE `+dialect.InArray("name", "$1")+` ORDER BY name`, pq.StringArray{"a", "b", "c"}); err != nil {
+		t.Fatalf("failed to select with InArray: %s", err)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("selected names %v want [a b]", names)
+	}
+	var nids pq.Int64Array
+	if err = db.QueryRow(`SELECT nids FROM arrays WHERE name = $1`, "a").Scan(&nids); err != nil {
+		t.Fatalf("failed to select array: %s", err)
+	}
+	if !reflect.DeepEqual(nids, pq.Int64Array{1, 2, 3}) {
+		t.Errorf("selected nids %v want [1 2 3]", nids)
+	}
+	var total int64
+	if err = db.QueryRow(`SELECT SUM(nids.value) FROM arrays CROSS JOIN ` + dialect.ArrayElements("nids", "nids")).Scan(&total); err != nil {
+		t.Fatalf("failed to unnest array: %s", err)
+	}
+	if total != 6 {
+		t.Errorf("sum of nids got %d want 6", total)
+	}
+	var data []byte
+	if err = db.QueryRow(`SELECT data FROM arrays WHERE name = $1`, "a").Scan(&data); err != nil {
+		t.Fatalf("failed to select data: %s", err)
+	}
+	if data == nil || len(data) != 0 {
+		t.Errorf("nil byte slice was not stored as empty: %v", data)
+	}
+
+	var zipped []struct {
+		Name string `db:"name"`
+		NID  int64  `db:"nid"`
+	}
+	err = db.Select(&zipped, `SELECT name, nid FROM `+dialect.ZipArrays("z",
+		ArrayColumn{Name: "name", Array: "$1", ElemType: "TEXT"},
+		ArrayColumn{Name: "nid", Array: "$2", ElemType: "BIGINT"},
+	)+` ORDER BY nid`, pq.StringArray{"x", "y"}, pq.Int64Array{1, 2})
+	if err != nil {
+		t.Fatalf("failed to zip arrays: %s", err)
+	}
+	if len(zipped) != 2 || zipped[0].Name != "x" || zipped[0].NID != 1 || zipped[1].Name != "y" || zipped[1].NID != 2 {
+		t.Errorf("zipped arrays got %+v want [{x 1} {y 2}]", zipped)
+	}
+
+	if _, err = db.Exec(`INSERT INTO arrays(name, nids, data) VALUES($2, $1, $3)`, "{}", "c", []byte("c")); err == nil {
+		t.Errorf("out of order placeholders were accepted")
+	}
+
+	var vals [][]int64
+	for _, n := range []int{1, 5, 2} {
+		err = WithTransaction(db, func(txn *sqlx.Tx) error {
+			v, err := dialect.NextVals(txn, "test_seq", n)
+			vals = append(vals, v)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("NextVals: %s", err)
+		}
+	}
+	if want := [][]int64{{1}, {2, 3, 4, 5, 6}, {7, 8}}; !reflect.DeepEqual(vals, want) {
+		t.Errorf("NextVals returned %v want %v", vals, want)
+	}
+
+	exists, err := dialect.TableExists(db, "arrays")
+	if err != nil || !exists {
+		t.Errorf("TableExists(arrays) got %v, %v want true", exists, err)
+	}
+	exists, err = dialect.ColumnExists(db, "arrays", "nids")
+	if err != nil || !exists {
+		t.Errorf("ColumnExists(arrays, nids) got %v, %v want true", exists, err)
+	}
+	exists, err = dialect.ColumnExists(db, "arrays", "missing")
+	if err != nil || exists {
+		t.Errorf("ColumnExists(arrays, missing) got %v, %v want false", exists, err)
+	}
+	tables, err := dialect.Tables(db)
+	if err != nil {
+		t.Fatalf("Tables: %s", err)
+	}
+	if !reflect.DeepEqual(tables, []string{"arrays"}) {
+		t.Errorf("Tables got %v want [arrays]", tables)
+	}
+}
@@ -23,10 +23,9 @@ type AccountDataTable struct{}
 
 func NewAccountDataTable(db *sqlx.DB) *AccountDataTable {
 	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_account_data_seq;
+	db.MustExec(sqlutil.DialectOf(db).CreateSequence("syncv3_account_data_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_account_data (
-		id BIGINT NOT NULL DEFAULT nextval('syncv3_account_data_seq'),
+		id BIGINT NOT NULL,
 		user_id TEXT NOT NULL,
 		room_id TEXT NOT NULL, -- optional if global
 		type TEXT NOT NULL,
@@ -53,11 +52,21 @@ func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]Accou
 	for _, ad := range keys {
 		dedupedAccountData = append(dedupedAccountData, *ad)
 	}
-	chunks := sqlutil.Chunkify(4, MaxPostgresParameters, AccountDataChunker(dedupedAccountData))
+	if len(dedupedAccountData) == 0 {
+		return dedupedAccountData, nil
+	}
+	ids, err := sqlutil.DialectOf(txn).NextVals(txn, "syncv3_account_data_seq", len(dedupedAccountData))
+	if err != nil {
+		return nil, err
+	}
+	for i := range dedupedAccountData {
+		dedupedAccountData[i].ID = ids[i]
+	}
+	chunks := sqlutil.Chunkify(5, sqlutil.DialectOf(txn).MaxParameters(), AccountDataChunker(dedupedAccountData))
 	for _, chunk := range chunks {
 		_, err := txn.NamedExec(`
-		INSERT INTO syncv3_account_data (user_id, room_id, type, data)
-        VALUES (:user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data, id=nextval('syncv3_account_data_seq')`, chunk)
+		INSERT INTO syncv3_account_data (id, user_id, room_id, type, data)
+		VALUES (:id, :user_id, :room_id, :type, :data) ON CONFLICT (user_id, room_id, type) DO UPDATE SET data = EXCLUDED.data, id = EXCLUDED.id`, chunk)
 		if err != nil {
 			return nil, err
 		}
@@ -67,7 +76,7 @@ func (t *AccountDataTable) Insert(txn *sqlx.Tx, accDatas []AccountData) ([]Accou
 
 func (t *AccountDataTable) Select(txn *sqlx.Tx, userID string, eventTypes []string, roomID string) (datas []AccountData, err error) {
 	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-	WHERE user_id=$1 AND type=ANY($2) AND room_id=$3`, userID, pq.StringArray(eventTypes), roomID)
+	WHERE user_id=$1 AND `+sqlutil.DialectOf(txn).InArray("type", "$2")+` AND room_id=$3`, userID, pq.StringArray(eventTypes), roomID)
 	return
 }
 
@@ -84,7 +93,22 @@ func (t *AccountDataTable) SelectMany(txn *sqlx.Tx, userID string, roomIDs ...st
 		return
 	}
 	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
-	WHERE user_id=$1 AND room_id=ANY($2)`, userID, pq.StringArray(roomIDs))
+	WHERE user_id=$1 AND `+sqlutil.DialectOf(txn).InArray("room_id", "$2"), userID, pq.StringArray(roomIDs))
+	return
+}
+
+// SelectGlobalPage returns up to `limit` global account data events for this user with an ID greater
+// than `fromID`, in ID order. If `types` is non-empty, only these event types are returned. Event
+// types in `notTypes` are never returned.
+func (t *AccountDataTable) SelectGlobalPage(txn *sqlx.Tx, userID string, fromID int64, limit int, types, notTypes []string) (datas []AccountData, err error) {
+	if notTypes == nil {
+		notTypes = []string{}
+	}
+	dialect := sqlutil.DialectOf(txn)
+	err = txn.Select(&datas, `SELECT id, user_id, room_id, type, data FROM syncv3_account_data
+	WHERE user_id=$1 AND room_id=$2 AND id > $3
+	AND ($4 OR `+dialect.InArray("type", "$5")+`) AND NOT `+dialect.InArray("type", "$6")+`
+	ORDER BY id ASC LIMIT $7`, userID, AccountDataGlobalRoom, fromID, len(types) == 0, pq.StringArray(types), pq.StringArray(notTypes), limit)
 	return
 }
 
@@ -48,6 +48,7 @@ func TestAccountData(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to start txn: %s", err)
 	}
+	defer txn.Rollback()
 	alice := "@alice_TestAccountData:localhost"
 	roomA := "!TestAccountData_A:localhost"
 	roomB := "!TestAccountData_B:localhost"
@@ -178,6 +179,7 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to start txn: %s", err)
 	}
+	defer txn.Rollback()
 	alice := "@alice_TestAccountDataIDIncrements:localhost"
 	roomA := "!TestAccountData_A:localhost"
 	//roomB := "!TestAccountData_B:localhost"
@@ -227,3 +229,54 @@ func TestAccountDataIDIncrements(t *testing.T) {
 	assertNoError(t, err)
 	assertAccountDatasEqual(t, "SelectWithType", gots, []AccountData{data})
 }
+
+func TestAccountDataSelectGlobalPage(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("failed to start txn: %s", err)
+	}
+	defer txn.Rollback()
+	alice := "@alice_TestAccountDataSelectGlobalPage:localhost"
+	table := NewAccountDataTable(db)
+	// insert one at a time so the ids are in a known order
+	var inserted []AccountData
+	for _, evType := range []string{"m.direct", "m.push_rules", "com.example.a", "com.example.b"} {
+		_, err = table.Insert(txn, []AccountData{{
+			UserID: alice,
+			RoomID: AccountDataGlobalRoom,
+			Type:   evType,
+			Data:   []byte(`{"type":"` + evType + `"}`),
+		}})
+		assertNoError(t, err)
+		got, err := table.Select(txn, alice, []string{evType}, AccountDataGlobalRoom)
+		assertNoError(t, err)
+		inserted = append(inserted, got...)
+	}
+	// room account data is never returned
+	_, err = table.Insert(txn, []AccountData{{
+		UserID: alice,
+		RoomID: "!TestAccountDataSelectGlobalPage:localhost",
+		Type:   "m.direct",
+		Data:   []byte(`{}`),
+	}})
+	assertNoError(t, err)
+
+	gots, err := table.SelectGlobalPage(txn, alice, 0, 2, nil, nil)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "first page", gots, inserted[:2])
+	gots, err = table.SelectGlobalPage(txn, alice, inserted[1].ID, 2, nil, nil)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "second page", gots, inserted[2:])
+	gots, err = table.SelectGlobalPage(txn, alice, inserted[3].ID, 2, nil, nil)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "last page", gots, nil)
+
+	gots, err = table.SelectGlobalPage(txn, alice, 0, 10, []string{"m.direct", "com.example.a"}, nil)
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "types", gots, []AccountData{inserted[0], inserted[2]})
+	gots, err = table.SelectGlobalPage(txn, alice, 0, 10, nil, []string{"m.push_rules"})
+	assertNoError(t, err)
+	assertAccountDatasEqual(t, "not_types", gots, []AccountData{inserted[0], inserted[2], inserted[3]})
+}
@@ -188,7 +188,7 @@ func (a *Accumulator) Initialise(roomID string, state []json.RawMessage) (Initia
 				eventIDToRawEvent[eventID.Str] = state[i]
 				eventIDs[i] = eventID.Str
 			}
-			unknownEventIDs, err := a.eventsTable.SelectUnknownEventIDs(txn, eventIDs)
+			unknownEventIDs, err := a.eventsTable.SelectUnknownEventIDs(txn, roomID, eventIDs)
 			if err != nil {
 				return fmt.Errorf("error determing which event IDs are unknown: %s", err)
 			}
@@ -396,7 +396,7 @@ func (a *Accumulator) Accumulate(txn *sqlx.Tx, roomID string, prevBatch string,
 			}
 			snapID = newSnapshot.SnapshotID
 		}
-		if err := a.eventsTable.UpdateBeforeSnapshotID(txn, ev.NID, beforeSnapID, replacesNID); err != nil {
+		if err := a.eventsTable.UpdateBeforeSnapshotID(txn, roomID, ev.NID, beforeSnapID, replacesNID); err != nil {
 			return 0, nil, err
 		}
 	}
@@ -296,7 +296,7 @@ func TestAccumulatorMembershipLogs(t *testing.T) {
 	// Begin assertions
 
 	// Pull nids for these events
-	insertedEvents, err := accumulator.eventsTable.SelectByIDs(txn, true, roomEventIDs)
+	insertedEvents, err := accumulator.eventsTable.SelectByIDs(txn, true, roomID, roomEventIDs)
 	txn.Rollback()
 	if err != nil {
 		t.Fatalf("Failed to select accumulated events: %s", err)
@@ -472,7 +472,7 @@ func TestAccumulatorMisorderedGraceful(t *testing.T) {
 	}
 	t.Logf("Events A,B,C,D: %v", eventIDs)
 	txn := accumulator.db.MustBeginTx(context.Background(), nil)
-	idsToNIDs, err := accumulator.eventsTable.SelectNIDsByIDs(txn, eventIDs)
+	idsToNIDs, err := accumulator.eventsTable.SelectNIDsByIDs(txn, roomID, eventIDs)
 	if err != nil {
 		t.Fatalf("Failed to SelectNIDsByIDs: %s", err)
 	}
@@ -0,0 +1,95 @@
+package state
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// Checkpoint is a copy of the in-memory global state of the sliding sync API at a point in time.
+// Starting up from a checkpoint and then processing only the events after it is much faster than
+// calculating a StartupSnapshot from every room in the database.
+type Checkpoint struct {
+	// All events up to and including this NID are reflected in the checkpoint.
+	EventNID int64 `json:"event_nid"`
+	// Events are replayed from after this NID when starting up from the checkpoint, which is the
+	// EventNID of the previous checkpoint. Events are committed and then dispatched, so they may be
+	// dispatched slightly out of NID order: the checkpoint may not reflect some events before
+	// EventNID. Replaying from an earlier checkpoint covers these, and replaying an event which is
+	// already reflected is harmless.
+	ReplayFromNID int64 `json:"replay_from_nid"`
+	// Metadata for each room. Nil if room metadata is loaded on demand, in which case it is not checkpointed.
+	GlobalMetadata    map[string]internal.RoomMetadata `json:"global_metadata,omitempty"`
+	AllJoinedMembers  map[string][]string              `json:"joined_members"`  // room_id -> [user_id]
+	AllInvitedMembers map[string][]string              `json:"invited_members"` // room_id -> [user_id]
+}
+
+// CheckpointTable stores the most recent Checkpoint. Checkpoints can be large so are stored as
+// gzipped JSON.
+type CheckpointTable struct {
+	db *sqlx.DB
+}
+
+func NewCheckpointTable(db *sqlx.DB) *CheckpointTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_checkpoints (
+		-- there is only ever one checkpoint, the latest one
+		id SMALLINT NOT NULL PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+		event_nid BIGINT NOT NULL,
+		created_ts BIGINT NOT NULL,
+		data BYTEA NOT NULL
+	);
+	`)
+	return &CheckpointTable{db}
+}
+
+// Upsert replaces the stored checkpoint with this one.
+func (t *CheckpointTable) Upsert(cp *Checkpoint) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(cp); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	_, err := t.db.Exec(
+		`INSERT INTO syncv3_checkpoints(id, event_nid, created_ts, data) VALUES(1, $1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET event_nid = $1, created_ts = $2, data = $3`,
+		cp.EventNID, time.Now().UnixMilli(), buf.Bytes(),
+	)
+	return err
+}
+
+// Select the stored checkpoint. Returns nil if there is no checkpoint.
+func (t *CheckpointTable) Select() (*Checkpoint, error) {
+	var data []byte
+	err := t.db.QueryRow(`SELECT data FROM syncv3_checkpoints WHERE id = 1`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var cp Checkpoint
+	if err = json.NewDecoder(zr).Decode(&cp); err != nil {
+		return nil, err
+	}
+	for roomID, metadata := range cp.GlobalMetadata {
+		// typing notifications are not checkpointed, but a nil value is decoded as a JSON null
+		metadata.TypingEvent = nil
+		cp.GlobalMetadata[roomID] = metadata
+	}
+	return &cp, nil
+}
@@ -0,0 +1,54 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestCheckpointTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewCheckpointTable(db)
+	_, err := db.Exec(`DELETE FROM syncv3_checkpoints`)
+	assertNoError(t, err)
+
+	cp, err := table.Select()
+	assertNoError(t, err)
+	if cp != nil {
+		t.Fatalf("Select: got %+v want nil", cp)
+	}
+
+	roomA := "!a_TestCheckpointTable:localhost"
+	metadata := internal.NewRoomMetadata(roomA)
+	metadata.NameEvent = "Room A"
+	metadata.JoinCount = 2
+	metadata.LastMessageTimestamp = 123456
+	metadata.LatestEventsByType["m.room.message"] = internal.EventMetadata{NID: 42, Timestamp: 123456}
+	want := &Checkpoint{
+		EventNID:          42,
+		GlobalMetadata:    map[string]internal.RoomMetadata{roomA: *metadata},
+		AllJoinedMembers:  map[string][]string{roomA: {"@alice:localhost", "@bob:localhost"}},
+		AllInvitedMembers: map[string][]string{roomA: {"@charlie:localhost"}},
+	}
+	assertNoError(t, table.Upsert(want))
+	cp, err = table.Select()
+	assertNoError(t, err)
+	if !reflect.DeepEqual(cp, want) {
+		t.Fatalf("Select:\ngot  %+v\nwant %+v", cp, want)
+	}
+
+	// upserting replaces the checkpoint
+	want = &Checkpoint{
+		EventNID:          50,
+		AllJoinedMembers:  map[string][]string{roomA: {"@alice:localhost"}},
+		AllInvitedMembers: map[string][]string{},
+	}
+	assertNoError(t, table.Upsert(want))
+	cp, err = table.Select()
+	assertNoError(t, err)
+	if !reflect.DeepEqual(cp, want) {
+		t.Fatalf("Select:\ngot  %+v\nwant %+v", cp, want)
+	}
+}
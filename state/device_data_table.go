@@ -24,10 +24,9 @@ type DeviceDataTable struct {
 }
 
 func NewDeviceDataTable(db *sqlx.DB) *DeviceDataTable {
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_device_data_seq;
+	db.MustExec(sqlutil.DialectOf(db).CreateSequence("syncv3_device_data_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_device_data (
-		id BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_device_data_seq'),
+		id BIGINT PRIMARY KEY NOT NULL,
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
 		data BYTEA NOT NULL,
@@ -39,7 +38,7 @@ func NewDeviceDataTable(db *sqlx.DB) *DeviceDataTable {
 	}
 }
 
-// Atomically select the device data for this user|device and then swap DeviceLists around if set.
+// Atomically select the device data for this user|device and then reset the changed bits if swap is set.
 // This should only be called by the v3 HTTP APIs when servicing an E2EE extension request.
 func (t *DeviceDataTable) Select(userID, deviceID string, swap bool) (result *internal.DeviceData, err error) {
 	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
@@ -61,10 +60,8 @@ func (t *DeviceDataTable) Select(userID, deviceID string, swap bool) (result *in
 		if !swap {
 			return nil // don't swap
 		}
-		// swap over the fields
+		// reset the changed bits
 		writeBack := *result
-		writeBack.DeviceLists.Sent = result.DeviceLists.New
-		writeBack.DeviceLists.New = make(map[string]int)
 		writeBack.ChangedBits = 0
 
 		// re-marshal and write
@@ -113,16 +110,19 @@ func (t *DeviceDataTable) Upsert(dd *internal.DeviceData) (pos int64, err error)
 			tempDD.OTKCounts = dd.OTKCounts
 			tempDD.SetOTKCountChanged()
 		}
-		tempDD.DeviceLists = tempDD.DeviceLists.Combine(dd.DeviceLists)
 
 		data, err := json.Marshal(tempDD)
 		if err != nil {
 			return err
 		}
+		ids, err := sqlutil.DialectOf(txn).NextVals(txn, "syncv3_device_data_seq", 1)
+		if err != nil {
+			return err
+		}
 		err = txn.QueryRow(
-			`INSERT INTO syncv3_device_data(user_id, device_id, data) VALUES($1,$2,$3)
-			ON CONFLICT (user_id, device_id) DO UPDATE SET data=$3, id=nextval('syncv3_device_data_seq') RETURNING id`,
-			dd.UserID, dd.DeviceID, data,
+			`INSERT INTO syncv3_device_data(user_id, device_id, data, id) VALUES($1,$2,$3,$4)
+			ON CONFLICT (user_id, device_id) DO UPDATE SET data=$3, id=$4 RETURNING id`,
+			dd.UserID, dd.DeviceID, data, ids[0],
 		).Scan(&pos)
 		return err
 	})
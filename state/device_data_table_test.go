@@ -44,9 +44,6 @@ func TestDeviceDataTableSwaps(t *testing.T) {
 			UserID:           userID,
 			DeviceID:         deviceID,
 			FallbackKeyTypes: []string{"foobar"},
-			DeviceLists: internal.DeviceLists{
-				New: internal.ToDeviceListChangesMap([]string{"alice"}, nil),
-			},
 		},
 		{
 			UserID:   userID,
@@ -55,13 +52,6 @@ func TestDeviceDataTableSwaps(t *testing.T) {
 				"foo": 99,
 			},
 		},
-		{
-			UserID:   userID,
-			DeviceID: deviceID,
-			DeviceLists: internal.DeviceLists{
-				New: internal.ToDeviceListChangesMap([]string{"bob"}, nil),
-			},
-		},
 	}
 	for _, dd := range deltas {
 		_, err := table.Upsert(&dd)
@@ -75,9 +65,6 @@ func TestDeviceDataTableSwaps(t *testing.T) {
 			"foo": 99,
 		},
 		FallbackKeyTypes: []string{"foobar"},
-		DeviceLists: internal.DeviceLists{
-			New: internal.ToDeviceListChangesMap([]string{"alice", "bob"}, nil),
-		},
 	}
 	want.SetFallbackKeysChanged()
 	want.SetOTKCountChanged()
@@ -91,10 +78,6 @@ func TestDeviceDataTableSwaps(t *testing.T) {
 	got, err := table.Select(userID, deviceID, true)
 	assertNoError(t, err)
 	want2 := want
-	want2.DeviceLists = internal.DeviceLists{
-		Sent: internal.ToDeviceListChangesMap([]string{"alice"}, nil),
-		New:  nil,
-	}
 	assertDeviceData(t, *got, want2)
 
 	// changed bits were reset when we swapped
@@ -106,15 +89,10 @@ func TestDeviceDataTableSwaps(t *testing.T) {
 	assertNoError(t, err)
 	assertDeviceData(t, *got, want2)
 
-	// another swap causes sent to be cleared out
+	// another swap is a no-op
 	got, err = table.Select(userID, deviceID, true)
 	assertNoError(t, err)
-	want3 := want2
-	want3.DeviceLists = internal.DeviceLists{
-		Sent: nil,
-		New:  nil,
-	}
-	assertDeviceData(t, *got, want3)
+	assertDeviceData(t, *got, want2)
 
 	// get back the original state
 	for _, dd := range deltas {
@@ -127,46 +105,13 @@ func TestDeviceDataTableSwaps(t *testing.T) {
 	assertNoError(t, err)
 	assertDeviceData(t, *got, want)
 
-	// swap once then add once so both sent and new are populated
+	// swap again, which resets the changed bits
 	_, err = table.Select(userID, deviceID, true)
 	assertNoError(t, err)
-	_, err = table.Upsert(&internal.DeviceData{
-		UserID:   userID,
-		DeviceID: deviceID,
-		DeviceLists: internal.DeviceLists{
-			New: internal.ToDeviceListChangesMap([]string{"bob"}, []string{"charlie"}),
-		},
-	})
-	assertNoError(t, err)
-
 	want.ChangedBits = 0
-
-	want4 := want
-	want4.DeviceLists = internal.DeviceLists{
-		Sent: internal.ToDeviceListChangesMap([]string{"alice"}, nil),
-		New:  internal.ToDeviceListChangesMap([]string{"bob"}, []string{"charlie"}),
-	}
 	got, err = table.Select(userID, deviceID, false)
 	assertNoError(t, err)
-	assertDeviceData(t, *got, want4)
-
-	// another append then consume
-	_, err = table.Upsert(&internal.DeviceData{
-		UserID:   userID,
-		DeviceID: deviceID,
-		DeviceLists: internal.DeviceLists{
-			New: internal.ToDeviceListChangesMap([]string{"dave"}, []string{"dave"}),
-		},
-	})
-	assertNoError(t, err)
-	got, err = table.Select(userID, deviceID, true)
-	assertNoError(t, err)
-	want5 := want4
-	want5.DeviceLists = internal.DeviceLists{
-		Sent: internal.ToDeviceListChangesMap([]string{"bob", "dave"}, []string{"charlie", "dave"}),
-		New:  nil,
-	}
-	assertDeviceData(t, *got, want5)
+	assertDeviceData(t, *got, want)
 
 	// delete everything, no data returned
 	assertNoError(t, table.DeleteDevice(userID, deviceID))
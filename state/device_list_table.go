@@ -0,0 +1,200 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// DeviceListTable stores device list changes for devices as an append-only stream. Each connection
+// consumes the stream using positions, in the same way as to-device messages. Unlike to-device
+// messages, changes are deleted once they are old rather than when they are acknowledged.
+type DeviceListTable struct {
+	db *sqlx.DB
+}
+
+type DeviceListRow struct {
+	Position     int64  `db:"position"`
+	UserID       string `db:"user_id"`
+	DeviceID     string `db:"device_id"`
+	TargetUserID string `db:"target_user_id"`
+	// One of internal.DeviceListChanged or internal.DeviceListLeft
+	TargetState int `db:"target_state"`
+}
+
+func NewDeviceListTable(db *sqlx.DB) *DeviceListTable {
+	db.MustExec(deviceListTableSchema(sqlutil.DialectOf(db)))
+	return &DeviceListTable{
+		db: db,
+	}
+}
+
+func deviceListTableSchema(dialect sqlutil.Dialect) string {
+	return dialect.CreateSequence("syncv3_device_list_updates_seq") + `
+	CREATE TABLE IF NOT EXISTS syncv3_device_list_updates (
+		` + dialect.SerialPrimaryKey("position", "syncv3_device_list_updates_seq") + `,
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		target_user_id TEXT NOT NULL,
+		target_state SMALLINT NOT NULL,
+		created_ts BIGINT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS syncv3_device_list_updates_device_pos_idx ON syncv3_device_list_updates(user_id, device_id, position);
+	CREATE INDEX IF NOT EXISTS syncv3_device_list_updates_created_ts_idx ON syncv3_device_list_updates(created_ts);
+	`
+}
+
+// Insert appends device list changes for this user|device, which is a map of user_id ->
+// internal.DeviceList enum. Returns the highest position inserted, or 0 if there were no changes.
+func (t *DeviceListTable) Insert(userID, deviceID string, deviceListChanges map[string]int) (pos int64, err error) {
+	return insertDeviceListChanges(t.db, sqlutil.DialectOf(t.db), userID, deviceID, deviceListChanges, time.Now())
+}
+
+func insertDeviceListChanges(q sqlx.Queryer, dialect sqlutil.Dialect, userID, deviceID string, deviceListChanges map[string]int, now time.Time) (pos int64, err error) {
+	if len(deviceListChanges) == 0 {
+		return 0, nil
+	}
+	// sort for determinism
+	targetUserIDs := make([]string, 0, len(deviceListChanges))
+	for targetUserID := range deviceListChanges {
+		targetUserIDs = append(targetUserIDs, targetUserID)
+	}
+	sort.Strings(targetUserIDs)
+	targetStates := make([]int64, len(targetUserIDs))
+	for i, targetUserID := range targetUserIDs {
+		targetStates[i] = int64(deviceListChanges[targetUserID])
+	}
+	var positions []int64
+	err = sqlx.Select(q, &positions, `
+	INSERT INTO syncv3_device_list_updates(user_id, device_id, target_user_id, target_state, created_ts)
+	SELECT $1, $2, changes.target_user_id, changes.target_state, $3
+	FROM `+dialect.ZipArrays("changes",
+		sqlutil.ArrayColumn{Name: "target_user_id", Array: "$4", ElemType: "TEXT"},
+		sqlutil.ArrayColumn{Name: "target_state", Array: "$5", ElemType: "SMALLINT"},
+	)+`
+	RETURNING position`,
+		userID, deviceID, now.UnixMilli(), pq.StringArray(targetUserIDs), pq.Int64Array(targetStates),
+	)
+	for _, p := range positions {
+		if p > pos {
+			pos = p
+		}
+	}
+	return
+}
+
+// Select returns up to `limit` device list changes for this user|device after `from`, as a map of
+// user_id -> internal.DeviceList enum. Later changes for the same user replace earlier ones.
+// Returns the position of the latest change returned, or `from` if there are no changes.
+func (t *DeviceListTable) Select(userID, deviceID string, from, limit int64) (deviceListChanges map[string]int, upTo int64, err error) {
+	var rows []DeviceListRow
+	err = t.db.Select(&rows, `SELECT position, target_user_id, target_state FROM syncv3_device_list_updates
+	WHERE user_id = $1 AND device_id = $2 AND position > $3 ORDER BY position ASC LIMIT $4`, userID, deviceID, from, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	upTo = from
+	deviceListChanges = make(map[string]int, len(rows))
+	for _, row := range rows {
+		deviceListChanges[row.TargetUserID] = row.TargetState
+		upTo = row.Position
+	}
+	return
+}
+
+// DeleteOlderThan deletes device list changes which were inserted before this time. Changes are
+// not deleted when a device acknowledges them, as each of the device's connections may be at a
+// different position, so they are kept for a while instead. Returns the number of deleted changes.
+func (t *DeviceListTable) DeleteOlderThan(before time.Time) (int64, error) {
+	res, err := t.db.Exec(`DELETE FROM syncv3_device_list_updates WHERE created_ts < $1`, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// MigrateDeviceLists moves pending device list changes out of the device data table, where older
+// versions of the proxy stored them, into the device list table. It also adds the created_ts column
+// to device list tables which were created before it existed. If there is nothing to migrate, this
+// function is a no-op.
+//
+// This runs as a migration in the migrations package.
+func MigrateDeviceLists(txn *sqlx.Tx) error {
+	dialect := sqlutil.DialectOf(txn)
+	now := time.Now()
+	hasTable, err := dialect.ColumnExists(txn, "syncv3_device_list_updates", "position")
+	if err != nil {
+		return err
+	}
+	hasCreatedTS, err := dialect.ColumnExists(txn, "syncv3_device_list_updates", "created_ts")
+	if err != nil {
+		return err
+	}
+	if hasTable && !hasCreatedTS {
+		// treat existing changes as new, so they are kept for as long as new changes are
+		_, err = txn.Exec(fmt.Sprintf(
+			`ALTER TABLE syncv3_device_list_updates ADD COLUMN created_ts BIGINT NOT NULL DEFAULT %d`, now.UnixMilli(),
+		))
+		if err != nil {
+			return fmt.Errorf("failed to add created_ts column: %w", err)
+		}
+	}
+	if _, err = txn.Exec(deviceListTableSchema(dialect)); err != nil {
+		return err
+	}
+
+	hasDeviceData, err := dialect.ColumnExists(txn, "syncv3_device_data", "data")
+	if err != nil || !hasDeviceData {
+		return err
+	}
+	var rows []DeviceDataRow
+	if err = txn.Select(&rows, `SELECT id, user_id, device_id, data FROM syncv3_device_data`); err != nil {
+		return err
+	}
+	numMigrated := 0
+	for _, row := range rows {
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(row.Data, &fields); err != nil {
+			return fmt.Errorf("failed to unmarshal device data for %s %s: %w", row.UserID, row.DeviceID, err)
+		}
+		dlJSON, ok := fields["dl"]
+		if !ok {
+			continue
+		}
+		var deviceLists struct {
+			New  map[string]int `json:"n"`
+			Sent map[string]int `json:"s"`
+		}
+		if err = json.Unmarshal(dlJSON, &deviceLists); err != nil {
+			return fmt.Errorf("failed to unmarshal device lists for %s %s: %w", row.UserID, row.DeviceID, err)
+		}
+		// Sent changes may not have been received by the client, so send them again. New changes
+		// are more recent so take precedence.
+		changes := make(map[string]int, len(deviceLists.New)+len(deviceLists.Sent))
+		for userID, state := range deviceLists.Sent {
+			changes[userID] = state
+		}
+		for userID, state := range deviceLists.New {
+			changes[userID] = state
+		}
+		if _, err = insertDeviceListChanges(txn, dialect, row.UserID, row.DeviceID, changes, now); err != nil {
+			return fmt.Errorf("failed to insert device lists for %s %s: %w", row.UserID, row.DeviceID, err)
+		}
+		delete(fields, "dl")
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if _, err = txn.Exec(`UPDATE syncv3_device_data SET data = $1 WHERE id = $2`, data, row.ID); err != nil {
+			return err
+		}
+		numMigrated++
+	}
+	logger.Info().Int("devices", numMigrated).Msg("MigrateDeviceLists: moved device list changes out of device data")
+	return nil
+}
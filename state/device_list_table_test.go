@@ -0,0 +1,143 @@
+package state
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+func TestDeviceListTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewDeviceListTable(db)
+	userID := "@alice_TestDeviceListTable:localhost"
+	deviceID := "ALICE"
+	otherDeviceID := "ALICE2"
+
+	// empty inserts are a no-op
+	pos, err := table.Insert(userID, deviceID, nil)
+	assertNoError(t, err)
+	assertVal(t, "empty insert pos", pos, int64(0))
+
+	pos1, err := table.Insert(userID, deviceID, internal.ToDeviceListChangesMap([]string{"@bob", "@charlie"}, nil))
+	assertNoError(t, err)
+	pos2, err := table.Insert(userID, deviceID, internal.ToDeviceListChangesMap([]string{"@dave"}, []string{"@charlie"}))
+	assertNoError(t, err)
+	if pos2 <= pos1 {
+		t.Fatalf("positions did not increase: %d then %d", pos1, pos2)
+	}
+	_, err = table.Insert(userID, otherDeviceID, internal.ToDeviceListChangesMap([]string{"@eve"}, nil))
+	assertNoError(t, err)
+
+	// later changes replace earlier ones
+	changes, upTo, err := table.Select(userID, deviceID, 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "all changes", changes, internal.ToDeviceListChangesMap([]string{"@bob", "@dave"}, []string{"@charlie"}))
+	assertVal(t, "all changes upTo", upTo, pos2)
+
+	// changes are paginated by the limit
+	changes, upTo, err = table.Select(userID, deviceID, 0, 1)
+	assertNoError(t, err)
+	assertVal(t, "first page", changes, internal.ToDeviceListChangesMap([]string{"@bob"}, nil))
+	if upTo >= pos1 {
+		t.Fatalf("first page upTo %d, want < %d", upTo, pos1)
+	}
+	changes, upTo, err = table.Select(userID, deviceID, upTo, 1)
+	assertNoError(t, err)
+	assertVal(t, "second page", changes, internal.ToDeviceListChangesMap([]string{"@charlie"}, nil))
+	assertVal(t, "second page upTo", upTo, pos1)
+
+	// selecting is read-only, so can be done multiple times from different positions
+	changes, upTo, err = table.Select(userID, deviceID, pos1, 100)
+	assertNoError(t, err)
+	assertVal(t, "changes after pos1", changes, internal.ToDeviceListChangesMap([]string{"@dave"}, []string{"@charlie"}))
+	assertVal(t, "changes after pos1 upTo", upTo, pos2)
+	changes, upTo, err = table.Select(userID, deviceID, pos2, 100)
+	assertNoError(t, err)
+	assertVal(t, "no changes", changes, map[string]int{})
+	assertVal(t, "no changes upTo", upTo, pos2)
+
+	// old changes are deleted, regardless of device
+	_, err = table.Insert(userID, otherDeviceID, internal.ToDeviceListChangesMap(nil, []string{"@eve"}))
+	assertNoError(t, err)
+	_, err = db.Exec(`UPDATE syncv3_device_list_updates SET created_ts = 1 WHERE user_id = $1 AND position <= $2`, userID, pos2)
+	assertNoError(t, err)
+	_, err = table.DeleteOlderThan(time.UnixMilli(2))
+	assertNoError(t, err)
+	changes, _, err = table.Select(userID, deviceID, 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "changes after delete", changes, map[string]int{})
+	changes, _, err = table.Select(userID, otherDeviceID, 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "other device changes", changes, internal.ToDeviceListChangesMap(nil, []string{"@eve"}))
+}
+
+func TestMigrateDeviceLists(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	NewDeviceDataTable(db)
+	userID := "@alice_TestMigrateDeviceLists:localhost"
+
+	// make a device list table from before created_ts existed, with a change in it
+	dialect := sqlutil.DialectOf(db)
+	db.MustExec(`DROP TABLE IF EXISTS syncv3_device_list_updates`)
+	db.MustExec(dialect.CreateSequence("syncv3_device_list_updates_seq") + `CREATE TABLE syncv3_device_list_updates (` +
+		dialect.SerialPrimaryKey("position", "syncv3_device_list_updates_seq") + `,
+		user_id TEXT NOT NULL, device_id TEXT NOT NULL, target_user_id TEXT NOT NULL, target_state SMALLINT NOT NULL
+	)`)
+	db.MustExec(`INSERT INTO syncv3_device_list_updates(user_id, device_id, target_user_id, target_state) VALUES($1, 'A', '@bob', $2)`,
+		userID, internal.DeviceListChanged)
+
+	// device data with pending device lists in the old format
+	_, err := db.Exec(`DELETE FROM syncv3_device_data WHERE user_id = $1`, userID)
+	assertNoError(t, err)
+	for i, deviceID := range []string{"B", "C"} {
+		data := `{"otk":{"foo":1},"c":1}`
+		if deviceID == "B" {
+			data = `{"otk":{"foo":1},"dl":{"n":{"@charlie":2,"@dave":1},"s":{"@charlie":1,"@eve":1}},"c":1}`
+		}
+		_, err = db.Exec(`INSERT INTO syncv3_device_data(id, user_id, device_id, data) VALUES($1, $2, $3, $4)`,
+			-1-i, userID, deviceID, []byte(data))
+		assertNoError(t, err)
+	}
+
+	err = sqlutil.WithTransaction(db, MigrateDeviceLists)
+	assertNoError(t, err)
+
+	table := NewDeviceListTable(db)
+	changes, _, err := table.Select(userID, "A", 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "existing changes", changes, internal.ToDeviceListChangesMap([]string{"@bob"}, nil))
+	changes, _, err = table.Select(userID, "B", 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "migrated changes", changes, internal.ToDeviceListChangesMap([]string{"@dave", "@eve"}, []string{"@charlie"}))
+	changes, _, err = table.Select(userID, "C", 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "no changes", changes, map[string]int{})
+
+	// existing changes are treated as new, so are not deleted by a sweep
+	_, err = table.DeleteOlderThan(time.Now().Add(-time.Minute))
+	assertNoError(t, err)
+	changes, _, err = table.Select(userID, "A", 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "existing changes after sweep", changes, internal.ToDeviceListChangesMap([]string{"@bob"}, nil))
+
+	dd, err := NewDeviceDataTable(db).Select(userID, "B", false)
+	assertNoError(t, err)
+	assertVal(t, "otk counts kept", dd.OTKCounts, map[string]int{"foo": 1})
+	var data []byte
+	assertNoError(t, db.QueryRow(`SELECT data FROM syncv3_device_data WHERE user_id = $1 AND device_id = 'B'`, userID).Scan(&data))
+	if strings.Contains(string(data), `"dl"`) {
+		t.Errorf("device lists were not removed from device data: %s", data)
+	}
+
+	// migrating again is a no-op
+	err = sqlutil.WithTransaction(db, MigrateDeviceLists)
+	assertNoError(t, err)
+	changes, _, err = table.Select(userID, "B", 0, 100)
+	assertNoError(t, err)
+	assertVal(t, "migrated changes after second migration", changes, internal.ToDeviceListChangesMap([]string{"@dave", "@eve"}, []string{"@charlie"}))
+}
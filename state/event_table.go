@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"math"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -108,12 +109,284 @@ type EventTable struct {
 
 // NewEventTable makes a new EventTable
 func NewEventTable(db *sqlx.DB) *EventTable {
+	return NewPartitionedEventTable(db, 0)
+}
+
+// NewPartitionedEventTable makes a new EventTable. If numPartitions is non-zero, a new or empty events
+// table is partitioned by a hash of the room ID into this many partitions, so that queries for particular
+// rooms only need to look at the partitions holding those rooms. An existing table which holds events is
+// never partitioned, unpartitioned nor repartitioned here: use PartitionEventTable to partition it.
+// Partitioning is not supported on SQLite.
+func NewPartitionedEventTable(db *sqlx.DB, numPartitions int) *EventTable {
+	dialect := sqlutil.DialectOf(db)
+	if !dialect.SupportsPartitioning() {
+		if numPartitions > 0 {
+			logger.Warn().Int("partitions", numPartitions).Msg("partitioning the events table is not supported on SQLite, ignoring")
+		}
+		db.MustExec(eventTableSchema(dialect, 0) + eventTableIndexes(0))
+		return &EventTable{db}
+	}
+	db.MustExec(dialect.CreateSequence("syncv3_event_nids_seq"))
+	isPartitioned, existingPartitions, err := selectEventTableLayout(db)
+	if err != nil {
+		logger.Panic().Err(err).Msg("failed to determine the layout of the events table")
+	}
+	switch {
+	case isPartitioned:
+		if numPartitions > 0 && numPartitions != existingPartitions {
+			logger.Warn().Int("partitions", existingPartitions).Int("wanted", numPartitions).Msg(
+				"events table is already partitioned, keeping the existing number of partitions",
+			)
+		}
+		numPartitions = existingPartitions
+	case existingPartitions < 0 && numPartitions > 0:
+		// the table exists but isn't partitioned
+		var partitioned bool
+		err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+			partitioned, err = partitionEmptyEventTable(txn, numPartitions)
+			return err
+		})
+		if err != nil {
+			logger.Panic().Err(err).Int("partitions", numPartitions).Msg("failed to partition the empty events table")
+		}
+		if !partitioned {
+			numPartitions = 0
+		}
+	case existingPartitions < 0:
+		numPartitions = 0
+	}
 	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_event_nids_seq;
+	db.MustExec(eventTableSchema(dialect, numPartitions) + eventTableIndexes(numPartitions))
+	return &EventTable{db}
+}
+
+// selectEventTableLayout returns whether the events table is partitioned and if so, how many partitions
+// it has. If the table exists but is not partitioned, numPartitions is -1. If the table does not exist,
+// numPartitions is 0.
+func selectEventTableLayout(q sqlx.Queryer) (isPartitioned bool, numPartitions int, err error) {
+	var relkind string
+	err = q.QueryRowx(`
+	SELECT relkind::TEXT, (SELECT count(*) FROM pg_inherits WHERE inhparent = pg_class.oid)
+	FROM pg_class WHERE oid = to_regclass('syncv3_events')`,
+	).Scan(&relkind, &numPartitions)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	if relkind != "p" {
+		return false, -1, nil
+	}
+	return true, numPartitions, nil
+}
+
+// The schema which holds the partitioned events table whilst PartitionEventTable copies events into it.
+// Using a separate schema means the table, its partitions and its indexes can have their usual names.
+const partitioningSchema = "syncv3_partitioning"
+
+// PartitionEventTable partitions an existing unpartitioned events table into numPartitions partitions.
+// Events are copied in NID order into a new partitioned table in batches of batchSize, each committed
+// separately, so this can be interrupted and called again to carry on where it left off. Once every
+// event has been copied, the new table replaces the old table in a single transaction. Event NIDs are
+// preserved, and the NID sequence is shared by both tables.
+//
+// Events stored whilst this is running are copied by the final transaction, but events which are
+// being stored as a batch is copied may be missed, so the proxy must not be running.
+func PartitionEventTable(db *sqlx.DB, numPartitions, batchSize int) error {
+	if !sqlutil.DialectOf(db).SupportsPartitioning() {
+		return fmt.Errorf("partitioning the events table is not supported on SQLite")
+	}
+	if numPartitions <= 0 || batchSize <= 0 {
+		return fmt.Errorf("numPartitions and batchSize must be positive")
+	}
+	isPartitioned, existingPartitions, err := selectEventTableLayout(db)
+	if err != nil {
+		return err
+	}
+	if isPartitioned || existingPartitions == 0 {
+		logger.Info().Msg("events table does not need partitioning")
+		return nil
+	}
+	err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+		return createPartitioningTable(txn, numPartitions)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create partitioned events table: %w", err)
+	}
+	start := time.Now()
+	var total int64
+	for {
+		var copied int64
+		err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+			copied, err = copyEventsToPartitioningTable(txn, int64(batchSize))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to copy events into partitioned events table: %w", err)
+		}
+		total += copied
+		logger.Info().Int64("copied", total).Dur("duration", time.Since(start)).Msg("partitioning the events table")
+		if copied < int64(batchSize) {
+			break
+		}
+	}
+	err = sqlutil.WithTransaction(db, swapPartitioningTable)
+	if err != nil {
+		return fmt.Errorf("failed to replace the events table: %w", err)
+	}
+	logger.Info().Int64("copied", total).Dur("duration", time.Since(start)).Msg("partitioned the events table")
+	return nil
+}
+
+// MigrateEventPartitions partitions an existing unpartitioned events table into numPartitions
+// partitions if it holds no events. A table which holds events is left as it is with a warning, as
+// copying every event in one transaction would lock the table for too long: it must be partitioned
+// with PartitionEventTable instead. If numPartitions is zero, or the table does not exist or is
+// already partitioned, this function is a no-op. NewPartitionedEventTable does the same on startup,
+// so an empty table is still partitioned if this migration was applied before partitioning was enabled.
+//
+// This runs as a migration in the migrations package.
+func MigrateEventPartitions(txn *sqlx.Tx, numPartitions int) error {
+	if numPartitions <= 0 || !sqlutil.DialectOf(txn).SupportsPartitioning() {
+		return nil
+	}
+	_, err := partitionEmptyEventTable(txn, numPartitions)
+	return err
+}
+
+// partitionEmptyEventTable partitions the events table into numPartitions partitions if it is not
+// partitioned and holds no events. Returns true if the table was partitioned.
+func partitionEmptyEventTable(txn *sqlx.Tx, numPartitions int) (bool, error) {
+	isPartitioned, existingPartitions, err := selectEventTableLayout(txn)
+	if err != nil || isPartitioned || existingPartitions == 0 {
+		return false, err
+	}
+	var hasEvents bool
+	if err = txn.QueryRow(`SELECT EXISTS(SELECT 1 FROM syncv3_events)`).Scan(&hasEvents); err != nil {
+		return false, err
+	}
+	if hasEvents {
+		logger.Warn().Int("wanted", numPartitions).Msg(
+			"events table is not partitioned, run 'syncv3 migrate partition-events' whilst the proxy is stopped to partition it",
+		)
+		return false, nil
+	}
+	if err = createPartitioningTable(txn, numPartitions); err != nil {
+		return false, err
+	}
+	return true, swapPartitioningTable(txn)
+}
+
+// createPartitioningTable creates the partitioned events table in the partitioning schema, if it was
+// not created by an earlier call to PartitionEventTable.
+func createPartitioningTable(txn *sqlx.Tx, numPartitions int) error {
+	var searchPath string
+	if err := txn.QueryRow(`SELECT current_setting('search_path')`).Scan(&searchPath); err != nil {
+		return err
+	}
+	// create the table in the partitioning schema, but still use the NID sequence in the usual schema
+	_, err := txn.Exec(`CREATE SCHEMA IF NOT EXISTS ` + partitioningSchema + `;
+	SET LOCAL search_path TO ` + partitioningSchema + `, ` + searchPath)
+	if err != nil {
+		return err
+	}
+	isPartitioned, existingPartitions, err := selectEventTableLayout(txn)
+	if err != nil {
+		return err
+	}
+	if isPartitioned {
+		// keep the partitions from the earlier call, which may have already copied events
+		numPartitions = existingPartitions
+	}
+	if _, err = txn.Exec(eventTableSchema(sqlutil.DialectOf(txn), numPartitions) + eventTableIndexes(numPartitions)); err != nil {
+		return err
+	}
+	_, err = txn.Exec(`SELECT set_config('search_path', $1, true)`, searchPath)
+	return err
+}
+
+// copyEventsToPartitioningTable copies up to limit events which have not been copied yet into the
+// partitioned events table. Returns the number of events copied.
+func copyEventsToPartitioningTable(txn *sqlx.Tx, limit int64) (int64, error) {
+	res, err := txn.Exec(`
+	INSERT INTO `+partitioningSchema+`.syncv3_events (`+eventTableColumns+`)
+		SELECT `+eventTableColumns+` FROM syncv3_events
+		WHERE event_nid > (SELECT COALESCE(MAX(event_nid), 0) FROM `+partitioningSchema+`.syncv3_events)
+		ORDER BY event_nid ASC LIMIT $1`, limit,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// swapPartitioningTable copies the remaining events into the partitioned events table, then replaces
+// the events table with it.
+func swapPartitioningTable(txn *sqlx.Tx) error {
+	if _, err := txn.Exec(`LOCK TABLE syncv3_events IN EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+	if _, err := copyEventsToPartitioningTable(txn, math.MaxInt64); err != nil {
+		return err
+	}
+	var schema string
+	if err := txn.QueryRow(`SELECT current_schema()`).Scan(&schema); err != nil {
+		return err
+	}
+	var partitions []string
+	err := txn.Select(&partitions, `SELECT inhrelid::regclass::TEXT FROM pg_inherits WHERE inhparent = $1::regclass`,
+		partitioningSchema+".syncv3_events",
+	)
+	if err != nil {
+		return err
+	}
+	// indexes and constraints move with their tables
+	_, err = txn.Exec(`DROP TABLE syncv3_events;
+	ALTER TABLE ` + partitioningSchema + `.syncv3_events SET SCHEMA ` + pq.QuoteIdentifier(schema))
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		if _, err = txn.Exec(`ALTER TABLE ` + partition + ` SET SCHEMA ` + pq.QuoteIdentifier(schema)); err != nil {
+			return err
+		}
+	}
+	_, err = txn.Exec(`DROP SCHEMA ` + partitioningSchema)
+	return err
+}
+
+const eventTableColumns = `event_nid, event_id, before_state_snapshot_id, event_replaces_nid, room_id, event_type, state_key, prev_batch, membership, is_state, event`
+
+// eventTableSchema returns the SQL to create the events table, partitioned by room ID if numPartitions
+// is non-zero. The primary key and unique constraints of a partitioned table must include the partition
+// key, so event IDs are only unique per room in a partitioned table. Event IDs are not guaranteed to be
+// globally unique anyway: in v1 and v2 rooms they are assigned by the sending server. Events are
+// therefore always looked up by event ID within a room, so an event ID reused in another room is stored
+// and treated as a separate event. The unpartitioned table keeps its global constraint, so the first
+// room to store an event ID keeps it.
+func eventTableSchema(dialect sqlutil.Dialect, numPartitions int) string {
+	nidColumn := dialect.SerialPrimaryKey("event_nid", "syncv3_event_nids_seq")
+	eventIDColumn := `event_id TEXT NOT NULL UNIQUE`
+	var constraints, partitioning, partitions string
+	if numPartitions > 0 {
+		nidColumn = `event_nid BIGINT NOT NULL DEFAULT nextval('syncv3_event_nids_seq')`
+		eventIDColumn = `event_id TEXT NOT NULL`
+		constraints = `,
+		PRIMARY KEY (event_nid, room_id),
+		UNIQUE (event_id, room_id)`
+		partitioning = ` PARTITION BY HASH (room_id)`
+		for i := 0; i < numPartitions; i++ {
+			partitions += fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS syncv3_events_p%d PARTITION OF syncv3_events FOR VALUES WITH (MODULUS %d, REMAINDER %d);`,
+				i, numPartitions, i,
+			)
+		}
+	}
+	return `
 	CREATE TABLE IF NOT EXISTS syncv3_events (
-		event_nid BIGINT PRIMARY KEY NOT NULL DEFAULT nextval('syncv3_event_nids_seq'),
-		event_id TEXT NOT NULL UNIQUE,
+		` + nidColumn + `,
+		` + eventIDColumn + `,
 		before_state_snapshot_id BIGINT NOT NULL DEFAULT 0,
 		-- which nid gets replaced in the snapshot with event_nid
 		event_replaces_nid BIGINT NOT NULL DEFAULT 0,
@@ -123,18 +396,26 @@ func NewEventTable(db *sqlx.DB) *EventTable {
 		prev_batch TEXT,
 		membership TEXT,
 		is_state BOOLEAN NOT NULL, -- is this event part of the v2 state response?
-		event BYTEA NOT NULL
-	);
+		event BYTEA NOT NULL` + constraints + `
+	)` + partitioning + `;` + partitions
+}
+
+// eventTableIndexes returns the SQL to create the indexes on the events table. Indexes on a partitioned
+// table are created on every partition.
+func eventTableIndexes(numPartitions int) string {
+	uniqueColumns := "event_nid, event_type, state_key"
+	if numPartitions > 0 {
+		uniqueColumns += ", room_id"
+	}
+	return `
 	-- index for querying all joined rooms for a given user
 	CREATE INDEX IF NOT EXISTS syncv3_events_type_sk_idx ON syncv3_events(event_type, state_key);
 	-- index for querying membership deltas in particular rooms
 	CREATE INDEX IF NOT EXISTS syncv3_events_type_room_nid_idx ON syncv3_events(event_type, room_id, event_nid);
 	-- index for querying events in a given room
 	CREATE INDEX IF NOT EXISTS syncv3_nid_room_state_idx ON syncv3_events(room_id, event_nid, is_state);
-
-	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(event_nid, event_type, state_key);
-	`)
-	return &EventTable{db}
+	CREATE UNIQUE INDEX IF NOT EXISTS syncv3_events_room_event_nid_type_skey_idx ON syncv3_events(` + uniqueColumns + `);
+	`
 }
 
 func (t *EventTable) SelectHighestNID() (highest int64, err error) {
@@ -166,13 +447,13 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 		}
 		events[i].JSON = js
 	}
-	chunks := sqlutil.Chunkify(8, MaxPostgresParameters, EventChunker(events))
+	chunks := sqlutil.Chunkify(8, sqlutil.DialectOf(txn).MaxParameters(), EventChunker(events))
 	var eventID string
 	var eventNID int64
 	for _, chunk := range chunks {
 		rows, err := txn.NamedQuery(`
 		INSERT INTO syncv3_events (event_id, event, event_type, state_key, room_id, membership, prev_batch, is_state)
-        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state) ON CONFLICT (event_id) DO NOTHING RETURNING event_id, event_nid`, chunk)
+        VALUES (:event_id, :event, :event_type, :state_key, :room_id, :membership, :prev_batch, :is_state) ON CONFLICT DO NOTHING RETURNING event_id, event_nid`, chunk)
 		if err != nil {
 			return nil, err
 		}
@@ -189,11 +470,11 @@ func (t *EventTable) Insert(txn *sqlx.Tx, events []Event, checkFields bool) (map
 
 // select events in a list of nids or ids, depending on the query. Provides flexibility to query on NID or ID, as well as
 // the ability to pull stripped events or normal events
-func (t *EventTable) selectAny(txn *sqlx.Tx, numWanted int, queryStr string, pqArray interface{}) (events []Event, err error) {
+func (t *EventTable) selectAny(txn *sqlx.Tx, numWanted int, queryStr string, args ...interface{}) (events []Event, err error) {
 	if txn != nil {
-		err = txn.Select(&events, queryStr, pqArray)
+		err = txn.Select(&events, queryStr, args...)
 	} else {
-		err = t.db.Select(&events, queryStr, pqArray)
+		err = t.db.Select(&events, queryStr, args...)
 	}
 	if numWanted > 0 {
 		if numWanted != len(events) {
@@ -214,26 +495,50 @@ func (t *EventTable) SelectByNIDs(txn *sqlx.Tx, verifyAll bool, nids []int64) (e
 	}
 	return t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership, event_replaces_nid FROM syncv3_events
-	WHERE event_nid = ANY ($1) ORDER BY event_nid ASC;`, pq.Int64Array(nids))
+	WHERE `+sqlutil.DialectOf(t.db).InArray("event_nid", "$1")+` ORDER BY event_nid ASC;`, pq.Int64Array(nids))
 }
 
-// SelectByIDs fetches all events with the given event IDs from the DB as Event structs.
+// SelectByNIDsInRooms is the same as SelectByNIDs but only looks for events in the given rooms,
+// which is faster if the events table is partitioned.
+func (t *EventTable) SelectByNIDsInRooms(txn *sqlx.Tx, verifyAll bool, roomIDs []string, nids []int64) (events []Event, err error) {
+	wanted := 0
+	if verifyAll {
+		wanted = len(nids)
+	}
+	return t.selectAny(txn, wanted, selectByNIDsInRoomsSQL(sqlutil.DialectOf(t.db)), pq.Int64Array(nids), pq.StringArray(roomIDs))
+}
+
+func selectByNIDsInRoomsSQL(dialect sqlutil.Dialect) string {
+	return `
+	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership, event_replaces_nid FROM syncv3_events
+	WHERE ` + dialect.InArray("event_nid", "$1") + ` AND ` + dialect.InArray("room_id", "$2") + ` ORDER BY event_nid ASC;`
+}
+
+// SelectByIDs fetches all events in this room with the given event IDs from the DB as Event structs.
 // If verifyAll is true, the function will check that each event ID has a matching
 // event row in the database. The returned events are ordered by ascending NID; the
 // order of the event IDs is irrelevant.
-func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (events []Event, err error) {
+func (t *EventTable) SelectByIDs(txn *sqlx.Tx, verifyAll bool, roomID string, ids []string) (events []Event, err error) {
 	wanted := 0
 	if verifyAll {
 		wanted = len(ids)
 	}
-	return t.selectAny(txn, wanted, `
-	SELECT event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership FROM syncv3_events
-	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
+	return t.selectAny(txn, wanted, selectByIDsInRoomSQL(sqlutil.DialectOf(t.db),
+		"event_nid, event_id, event, event_type, state_key, room_id, before_state_snapshot_id, membership",
+	), roomID, pq.StringArray(ids))
+}
+
+// selectByIDsInRoomSQL selects these columns for the events in room $1 with event IDs in $2. Event IDs
+// are only unique per room, so looking them up in a room also lets Postgres skip the other partitions.
+func selectByIDsInRoomSQL(dialect sqlutil.Dialect, columns string) string {
+	return `
+	SELECT ` + columns + ` FROM syncv3_events
+	WHERE room_id = $1 AND ` + dialect.InArray("event_id", "$2") + ` ORDER BY event_nid ASC;`
 }
 
-// SelectNIDsByIDs does just that. Returns a map from event ID to nid, with a key-value
-// pair for every event_id that was found in the database.
-func (t *EventTable) SelectNIDsByIDs(txn *sqlx.Tx, ids []string) (nids map[string]int64, err error) {
+// SelectNIDsByIDs does just that for events in this room. Returns a map from event ID to nid, with a
+// key-value pair for every event_id that was found in the database.
+func (t *EventTable) SelectNIDsByIDs(txn *sqlx.Tx, roomID string, ids []string) (nids map[string]int64, err error) {
 	// Select NIDs using a single parameter which is a string array
 	// https://stackoverflow.com/questions/52712022/what-is-the-most-performant-way-to-rewrite-a-large-in-clause
 	result := make(map[string]int64, len(ids))
@@ -241,7 +546,7 @@ func (t *EventTable) SelectNIDsByIDs(txn *sqlx.Tx, ids []string) (nids map[strin
 		NID int64  `db:"event_nid"`
 		ID  string `db:"event_id"`
 	}{}
-	err = txn.Select(&rows, "SELECT event_nid, event_id FROM syncv3_events WHERE event_id = ANY ($1);", pq.StringArray(ids))
+	err = txn.Select(&rows, selectByIDsInRoomSQL(sqlutil.DialectOf(txn), "event_nid, event_id"), roomID, pq.StringArray(ids))
 	for _, row := range rows {
 		result[row.ID] = row.NID
 	}
@@ -256,35 +561,28 @@ func (t *EventTable) SelectStrippedEventsByNIDs(txn *sqlx.Tx, verifyAll bool, ni
 	// don't include the 'event' column
 	return t.selectAny(txn, wanted, `
 	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id FROM syncv3_events
-	WHERE event_nid = ANY ($1) ORDER BY event_nid ASC;`, pq.Int64Array(nids))
+	WHERE `+sqlutil.DialectOf(t.db).InArray("event_nid", "$1")+` ORDER BY event_nid ASC;`, pq.Int64Array(nids))
 }
 
-func (t *EventTable) SelectStrippedEventsByIDs(txn *sqlx.Tx, verifyAll bool, ids []string) (StrippedEvents, error) {
+func (t *EventTable) SelectStrippedEventsByIDs(txn *sqlx.Tx, verifyAll bool, roomID string, ids []string) (StrippedEvents, error) {
 	wanted := 0
 	if verifyAll {
 		wanted = len(ids)
 	}
 	// don't include the 'event' column
-	return t.selectAny(txn, wanted, `
-	SELECT event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id FROM syncv3_events
-	WHERE event_id = ANY ($1) ORDER BY event_nid ASC;`, pq.StringArray(ids))
-
+	return t.selectAny(txn, wanted, selectByIDsInRoomSQL(sqlutil.DialectOf(t.db),
+		"event_nid, event_id, event_type, state_key, room_id, before_state_snapshot_id",
+	), roomID, pq.StringArray(ids))
 }
 
-// SelectUnknownEventIDs accepts a list of event IDs and returns the subset of those which are not known to the DB.
-// It MUST be called within a transaction, or else will panic.
-func (t *EventTable) SelectUnknownEventIDs(txn *sqlx.Tx, maybeUnknownEventIDs []string) (map[string]struct{}, error) {
+// SelectUnknownEventIDs accepts a list of event IDs and returns the subset of those which are not known
+// to the DB in this room. It MUST be called within a transaction, or else will panic.
+func (t *EventTable) SelectUnknownEventIDs(txn *sqlx.Tx, roomID string, maybeUnknownEventIDs []string) (map[string]struct{}, error) {
 	// Note: in practice, the order of rows returned matches the order of rows of
 	// array entries. But I don't think that's guaranteed. Return an (unordered) set
 	// out of paranoia.
-	queryStr := `
-	WITH maybe_unknown_events(event_id) AS (SELECT unnest($1::text[]))
-	SELECT event_id
-	FROM maybe_unknown_events LEFT JOIN syncv3_events USING(event_id)
-	WHERE event_nid IS NULL;`
-
 	var unknownEventIDs []string
-	if err := txn.Select(&unknownEventIDs, queryStr, pq.StringArray(maybeUnknownEventIDs)); err != nil {
+	if err := txn.Select(&unknownEventIDs, selectUnknownEventIDsSQL(sqlutil.DialectOf(txn)), pq.StringArray(maybeUnknownEventIDs), roomID); err != nil {
 		return nil, err
 	}
 	unknownMap := make(map[string]struct{}, len(unknownEventIDs))
@@ -294,10 +592,20 @@ func (t *EventTable) SelectUnknownEventIDs(txn *sqlx.Tx, maybeUnknownEventIDs []
 	return unknownMap, nil
 }
 
-// UpdateBeforeSnapshotID sets the before_state_snapshot_id field to `snapID` for the given NIDs.
-func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, replacesNID int64) error {
+// selectUnknownEventIDsSQL selects the event IDs in $1 which are not in room $2.
+func selectUnknownEventIDsSQL(dialect sqlutil.Dialect) string {
+	return `
+	SELECT maybe_unknown_events.event_id
+	FROM ` + dialect.ZipArrays("maybe_unknown_events", sqlutil.ArrayColumn{Name: "event_id", Array: "$1", ElemType: "TEXT"}) + `
+	LEFT JOIN syncv3_events ON syncv3_events.event_id = maybe_unknown_events.event_id AND syncv3_events.room_id = $2
+	WHERE syncv3_events.event_nid IS NULL;`
+}
+
+// UpdateBeforeSnapshotID sets the before_state_snapshot_id field to `snapID` for the given NID in this room.
+func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, roomID string, eventNID, snapID, replacesNID int64) error {
 	_, err := txn.Exec(
-		`UPDATE syncv3_events SET before_state_snapshot_id=$1, event_replaces_nid=$2 WHERE event_nid = $3`, snapID, replacesNID, eventNID,
+		`UPDATE syncv3_events SET before_state_snapshot_id=$1, event_replaces_nid=$2 WHERE event_nid = $3 AND room_id = $4`,
+		snapID, replacesNID, eventNID, roomID,
 	)
 	return err
 }
@@ -305,26 +613,30 @@ func (t *EventTable) UpdateBeforeSnapshotID(txn *sqlx.Tx, eventNID, snapID, repl
 // query the latest events in each of the room IDs given, using highestNID as the highest event.
 func (t *EventTable) LatestEventInRooms(txn *sqlx.Tx, roomIDs []string, highestNID int64) (events []Event, err error) {
 	// the position (event nid) may be for a random different room, so we need to find the highest nid <= this position for this room
-	err = txn.Select(
-		&events,
-		`SELECT event_nid, room_id, event_replaces_nid, before_state_snapshot_id, event_type, state_key, event FROM syncv3_events
-		WHERE event_nid IN (SELECT max(event_nid) FROM syncv3_events WHERE event_nid <= $1 AND room_id = ANY($2) GROUP BY room_id)`,
-		highestNID, pq.StringArray(roomIDs),
-	)
+	err = txn.Select(&events, latestEventInRoomsSQL(sqlutil.DialectOf(txn)), pq.StringArray(roomIDs), highestNID)
 	if err == sql.ErrNoRows {
 		err = nil
 	}
 	return
 }
 
+func latestEventInRoomsSQL(dialect sqlutil.Dialect) string {
+	return `SELECT event_nid, room_id, event_replaces_nid, before_state_snapshot_id, event_type, state_key, event FROM syncv3_events
+		WHERE ` + dialect.InArray("room_id", "$1") + ` AND event_nid IN (
+			SELECT max(event_nid) FROM syncv3_events WHERE event_nid <= $2 AND ` + dialect.InArray("room_id", "$1") + ` GROUP BY room_id
+		)`
+}
+
 func (t *EventTable) LatestEventNIDInRooms(roomIDs []string, highestNID int64) (roomToNID map[string]int64, err error) {
 	// the position (event nid) may be for a random different room, so we need to find the highest nid <= this position for this room
 	var events []Event
 	err = t.db.Select(
 		&events,
 		`SELECT event_nid, room_id FROM syncv3_events
-		WHERE event_nid IN (SELECT max(event_nid) FROM syncv3_events WHERE event_nid <= $1 AND room_id = ANY($2) GROUP BY room_id)`,
-		highestNID, pq.StringArray(roomIDs),
+		WHERE `+sqlutil.DialectOf(t.db).InArray("room_id", "$1")+` AND event_nid IN (
+			SELECT max(event_nid) FROM syncv3_events WHERE event_nid <= $2 AND `+sqlutil.DialectOf(t.db).InArray("room_id", "$1")+` GROUP BY room_id
+		)`,
+		pq.StringArray(roomIDs), highestNID,
 	)
 	if err == sql.ErrNoRows {
 		err = nil
@@ -344,6 +656,16 @@ func (t *EventTable) SelectEventsBetween(txn *sqlx.Tx, roomID string, lowerExclu
 	return events, err
 }
 
+// SelectEventsAfter returns up to limit events in any room with a NID greater than lowerExclusive,
+// in ascending NID order. This includes events from v2 state blocks, which have IsState set.
+func (t *EventTable) SelectEventsAfter(lowerExclusive int64, limit int) ([]Event, error) {
+	var events []Event
+	err := t.db.Select(&events, `SELECT event_nid, room_id, is_state, event FROM syncv3_events WHERE event_nid > $1 ORDER BY event_nid ASC LIMIT $2`,
+		lowerExclusive, limit,
+	)
+	return events, err
+}
+
 func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowerExclusive, upperInclusive int64, limit int) ([]Event, error) {
 	var events []Event
 	// do not pull in events which were in the v2 state block
@@ -353,6 +675,43 @@ func (t *EventTable) SelectLatestEventsBetween(txn *sqlx.Tx, roomID string, lowe
 	return events, err
 }
 
+// SelectLatestEventsInRanges is SelectLatestEventsBetween for many rooms at once. roomIDToRanges
+// maps room IDs to inclusive ranges of event NIDs to select events from. Returns at most limit
+// events per room across all of its ranges, the most recent event first.
+func (t *EventTable) SelectLatestEventsInRanges(txn *sqlx.Tx, roomIDToRanges map[string][][2]int64, limit int) (map[string][]Event, error) {
+	var roomIDs []string
+	var lowerExclusive, upperInclusive []int64
+	for roomID, ranges := range roomIDToRanges {
+		for _, r := range ranges {
+			roomIDs = append(roomIDs, roomID)
+			lowerExclusive = append(lowerExclusive, r[0]-1)
+			upperInclusive = append(upperInclusive, r[1])
+		}
+	}
+	result := make(map[string][]Event, len(roomIDToRanges))
+	if len(roomIDs) == 0 {
+		return result, nil
+	}
+	// Select at most `limit` events from each range, which can use the (room_id, event_nid) index,
+	// then number the events in each room to keep the most recent `limit` across all of its ranges.
+	// Like SelectLatestEventsBetween, do not pull in events which were in the v2 state block.
+	rows, err := txn.Query(selectLatestEventsInRangesSQL[sqlutil.DialectOf(txn).Name()],
+		pq.StringArray(roomIDs), pq.Int64Array(lowerExclusive), pq.Int64Array(upperInclusive), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.RoomID, &ev.NID, &ev.JSON); err != nil {
+			return nil, err
+		}
+		result[ev.RoomID] = append(result[ev.RoomID], ev)
+	}
+	return result, rows.Err()
+}
+
 func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, error) {
 	result := []Event{}
 	// TODO: this query ends up doing a sequential scan on the events table. We have
@@ -382,6 +741,56 @@ func (t *EventTable) selectLatestEventByTypeInAllRooms(txn *sqlx.Tx) ([]Event, e
 	return result, nil
 }
 
+// selectLatestEventsInRangesSQL is the query used by SelectLatestEventsInRanges for each dialect.
+// Postgres selects at most `limit` events from each range with a LATERAL join. SQLite has no
+// LATERAL joins, so numbers every event in each range instead.
+var selectLatestEventsInRangesSQL = map[string]string{
+	sqlutil.Postgres: `
+	SELECT room_id, event_nid, event FROM (
+		SELECT r.room_id, e.event_nid, e.event, ROW_NUMBER() OVER (PARTITION BY r.room_id ORDER BY e.event_nid DESC) AS n
+		FROM unnest($1::TEXT[], $2::BIGINT[], $3::BIGINT[]) AS r(room_id, lower_nid, upper_nid)
+		CROSS JOIN LATERAL (
+			SELECT event_nid, event FROM syncv3_events
+			WHERE syncv3_events.room_id = r.room_id AND event_nid > r.lower_nid AND event_nid <= r.upper_nid AND is_state=FALSE
+			ORDER BY event_nid DESC LIMIT $4
+		) AS e
+	) AS latest WHERE n <= $4 ORDER BY room_id, event_nid DESC`,
+	sqlutil.SQLite: `
+	SELECT room_id, event_nid, event FROM (
+		SELECT r.room_id, e.event_nid, e.event, ROW_NUMBER() OVER (PARTITION BY r.room_id ORDER BY e.event_nid DESC) AS n
+		FROM (
+			SELECT rooms.value AS room_id, lowers.value AS lower_nid, uppers.value AS upper_nid
+			FROM json_each(array_to_json($1)) AS rooms
+			JOIN json_each(array_to_json($2)) AS lowers ON lowers.key = rooms.key
+			JOIN json_each(array_to_json($3)) AS uppers ON uppers.key = rooms.key
+		) AS r
+		JOIN syncv3_events AS e
+		ON e.room_id = r.room_id AND e.event_nid > r.lower_nid AND e.event_nid <= r.upper_nid AND e.is_state=FALSE
+	) AS latest WHERE n <= $4 ORDER BY room_id, event_nid DESC`,
+}
+
+// selectLatestEventByTypeInRooms is like selectLatestEventByTypeInAllRooms but only considers the given rooms.
+func (t *EventTable) selectLatestEventByTypeInRooms(txn *sqlx.Tx, roomIDs []string) ([]Event, error) {
+	result := []Event{}
+	rows, err := txn.Query(
+		`SELECT room_id, event_nid, event FROM syncv3_events WHERE event_nid in (
+			SELECT MAX(event_nid) FROM syncv3_events WHERE `+sqlutil.DialectOf(t.db).InArray("room_id", "$1")+` GROUP BY room_id, event_type
+		)`, pq.StringArray(roomIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ev Event
+		if err := rows.Scan(&ev.RoomID, &ev.NID, &ev.JSON); err != nil {
+			return nil, err
+		}
+		result = append(result, ev)
+	}
+	return result, nil
+}
+
 // Select all events between the bounds matching the type, state_key given.
 // Used to work out which rooms the user was joined to at a given point in time.
 func (t *EventTable) SelectEventsWithTypeStateKey(eventType, stateKey string, lowerExclusive, upperInclusive int64) ([]Event, error) {
@@ -427,7 +836,7 @@ func (t *EventTable) SelectEventNIDsWithTypeInRoom(txn *sqlx.Tx, eventType strin
 func (t *EventTable) SelectClosestPrevBatchByID(roomID string, eventID string) (prevBatch string, err error) {
 	err = t.db.QueryRow(
 		`SELECT prev_batch FROM syncv3_events WHERE prev_batch IS NOT NULL AND room_id=$1 AND event_nid >= (
-			SELECT event_nid FROM syncv3_events WHERE event_id = $2
+			SELECT event_nid FROM syncv3_events WHERE event_id = $2 AND room_id = $1
 		) LIMIT 1`, roomID, eventID,
 	).Scan(&prevBatch)
 	if err == sql.ErrNoRows {
@@ -448,6 +857,46 @@ func (t *EventTable) SelectClosestPrevBatch(txn *sqlx.Tx, roomID string, eventNI
 	return
 }
 
+// SelectClosestPrevBatchInRooms is SelectClosestPrevBatch for many rooms at once, given a map of
+// room ID to event NID. Rooms without a closest prev batch token are omitted from the result.
+func (t *EventTable) SelectClosestPrevBatchInRooms(txn *sqlx.Tx, roomIDToEventNID map[string]int64) (map[string]string, error) {
+	roomIDs := make([]string, 0, len(roomIDToEventNID))
+	eventNIDs := make([]int64, 0, len(roomIDToEventNID))
+	for roomID, eventNID := range roomIDToEventNID {
+		roomIDs = append(roomIDs, roomID)
+		eventNIDs = append(eventNIDs, eventNID)
+	}
+	result := make(map[string]string, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return result, nil
+	}
+	queryStr := `
+	SELECT room_id, prev_batch FROM (
+		SELECT r.room_id, (
+			SELECT prev_batch FROM syncv3_events
+			WHERE prev_batch IS NOT NULL AND syncv3_events.room_id = r.room_id AND syncv3_events.event_nid >= r.event_nid
+			ORDER BY syncv3_events.event_nid ASC LIMIT 1
+		) AS prev_batch
+		FROM ` + sqlutil.DialectOf(txn).ZipArrays("r",
+		sqlutil.ArrayColumn{Name: "room_id", Array: "$1", ElemType: "TEXT"},
+		sqlutil.ArrayColumn{Name: "event_nid", Array: "$2", ElemType: "BIGINT"},
+	) + `
+	) AS pb WHERE prev_batch IS NOT NULL`
+	rows, err := txn.Query(queryStr, pq.StringArray(roomIDs), pq.Int64Array(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var roomID, prevBatch string
+		if err := rows.Scan(&roomID, &prevBatch); err != nil {
+			return nil, err
+		}
+		result[roomID] = prevBatch
+	}
+	return result, rows.Err()
+}
+
 type EventChunker []Event
 
 func (c EventChunker) Len() int {
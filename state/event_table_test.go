@@ -5,9 +5,12 @@ import (
 	"database/sql"
 	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/sliding-sync/sqlutil"
@@ -61,7 +64,7 @@ func TestEventTable(t *testing.T) {
 	}
 
 	// pulling non-existent ids returns no error but a zero slice
-	events, err = table.SelectByIDs(txn, false, []string{"101010101010"})
+	events, err = table.SelectByIDs(txn, false, roomID, []string{"101010101010"})
 	if err != nil {
 		t.Fatalf("SelectByIDs failed: %s", err)
 	}
@@ -70,7 +73,7 @@ func TestEventTable(t *testing.T) {
 	}
 
 	// pulling events by event_id is ok
-	events, err = table.SelectByIDs(txn, true, []string{"100", "101", "102"})
+	events, err = table.SelectByIDs(txn, true, roomID, []string{"100", "101", "102"})
 	if err != nil {
 		t.Fatalf("SelectByIDs failed: %s", err)
 	}
@@ -79,7 +82,7 @@ func TestEventTable(t *testing.T) {
 	}
 
 	// pulling nids by event_id is ok
-	idToNIDs, err := table.SelectNIDsByIDs(txn, []string{"100", "101", "102"})
+	idToNIDs, err := table.SelectNIDsByIDs(txn, roomID, []string{"100", "101", "102"})
 	if err != nil {
 		t.Fatalf("SelectNIDsByIDs failed: %s", err)
 	}
@@ -90,7 +93,7 @@ func TestEventTable(t *testing.T) {
 	// set a snapshot ID on them
 	var firstSnapshotID int64 = 55
 	for _, nid := range idToNIDs {
-		if err = table.UpdateBeforeSnapshotID(txn, nid, firstSnapshotID, 0); err != nil {
+		if err = table.UpdateBeforeSnapshotID(txn, roomID, nid, firstSnapshotID, 0); err != nil {
 			t.Fatalf("UpdateSnapshotID: %s", err)
 		}
 	}
@@ -187,7 +190,7 @@ func TestEventTable(t *testing.T) {
 	}
 	verifyStripped(strippedEvents)
 	// pulling stripped events by ID is ok
-	strippedEvents, err = table.SelectStrippedEventsByIDs(txn, true, []string{"100", "101", "102"})
+	strippedEvents, err = table.SelectStrippedEventsByIDs(txn, true, roomID, []string{"100", "101", "102"})
 	if err != nil {
 		t.Fatalf("SelectStrippedEventsByIDs failed: %s", err)
 	}
@@ -222,7 +225,7 @@ func TestEventTableNullValue(t *testing.T) {
 	if len(idToNID) != len(events) {
 		t.Fatalf("wanted %d new events, got %d", len(events), len(idToNID))
 	}
-	gotEvents, err := table.SelectByIDs(txn, true, []string{"nullevent"})
+	gotEvents, err := table.SelectByIDs(txn, true, roomID, []string{"nullevent"})
 	if err != nil {
 		t.Fatalf("SelectByIDs: %s", err)
 	}
@@ -286,7 +289,7 @@ func TestEventTableDupeInsert(t *testing.T) {
 	}
 
 	// pull out the nid
-	idToNID3, err := table.SelectNIDsByIDs(txn, []string{"dupeevent"})
+	idToNID3, err := table.SelectNIDsByIDs(txn, roomID, []string{"dupeevent"})
 	if err != nil {
 		t.Fatalf("SelectNIDsByIDs: %v", err)
 	}
@@ -348,7 +351,7 @@ func TestEventTableSelectEventsBetween(t *testing.T) {
 				t.Fatalf("failed to start txn: %s", err)
 			}
 			defer txn2.Rollback()
-			events, err := table.SelectByIDs(txn2, true, []string{eventIDs[0]})
+			events, err := table.SelectByIDs(txn2, true, searchRoomID, []string{eventIDs[0]})
 			if err != nil || len(events) == 0 {
 				t.Fatalf("failed to extract event for lower bound: %s", err)
 			}
@@ -368,7 +371,7 @@ func TestEventTableSelectEventsBetween(t *testing.T) {
 				t.Fatalf("failed to start txn: %s", err)
 			}
 			defer txn3.Rollback()
-			events, err := table.SelectByIDs(txn3, true, []string{eventIDs[0], eventIDs[2]})
+			events, err := table.SelectByIDs(txn3, true, searchRoomID, []string{eventIDs[0], eventIDs[2]})
 			if err != nil || len(events) == 0 {
 				t.Fatalf("failed to extract event for lower/upper bound: %s", err)
 			}
@@ -456,7 +459,7 @@ func TestEventTableMembershipDetection(t *testing.T) {
 	for i := range events {
 		eventIDs[i] = events[i].ID
 	}
-	gotEvents, err := table.SelectByIDs(txn, true, eventIDs)
+	gotEvents, err := table.SelectByIDs(txn, true, roomID, eventIDs)
 	if err != nil {
 		t.Fatalf("failed to select: %s", err)
 	}
@@ -672,7 +675,7 @@ func TestTortureEventTable(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to start txn: %s", err)
 	}
-	nids, err := table.SelectNIDsByIDs(txn, eventIDs)
+	nids, err := table.SelectNIDsByIDs(txn, roomID, eventIDs)
 	if err != nil {
 		t.Fatalf("SelectNIDsByIDs: %s", err)
 	}
@@ -804,6 +807,19 @@ func TestEventTablePrevBatch(t *testing.T) {
 		} else if gotPrevBatch != "" {
 			t.Fatalf("SelectClosestPrevBatchByID: got %v want nothing", gotPrevBatch)
 		}
+		var gotPrevBatches map[string]string
+		_ = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) error {
+			gotPrevBatches, err = table.SelectClosestPrevBatchInRooms(txn, map[string]int64{
+				roomID: int64(idToNID[events[index].ID]),
+			})
+			if err != nil {
+				t.Fatalf("failed to SelectClosestPrevBatchInRooms: %s", err)
+			}
+			return nil
+		})
+		if gotPrevBatches[roomID] != wantPrevBatch {
+			t.Fatalf("SelectClosestPrevBatchInRooms: got %v want %v", gotPrevBatches, wantPrevBatch)
+		}
 	}
 
 	// 2: SelectClosestPrevBatch with the event which has the prev_batch field returns that event's prev_batch
@@ -817,6 +833,117 @@ func TestEventTablePrevBatch(t *testing.T) {
 	assertPrevBatch(roomID1, 8, "") // query event I, returns nothing
 }
 
+func TestEventTableSelectLatestEventsInRanges(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewEventTable(db)
+	roomID1 := "!TestEventTableSelectLatestEventsInRanges_1:localhost"
+	roomID2 := "!TestEventTableSelectLatestEventsInRanges_2:localhost"
+	roomID3 := "!TestEventTableSelectLatestEventsInRanges_3:localhost"
+	// 5 events in room 1, the first of which is state, and 3 events in room 2
+	var events []Event
+	for i := 0; i < 5; i++ {
+		events = append(events, Event{
+			ID:      fmt.Sprintf("$TestEventTableSelectLatestEventsInRanges_1_%d", i),
+			RoomID:  roomID1,
+			JSON:    []byte(fmt.Sprintf(`{"type":"my_type","event_id":"$TestEventTableSelectLatestEventsInRanges_1_%d"}`, i)),
+			IsState: i == 0,
+		})
+	}
+	for i := 0; i < 3; i++ {
+		events = append(events, Event{
+			ID:     fmt.Sprintf("$TestEventTableSelectLatestEventsInRanges_2_%d", i),
+			RoomID: roomID2,
+			JSON:   []byte(fmt.Sprintf(`{"type":"my_type","event_id":"$TestEventTableSelectLatestEventsInRanges_2_%d"}`, i)),
+		})
+	}
+	var idToNID map[string]int64
+	err := sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+		idToNID, err = table.Insert(txn, events, true)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to insert events: %s", err)
+	}
+	nid := func(index int) int64 {
+		return idToNID[events[index].ID]
+	}
+
+	testCases := []struct {
+		name           string
+		roomIDToRanges map[string][][2]int64
+		limit          int
+		want           map[string][]int // room ID -> event indexes, newest first
+	}{
+		{
+			name: "state events are excluded",
+			roomIDToRanges: map[string][][2]int64{
+				roomID1: {{nid(0), nid(4)}},
+			},
+			limit: 10,
+			want:  map[string][]int{roomID1: {4, 3, 2, 1}},
+		},
+		{
+			name: "limit applies to each room",
+			roomIDToRanges: map[string][][2]int64{
+				roomID1: {{nid(0), nid(4)}},
+				roomID2: {{nid(5), nid(7)}},
+			},
+			limit: 2,
+			want:  map[string][]int{roomID1: {4, 3}, roomID2: {7, 6}},
+		},
+		{
+			name: "limit applies across ranges",
+			roomIDToRanges: map[string][][2]int64{
+				roomID1: {{nid(1), nid(2)}, {nid(4), nid(4)}},
+			},
+			limit: 2,
+			want:  map[string][]int{roomID1: {4, 2}},
+		},
+		{
+			name: "ranges are inclusive",
+			roomIDToRanges: map[string][][2]int64{
+				roomID1: {{nid(2), nid(3)}},
+			},
+			limit: 10,
+			want:  map[string][]int{roomID1: {3, 2}},
+		},
+		{
+			name: "rooms without events are omitted",
+			roomIDToRanges: map[string][][2]int64{
+				roomID3: {{0, nid(7)}},
+			},
+			limit: 10,
+			want:  map[string][]int{},
+		},
+	}
+	for _, tc := range testCases {
+		var got map[string][]Event
+		err = sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
+			got, err = table.SelectLatestEventsInRanges(txn, tc.roomIDToRanges, tc.limit)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("%s: SelectLatestEventsInRanges: %s", tc.name, err)
+		}
+		gotIDs := make(map[string][]string)
+		for roomID, roomEvents := range got {
+			for _, ev := range roomEvents {
+				gotIDs[roomID] = append(gotIDs[roomID], gjson.GetBytes(ev.JSON, "event_id").Str)
+			}
+		}
+		wantIDs := make(map[string][]string)
+		for roomID, indexes := range tc.want {
+			for _, i := range indexes {
+				wantIDs[roomID] = append(wantIDs[roomID], events[i].ID)
+			}
+		}
+		if !reflect.DeepEqual(gotIDs, wantIDs) {
+			t.Errorf("%s: got %v want %v", tc.name, gotIDs, wantIDs)
+		}
+	}
+}
+
 func TestRemoveUnsignedTXNID(t *testing.T) {
 	db, close := connectToDB(t)
 	defer close()
@@ -863,7 +990,7 @@ func TestRemoveUnsignedTXNID(t *testing.T) {
 	}
 
 	// Get the inserted events
-	gotEvents, err := table.SelectByIDs(txn, false, []string{"$A", "$B"})
+	gotEvents, err := table.SelectByIDs(txn, false, roomID1, []string{"$A", "$B"})
 	if err != nil {
 		t.Fatalf("failed to select events: %s", err)
 	}
@@ -998,7 +1125,7 @@ func TestEventTableSelectUnknownEventIDs(t *testing.T) {
 	table := NewEventTable(db)
 
 	// Check the event IDs haven't been added by another test.
-	gotEvents, err := table.SelectByIDs(txn, true, []string{eventID1, eventID2})
+	gotEvents, err := table.SelectByIDs(txn, true, roomID, []string{eventID1, eventID2})
 	if len(gotEvents) > 0 {
 		t.Fatalf("Event IDs already in use---commited by another test?")
 	}
@@ -1009,7 +1136,7 @@ func TestEventTableSelectUnknownEventIDs(t *testing.T) {
 		t.Fatalf("failed to insert event: %s", err)
 	}
 
-	gotEvents, err = table.SelectByIDs(txn, true, []string{eventID1, eventID2})
+	gotEvents, err = table.SelectByIDs(txn, true, roomID, []string{eventID1, eventID2})
 	if err != nil {
 		t.Fatalf("failed to select events: %s", err)
 	}
@@ -1023,7 +1150,7 @@ func TestEventTableSelectUnknownEventIDs(t *testing.T) {
 	// event IDs are unknown.
 	shouldBeUnknownIDs := []string{"$C-SelectUnknownEventIDs", "$D-SelectUnknownEventIDs"}
 	stateBlockIDs := append(shouldBeUnknownIDs, eventID1)
-	unknownIDs, err := table.SelectUnknownEventIDs(txn, stateBlockIDs)
+	unknownIDs, err := table.SelectUnknownEventIDs(txn, roomID, stateBlockIDs)
 	t.Logf("unknownIDs=%v", unknownIDs)
 	if err != nil {
 		t.Fatalf("failed to select unknown state events: %s", err)
@@ -1038,4 +1165,276 @@ func TestEventTableSelectUnknownEventIDs(t *testing.T) {
 			t.Errorf("Expected %s to be unknown to the DB, but it wasn't", unknownEventID)
 		}
 	}
+
+	// Event IDs are looked up per room, so known events are unknown in other rooms.
+	unknownIDs, err = table.SelectUnknownEventIDs(txn, "!other:localhost", []string{eventID1, eventID2})
+	if err != nil {
+		t.Fatalf("failed to select unknown state events: %s", err)
+	}
+	if len(unknownIDs) != 2 {
+		t.Fatalf("Expected known events to be unknown in another room, got %v", unknownIDs)
+	}
+}
+
+func TestEventTableSchemaPartitions(t *testing.T) {
+	// partitioning is only supported on Postgres
+	postgres := sqlutil.DialectOf(sqlx.NewDb(nil, "postgres"))
+	schema := eventTableSchema(postgres, 3)
+	for i := 0; i < 3; i++ {
+		partition := fmt.Sprintf("syncv3_events_p%d PARTITION OF syncv3_events FOR VALUES WITH (MODULUS 3, REMAINDER %d)", i, i)
+		if !strings.Contains(schema, partition) {
+			t.Errorf("schema is missing partition %d: %s", i, schema)
+		}
+	}
+	if strings.Contains(schema, "syncv3_events_p3") {
+		t.Errorf("schema has too many partitions: %s", schema)
+	}
+	if strings.Contains(eventTableSchema(postgres, 0), "PARTITION") {
+		t.Errorf("unpartitioned schema is partitioned")
+	}
+}
+
+// connectToPartitionTestDB connects to a separate schema, so that partitioning doesn't affect the
+// events table used by other tests.
+func connectToPartitionTestDB(t *testing.T) (*sqlx.DB, func()) {
+	db, close := connectToDB(t)
+	if !sqlutil.DialectOf(db).SupportsPartitioning() {
+		close()
+		t.Skip("partitioning is not supported on SQLite")
+	}
+	db.MustExec(`DROP SCHEMA IF EXISTS syncv3_partition_test CASCADE; CREATE SCHEMA syncv3_partition_test;`)
+	pdb, err := sqlutil.Open(postgresConnectionString + " search_path=syncv3_partition_test")
+	if err != nil {
+		t.Fatalf("failed to open SQL db: %s", err)
+	}
+	return pdb, func() {
+		pdb.Close()
+		db.MustExec(`DROP SCHEMA syncv3_partition_test CASCADE;`)
+		close()
+	}
+}
+
+func TestEventTablePartitioning(t *testing.T) {
+	pdb, close := connectToPartitionTestDB(t)
+	defer close()
+	assertLayout := func(wantPartitioned bool, wantPartitions int) {
+		t.Helper()
+		isPartitioned, numPartitions, err := selectEventTableLayout(pdb)
+		if err != nil {
+			t.Fatalf("selectEventTableLayout: %s", err)
+		}
+		if isPartitioned != wantPartitioned || numPartitions != wantPartitions {
+			t.Fatalf("got partitioned=%v partitions=%d, want partitioned=%v partitions=%d",
+				isPartitioned, numPartitions, wantPartitioned, wantPartitions)
+		}
+	}
+	insert := func(table *EventTable, events []Event) (idToNID map[string]int64) {
+		t.Helper()
+		err := sqlutil.WithTransaction(pdb, func(txn *sqlx.Tx) (err error) {
+			idToNID, err = table.Insert(txn, events, true)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Insert: %s", err)
+		}
+		return idToNID
+	}
+	alice := "@alice:localhost"
+	roomIDs := []string{"!a:localhost", "!b:localhost", "!c:localhost"}
+	var events []Event
+	for _, roomID := range roomIDs {
+		events = append(events, Event{
+			RoomID: roomID,
+			JSON:   testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{}),
+		}, Event{
+			RoomID: roomID,
+			JSON:   testutils.NewMessageEvent(t, alice, "hello"),
+		})
+	}
+
+	// start with an unpartitioned table
+	table := NewEventTable(pdb)
+	assertLayout(false, -1)
+	idToNID := insert(table, events)
+	if len(idToNID) != len(events) {
+		t.Fatalf("inserted %d events, want %d", len(idToNID), len(events))
+	}
+
+	// an existing table is not partitioned on startup
+	table = NewPartitionedEventTable(pdb, 4)
+	assertLayout(false, -1)
+
+	// partitioning is interrupted after copying one batch, then more events are stored
+	err := sqlutil.WithTransaction(pdb, func(txn *sqlx.Tx) error {
+		if err := createPartitioningTable(txn, 4); err != nil {
+			return err
+		}
+		copied, err := copyEventsToPartitioningTable(txn, 2)
+		if err == nil && copied != 2 {
+			err = fmt.Errorf("copied %d events, want 2", copied)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to partially partition: %s", err)
+	}
+	assertLayout(false, -1)
+	events = append(events, Event{
+		RoomID: roomIDs[1],
+		JSON:   testutils.NewMessageEvent(t, alice, "during partitioning"),
+	})
+	for eventID, nid := range insert(table, events) {
+		idToNID[eventID] = nid
+	}
+
+	// resuming partitioning copies the remaining events, keeping their NIDs and the partitions from
+	// the first attempt
+	if err = PartitionEventTable(pdb, 8, 2); err != nil {
+		t.Fatalf("PartitionEventTable: %s", err)
+	}
+	assertLayout(true, 4)
+	var schemaExists bool
+	if err = pdb.QueryRow(`SELECT to_regnamespace($1) IS NOT NULL`, partitioningSchema).Scan(&schemaExists); err != nil || schemaExists {
+		t.Fatalf("partitioning schema was not dropped: exists=%v err=%v", schemaExists, err)
+	}
+	table = NewPartitionedEventTable(pdb, 4)
+	var highestNID int64
+	roomToEventIDs := make(map[string][]string)
+	for _, ev := range events {
+		roomToEventIDs[ev.RoomID] = append(roomToEventIDs[ev.RoomID], ev.ID)
+		if idToNID[ev.ID] > highestNID {
+			highestNID = idToNID[ev.ID]
+		}
+	}
+	for roomID, eventIDs := range roomToEventIDs {
+		gotEvents, err := table.SelectByIDs(nil, true, roomID, eventIDs)
+		if err != nil {
+			t.Fatalf("SelectByIDs: %s", err)
+		}
+		for _, ev := range gotEvents {
+			if ev.NID != idToNID[ev.ID] {
+				t.Errorf("event %s has nid %d after partitioning, want %d", ev.ID, ev.NID, idToNID[ev.ID])
+			}
+		}
+	}
+
+	// existing events are deduplicated, and new events continue the NID sequence
+	newEvent := Event{
+		RoomID: roomIDs[0],
+		JSON:   testutils.NewMessageEvent(t, alice, "world"),
+	}
+	newIDToNID := insert(table, append(events, newEvent))
+	if len(newIDToNID) != 1 {
+		t.Fatalf("inserted %v, want only the new event", newIDToNID)
+	}
+	var newEventID string
+	for eventID, nid := range newIDToNID {
+		if nid <= highestNID {
+			t.Errorf("new event has nid %d, want > %d", nid, highestNID)
+		}
+		newEventID = eventID
+		highestNID = nid
+	}
+
+	// an event ID reused in another room is a separate event
+	dupeIDToNID := insert(table, []Event{{RoomID: roomIDs[2], JSON: newEvent.JSON}})
+	if dupeIDToNID[newEventID] <= highestNID {
+		t.Fatalf("inserted %v for a reused event ID in another room, want a new nid", dupeIDToNID)
+	}
+	roomToNID := map[string]int64{roomIDs[0]: highestNID, roomIDs[2]: dupeIDToNID[newEventID]}
+	err = sqlutil.WithTransaction(pdb, func(txn *sqlx.Tx) error {
+		for roomID, wantNID := range roomToNID {
+			idToNID, err := table.SelectNIDsByIDs(txn, roomID, []string{newEventID})
+			if err != nil {
+				return err
+			}
+			if idToNID[newEventID] != wantNID {
+				return fmt.Errorf("SelectNIDsByIDs in %s returned %v, want nid %d", roomID, idToNID, wantNID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// queries filtered by room still work
+	err = sqlutil.WithTransaction(pdb, func(txn *sqlx.Tx) error {
+		if err := table.UpdateBeforeSnapshotID(txn, roomIDs[0], highestNID, 42, 0); err != nil {
+			return err
+		}
+		latest, err := table.LatestEventInRooms(txn, roomIDs, highestNID)
+		if err != nil {
+			return err
+		}
+		if len(latest) != len(roomIDs) {
+			return fmt.Errorf("LatestEventInRooms returned %d events, want %d", len(latest), len(roomIDs))
+		}
+		for _, ev := range latest {
+			if ev.RoomID == roomIDs[0] && (ev.NID != highestNID || ev.BeforeStateSnapshotID != 42) {
+				return fmt.Errorf("LatestEventInRooms returned %+v, want nid %d with snapshot 42", ev, highestNID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the table is never unpartitioned or repartitioned
+	NewEventTable(pdb)
+	assertLayout(true, 4)
+	NewPartitionedEventTable(pdb, 8)
+	assertLayout(true, 4)
+}
+
+// Test that the queries used by RoomStateAfterEventPosition only scan the partition of the room they
+// are filtered by.
+func TestEventTablePartitionPruning(t *testing.T) {
+	pdb, close := connectToPartitionTestDB(t)
+	defer close()
+	NewPartitionedEventTable(pdb, 8)
+	NewSnapshotsTable(pdb)
+
+	partitionRegexp := regexp.MustCompile(`syncv3_events_p\d+`)
+	roomIDs := pq.StringArray{"!a:localhost"}
+	err := sqlutil.WithTransaction(pdb, func(txn *sqlx.Tx) error {
+		stateQuery, stateArgs, err := sqlx.In(
+			roomStateAfterEventPositionSQL(txn, []string{"(syncv3_events.event_type = ? AND syncv3_events.state_key = ?)"}, "events"),
+			"m.room.create", "", pq.Int64Array{1}, roomIDs,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to form sql query: %s", err)
+		}
+		testCases := []struct {
+			name  string
+			query string
+			args  []interface{}
+		}{
+			{name: "SelectByNIDsInRooms", query: selectByNIDsInRoomsSQL(sqlutil.DialectOf(txn)), args: []interface{}{pq.Int64Array{1, 2}, roomIDs}},
+			{name: "LatestEventInRooms", query: latestEventInRoomsSQL(sqlutil.DialectOf(txn)), args: []interface{}{roomIDs, int64(100)}},
+			{name: "RoomStateAfterEventPosition", query: txn.Rebind(stateQuery), args: stateArgs},
+			{name: "SelectByIDs", query: selectByIDsInRoomSQL(sqlutil.DialectOf(txn), "event_nid"), args: []interface{}{roomIDs[0], pq.StringArray{"$a"}}},
+			{name: "SelectUnknownEventIDs", query: selectUnknownEventIDsSQL(sqlutil.DialectOf(txn)), args: []interface{}{pq.StringArray{"$a"}, roomIDs[0]}},
+		}
+		for _, tc := range testCases {
+			var plan []string
+			if err := txn.Select(&plan, "EXPLAIN (COSTS OFF) "+tc.query, tc.args...); err != nil {
+				return fmt.Errorf("%s: failed to explain query: %s", tc.name, err)
+			}
+			partitions := make(map[string]bool)
+			for _, line := range plan {
+				for _, partition := range partitionRegexp.FindAllString(line, -1) {
+					partitions[partition] = true
+				}
+			}
+			if len(partitions) != 1 {
+				t.Errorf("%s: query scans partitions %v, want exactly 1. Plan:\n%s", tc.name, partitions, strings.Join(plan, "\n"))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
 }
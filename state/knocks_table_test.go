@@ -0,0 +1,51 @@
+package state
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestKnocksTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewKnocksTable(db)
+	alice := "@alice_TestKnocksTable:localhost"
+	roomA := "!a_TestKnocksTable:localhost"
+	roomB := "!b_TestKnocksTable:localhost"
+	knockStateA := []json.RawMessage{[]byte(`{"foo":"bar"}`)}
+	knockStateB := []json.RawMessage{[]byte(`{"foo":"bar"}`), []byte(`{"baz":"quuz"}`)}
+
+	assertNoError(t, table.InsertKnock(alice, roomA, knockStateA))
+	assertNoError(t, table.InsertKnock(alice, roomB, knockStateA))
+	// knocking again replaces the knock state
+	assertNoError(t, table.InsertKnock(alice, roomB, knockStateB))
+
+	knocks, err := table.SelectAllKnocksForUser(alice)
+	assertNoError(t, err)
+	want := map[string][]json.RawMessage{
+		roomA: knockStateA,
+		roomB: knockStateB,
+	}
+	if !reflect.DeepEqual(knocks, want) {
+		t.Fatalf("SelectAllKnocksForUser: got %v want %v", knocks, want)
+	}
+	knockState, err := table.SelectKnockState(alice, roomB)
+	assertNoError(t, err)
+	if !reflect.DeepEqual(knockState, knockStateB) {
+		t.Fatalf("SelectKnockState: got %v want %v", knockState, knockStateB)
+	}
+
+	// retire the knock
+	assertNoError(t, table.RemoveKnock(alice, roomA))
+	knocks, err = table.SelectAllKnocksForUser(alice)
+	assertNoError(t, err)
+	if _, exists := knocks[roomA]; exists || len(knocks) != 1 {
+		t.Fatalf("knock was not removed: %v", knocks)
+	}
+	knockState, err = table.SelectKnockState(alice, roomA)
+	assertNoError(t, err)
+	if knockState != nil {
+		t.Fatalf("SelectKnockState for removed knock: got %v want nil", knockState)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/matrix-org/sliding-sync/testutils"
 )
 
@@ -17,7 +18,7 @@ func TestMain(m *testing.M) {
 }
 
 func connectToDB(t *testing.T) (*sqlx.DB, func()) {
-	db, err := sqlx.Open("postgres", postgresConnectionString)
+	db, err := sqlutil.Open(postgresConnectionString)
 	if err != nil {
 		t.Fatalf("failed to open SQL db: %s", err)
 	}
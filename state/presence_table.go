@@ -0,0 +1,67 @@
+package state
+
+import (
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sqlutil"
+)
+
+// PresenceTable stores the latest presence for each user. Presence is seen by every poller which
+// shares a room with the user, so writes only take effect when the presence has meaningfully
+// changed: this is how we work out which updates to send to the API processes.
+type PresenceTable struct {
+	db *sqlx.DB
+}
+
+func NewPresenceTable(db *sqlx.DB) *PresenceTable {
+	// make sure tables are made
+	db.MustExec(`
+	CREATE TABLE IF NOT EXISTS syncv3_presence (
+		user_id TEXT NOT NULL PRIMARY KEY,
+		presence TEXT NOT NULL,
+		status_msg TEXT NOT NULL,
+		currently_active BOOLEAN NOT NULL,
+		last_active_ts BIGINT NOT NULL
+	);
+	`)
+	return &PresenceTable{db}
+}
+
+// Upsert the presence for this user. Returns true if the presence, status message or currently
+// active flag changed. last_active_ts is only updated when one of these fields changes, as every
+// poller computes a slightly different value for it.
+func (t *PresenceTable) Upsert(p internal.Presence) (changed bool, err error) {
+	var userID string
+	err = t.db.QueryRow(`
+		INSERT INTO syncv3_presence(user_id, presence, status_msg, currently_active, last_active_ts)
+		VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET
+			presence = EXCLUDED.presence, status_msg = EXCLUDED.status_msg,
+			currently_active = EXCLUDED.currently_active, last_active_ts = EXCLUDED.last_active_ts
+		WHERE (syncv3_presence.presence, syncv3_presence.status_msg, syncv3_presence.currently_active)
+			IS DISTINCT FROM (EXCLUDED.presence, EXCLUDED.status_msg, EXCLUDED.currently_active)
+		RETURNING user_id`,
+		p.UserID, p.Presence, p.StatusMsg, p.CurrentlyActive, p.LastActiveTS,
+	).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Select the presence for these users. Users without any known presence are omitted.
+func (t *PresenceTable) Select(userIDs []string) (presence []internal.Presence, err error) {
+	err = t.db.Select(&presence, `SELECT user_id, presence, status_msg, currently_active, last_active_ts
+		FROM syncv3_presence WHERE `+sqlutil.DialectOf(t.db).InArray("user_id", "$1"), pq.StringArray(userIDs))
+	return
+}
+
+// SelectAll returns the presence of every user. Used at startup to populate in-memory caches.
+func (t *PresenceTable) SelectAll() (presence []internal.Presence, err error) {
+	err = t.db.Select(&presence, `SELECT user_id, presence, status_msg, currently_active, last_active_ts
+		FROM syncv3_presence`)
+	return
+}
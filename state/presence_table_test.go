@@ -0,0 +1,86 @@
+package state
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+func TestPresenceTable(t *testing.T) {
+	db, close := connectToDB(t)
+	defer close()
+	table := NewPresenceTable(db)
+	alice := internal.Presence{
+		UserID:          "@TestPresenceTable_alice:localhost",
+		Presence:        "online",
+		CurrentlyActive: true,
+		LastActiveTS:    1000,
+	}
+	bob := internal.Presence{
+		UserID:       "@TestPresenceTable_bob:localhost",
+		Presence:     "unavailable",
+		StatusMsg:    "away",
+		LastActiveTS: 2000,
+	}
+	for _, p := range []internal.Presence{alice, bob} {
+		changed, err := table.Upsert(p)
+		if err != nil {
+			t.Fatalf("Upsert: %s", err)
+		}
+		if !changed {
+			t.Fatalf("Upsert: new presence for %s was not marked as changed", p.UserID)
+		}
+	}
+
+	// Seeing the same presence with a different last active time is not a change
+	aliceLater := alice
+	aliceLater.LastActiveTS = 1500
+	changed, err := table.Upsert(aliceLater)
+	if err != nil {
+		t.Fatalf("Upsert: %s", err)
+	}
+	if changed {
+		t.Fatalf("Upsert: last_active_ts change was marked as changed")
+	}
+
+	// Going offline is a change
+	aliceOffline := alice
+	aliceOffline.Presence = "offline"
+	aliceOffline.CurrentlyActive = false
+	aliceOffline.LastActiveTS = 3000
+	changed, err = table.Upsert(aliceOffline)
+	if err != nil {
+		t.Fatalf("Upsert: %s", err)
+	}
+	if !changed {
+		t.Fatalf("Upsert: going offline was not marked as changed")
+	}
+
+	got, err := table.Select([]string{alice.UserID, bob.UserID, "@TestPresenceTable_unknown:localhost"})
+	if err != nil {
+		t.Fatalf("Select: %s", err)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].UserID < got[j].UserID
+	})
+	want := []internal.Presence{aliceOffline, bob}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Select: got %+v want %+v", got, want)
+	}
+
+	all, err := table.SelectAll()
+	if err != nil {
+		t.Fatalf("SelectAll: %s", err)
+	}
+	found := 0
+	for _, p := range all {
+		if p.UserID == alice.UserID || p.UserID == bob.UserID {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Fatalf("SelectAll: got %d test users, want 2", found)
+	}
+}
@@ -6,6 +6,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 type RoomInfo struct {
@@ -40,6 +41,13 @@ func (t *RoomsTable) SelectRoomInfos(txn *sqlx.Tx) (infos []RoomInfo, err error)
 	return
 }
 
+// SelectRoomInfosForRooms is like SelectRoomInfos but only returns infos for the given rooms.
+func (t *RoomsTable) SelectRoomInfosForRooms(txn *sqlx.Tx, roomIDs []string) (infos []RoomInfo, err error) {
+	err = txn.Select(&infos, `SELECT room_id, is_encrypted, upgraded_room_id, predecessor_room_id, type FROM syncv3_rooms
+	WHERE `+sqlutil.DialectOf(txn).InArray("room_id", "$1"), pq.StringArray(roomIDs))
+	return
+}
+
 func (t *RoomsTable) Upsert(txn *sqlx.Tx, info RoomInfo, snapshotID, latestNID int64) (err error) {
 	// This is a bit of a wonky query to ensure that you cannot set is_encrypted=false after it has been
 	// set to true.
@@ -92,7 +100,7 @@ func (t *RoomsTable) Upsert(txn *sqlx.Tx, info RoomInfo, snapshotID, latestNID i
 
 func (t *RoomsTable) LatestNIDs(txn *sqlx.Tx, roomIDs []string) (nids map[string]int64, err error) {
 	nids = make(map[string]int64, len(roomIDs))
-	rows, err := txn.Query(`SELECT room_id, latest_nid FROM syncv3_rooms WHERE room_id = ANY($1)`, pq.StringArray(roomIDs))
+	rows, err := txn.Query(`SELECT room_id, latest_nid FROM syncv3_rooms WHERE `+sqlutil.DialectOf(txn).InArray("room_id", "$1"), pq.StringArray(roomIDs))
 	if err != nil {
 		return nil, err
 	}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 type SnapshotRow struct {
@@ -21,14 +22,14 @@ type SnapshotTable struct {
 }
 
 func NewSnapshotsTable(db *sqlx.DB) *SnapshotTable {
+	dialect := sqlutil.DialectOf(db)
 	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_snapshots_seq;
+	db.MustExec(dialect.CreateSequence("syncv3_snapshots_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_snapshots (
-		snapshot_id BIGINT PRIMARY KEY DEFAULT nextval('syncv3_snapshots_seq'),
+		` + dialect.SerialPrimaryKey("snapshot_id", "syncv3_snapshots_seq") + `,
 		room_id TEXT NOT NULL,
-		events BIGINT[] NOT NULL,
-		membership_events BIGINT[] NOT NULL,
+		events ` + dialect.ArrayType("BIGINT") + ` NOT NULL,
+		membership_events ` + dialect.ArrayType("BIGINT") + ` NOT NULL,
 		UNIQUE(snapshot_id, room_id)
 	);
 	`)
@@ -85,11 +86,6 @@ func (s *SnapshotTable) Insert(txn *sqlx.Tx, row *SnapshotRow) error {
 
 // Delete the snapshot IDs given
 func (s *SnapshotTable) Delete(txn *sqlx.Tx, snapshotIDs []int64) error {
-	query, args, err := sqlx.In(`DELETE FROM syncv3_snapshots WHERE snapshot_id = ANY(?)`, pq.Int64Array(snapshotIDs))
-	if err != nil {
-		return err
-	}
-	query = txn.Rebind(query)
-	_, err = txn.Exec(query, args...)
+	_, err := txn.Exec(`DELETE FROM syncv3_snapshots WHERE `+sqlutil.DialectOf(txn).InArray("snapshot_id", "$1"), pq.Int64Array(snapshotIDs))
 	return err
 }
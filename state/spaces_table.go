@@ -76,7 +76,7 @@ func (t *SpacesTable) BulkInsert(txn *sqlx.Tx, relations []SpaceRelation) error
 	if len(relations) == 0 {
 		return nil
 	}
-	chunks := sqlutil.Chunkify(5, MaxPostgresParameters, SpaceRelationChunker(relations))
+	chunks := sqlutil.Chunkify(5, sqlutil.DialectOf(txn).MaxParameters(), SpaceRelationChunker(relations))
 	for _, chunk := range chunks {
 		_, err := txn.NamedExec(`
 		INSERT INTO syncv3_spaces (parent, child, relation, ordering, suggested)
@@ -108,7 +108,7 @@ func (t *SpacesTable) BulkDelete(txn *sqlx.Tx, relations []SpaceRelation) error
 func (t *SpacesTable) SelectChildren(txn *sqlx.Tx, spaces []string) (map[string][]SpaceRelation, error) {
 	result := make(map[string][]SpaceRelation)
 	var data []SpaceRelation
-	err := txn.Select(&data, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces WHERE parent = ANY($1)`, pq.StringArray(spaces))
+	err := txn.Select(&data, `SELECT parent, child, relation, ordering, suggested FROM syncv3_spaces WHERE `+sqlutil.DialectOf(txn).InArray("parent", "$1"), pq.StringArray(spaces))
 	if err != nil {
 		return nil, err
 	}
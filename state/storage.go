@@ -29,6 +29,10 @@ const MaxPostgresParameters = 65535
 type StartupSnapshot struct {
 	GlobalMetadata   map[string]internal.RoomMetadata // room_id -> metadata
 	AllJoinedMembers map[string][]string              // room_id -> [user_id]
+	Presence         []internal.Presence
+	// The latest event NID before the snapshot was taken. Events after this may or may not be
+	// included in the snapshot.
+	LatestNID int64
 }
 
 type LatestEvents struct {
@@ -44,14 +48,29 @@ type Storage struct {
 	UnreadTable       *UnreadTable
 	AccountDataTable  *AccountDataTable
 	InvitesTable      *InvitesTable
+	KnocksTable       *KnocksTable
 	TransactionsTable *TransactionsTable
 	DeviceDataTable   *DeviceDataTable
+	DeviceListTable   *DeviceListTable
 	ReceiptTable      *ReceiptTable
+	PresenceTable     *PresenceTable
+	CheckpointTable   *CheckpointTable
 	DB                *sqlx.DB
 }
 
+// StorageOptions configures how the storage layer lays out its tables.
+type StorageOptions struct {
+	// If non-zero, the events table is partitioned by room ID into this many partitions. See
+	// NewPartitionedEventTable.
+	EventPartitions int
+}
+
 func NewStorage(postgresURI string) *Storage {
-	db, err := sqlx.Open("postgres", postgresURI)
+	return NewStorageWithOptions(postgresURI, StorageOptions{})
+}
+
+func NewStorageWithOptions(postgresURI string, opts StorageOptions) *Storage {
+	db, err := sqlutil.Open(postgresURI)
 	if err != nil {
 		sentry.CaptureException(err)
 		// TODO: if we panic(), will sentry have a chance to flush the event?
@@ -60,7 +79,7 @@ func NewStorage(postgresURI string) *Storage {
 	acc := &Accumulator{
 		db:            db,
 		roomsTable:    NewRoomsTable(db),
-		eventsTable:   NewEventTable(db),
+		eventsTable:   NewPartitionedEventTable(db, opts.EventPartitions),
 		snapshotTable: NewSnapshotsTable(db),
 		spacesTable:   NewSpacesTable(db),
 		entityName:    "server",
@@ -72,9 +91,13 @@ func NewStorage(postgresURI string) *Storage {
 		EventsTable:       acc.eventsTable,
 		AccountDataTable:  NewAccountDataTable(db),
 		InvitesTable:      NewInvitesTable(db),
+		KnocksTable:       NewKnocksTable(db),
 		TransactionsTable: NewTransactionsTable(db),
 		DeviceDataTable:   NewDeviceDataTable(db),
+		DeviceListTable:   NewDeviceListTable(db),
 		ReceiptTable:      NewReceiptTable(db),
+		PresenceTable:     NewPresenceTable(db),
+		CheckpointTable:   NewCheckpointTable(db),
 		DB:                db,
 	}
 }
@@ -109,6 +132,16 @@ func (s *Storage) AccountDatas(userID string, roomIDs ...string) (datas []Accoun
 	return
 }
 
+// GlobalAccountDataPage returns up to `limit` global account data events for this user after
+// `fromID`, optionally filtered by event type. See AccountDataTable.SelectGlobalPage.
+func (s *Storage) GlobalAccountDataPage(userID string, fromID int64, limit int, types, notTypes []string) (datas []AccountData, err error) {
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		datas, err = s.AccountDataTable.SelectGlobalPage(txn, userID, fromID, limit, types, notTypes)
+		return err
+	})
+	return
+}
+
 func (s *Storage) InsertAccountData(userID, roomID string, events []json.RawMessage) (data []AccountData, err error) {
 	data = make([]AccountData, len(events))
 	for i := range events {
@@ -135,17 +168,61 @@ func (s *Storage) PrepareSnapshot(txn *sqlx.Tx) (tableName string, err error) {
 	// each event NID is queried using a btree index, rather than doing a seq scan as this query will pull
 	// out ~50% of the rows in syncv3_events.
 	tempTableName := "temp_snapshot"
+	err = fillTempSnapshotTable(txn, tempTableName, `syncv3_rooms.current_snapshot_id IS NOT NULL`)
+	return tempTableName, err
+}
+
+// fillTempSnapshotTable creates this temporary table if it does not exist, and replaces its rows with
+// the membership nids of the current snapshots of the rooms matching the condition `where`.
+func fillTempSnapshotTable(txn *sqlx.Tx, tempTableName, where string, args ...interface{}) error {
+	_, err := txn.Exec(`CREATE TEMP TABLE IF NOT EXISTS ` + tempTableName + ` (membership_nid BIGINT);
+	DELETE FROM ` + tempTableName)
+	if err != nil {
+		return err
+	}
 	_, err = txn.Exec(
-		`SELECT UNNEST(membership_events) AS membership_nid INTO TEMP ` + tempTableName + ` FROM syncv3_snapshots
-		JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id`,
+		`INSERT INTO `+tempTableName+` SELECT nids.value FROM syncv3_snapshots
+		JOIN syncv3_rooms ON syncv3_snapshots.snapshot_id = syncv3_rooms.current_snapshot_id
+		CROSS JOIN `+sqlutil.DialectOf(txn).ArrayElements("membership_events", "nids")+`
+		WHERE `+where, args...,
 	)
-	return tempTableName, err
+	return err
+}
+
+// unnestSnapshots returns a SELECT of every element of the array expression `nids` in the rows of
+// syncv3_snapshots, e.g unnestSnapshots(txn, "events") + " WHERE snapshot_id = 1".
+func unnestSnapshots(txn *sqlx.Tx, nids string) string {
+	return `SELECT nids.value FROM syncv3_snapshots CROSS JOIN ` + sqlutil.DialectOf(txn).ArrayElements(nids, "nids")
+}
+
+// roomStateAfterEventPositionSQL returns the query used by RoomStateAfterEventPosition to select the
+// state events matching these filters from the state snapshots in these rooms. The arguments are the
+// filter arguments, then the snapshot IDs and the room IDs.
+func roomStateAfterEventPositionSQL(txn *sqlx.Tx, wheres []string, nidcols string) string {
+	return `SELECT syncv3_events.event_nid, syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
+				WHERE (` + strings.Join(wheres, " OR ") + `) AND syncv3_events.event_nid IN (
+					` + unnestSnapshots(txn, nidcols) + ` WHERE ` + sqlutil.DialectOf(txn).InArray("syncv3_snapshots.snapshot_id", "?") + `
+				) AND ` + sqlutil.DialectOf(txn).InArray("syncv3_events.room_id", "?") + ` ORDER BY syncv3_events.event_nid ASC`
 }
 
 // GlobalSnapshot snapshots the entire database for the purposes of initialising
 // a sliding sync instance. It will atomically grab metadata for all rooms and all joined members
 // in a single transaction.
 func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
+	return s.globalSnapshot(true)
+}
+
+// GlobalSnapshotWithoutMetadata is like GlobalSnapshot but does not load metadata for every room,
+// leaving GlobalMetadata empty. Used when room metadata is instead loaded on demand via MetadataForRooms.
+func (s *Storage) GlobalSnapshotWithoutMetadata() (ss StartupSnapshot, err error) {
+	return s.globalSnapshot(false)
+}
+
+func (s *Storage) globalSnapshot(withMetadata bool) (ss StartupSnapshot, err error) {
+	ss.LatestNID, err = s.LatestEventNID()
+	if err != nil {
+		return ss, fmt.Errorf("GlobalSnapshot: failed to select latest NID: %w", err)
+	}
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
 		tempTableName, err := s.PrepareSnapshot(txn)
 		if err != nil {
@@ -160,20 +237,72 @@ func (s *Storage) GlobalSnapshot() (ss StartupSnapshot, err error) {
 			sentry.CaptureException(err)
 			return err
 		}
-		err = s.MetadataForAllRooms(txn, tempTableName, metadata)
-		if err != nil {
-			err = fmt.Errorf("GlobalSnapshot: failed to call MetadataForAllRooms: %w", err)
-			sentry.CaptureException(err)
-			return err
+		if withMetadata {
+			err = s.MetadataForAllRooms(txn, tempTableName, metadata)
+			if err != nil {
+				err = fmt.Errorf("GlobalSnapshot: failed to call MetadataForAllRooms: %w", err)
+				sentry.CaptureException(err)
+				return err
+			}
+			ss.GlobalMetadata = metadata
 		}
-		ss.GlobalMetadata = metadata
 		return err
 	})
+	if err != nil {
+		return
+	}
+	// outside the transaction, which would otherwise need a second connection
+	ss.Presence, err = s.PresenceTable.SelectAll()
+	if err != nil {
+		err = fmt.Errorf("GlobalSnapshot: failed to select presence: %w", err)
+		sentry.CaptureException(err)
+	}
 	return
 }
 
+// MetadataForRooms loads the current metadata for the given rooms, in the same form as the
+// GlobalMetadata of a StartupSnapshot. Rooms unknown to the database are omitted from the result.
+// Used to load room metadata on demand rather than all at once at startup.
+func (s *Storage) MetadataForRooms(roomIDs []string) (result map[string]internal.RoomMetadata, err error) {
+	if len(roomIDs) == 0 {
+		return map[string]internal.RoomMetadata{}, nil
+	}
+	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
+		tempTableName, err := s.prepareSnapshotForRooms(txn, roomIDs)
+		if err != nil {
+			return fmt.Errorf("MetadataForRooms: failed to prepare snapshot: %w", err)
+		}
+		_, result, err = s.AllJoinedMembers(txn, tempTableName)
+		if err != nil {
+			return fmt.Errorf("MetadataForRooms: failed to call AllJoinedMembers: %w", err)
+		}
+		if err = s.metadataForRooms(txn, tempTableName, roomIDs, result); err != nil {
+			return fmt.Errorf("MetadataForRooms: %w", err)
+		}
+		return nil
+	})
+	return
+}
+
+// prepareSnapshotForRooms is like PrepareSnapshot but only includes the membership nids for the
+// current snapshots of the given rooms. The table is emptied each time this is called, so this can be
+// called many times over the lifetime of the process.
+func (s *Storage) prepareSnapshotForRooms(txn *sqlx.Tx, roomIDs []string) (tableName string, err error) {
+	tempTableName := "temp_rooms_snapshot"
+	err = fillTempSnapshotTable(
+		txn, tempTableName, sqlutil.DialectOf(txn).InArray("syncv3_rooms.room_id", "$1"), pq.StringArray(roomIDs),
+	)
+	return tempTableName, err
+}
+
 // Extract hero info for all rooms. Requires a prepared snapshot in order to be called.
 func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result map[string]internal.RoomMetadata) error {
+	return s.metadataForRooms(txn, tempTableName, nil, result)
+}
+
+// metadataForRooms extracts metadata for the given rooms, or all rooms if roomIDs is nil. The
+// snapshot in tempTableName must cover at least these rooms.
+func (s *Storage) metadataForRooms(txn *sqlx.Tx, tempTableName string, roomIDs []string, result map[string]internal.RoomMetadata) error {
 	// Select the invited member counts
 	rows, err := txn.Query(`
 	SELECT room_id, count(state_key) FROM syncv3_events INNER JOIN ` + tempTableName + ` ON membership_nid=event_nid
@@ -197,7 +326,12 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 	}
 
 	// work out latest timestamps
-	events, err := s.Accumulator.eventsTable.selectLatestEventByTypeInAllRooms(txn)
+	var events []Event
+	if roomIDs == nil {
+		events, err = s.Accumulator.eventsTable.selectLatestEventByTypeInAllRooms(txn)
+	} else {
+		events, err = s.Accumulator.eventsTable.selectLatestEventByTypeInRooms(txn, roomIDs)
+	}
 	if err != nil {
 		return err
 	}
@@ -227,11 +361,11 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 	}
 
 	// Select the name / canonical alias for all rooms
-	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInAllRooms(txn, []string{
+	roomIDToStateEvents, err := s.currentNotMembershipStateEventsInRooms(txn, roomIDs, []string{
 		"m.room.name", "m.room.canonical_alias",
 	})
 	if err != nil {
-		return fmt.Errorf("failed to load state events for all rooms: %s", err)
+		return fmt.Errorf("failed to load state events for rooms: %s", err)
 	}
 	for roomID, stateEvents := range roomIDToStateEvents {
 		metadata := result[roomID]
@@ -253,7 +387,7 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 	SELECT rf.* FROM (
 		SELECT room_id, event, rank() OVER (
 			PARTITION BY room_id ORDER BY event_nid DESC
-		) FROM syncv3_events INNER JOIN ` + tempTableName + ` ON membership_nid=event_nid WHERE (
+		) AS rank FROM syncv3_events INNER JOIN ` + tempTableName + ` ON membership_nid=event_nid WHERE (
 			membership='join' OR membership='invite' OR membership='_join'
 		) AND event_type='m.room.member'
 	) rf WHERE rank <= 6;`)
@@ -283,7 +417,12 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 		})
 		result[roomID] = metadata
 	}
-	roomInfos, err := s.Accumulator.roomsTable.SelectRoomInfos(txn)
+	var roomInfos []RoomInfo
+	if roomIDs == nil {
+		roomInfos, err = s.Accumulator.roomsTable.SelectRoomInfos(txn)
+	} else {
+		roomInfos, err = s.Accumulator.roomsTable.SelectRoomInfosForRooms(txn, roomIDs)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to select room infos: %s", err)
 	}
@@ -322,14 +461,35 @@ func (s *Storage) MetadataForAllRooms(txn *sqlx.Tx, tempTableName string, result
 // Returns all current NOT MEMBERSHIP state events matching the event types given in all rooms. Returns a map of
 // room ID to events in that room.
 func (s *Storage) currentNotMembershipStateEventsInAllRooms(txn *sqlx.Tx, eventTypes []string) (map[string][]Event, error) {
-	query, args, err := sqlx.In(
-		`SELECT syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
+	return s.currentNotMembershipStateEventsInRooms(txn, nil, eventTypes)
+}
+
+// Like currentNotMembershipStateEventsInAllRooms but only for the given rooms, or all rooms if roomIDs is nil.
+func (s *Storage) currentNotMembershipStateEventsInRooms(txn *sqlx.Tx, roomIDs, eventTypes []string) (map[string][]Event, error) {
+	var query string
+	var args []interface{}
+	var err error
+	if roomIDs == nil {
+		query, args, err = sqlx.In(
+			`SELECT syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
 		WHERE syncv3_events.event_type IN (?)
 		AND syncv3_events.event_nid IN (
-			SELECT unnest(events) FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id IN (SELECT current_snapshot_id FROM syncv3_rooms)
+			`+unnestSnapshots(txn, "events")+` WHERE syncv3_snapshots.snapshot_id IN (SELECT current_snapshot_id FROM syncv3_rooms)
 		)`,
-		eventTypes,
-	)
+			eventTypes,
+		)
+	} else {
+		query, args, err = sqlx.In(
+			`SELECT syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
+		WHERE syncv3_events.event_type IN (?)
+		AND syncv3_events.event_nid IN (
+			`+unnestSnapshots(txn, "events")+` WHERE syncv3_snapshots.snapshot_id IN (
+				SELECT current_snapshot_id FROM syncv3_rooms WHERE room_id IN (?)
+			)
+		)`,
+			eventTypes, roomIDs,
+		)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -428,7 +588,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 				fastNIDs = append(fastNIDs, latestNID)
 			}
 		}
-		latestEvents, err := s.Accumulator.eventsTable.SelectByNIDs(txn, true, fastNIDs)
+		latestEvents, err := s.Accumulator.eventsTable.SelectByNIDsInRooms(txn, true, roomIDs, fastNIDs)
 		if err != nil {
 			return fmt.Errorf("failed to select latest nids in rooms %v: %s", roomIDs, err)
 		}
@@ -487,7 +647,7 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 						}
 					}
 				}
-				events, err := s.Accumulator.eventsTable.SelectByNIDs(txn, true, allStateEventNIDs)
+				events, err := s.Accumulator.eventsTable.SelectByNIDsInRooms(txn, true, []string{ev.RoomID}, allStateEventNIDs)
 				if err != nil {
 					return fmt.Errorf("failed to select state snapshot %v for room %v: %s", ev.BeforeStateSnapshotID, ev.RoomID, err)
 				}
@@ -518,26 +678,20 @@ func (s *Storage) RoomStateAfterEventPosition(ctx context.Context, roomIDs []str
 			for i := range latestEvents {
 				snapIDs[i] = latestEvents[i].BeforeStateSnapshotID
 			}
-			args = append(args, pq.Int64Array(snapIDs))
+			args = append(args, pq.Int64Array(snapIDs), pq.StringArray(roomIDs))
 
 			// figure out which state events to look at - if there is no m.room.member filter we can be super fast
-			nidcols := "unnest(array_cat(events, membership_events))"
+			nidcols := "array_cat(events, membership_events)"
 			if hasMembershipFilter && !hasOtherFilter {
-				nidcols = "unnest(membership_events)"
+				nidcols = "membership_events"
 			} else if !hasMembershipFilter && hasOtherFilter {
-				nidcols = "unnest(events)"
+				nidcols = "events"
 			}
 			// it's not possible for there to be no membership filter and no other filter, we wouldn't be executing this code
 			// it is possible to have both, so neither if will execute.
 
 			// Similar to CurrentStateEventsInAllRooms
-			query, args, err := sqlx.In(
-				`SELECT syncv3_events.event_nid, syncv3_events.room_id, syncv3_events.event_type, syncv3_events.state_key, syncv3_events.event FROM syncv3_events
-				WHERE (`+strings.Join(wheres, " OR ")+`) AND syncv3_events.event_nid IN (
-					SELECT `+nidcols+` FROM syncv3_snapshots WHERE syncv3_snapshots.snapshot_id = ANY(?)
-				) ORDER BY syncv3_events.event_nid ASC`,
-				args...,
-			)
+			query, args, err := sqlx.In(roomStateAfterEventPositionSQL(txn, wheres, nidcols), args...)
 			if err != nil {
 				return fmt.Errorf("failed to form sql query: %s", err)
 			}
@@ -591,49 +745,36 @@ func (s *Storage) LatestEventsInRooms(userID string, roomIDs []string, to int64,
 	if err != nil {
 		return nil, err
 	}
-	result := make(map[string]*LatestEvents, len(roomIDs))
+	result := make(map[string]*LatestEvents, len(roomIDToRanges))
 	err = sqlutil.WithTransaction(s.Accumulator.db, func(txn *sqlx.Tx) error {
-		for roomID, ranges := range roomIDToRanges {
-			var earliestEventNID int64
-			var latestEventNID int64
-			var roomEvents []json.RawMessage
-			// start at the most recent range as we want to return the most recent `limit` events
-			for i := len(ranges) - 1; i >= 0; i-- {
-				if len(roomEvents) >= limit {
-					break
-				}
-				r := ranges[i]
-				// the most recent event will be first
-				events, err := s.EventsTable.SelectLatestEventsBetween(txn, roomID, r[0]-1, r[1], limit)
-				if err != nil {
-					return fmt.Errorf("room %s failed to SelectEventsBetween: %s", roomID, err)
-				}
-				// keep pushing to the front so we end up with A,B,C
-				for _, ev := range events {
-					if latestEventNID == 0 { // set first time and never again
-						latestEventNID = ev.NID
-					}
-					roomEvents = append([]json.RawMessage{ev.JSON}, roomEvents...)
-					earliestEventNID = ev.NID
-					if len(roomEvents) >= limit {
-						break
-					}
-				}
-			}
-			latestEvents := LatestEvents{
-				LatestNID: latestEventNID,
-				Timeline:  roomEvents,
-			}
-			if earliestEventNID != 0 {
-				// the oldest event needs a prev batch token, so find one now
-				prevBatch, err := s.EventsTable.SelectClosestPrevBatch(txn, roomID, earliestEventNID)
-				if err != nil {
-					return fmt.Errorf("failed to select prev_batch for room %s : %s", roomID, err)
+		// load the timelines for every room at once, as this is called for hundreds of rooms on initial syncs
+		roomIDToEvents, err := s.EventsTable.SelectLatestEventsInRanges(txn, roomIDToRanges, limit)
+		if err != nil {
+			return fmt.Errorf("failed to SelectLatestEventsInRanges: %s", err)
+		}
+		earliestEventNIDs := make(map[string]int64, len(roomIDToEvents))
+		for roomID := range roomIDToRanges {
+			// the most recent event is first
+			events := roomIDToEvents[roomID]
+			var latestEvents LatestEvents
+			if len(events) > 0 {
+				latestEvents.LatestNID = events[0].NID
+				latestEvents.Timeline = make([]json.RawMessage, len(events))
+				for i, ev := range events {
+					latestEvents.Timeline[len(events)-1-i] = ev.JSON
 				}
-				latestEvents.PrevBatch = prevBatch
+				// the oldest event needs a prev batch token
+				earliestEventNIDs[roomID] = events[len(events)-1].NID
 			}
 			result[roomID] = &latestEvents
 		}
+		prevBatches, err := s.EventsTable.SelectClosestPrevBatchInRooms(txn, earliestEventNIDs)
+		if err != nil {
+			return fmt.Errorf("failed to select prev_batches: %s", err)
+		}
+		for roomID, prevBatch := range prevBatches {
+			result[roomID].PrevBatch = prevBatch
+		}
 		return nil
 	})
 	return result, err
@@ -543,7 +543,7 @@ func TestStorageLatestEventsInRoomsPrevBatch(t *testing.T) {
 	t.Logf("events: %v", eventIDs)
 	var idsToNIDs map[string]int64
 	sqlutil.WithTransaction(store.EventsTable.db, func(txn *sqlx.Tx) error {
-		idsToNIDs, err = store.EventsTable.SelectNIDsByIDs(txn, eventIDs)
+		idsToNIDs, err = store.EventsTable.SelectNIDsByIDs(txn, roomID, eventIDs)
 		if err != nil {
 			t.Fatalf("failed to get nids for events: %s", err)
 		}
@@ -685,6 +685,26 @@ func TestGlobalSnapshot(t *testing.T) {
 	for roomID, want := range wantMetadata {
 		assertRoomMetadata(t, snapshot.GlobalMetadata[roomID], want)
 	}
+
+	// loading a subset of rooms gives the same metadata, and skips unknown rooms
+	subset, err := store.MetadataForRooms([]string{roomAliceBob, roomSpace, "!unknown"})
+	assertNoError(t, err)
+	if len(subset) != 2 {
+		t.Fatalf("MetadataForRooms: got %d rooms, want 2", len(subset))
+	}
+	for _, roomID := range []string{roomAliceBob, roomSpace} {
+		assertRoomMetadata(t, subset[roomID], wantMetadata[roomID])
+	}
+
+	// the snapshot without metadata still includes joined members
+	snapshot, err = store.GlobalSnapshotWithoutMetadata()
+	assertNoError(t, err)
+	if !reflect.DeepEqual(snapshot.AllJoinedMembers, wantJoinedMembers) {
+		t.Errorf("Snapshot.AllJoinedMembers:\ngot:  %+v\nwant: %+v", snapshot.AllJoinedMembers, wantJoinedMembers)
+	}
+	if len(snapshot.GlobalMetadata) != 0 {
+		t.Errorf("GlobalSnapshotWithoutMetadata: got metadata for %d rooms, want none", len(snapshot.GlobalMetadata))
+	}
 }
 
 func cleanDB(t *testing.T) error {
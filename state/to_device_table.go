@@ -42,11 +42,11 @@ func (c ToDeviceRowChunker) Subslice(i, j int) sqlutil.Chunker {
 }
 
 func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
+	dialect := sqlutil.DialectOf(db)
 	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_to_device_messages_seq;
+	db.MustExec(dialect.CreateSequence("syncv3_to_device_messages_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_messages (
-		position BIGINT NOT NULL PRIMARY KEY DEFAULT nextval('syncv3_to_device_messages_seq'),
+		` + dialect.SerialPrimaryKey("position", "syncv3_to_device_messages_seq") + `,
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
 		event_type TEXT NOT NULL,
@@ -59,8 +59,8 @@ func NewToDeviceTable(db *sqlx.DB) *ToDeviceTable {
 	CREATE TABLE IF NOT EXISTS syncv3_to_device_ack_pos (
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
-		PRIMARY KEY (user_id, device_id),
-		unack_pos BIGINT NOT NULL
+		unack_pos BIGINT NOT NULL,
+		PRIMARY KEY (user_id, device_id)
 	);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_device_idx ON syncv3_to_device_messages(device_id);
 	CREATE INDEX IF NOT EXISTS syncv3_to_device_messages_ukey_idx ON syncv3_to_device_messages(unique_key, device_id);
@@ -167,7 +167,7 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 		if len(cancels) > 0 {
 			var cancelled []string
 			// delete action: request events which have the same unique key, for this device inbox, only if they are not sent to the client already (unacked)
-			err = txn.Select(&cancelled, `DELETE FROM syncv3_to_device_messages WHERE unique_key = ANY($1) AND user_id = $2 AND device_id = $3 AND position > $4 RETURNING unique_key`,
+			err = txn.Select(&cancelled, `DELETE FROM syncv3_to_device_messages WHERE `+sqlutil.DialectOf(txn).InArray("unique_key", "$1")+` AND user_id = $2 AND device_id = $3 AND position > $4 RETURNING unique_key`,
 				pq.StringArray(cancels), userID, deviceID, unackPos)
 			if err != nil {
 				return fmt.Errorf("failed to delete cancelled events: %s", err)
@@ -201,7 +201,7 @@ func (t *ToDeviceTable) InsertMessages(userID, deviceID string, msgs []json.RawM
 			return nil
 		}
 
-		chunks := sqlutil.Chunkify(7, MaxPostgresParameters, ToDeviceRowChunker(rows))
+		chunks := sqlutil.Chunkify(7, sqlutil.DialectOf(txn).MaxParameters(), ToDeviceRowChunker(rows))
 		for _, chunk := range chunks {
 			result, err := txn.NamedQuery(`INSERT INTO syncv3_to_device_messages (user_id, device_id, message, event_type, sender, action, unique_key)
         VALUES (:user_id, :device_id, :message, :event_type, :sender, :action, :unique_key) RETURNING position`, chunk)
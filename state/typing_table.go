@@ -5,6 +5,7 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 )
 
 // TypingTable stores who is currently typing
@@ -16,12 +17,11 @@ type TypingTable struct {
 
 func NewTypingTable(db *sqlx.DB) *TypingTable {
 	// make sure tables are made
-	db.MustExec(`
-	CREATE SEQUENCE IF NOT EXISTS syncv3_typing_seq;
+	db.MustExec(sqlutil.DialectOf(db).CreateSequence("syncv3_typing_seq") + `
 	CREATE TABLE IF NOT EXISTS syncv3_typing (
-		stream_id BIGINT NOT NULL DEFAULT nextval('syncv3_typing_seq'),
+		stream_id BIGINT NOT NULL,
 		room_id TEXT NOT NULL PRIMARY KEY,
-		user_ids TEXT[] NOT NULL
+		user_ids ` + sqlutil.DialectOf(db).ArrayType("TEXT") + ` NOT NULL
 	);
 	`)
 	return &TypingTable{db}
@@ -42,11 +42,17 @@ func (t *TypingTable) SetTyping(roomID string, userIDs []string) (position int64
 	if userIDs == nil {
 		userIDs = []string{}
 	}
-	err = t.db.QueryRow(`
-		INSERT INTO syncv3_typing(room_id, user_ids) VALUES($1, $2)
-		ON CONFLICT (room_id) DO UPDATE SET user_ids = $2, stream_id = nextval('syncv3_typing_seq') RETURNING stream_id`,
-		roomID, pq.Array(userIDs),
-	).Scan(&position)
+	err = sqlutil.WithTransaction(t.db, func(txn *sqlx.Tx) error {
+		streamIDs, err := sqlutil.DialectOf(txn).NextVals(txn, "syncv3_typing_seq", 1)
+		if err != nil {
+			return err
+		}
+		return txn.QueryRow(`
+		INSERT INTO syncv3_typing(room_id, user_ids, stream_id) VALUES($1, $2, $3)
+		ON CONFLICT (room_id) DO UPDATE SET user_ids = $2, stream_id = $3 RETURNING stream_id`,
+			roomID, pq.Array(userIDs), streamIDs[0],
+		).Scan(&position)
+	})
 	return position, err
 }
 
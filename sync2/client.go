@@ -1,14 +1,16 @@
 package sync2
 
 import (
+	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sync"
 
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
 )
 
@@ -22,7 +24,24 @@ type Client interface {
 	// endpoint. The response must contain a device ID (meaning that we assume the
 	// homeserver supports Matrix >= 1.1.)
 	WhoAmI(accessToken string) (userID, deviceID string, err error)
-	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool) (*SyncResponse, int, error)
+	// DoSyncV2 performs a sync v2 request. The room data returned is restricted by roomFilter.
+	// If setPresence is non-empty, it is sent as the v2 `set_presence` parameter.
+	DoSyncV2(ctx context.Context, accessToken, since string, isFirst bool, toDeviceOnly bool, roomFilter RoomFilter, setPresence string) (*SyncResponse, int, error)
+}
+
+// RoomFilter restricts the room data returned by a sync v2 request. The zero value returns
+// data for all rooms.
+type RoomFilter struct {
+	// If non-empty, only data for these rooms is returned.
+	Rooms []string
+	// The timelines of these rooms are not returned.
+	NotTimelineRooms []string
+	// If true, global account data and presence are not returned.
+	OnlyRooms bool
+}
+
+func (f RoomFilter) isEmpty() bool {
+	return len(f.Rooms) == 0 && len(f.NotTimelineRooms) == 0 && !f.OnlyRooms
 }
 
 // HTTPClient represents a Sync v2 Client.
@@ -30,6 +49,63 @@ type Client interface {
 type HTTPClient struct {
 	Client            *http.Client
 	DestinationServer string
+
+	// Filters with room lists can be too large to send in the URL, so they are uploaded instead.
+	// This maps PollerID => filter JSON => filter ID.
+	filtersMu sync.Mutex
+	filters   map[PollerID]*filterCache
+}
+
+// The number of uploaded filter IDs to remember for each device. Excluded rooms change as pollers
+// come and go, so the least recently used filters are forgotten rather than kept forever.
+const maxFiltersPerDevice = 8
+
+// filterCache maps filter JSON to uploaded filter IDs, evicting the least recently used filter when
+// full. Not thread-safe.
+type filterCache struct {
+	// Elements are *filterCacheEntry, most recently used first.
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+type filterCacheEntry struct {
+	filter   string
+	filterID string
+}
+
+func newFilterCache() *filterCache {
+	return &filterCache{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// get returns the ID of this filter, marking it as the most recently used. Safe to call on a nil cache.
+func (c *filterCache) get(filter string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	el, ok := c.elements[filter]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*filterCacheEntry).filterID, true
+}
+
+// add remembers the ID of this filter, evicting the least recently used filter if the cache is full.
+func (c *filterCache) add(filter, filterID string) {
+	if el, ok := c.elements[filter]; ok {
+		el.Value.(*filterCacheEntry).filterID = filterID
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.order.Len() >= maxFiltersPerDevice {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.elements, oldest.Value.(*filterCacheEntry).filter)
+	}
+	c.elements[filter] = c.order.PushFront(&filterCacheEntry{filter: filter, filterID: filterID})
 }
 
 // Return sync2.HTTP401 if this request returns 401
@@ -61,8 +137,17 @@ func (v *HTTPClient) WhoAmI(accessToken string) (string, string, error) {
 
 // DoSyncV2 performs a sync v2 request. Returns the sync response and the response status code
 // or an error. Set isFirst=true on the first sync to force a timeout=0 sync to ensure snapiness.
-func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
-	syncURL := v.createSyncURL(since, isFirst, toDeviceOnly)
+func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool, roomFilter RoomFilter, setPresence string) (*SyncResponse, int, error) {
+	filter := createSyncFilter(since, toDeviceOnly, roomFilter)
+	if !roomFilter.isEmpty() {
+		// room lists can be thousands of rooms long, which would exceed URL length limits
+		filterID, statusCode, err := v.filterID(ctx, accessToken, filter)
+		if err != nil {
+			return nil, statusCode, fmt.Errorf("DoSyncV2: %w", err)
+		}
+		filter = filterID
+	}
+	syncURL := v.createSyncURL(since, isFirst, filter, setPresence)
 	req, err := http.NewRequest("GET", syncURL, nil)
 	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
 	req.Header.Set("Authorization", "Bearer "+accessToken)
@@ -85,17 +170,59 @@ func (v *HTTPClient) DoSyncV2(ctx context.Context, accessToken, since string, is
 	}
 }
 
-func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) string {
-	qps := "?"
-	if isFirst { // first time polling for v2-sync in this process
-		qps += "timeout=0"
-	} else {
-		qps += "timeout=30000"
+// filterID returns the ID of this filter, uploading it if it has not been uploaded for this
+// device before. The device is taken from the context, as filters belong to users.
+func (v *HTTPClient) filterID(ctx context.Context, accessToken, filter string) (string, int, error) {
+	pid, ok := pollerIDFromContext(ctx)
+	if !ok {
+		return "", 0, fmt.Errorf("cannot upload filter: no device for request")
 	}
-	if since != "" {
-		qps += "&since=" + since
+	v.filtersMu.Lock()
+	filterID, ok := v.filters[pid].get(filter)
+	v.filtersMu.Unlock()
+	if ok {
+		return filterID, 200, nil
 	}
 
+	filterURL := v.DestinationServer + "/_matrix/client/r0/user/" + url.PathEscape(pid.UserID) + "/filter"
+	req, err := http.NewRequest("POST", filterURL, bytes.NewBufferString(filter))
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot upload filter: %w", err)
+	}
+	req.Header.Set("User-Agent", "sync-v3-proxy-"+ProxyVersion)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := v.Client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot upload filter: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", res.StatusCode, fmt.Errorf("cannot upload filter: response returned %s", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("cannot upload filter: %w", err)
+	}
+	filterID = gjson.GetBytes(body, "filter_id").Str
+	if filterID == "" {
+		return "", 0, fmt.Errorf("cannot upload filter: response has no filter_id")
+	}
+
+	v.filtersMu.Lock()
+	defer v.filtersMu.Unlock()
+	if v.filters == nil {
+		v.filters = make(map[PollerID]*filterCache)
+	}
+	if v.filters[pid] == nil {
+		v.filters[pid] = newFilterCache()
+	}
+	v.filters[pid].add(filter, filterID)
+	return filterID, 200, nil
+}
+
+// createSyncFilter returns the filter JSON to use for a sync v2 request.
+func createSyncFilter(since string, toDeviceOnly bool, roomFilter RoomFilter) string {
 	// To reduce the likelihood of a gappy v2 sync, ask for a large timeline by default.
 	// Synapse's default is 10; 50 is the maximum allowed, by my reading of
 	// https://github.com/matrix-org/synapse/blob/89a71e73905ffa1c97ae8be27d521cd2ef3f3a0c/synapse/handlers/sync.py#L576-L577
@@ -107,27 +234,54 @@ func (v *HTTPClient) createSyncURL(since string, isFirst, toDeviceOnly bool) str
 		timelineLimit = 1
 	}
 	room := map[string]interface{}{}
-	room["timeline"] = map[string]interface{}{"limit": timelineLimit}
+	timeline := map[string]interface{}{"limit": timelineLimit}
+	if len(roomFilter.NotTimelineRooms) > 0 {
+		// another poller is fetching the timelines for these rooms
+		timeline["not_rooms"] = roomFilter.NotTimelineRooms
+	}
+	room["timeline"] = timeline
 
 	if toDeviceOnly {
 		// no rooms match this filter, so we get everything but room data
 		room["rooms"] = []string{}
+	} else if len(roomFilter.Rooms) > 0 {
+		room["rooms"] = roomFilter.Rooms
 	}
 	filter := map[string]interface{}{
 		"room": room,
 	}
+	if roomFilter.OnlyRooms {
+		filter["account_data"] = map[string]interface{}{"types": []string{}}
+		filter["presence"] = map[string]interface{}{"types": []string{}}
+	}
 	filterJSON, _ := json.Marshal(filter)
-	qps += "&filter=" + url.QueryEscape(string(filterJSON))
+	return string(filterJSON)
+}
+
+// createSyncURL returns the URL for a sync v2 request. The filter is either filter JSON or the
+// ID of an uploaded filter.
+func (v *HTTPClient) createSyncURL(since string, isFirst bool, filter string, setPresence string) string {
+	qps := "?"
+	if isFirst { // first time polling for v2-sync in this process
+		qps += "timeout=0"
+	} else {
+		qps += "timeout=30000"
+	}
+	if since != "" {
+		qps += "&since=" + since
+	}
+	if setPresence != "" {
+		qps += "&set_presence=" + url.QueryEscape(setPresence)
+	}
+	qps += "&filter=" + url.QueryEscape(filter)
 
 	return v.DestinationServer + "/_matrix/client/r0/sync" + qps
 }
 
 type SyncResponse struct {
-	NextBatch   string         `json:"next_batch"`
-	AccountData EventsResponse `json:"account_data"`
-	Presence    struct {
-		Events []gomatrixserverlib.ClientEvent `json:"events,omitempty"`
-	} `json:"presence"`
+	NextBatch   string            `json:"next_batch"`
+	AccountData EventsResponse    `json:"account_data"`
+	Presence    EventsResponse    `json:"presence"`
 	Rooms       SyncRoomsResponse `json:"rooms"`
 	ToDevice    EventsResponse    `json:"to_device"`
 	DeviceLists struct {
@@ -142,6 +296,7 @@ type SyncRoomsResponse struct {
 	Join   map[string]SyncV2JoinResponse   `json:"join"`
 	Invite map[string]SyncV2InviteResponse `json:"invite"`
 	Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
+	Knock  map[string]SyncV2KnockResponse  `json:"knock"`
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' or 'peek' key.
@@ -173,6 +328,11 @@ type SyncV2InviteResponse struct {
 	InviteState EventsResponse `json:"invite_state"`
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type SyncV2KnockResponse struct {
+	KnockState EventsResponse `json:"knock_state"`
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type SyncV2LeaveResponse struct {
 	State struct {
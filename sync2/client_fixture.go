@@ -0,0 +1,277 @@
+package sync2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FixtureResponse is a single captured sync v2 response, along with the since token which was
+// used to request it.
+type FixtureResponse struct {
+	Since    string       `json:"since"`
+	Response SyncResponse `json:"response"`
+}
+
+// FixtureClient is a Client which replays previously captured sync v2 responses rather than
+// talking to a homeserver. This allows entire scenarios to be run without a live homeserver.
+//
+// Responses are looked up by the since token in the request, so pollers will walk through the
+// captured responses in order. Once a device has no more responses, requests block for
+// ExhaustedTimeout (mirroring a long-poll which timed out) and return an empty response with
+// the same since token.
+type FixtureClient struct {
+	// How long to block when there are no more responses for a device. Defaults to 30s.
+	ExhaustedTimeout time.Duration
+
+	mu        *sync.Mutex
+	tokens    map[string]PollerID // access_token => device
+	fixtures  map[PollerID]map[string]SyncResponse
+	exhausted map[PollerID]bool
+}
+
+type fixtureToken struct {
+	UserID   string `json:"user_id"`
+	DeviceID string `json:"device_id"`
+}
+
+// NewFixtureClient makes a FixtureClient with no fixtures loaded.
+func NewFixtureClient() *FixtureClient {
+	return &FixtureClient{
+		ExhaustedTimeout: 30 * time.Second,
+		mu:               &sync.Mutex{},
+		tokens:           make(map[string]PollerID),
+		fixtures:         make(map[PollerID]map[string]SyncResponse),
+		exhausted:        make(map[PollerID]bool),
+	}
+}
+
+// NewFixtureClientFromDir loads fixtures from a directory with the following layout:
+//
+//	tokens.json                     - {"$access_token": {"user_id":"@alice:localhost","device_id":"ALICE"}}
+//	@alice:localhost/ALICE/0.json   - the response to the initial sync (since="")
+//	@alice:localhost/ALICE/1.json   - the response to a sync with since=0.json's next_batch
+//	...
+//
+// Each numbered file contains a single sync v2 response body.
+func NewFixtureClientFromDir(dir string) (*FixtureClient, error) {
+	tokensJSON, err := os.ReadFile(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		return nil, fmt.Errorf("NewFixtureClientFromDir: failed to read tokens: %w", err)
+	}
+	var tokens map[string]fixtureToken
+	if err = json.Unmarshal(tokensJSON, &tokens); err != nil {
+		return nil, fmt.Errorf("NewFixtureClientFromDir: failed to parse tokens: %w", err)
+	}
+	c := NewFixtureClient()
+	for accessToken, t := range tokens {
+		pid := PollerID{UserID: t.UserID, DeviceID: t.DeviceID}
+		responses, err := readFixtureResponses(filepath.Join(dir, t.UserID, t.DeviceID))
+		if err != nil {
+			return nil, fmt.Errorf("NewFixtureClientFromDir: device %+v: %w", pid, err)
+		}
+		c.AddDevice(accessToken, pid)
+		c.AddResponses(pid, responses...)
+	}
+	return c, nil
+}
+
+// readFixtureResponses reads numbered response files in a device directory, chaining since
+// tokens from one response to the next.
+func readFixtureResponses(dir string) ([]FixtureResponse, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	indexToName := make(map[int]string)
+	var indexes []int
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil {
+			return nil, fmt.Errorf("fixture file %s is not numbered", e.Name())
+		}
+		indexToName[i] = e.Name()
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	responses := make([]FixtureResponse, 0, len(indexes))
+	since := ""
+	for _, i := range indexes {
+		body, err := os.ReadFile(filepath.Join(dir, indexToName[i]))
+		if err != nil {
+			return nil, err
+		}
+		var res SyncResponse
+		if err = json.Unmarshal(body, &res); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", indexToName[i], err)
+		}
+		responses = append(responses, FixtureResponse{
+			Since:    since,
+			Response: res,
+		})
+		since = res.NextBatch
+	}
+	return responses, nil
+}
+
+// AddDevice associates an access token with a device.
+func (c *FixtureClient) AddDevice(accessToken string, pid PollerID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[accessToken] = pid
+}
+
+// AddResponses adds captured responses for this device. If a response already exists for the
+// same since token, it is replaced.
+func (c *FixtureClient) AddResponses(pid PollerID, responses ...FixtureResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sinceToRes := c.fixtures[pid]
+	if sinceToRes == nil {
+		sinceToRes = make(map[string]SyncResponse)
+		c.fixtures[pid] = sinceToRes
+	}
+	for _, r := range responses {
+		sinceToRes[r.Since] = r.Response
+	}
+}
+
+// NumExhausted returns the number of devices which have requested past the end of their responses.
+func (c *FixtureClient) NumExhausted() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.exhausted)
+}
+
+// Exhausted returns true if this device has requested past the end of its responses.
+func (c *FixtureClient) Exhausted(pid PollerID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exhausted[pid]
+}
+
+// Return sync2.HTTP401 if this access token is not known.
+func (c *FixtureClient) WhoAmI(accessToken string) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pid, ok := c.tokens[accessToken]
+	if !ok {
+		return "", "", HTTP401
+	}
+	return pid.UserID, pid.DeviceID, nil
+}
+
+// DoSyncV2 returns the captured response for this since token. If toDeviceOnly or roomFilter
+// are set, data is stripped from the response to mirror the filter which would be sent to the
+// homeserver.
+func (c *FixtureClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool, roomFilter RoomFilter, setPresence string) (*SyncResponse, int, error) {
+	c.mu.Lock()
+	pid, ok := c.tokens[accessToken]
+	if !ok {
+		c.mu.Unlock()
+		return nil, 401, fmt.Errorf("DoSyncV2: response returned 401 Unauthorized")
+	}
+	res, ok := c.fixtures[pid][since]
+	if !ok {
+		c.exhausted[pid] = true
+	}
+	c.mu.Unlock()
+	if !ok {
+		// no more data for this device: behave like a long-poll which timed out.
+		if !isFirst {
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.ExhaustedTimeout):
+			}
+		}
+		return &SyncResponse{NextBatch: since}, 200, nil
+	}
+	if toDeviceOnly {
+		res.Rooms = SyncRoomsResponse{}
+	}
+	if !roomFilter.isEmpty() {
+		res.Rooms = filterFixtureRooms(res.Rooms, roomFilter)
+		if roomFilter.OnlyRooms {
+			res.AccountData = EventsResponse{}
+			res.Presence = EventsResponse{}
+		}
+	}
+	return &res, 200, nil
+}
+
+// filterFixtureRooms returns the rooms which match this filter, copying the maps so the fixture is
+// not modified. Like a homeserver, the room list applies to every section, and excluded timelines
+// apply to both joined and left rooms.
+func filterFixtureRooms(rooms SyncRoomsResponse, roomFilter RoomFilter) SyncRoomsResponse {
+	var wantRooms map[string]struct{}
+	if len(roomFilter.Rooms) > 0 {
+		wantRooms = make(map[string]struct{}, len(roomFilter.Rooms))
+		for _, roomID := range roomFilter.Rooms {
+			wantRooms[roomID] = struct{}{}
+		}
+	}
+	included := func(roomID string) bool {
+		if wantRooms == nil {
+			return true
+		}
+		_, ok := wantRooms[roomID]
+		return ok
+	}
+	notTimelineRooms := make(map[string]struct{}, len(roomFilter.NotTimelineRooms))
+	for _, roomID := range roomFilter.NotTimelineRooms {
+		notTimelineRooms[roomID] = struct{}{}
+	}
+
+	var result SyncRoomsResponse
+	if len(rooms.Join) > 0 {
+		result.Join = make(map[string]SyncV2JoinResponse, len(rooms.Join))
+		for roomID, roomData := range rooms.Join {
+			if !included(roomID) {
+				continue
+			}
+			if _, ok := notTimelineRooms[roomID]; ok {
+				roomData.Timeline = TimelineResponse{}
+			}
+			result.Join[roomID] = roomData
+		}
+	}
+	if len(rooms.Leave) > 0 {
+		result.Leave = make(map[string]SyncV2LeaveResponse, len(rooms.Leave))
+		for roomID, roomData := range rooms.Leave {
+			if !included(roomID) {
+				continue
+			}
+			if _, ok := notTimelineRooms[roomID]; ok {
+				roomData.Timeline = SyncV2LeaveResponse{}.Timeline
+			}
+			result.Leave[roomID] = roomData
+		}
+	}
+	if len(rooms.Invite) > 0 {
+		result.Invite = make(map[string]SyncV2InviteResponse, len(rooms.Invite))
+		for roomID, roomData := range rooms.Invite {
+			if included(roomID) {
+				result.Invite[roomID] = roomData
+			}
+		}
+	}
+	if len(rooms.Knock) > 0 {
+		result.Knock = make(map[string]SyncV2KnockResponse, len(rooms.Knock))
+		for roomID, roomData := range rooms.Knock {
+			if included(roomID) {
+				result.Knock[roomID] = roomData
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,149 @@
+package sync2
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFixtureClientFromDir(t *testing.T) {
+	dir := t.TempDir()
+	alice := "@alice:localhost"
+	aliceDevice := "ALICE"
+	writeJSON := func(path string, v interface{}) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll: %s", err)
+		}
+		b, _ := json.Marshal(v)
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+	writeJSON(filepath.Join(dir, "tokens.json"), map[string]fixtureToken{
+		"alice_token": {UserID: alice, DeviceID: aliceDevice},
+	})
+	roomResponse := SyncResponse{
+		NextBatch: "s1",
+		Rooms: SyncRoomsResponse{
+			Join: map[string]SyncV2JoinResponse{
+				"!a:localhost": {
+					Timeline: TimelineResponse{
+						Events: []json.RawMessage{json.RawMessage(`{"type":"m.room.message","event_id":"$a"}`)},
+					},
+				},
+			},
+		},
+	}
+	writeJSON(filepath.Join(dir, alice, aliceDevice, "0.json"), roomResponse)
+	writeJSON(filepath.Join(dir, alice, aliceDevice, "1.json"), SyncResponse{NextBatch: "s2"})
+
+	client, err := NewFixtureClientFromDir(dir)
+	if err != nil {
+		t.Fatalf("NewFixtureClientFromDir: %s", err)
+	}
+	client.ExhaustedTimeout = time.Millisecond
+
+	userID, deviceID, err := client.WhoAmI("alice_token")
+	if err != nil {
+		t.Fatalf("WhoAmI: %s", err)
+	}
+	assertEqual(t, userID, alice, "WhoAmI user_id mismatch")
+	assertEqual(t, deviceID, aliceDevice, "WhoAmI device_id mismatch")
+	if _, _, err = client.WhoAmI("unknown_token"); err != HTTP401 {
+		t.Fatalf("WhoAmI with unknown token: got %v want HTTP401", err)
+	}
+
+	ctx := context.Background()
+	testCases := []struct {
+		since        string
+		toDeviceOnly bool
+		wantNext     string
+		wantRooms    int
+	}{
+		{since: "", wantNext: "s1", wantRooms: 1},
+		{since: "", toDeviceOnly: true, wantNext: "s1", wantRooms: 0},
+		{since: "s1", wantNext: "s2", wantRooms: 0},
+		{since: "s2", wantNext: "s2", wantRooms: 0}, // exhausted
+	}
+	for i, tc := range testCases {
+		res, code, err := client.DoSyncV2(ctx, "alice_token", tc.since, false, tc.toDeviceOnly, RoomFilter{}, "")
+		if err != nil {
+			t.Fatalf("Case %d: DoSyncV2 returned error: %s", i, err)
+		}
+		if code != 200 {
+			t.Errorf("Case %d: got status %d want 200", i, code)
+		}
+		if res.NextBatch != tc.wantNext {
+			t.Errorf("Case %d: got next_batch %v want %v", i, res.NextBatch, tc.wantNext)
+		}
+		if len(res.Rooms.Join) != tc.wantRooms {
+			t.Errorf("Case %d: got %d joined rooms want %d", i, len(res.Rooms.Join), tc.wantRooms)
+		}
+	}
+
+	_, code, err := client.DoSyncV2(ctx, "unknown_token", "", false, false, RoomFilter{}, "")
+	if err == nil || code != 401 {
+		t.Errorf("DoSyncV2 with unknown token: got %d %v want 401 error", code, err)
+	}
+}
+
+func TestFixtureClientRoomFilter(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "ALICE"}
+	timeline := []json.RawMessage{json.RawMessage(`{"type":"m.room.message","event_id":"$a"}`)}
+	var leave SyncV2LeaveResponse
+	leave.Timeline.Events = timeline
+	res := SyncResponse{
+		NextBatch:   "s1",
+		AccountData: EventsResponse{Events: []json.RawMessage{json.RawMessage(`{"type":"m.direct"}`)}},
+		Rooms: SyncRoomsResponse{
+			Join: map[string]SyncV2JoinResponse{
+				"!join:localhost":  {Timeline: TimelineResponse{Events: timeline}},
+				"!other:localhost": {Timeline: TimelineResponse{Events: timeline}},
+			},
+			Invite: map[string]SyncV2InviteResponse{
+				"!invite:localhost": {},
+				"!other2:localhost": {},
+			},
+			Leave: map[string]SyncV2LeaveResponse{
+				"!leave:localhost":  leave,
+				"!other3:localhost": {},
+			},
+		},
+	}
+	client := NewFixtureClient()
+	client.AddDevice("alice_token", pid)
+	client.AddResponses(pid, FixtureResponse{Response: res})
+
+	ctx := context.Background()
+	roomFilter := RoomFilter{
+		Rooms:            []string{"!join:localhost", "!invite:localhost", "!leave:localhost"},
+		NotTimelineRooms: []string{"!join:localhost", "!leave:localhost"},
+		OnlyRooms:        true,
+	}
+	got, _, err := client.DoSyncV2(ctx, "alice_token", "", false, false, roomFilter, "")
+	if err != nil {
+		t.Fatalf("DoSyncV2: %s", err)
+	}
+	if len(got.Rooms.Join) != 1 || len(got.Rooms.Invite) != 1 || len(got.Rooms.Leave) != 1 {
+		t.Fatalf("rooms were not filtered: got %+v", got.Rooms)
+	}
+	if len(got.Rooms.Join["!join:localhost"].Timeline.Events) != 0 || len(got.Rooms.Leave["!leave:localhost"].Timeline.Events) != 0 {
+		t.Errorf("excluded timelines were returned: %+v", got.Rooms)
+	}
+	if len(got.AccountData.Events) != 0 {
+		t.Errorf("account data was returned with OnlyRooms: %+v", got.AccountData)
+	}
+
+	// the fixture itself is not modified
+	got, _, err = client.DoSyncV2(ctx, "alice_token", "", false, false, RoomFilter{}, "")
+	if err != nil {
+		t.Fatalf("DoSyncV2: %s", err)
+	}
+	if len(got.Rooms.Join) != 2 || len(got.Rooms.Invite) != 2 || len(got.Rooms.Leave) != 2 || len(got.Rooms.Leave["!leave:localhost"].Timeline.Events) != 1 {
+		t.Errorf("fixture was modified by filtering: %+v", got.Rooms)
+	}
+}
@@ -0,0 +1,45 @@
+package sync2
+
+import (
+	"context"
+	"net/http"
+)
+
+// SynapseClient is a Client for Synapse deployments which use workers. Synapse can route /sync
+// to dedicated sync workers; when the proxy is co-located with such a deployment it is cheaper
+// to hit the sync worker directly rather than going through the reverse proxy, which is often
+// configured with much shorter timeouts than the 30s long-poll the proxy uses.
+//
+// Only the destination of requests differs from an HTTPClient: the same CS API endpoints are
+// used, and Synapse admin APIs are not. /sync requests are sent to the sync worker and all other
+// requests (e.g /whoami) are sent to the main process.
+type SynapseClient struct {
+	Main *HTTPClient
+	Sync *HTTPClient
+}
+
+// NewSynapseClient makes a new SynapseClient. If syncWorkerURL is empty, /sync requests are sent
+// to mainURL, which makes this behave identically to an HTTPClient.
+func NewSynapseClient(client *http.Client, mainURL, syncWorkerURL string) *SynapseClient {
+	if syncWorkerURL == "" {
+		syncWorkerURL = mainURL
+	}
+	return &SynapseClient{
+		Main: &HTTPClient{
+			Client:            client,
+			DestinationServer: mainURL,
+		},
+		Sync: &HTTPClient{
+			Client:            client,
+			DestinationServer: syncWorkerURL,
+		},
+	}
+}
+
+func (c *SynapseClient) WhoAmI(accessToken string) (string, string, error) {
+	return c.Main.WhoAmI(accessToken)
+}
+
+func (c *SynapseClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool, roomFilter RoomFilter, setPresence string) (*SyncResponse, int, error) {
+	return c.Sync.DoSyncV2(ctx, accessToken, since, isFirst, toDeviceOnly, roomFilter, setPresence)
+}
@@ -1,7 +1,13 @@
 package sync2
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"testing"
 )
 
@@ -12,10 +18,12 @@ func TestSyncURL(t *testing.T) {
 		DestinationServer: baseURL,
 	}
 	testCases := []struct {
-		since        string
-		isFirst      bool
-		toDeviceOnly bool
-		wantURL      string
+		since                string
+		isFirst              bool
+		toDeviceOnly         bool
+		excludeTimelineRooms []string
+		setPresence          string
+		wantURL              string
 	}{
 		{
 			since:        "",
@@ -65,11 +73,141 @@ func TestSyncURL(t *testing.T) {
 			toDeviceOnly: true,
 			wantURL:      wantBaseURL + `?timeout=0&since=112233&filter=` + url.QueryEscape(`{"room":{"rooms":[],"timeline":{"limit":50}}}`),
 		},
+		{
+			since:                "112233",
+			isFirst:              false,
+			toDeviceOnly:         false,
+			excludeTimelineRooms: []string{"!a:localhost", "!b:localhost"},
+			wantURL:              wantBaseURL + `?timeout=30000&since=112233&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":50,"not_rooms":["!a:localhost","!b:localhost"]}}}`),
+		},
+		{
+			since:        "112233",
+			isFirst:      false,
+			toDeviceOnly: false,
+			setPresence:  "unavailable",
+			wantURL:      wantBaseURL + `?timeout=30000&since=112233&set_presence=unavailable&filter=` + url.QueryEscape(`{"room":{"timeline":{"limit":50}}}`),
+		},
 	}
 	for i, tc := range testCases {
-		gotURL := client.createSyncURL(tc.since, tc.isFirst, tc.toDeviceOnly)
+		filter := createSyncFilter(tc.since, tc.toDeviceOnly, RoomFilter{NotTimelineRooms: tc.excludeTimelineRooms})
+		gotURL := client.createSyncURL(tc.since, tc.isFirst, filter, tc.setPresence)
 		if gotURL != tc.wantURL {
 			t.Errorf("Case %d/%d: got %v want %v", i+1, len(testCases), gotURL, tc.wantURL)
 		}
 	}
 }
+
+func TestSyncUploadsRoomFilters(t *testing.T) {
+	alice := PollerID{UserID: "@alice:localhost", DeviceID: "A"}
+	var uploads []string
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/_matrix/client/r0/user/@alice:localhost/filter":
+			body, _ := io.ReadAll(req.Body)
+			uploads = append(uploads, string(body))
+			w.Write([]byte(fmt.Sprintf(`{"filter_id":"%d"}`, len(uploads))))
+		case "/_matrix/client/r0/sync":
+			filters = append(filters, req.URL.Query().Get("filter"))
+			w.Write([]byte(`{"next_batch":"next"}`))
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	client := &HTTPClient{
+		Client:            http.DefaultClient,
+		DestinationServer: srv.URL,
+	}
+	ctx := contextWithPollerID(context.Background(), alice)
+	excluded := RoomFilter{NotTimelineRooms: []string{"!a:localhost", "!b:localhost"}}
+	for _, roomFilter := range []RoomFilter{{}, excluded, excluded, {Rooms: []string{"!a:localhost"}}} {
+		if _, _, err := client.DoSyncV2(ctx, "token", "112233", false, false, roomFilter, ""); err != nil {
+			t.Fatalf("DoSyncV2: %s", err)
+		}
+	}
+	wantUploads := []string{
+		`{"room":{"timeline":{"limit":50,"not_rooms":["!a:localhost","!b:localhost"]}}}`,
+		`{"room":{"rooms":["!a:localhost"],"timeline":{"limit":50}}}`,
+	}
+	if !reflect.DeepEqual(uploads, wantUploads) {
+		t.Errorf("uploaded filters: got %v want %v", uploads, wantUploads)
+	}
+	// filters without room lists are sent inline, and uploaded filters are only uploaded once
+	wantFilters := []string{`{"room":{"timeline":{"limit":50}}}`, "1", "1", "2"}
+	if !reflect.DeepEqual(filters, wantFilters) {
+		t.Errorf("sync filters: got %v want %v", filters, wantFilters)
+	}
+}
+
+func TestSyncFilterOnlyRooms(t *testing.T) {
+	got := createSyncFilter("112233", false, RoomFilter{Rooms: []string{"!a:localhost"}, OnlyRooms: true})
+	want := `{"account_data":{"types":[]},"presence":{"types":[]},"room":{"rooms":["!a:localhost"],"timeline":{"limit":50}}}`
+	if got != want {
+		t.Errorf("createSyncFilter: got %s want %s", got, want)
+	}
+}
+
+func TestFilterCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newFilterCache()
+	for i := 0; i < maxFiltersPerDevice; i++ {
+		cache.add(fmt.Sprintf("filter%d", i), fmt.Sprintf("%d", i))
+	}
+	// using the oldest filter keeps it, so the next oldest is evicted instead
+	if id, ok := cache.get("filter0"); !ok || id != "0" {
+		t.Fatalf("get filter0: got %q %v", id, ok)
+	}
+	cache.add("new", "new")
+	if _, ok := cache.get("filter1"); ok {
+		t.Errorf("least recently used filter was not evicted")
+	}
+	for _, filter := range []string{"filter0", "filter2", "new"} {
+		if _, ok := cache.get(filter); !ok {
+			t.Errorf("%s was evicted", filter)
+		}
+	}
+	if cache.order.Len() != maxFiltersPerDevice || len(cache.elements) != maxFiltersPerDevice {
+		t.Errorf("cache has %d/%d entries, want %d", cache.order.Len(), len(cache.elements), maxFiltersPerDevice)
+	}
+	var nilCache *filterCache
+	if _, ok := nilCache.get("filter0"); ok {
+		t.Errorf("nil cache returned a filter")
+	}
+}
+
+func TestSynapseClientRoutesSyncToWorker(t *testing.T) {
+	var mainPaths, workerPaths []string
+	mainSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mainPaths = append(mainPaths, req.URL.Path)
+		w.Write([]byte(`{"user_id":"@alice:localhost","device_id":"ALICE","next_batch":"main"}`))
+	}))
+	defer mainSrv.Close()
+	workerSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		workerPaths = append(workerPaths, req.URL.Path)
+		w.Write([]byte(`{"next_batch":"worker"}`))
+	}))
+	defer workerSrv.Close()
+
+	client := NewSynapseClient(http.DefaultClient, mainSrv.URL, workerSrv.URL)
+	userID, deviceID, err := client.WhoAmI("token")
+	if err != nil {
+		t.Fatalf("WhoAmI: %s", err)
+	}
+	if userID != "@alice:localhost" || deviceID != "ALICE" {
+		t.Errorf("WhoAmI: got %s %s", userID, deviceID)
+	}
+	res, _, err := client.DoSyncV2(context.Background(), "token", "", true, false, RoomFilter{}, "")
+	if err != nil {
+		t.Fatalf("DoSyncV2: %s", err)
+	}
+	if res.NextBatch != "worker" {
+		t.Errorf("DoSyncV2: got next_batch %s want worker", res.NextBatch)
+	}
+	if len(mainPaths) != 1 || mainPaths[0] != "/_matrix/client/r0/account/whoami" {
+		t.Errorf("main process got paths %v", mainPaths)
+	}
+	if len(workerPaths) != 1 || workerPaths[0] != "/_matrix/client/r0/sync" {
+		t.Errorf("sync worker got paths %v", workerPaths)
+	}
+}
@@ -0,0 +1,220 @@
+package sync2
+
+import (
+	"sort"
+	"sync"
+)
+
+// roomCoordinator coalesces timeline fetching for rooms which are shared between pollers.
+//
+// Without coordination, every poller in a room receives (and submits to the accumulator) the same
+// timeline events, which are then deduplicated by the database. With coordination, one poller is
+// elected the leader of each room and is solely responsible for fetching that room's timeline.
+// All other pollers in the room are followers, and ask the homeserver to exclude the room's
+// timeline from their /sync responses. When the leader stops polling, leadership passes to a
+// follower, whose next /sync will include the room's timeline again.
+//
+// Events sent between the leader's final /sync and the follower's next /sync are not in either
+// response, so the follower backfills the room first. It does this by re-syncing the room from its
+// own since token from before the leader's final /sync, which returns everything the leader
+// missed. Using the follower's own (older) since token is important: using the leader's token
+// could cause the homeserver to drop to-device messages for the follower.
+//
+// This trades some fidelity for load: follower /sync responses will not include their own
+// transaction IDs for events in coalesced rooms, and unread counts in coalesced rooms are only
+// refreshed for followers when the room has some other activity (e.g receipts) in their response.
+type roomCoordinator struct {
+	mu      *sync.Mutex
+	leaders map[string]PollerID              // room_id => leader
+	rooms   map[PollerID]map[string]struct{} // poller => joined room IDs
+	// The recent since tokens of each poller, oldest first. Used to pick a since token to backfill
+	// from when a poller takes over a room.
+	positions map[PollerID][]syncPosition
+	// Rooms each poller has taken over but not yet backfilled. The value is the clock time of the
+	// previous leader's final /sync for the room.
+	handoffs map[PollerID]map[string]int64
+	// Incremented on every /sync so positions of different pollers can be ordered.
+	clock int64
+}
+
+// syncPosition is a since token along with when the poller received it.
+type syncPosition struct {
+	at    int64
+	since string
+}
+
+// The number of since tokens to remember for each poller. A poller which takes over a room
+// backfills on its next /sync, so only the last few are ever needed.
+const maxSyncPositions = 16
+
+func newRoomCoordinator() *roomCoordinator {
+	return &roomCoordinator{
+		mu:        &sync.Mutex{},
+		leaders:   make(map[string]PollerID),
+		rooms:     make(map[PollerID]map[string]struct{}),
+		positions: make(map[PollerID][]syncPosition),
+		handoffs:  make(map[PollerID]map[string]int64),
+	}
+}
+
+// OnSynced remembers that this poller has processed a /sync response, including the timelines of
+// the rooms it leads, up to this since token. Call this before OnJoinedRooms and OnLeftRoom.
+func (c *roomCoordinator) OnSynced(pid PollerID, since string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock++
+	positions := append(c.positions[pid], syncPosition{at: c.clock, since: since})
+	if len(positions) > maxSyncPositions {
+		positions = positions[len(positions)-maxSyncPositions:]
+	}
+	c.positions[pid] = positions
+}
+
+// OnJoinedRooms remembers that this poller is joined to these rooms. The poller becomes the leader
+// of any room which does not already have one.
+func (c *roomCoordinator) OnJoinedRooms(pid PollerID, roomIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	joined := c.rooms[pid]
+	if joined == nil {
+		joined = make(map[string]struct{})
+		c.rooms[pid] = joined
+	}
+	for _, roomID := range roomIDs {
+		joined[roomID] = struct{}{}
+		if _, exists := c.leaders[roomID]; !exists {
+			c.leaders[roomID] = pid
+		}
+	}
+}
+
+// OnLeftRoom forgets that this poller is joined to this room, electing a new leader if need be.
+func (c *roomCoordinator) OnLeftRoom(pid PollerID, roomID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.rooms[pid], roomID)
+	if c.leaders[roomID] == pid {
+		c.electLeader(roomID)
+	}
+	delete(c.handoffs[pid], roomID)
+}
+
+// RemovePoller forgets about this poller entirely, handing over leadership of all the rooms it
+// was leading. Call this when the poller stops.
+func (c *roomCoordinator) RemovePoller(pid PollerID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	joined := c.rooms[pid]
+	delete(c.rooms, pid)
+	for roomID := range joined {
+		if c.leaders[roomID] == pid {
+			c.electLeader(roomID)
+		}
+	}
+	delete(c.positions, pid)
+	delete(c.handoffs, pid)
+}
+
+// ExcludedTimelineRooms returns the sorted list of rooms this poller is joined to but is not the
+// leader of. The list is sorted so the resulting filter is stable between requests.
+func (c *roomCoordinator) ExcludedTimelineRooms(pid PollerID) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var excluded []string
+	for roomID := range c.rooms[pid] {
+		if c.leaders[roomID] != pid {
+			excluded = append(excluded, roomID)
+		}
+	}
+	sort.Strings(excluded)
+	return excluded
+}
+
+// Handoffs returns the rooms this poller has taken over from another poller but not yet
+// backfilled, grouped by the since token to backfill them from. Call OnBackfilled once they have
+// been backfilled.
+func (c *roomCoordinator) Handoffs(pid PollerID) map[string][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.handoffs[pid]) == 0 {
+		return nil
+	}
+	positions := c.positions[pid]
+	if len(positions) == 0 {
+		return nil
+	}
+	result := make(map[string][]string)
+	for roomID, at := range c.handoffs[pid] {
+		// use the newest since token we had when the previous leader last synced: the response
+		// to it includes every event after the previous leader's final since token.
+		since := ""
+		for i := len(positions) - 1; i >= 0; i-- {
+			if positions[i].at < at {
+				since = positions[i].since
+				break
+			}
+		}
+		if since == "" {
+			since = positions[0].since
+			logger.Warn().Str("room", roomID).Str("user", pid.UserID).Str("device", pid.DeviceID).Msg(
+				"roomCoordinator: no since token from before the handoff, backfill may miss events",
+			)
+		}
+		result[since] = append(result[since], roomID)
+	}
+	for _, roomIDs := range result {
+		sort.Strings(roomIDs)
+	}
+	return result
+}
+
+// OnBackfilled remembers that this poller has backfilled these rooms.
+func (c *roomCoordinator) OnBackfilled(pid PollerID, roomIDs []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, roomID := range roomIDs {
+		delete(c.handoffs[pid], roomID)
+	}
+}
+
+// electLeader picks a new leader for this room from the remaining joined pollers, which must
+// backfill the room. Must be called with the lock held.
+func (c *roomCoordinator) electLeader(roomID string) {
+	prevLeader := c.leaders[roomID]
+	delete(c.leaders, roomID)
+	// work out when the room's timeline was last fetched. If the previous leader never backfilled
+	// the room, that was before it took over.
+	at, ok := c.handoffs[prevLeader][roomID]
+	if !ok {
+		positions := c.positions[prevLeader]
+		if len(positions) == 0 {
+			// the previous leader never fetched the room either, so nobody has: the new leader's
+			// next /sync will include the room as normal.
+			at = 0
+		} else {
+			at = positions[len(positions)-1].at
+		}
+	}
+	// pick the lowest poller ID so elections do not depend on map iteration order
+	var leader *PollerID
+	for pid, joined := range c.rooms {
+		if _, ok := joined[roomID]; !ok {
+			continue
+		}
+		if leader == nil || pid.UserID < leader.UserID || (pid.UserID == leader.UserID && pid.DeviceID < leader.DeviceID) {
+			pid := pid
+			leader = &pid
+		}
+	}
+	if leader == nil {
+		return
+	}
+	c.leaders[roomID] = *leader
+	if at > 0 {
+		if c.handoffs[*leader] == nil {
+			c.handoffs[*leader] = make(map[string]int64)
+		}
+		c.handoffs[*leader][roomID] = at
+	}
+	logger.Info().Str("room", roomID).Str("user", leader.UserID).Str("device", leader.DeviceID).Msg("roomCoordinator: elected new leader")
+}
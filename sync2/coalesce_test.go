@@ -0,0 +1,87 @@
+package sync2
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoomCoordinator(t *testing.T) {
+	alice := PollerID{UserID: "@alice:localhost", DeviceID: "A"}
+	bob := PollerID{UserID: "@bob:localhost", DeviceID: "B"}
+	charlie := PollerID{UserID: "@charlie:localhost", DeviceID: "C"}
+	c := newRoomCoordinator()
+	assertExcluded := func(pid PollerID, want []string) {
+		t.Helper()
+		got := c.ExcludedTimelineRooms(pid)
+		if len(got) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("ExcludedTimelineRooms(%v): got %v want %v", pid.UserID, got, want)
+		}
+	}
+
+	// alice joins first so leads both rooms
+	c.OnJoinedRooms(alice, []string{"!a", "!b"})
+	c.OnJoinedRooms(bob, []string{"!b", "!a", "!c"})
+	assertExcluded(alice, nil)
+	assertExcluded(bob, []string{"!a", "!b"})
+
+	// charlie shares !c with bob, who leads it
+	c.OnJoinedRooms(charlie, []string{"!c"})
+	assertExcluded(charlie, []string{"!c"})
+
+	// alice leaving !a hands it to bob
+	c.OnLeftRoom(alice, "!a")
+	assertExcluded(bob, []string{"!b"})
+
+	// alice stopping hands !b to bob
+	c.RemovePoller(alice)
+	assertExcluded(bob, nil)
+
+	// bob stopping hands !c to charlie
+	c.RemovePoller(bob)
+	assertExcluded(charlie, nil)
+}
+
+func TestRoomCoordinatorHandoffs(t *testing.T) {
+	alice := PollerID{UserID: "@alice:localhost", DeviceID: "A"}
+	bob := PollerID{UserID: "@bob:localhost", DeviceID: "B"}
+	charlie := PollerID{UserID: "@charlie:localhost", DeviceID: "C"}
+	c := newRoomCoordinator()
+	assertHandoffs := func(pid PollerID, want map[string][]string) {
+		t.Helper()
+		got := c.Handoffs(pid)
+		if len(got) == 0 && len(want) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Handoffs(%v): got %v want %v", pid.UserID, got, want)
+		}
+	}
+
+	c.OnSynced(alice, "a1")
+	c.OnJoinedRooms(alice, []string{"!a", "!b"})
+	c.OnSynced(bob, "b1")
+	c.OnJoinedRooms(bob, []string{"!a", "!b"})
+	c.OnSynced(charlie, "c1")
+	c.OnSynced(alice, "a2") // alice's final sync
+	c.OnSynced(bob, "b2")
+	c.OnSynced(charlie, "c2")
+	c.OnJoinedRooms(charlie, []string{"!b"})
+	assertHandoffs(bob, nil)
+
+	// bob takes over and must backfill from before alice's final sync, not from b2
+	c.RemovePoller(alice)
+	assertHandoffs(bob, map[string][]string{"b1": {"!a", "!b"}})
+	assertHandoffs(charlie, nil)
+
+	// bob stops before backfilling !b, so charlie must backfill from before alice's final sync too
+	c.OnBackfilled(bob, []string{"!a"})
+	c.OnSynced(bob, "b3")
+	c.OnSynced(charlie, "c3")
+	c.RemovePoller(bob)
+	assertHandoffs(charlie, map[string][]string{"c1": {"!b"}})
+	c.OnBackfilled(charlie, []string{"!b"})
+	assertHandoffs(charlie, nil)
+}
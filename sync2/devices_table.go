@@ -21,8 +21,8 @@ func NewDevicesTable(db *sqlx.DB) *DevicesTable {
 	CREATE TABLE IF NOT EXISTS syncv3_sync2_devices (
 		user_id TEXT NOT NULL,
 		device_id TEXT NOT NULL,
-		PRIMARY KEY (user_id, device_id),
-		since TEXT NOT NULL
+		since TEXT NOT NULL,
+		PRIMARY KEY (user_id, device_id)
 	);`)
 
 	return &DevicesTable{
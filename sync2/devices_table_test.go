@@ -20,7 +20,7 @@ func TestMain(m *testing.M) {
 }
 
 func connectToDB(t *testing.T) (*sqlx.DB, func()) {
-	db, err := sqlx.Open("postgres", postgresConnectionString)
+	db, err := sqlutil.Open(postgresConnectionString)
 	if err != nil {
 		t.Fatalf("failed to open SQL db: %s", err)
 	}
@@ -100,7 +100,7 @@ func TestTokenForEachDevice(t *testing.T) {
 
 	// HACK: discard rows inserted by other tests. We don't normally need to do this,
 	// but this is testing a query that scans the entire devices table.
-	db.MustExec("TRUNCATE syncv3_sync2_devices, syncv3_sync2_tokens;")
+	db.MustExec("DELETE FROM syncv3_sync2_devices; DELETE FROM syncv3_sync2_tokens;")
 
 	tokens := NewTokensTable(db, "my_secret")
 	devices := NewDevicesTable(db)
@@ -7,6 +7,7 @@ import (
 	"hash/fnv"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
@@ -42,6 +43,10 @@ type Handler struct {
 	}
 	// room_id => fnv_hash([typing user ids])
 	typingMap map[string]uint64
+	// devices waiting for pollers to be started at startup
+	startupQueue *startupQueue
+	// closed to stop deleting old device list changes
+	stopSweeper chan struct{}
 
 	numPollers prometheus.Gauge
 	subSystem  string
@@ -60,7 +65,9 @@ func NewHandler(
 			Highlight int
 			Notif     int
 		}),
-		typingMap: make(map[string]uint64),
+		typingMap:    make(map[string]uint64),
+		startupQueue: newStartupQueue(),
+		stopSweeper:  make(chan struct{}),
 	}
 
 	if enablePrometheus {
@@ -85,10 +92,40 @@ func (h *Handler) Listen() {
 			sentry.CaptureException(err)
 		}
 	}()
+	go h.runDeviceListSweeper()
+}
+
+// How long device list changes are kept for. Changes are not deleted when they are acknowledged,
+// as a device may have several connections at different positions.
+const deviceListRetention = 7 * 24 * time.Hour
+
+// How often to delete device list changes which are older than deviceListRetention.
+const deviceListSweepInterval = time.Hour
+
+// runDeviceListSweeper periodically deletes old device list changes until Teardown is called.
+func (h *Handler) runDeviceListSweeper() {
+	defer internal.ReportPanicsToSentry()
+	ticker := time.NewTicker(deviceListSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stopSweeper:
+			return
+		case now := <-ticker.C:
+			deleted, err := h.Store.DeviceListTable.DeleteOlderThan(now.Add(-deviceListRetention))
+			if err != nil {
+				logger.Err(err).Msg("failed to delete old device list changes")
+				sentry.CaptureException(err)
+				continue
+			}
+			logger.Debug().Int64("deleted", deleted).Msg("deleted old device list changes")
+		}
+	}
 }
 
 func (h *Handler) Teardown() {
 	// stop polling and tear down DB conns
+	close(h.stopSweeper)
 	h.v3Sub.Teardown()
 	h.v2Pub.Close()
 	h.Store.Teardown()
@@ -111,23 +148,30 @@ func (h *Handler) StartV2Pollers() {
 	// Too low and this will take ages for the v2 pollers to startup.
 	numWorkers := 16
 	numFails := 0
-	ch := make(chan sync2.TokenForPoller, len(tokens))
+	validTokens := make([]sync2.TokenForPoller, 0, len(tokens))
 	for _, t := range tokens {
 		// if we fail to decrypt the access token, skip it.
 		if t.AccessToken == "" {
 			numFails++
 			continue
 		}
-		ch <- t
+		validTokens = append(validTokens, t)
 	}
-	close(ch)
+	// Start recently seen devices first. Devices which make a request whilst we are starting up
+	// jump the queue entirely: see EnsurePolling.
+	h.startupQueue.Fill(validTokens)
+	defer h.startupQueue.Close()
 	logger.Info().Int("num_devices", len(tokens)).Int("num_fail_decrypt", numFails).Msg("StartV2Pollers")
 	var wg sync.WaitGroup
 	wg.Add(numWorkers)
 	for i := 0; i < numWorkers; i++ {
 		go func() {
 			defer wg.Done()
-			for t := range ch {
+			for {
+				t, ok := h.startupQueue.Pop()
+				if !ok {
+					return
+				}
 				pid := sync2.PollerID{
 					UserID:   t.UserID,
 					DeviceID: t.DeviceID,
@@ -155,6 +199,11 @@ func (h *Handler) updateMetrics() {
 	h.numPollers.Set(float64(h.pMap.NumPollers()))
 }
 
+// IsPolling returns true if this device has a running poller.
+func (h *Handler) IsPolling(userID, deviceID string) bool {
+	return h.pMap.IsPolling(sync2.PollerID{UserID: userID, DeviceID: deviceID})
+}
+
 func (h *Handler) OnTerminated(ctx context.Context, userID, deviceID string) {
 	h.updateMetrics()
 }
@@ -192,21 +241,34 @@ func (h *Handler) UpdateDeviceSince(ctx context.Context, userID, deviceID, since
 }
 
 func (h *Handler) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) {
+	var nextPos int64
 	// some of these fields may be set
-	partialDD := internal.DeviceData{
-		UserID:           userID,
-		DeviceID:         deviceID,
-		OTKCounts:        otkCounts,
-		FallbackKeyTypes: fallbackKeyTypes,
-		DeviceLists: internal.DeviceLists{
-			New: deviceListChanges,
-		},
-	}
-	nextPos, err := h.Store.DeviceDataTable.Upsert(&partialDD)
-	if err != nil {
-		logger.Err(err).Str("user", userID).Msg("failed to upsert device data")
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-		return
+	if otkCounts != nil || fallbackKeyTypes != nil {
+		partialDD := internal.DeviceData{
+			UserID:           userID,
+			DeviceID:         deviceID,
+			OTKCounts:        otkCounts,
+			FallbackKeyTypes: fallbackKeyTypes,
+		}
+		var err error
+		nextPos, err = h.Store.DeviceDataTable.Upsert(&partialDD)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Msg("failed to upsert device data")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+	}
+	// device list changes are appended to a stream, so they are never lost or consumed twice
+	if len(deviceListChanges) > 0 {
+		pos, err := h.Store.DeviceListTable.Insert(userID, deviceID, deviceListChanges)
+		if err != nil {
+			logger.Err(err).Str("user", userID).Msg("failed to insert device list changes")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+		if pos > nextPos {
+			nextPos = pos
+		}
 	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2DeviceData{
 		UserID:   userID,
@@ -261,7 +323,7 @@ func (h *Handler) Accumulate(ctx context.Context, userID, deviceID, roomID, prev
 		// all events with txnIDs.
 		var nidsByIDs map[string]int64
 		err = sqlutil.WithTransaction(h.Store.DB, func(txn *sqlx.Tx) error {
-			nidsByIDs, err = h.Store.EventsTable.SelectNIDsByIDs(txn, eventIDsWithTxns)
+			nidsByIDs, err = h.Store.EventsTable.SelectNIDsByIDs(txn, roomID, eventIDsWithTxns)
 			return err
 		})
 		if err != nil {
@@ -347,6 +409,34 @@ func (h *Handler) OnReceipt(ctx context.Context, userID, roomID, ephEventType st
 	})
 }
 
+func (h *Handler) OnPresence(ctx context.Context, events []json.RawMessage) {
+	// every poller sharing a room with a user sees their presence, so only notify genuine changes
+	now := time.Now()
+	var changed []internal.Presence
+	for _, ev := range events {
+		p, err := internal.NewPresenceFromEvent(ev, now)
+		if err != nil {
+			logger.Warn().Err(err).Msg("OnPresence: ignoring malformed presence event")
+			continue
+		}
+		isChanged, err := h.Store.PresenceTable.Upsert(p)
+		if err != nil {
+			logger.Err(err).Str("user", p.UserID).Msg("failed to store presence")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			continue
+		}
+		if isChanged {
+			changed = append(changed, p)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2Presence{
+		Presence: changed,
+	})
+}
+
 func (h *Handler) AddToDeviceMessages(ctx context.Context, userID, deviceID string, msgs []json.RawMessage) {
 	_, err := h.Store.ToDeviceTable.InsertMessages(userID, deviceID, msgs)
 	if err != nil {
@@ -421,12 +511,31 @@ func (h *Handler) OnInvite(ctx context.Context, userID, roomID string, inviteSta
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return
 	}
+	// accepting a knock is done by inviting the user, so retire any knock for this room
+	err = h.Store.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire accepted knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2InviteRoom{
 		UserID: userID,
 		RoomID: roomID,
 	})
 }
 
+func (h *Handler) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) {
+	err := h.Store.KnocksTable.InsertKnock(userID, roomID, knockState)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to insert knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2KnockRoom{
+		UserID: userID,
+		RoomID: roomID,
+	})
+}
+
 func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string) {
 	// remove any invites for this user if they are rejecting an invite
 	err := h.Store.InvitesTable.RemoveInvite(userID, roomID)
@@ -434,6 +543,12 @@ func (h *Handler) OnLeftRoom(ctx context.Context, userID, roomID string) {
 		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire invite")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 	}
+	// remove any knocks for this user if their knock was rejected or withdrawn
+	err = h.Store.KnocksTable.RemoveKnock(userID, roomID)
+	if err != nil {
+		logger.Err(err).Str("user", userID).Str("room", roomID).Msg("failed to retire knock")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
 	h.v2Pub.Notify(pubsub.ChanV2, &pubsub.V2LeaveRoom{
 		UserID: userID,
 		RoomID: roomID,
@@ -452,13 +567,16 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 		sentry.CaptureException(err)
 		return
 	}
+	pid := sync2.PollerID{
+		UserID:   p.UserID,
+		DeviceID: p.DeviceID,
+	}
+	if h.startupQueue.Remove(pid) {
+		log.Info().Msg("EnsurePolling: starting poller ahead of startup queue")
+	}
 	// don't block us from consuming more pubsub messages just because someone wants to sync
 	go func() {
 		// blocks until an initial sync is done
-		pid := sync2.PollerID{
-			UserID:   p.UserID,
-			DeviceID: p.DeviceID,
-		}
 		h.pMap.EnsurePolling(
 			pid, accessToken, since, false, log,
 		)
@@ -470,6 +588,13 @@ func (h *Handler) EnsurePolling(p *pubsub.V3EnsurePolling) {
 	}()
 }
 
+func (h *Handler) OnSetPresence(p *pubsub.V3SetPresence) {
+	h.pMap.SetPresence(sync2.PollerID{
+		UserID:   p.UserID,
+		DeviceID: p.DeviceID,
+	}, p.Presence)
+}
+
 func typingHash(ephEvent json.RawMessage) uint64 {
 	h := fnv.New64a()
 	for _, userID := range gjson.ParseBytes(ephEvent).Get("content.user_ids").Array() {
@@ -39,8 +39,14 @@ type mockPollerMap struct {
 func (p *mockPollerMap) NumPollers() int {
 	return 0
 }
+func (p *mockPollerMap) IsPolling(pid sync2.PollerID) bool {
+	return false
+}
+
 func (p *mockPollerMap) Terminate() {}
 
+func (p *mockPollerMap) SetPresence(pid sync2.PollerID, presence string) {}
+
 func (p *mockPollerMap) EnsurePolling(pid sync2.PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger) {
 	p.calls = append(p.calls, pollInfo{
 		pid:         pid,
@@ -0,0 +1,83 @@
+package handler2
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+// startupQueue is the queue of devices which need pollers starting when the proxy boots.
+//
+// Devices are ordered by how recently they were seen, so active users are polled before dormant
+// accounts. Devices which make a sliding sync request whilst still queued are started immediately
+// by EnsurePolling and are removed from the queue so they are not started twice.
+type startupQueue struct {
+	mu      *sync.Mutex
+	tokens  []sync2.TokenForPoller // sorted by last_seen DESC
+	next    int
+	started map[sync2.PollerID]bool
+	active  bool
+}
+
+func newStartupQueue() *startupQueue {
+	return &startupQueue{
+		mu:      &sync.Mutex{},
+		started: make(map[sync2.PollerID]bool),
+	}
+}
+
+// Fill replaces the contents of the queue with these tokens, ordered most recently seen first.
+func (q *startupQueue) Fill(tokens []sync2.TokenForPoller) {
+	sorted := make([]sync2.TokenForPoller, len(tokens))
+	copy(sorted, tokens)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].LastSeen.After(sorted[j].LastSeen)
+	})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tokens = sorted
+	q.next = 0
+	q.started = make(map[sync2.PollerID]bool)
+	q.active = true
+}
+
+// Close empties the queue. Call this when startup has finished.
+func (q *startupQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.tokens = nil
+	q.next = 0
+	q.started = make(map[sync2.PollerID]bool)
+	q.active = false
+}
+
+// Pop returns the highest priority device which has not already been started, or false if the
+// queue is empty.
+func (q *startupQueue) Pop() (sync2.TokenForPoller, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.next < len(q.tokens) {
+		t := q.tokens[q.next]
+		q.next++
+		pid := sync2.PollerID{UserID: t.UserID, DeviceID: t.DeviceID}
+		if q.started[pid] {
+			continue
+		}
+		q.started[pid] = true
+		return t, true
+	}
+	return sync2.TokenForPoller{}, false
+}
+
+// Remove marks this device as started so it will not be returned by Pop. Returns true if
+// startup is still in progress.
+func (q *startupQueue) Remove(pid sync2.PollerID) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.active {
+		return false
+	}
+	q.started[pid] = true
+	return true
+}
@@ -0,0 +1,53 @@
+package handler2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync2"
+)
+
+func TestStartupQueueOrdersByLastSeen(t *testing.T) {
+	now := time.Now()
+	token := func(userID string, lastSeen time.Time) sync2.TokenForPoller {
+		return sync2.TokenForPoller{
+			Token: &sync2.Token{
+				AccessToken: userID + "_token",
+				UserID:      userID,
+				DeviceID:    "DEVICE",
+				LastSeen:    lastSeen,
+			},
+		}
+	}
+	q := newStartupQueue()
+	if q.Remove(sync2.PollerID{UserID: "@alice:localhost", DeviceID: "DEVICE"}) {
+		t.Fatalf("Remove returned true before startup")
+	}
+	q.Fill([]sync2.TokenForPoller{
+		token("@stale:localhost", now.Add(-30*24*time.Hour)),
+		token("@active:localhost", now),
+		token("@waiting:localhost", now.Add(-365*24*time.Hour)),
+		token("@recent:localhost", now.Add(-time.Hour)),
+	})
+	// @waiting makes a request, so it is started outside of the queue
+	if !q.Remove(sync2.PollerID{UserID: "@waiting:localhost", DeviceID: "DEVICE"}) {
+		t.Fatalf("Remove returned false during startup")
+	}
+	want := []string{"@active:localhost", "@recent:localhost", "@stale:localhost"}
+	for _, userID := range want {
+		got, ok := q.Pop()
+		if !ok {
+			t.Fatalf("Pop: queue empty, want %s", userID)
+		}
+		if got.UserID != userID {
+			t.Fatalf("Pop: got %s want %s", got.UserID, userID)
+		}
+	}
+	if got, ok := q.Pop(); ok {
+		t.Fatalf("Pop: got %s want empty queue", got.UserID)
+	}
+	q.Close()
+	if q.Remove(sync2.PollerID{UserID: "@active:localhost", DeviceID: "DEVICE"}) {
+		t.Fatalf("Remove returned true after startup")
+	}
+}
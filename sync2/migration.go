@@ -3,79 +3,58 @@ package sync2
 import (
 	"crypto/sha256"
 	"fmt"
-	"github.com/getsentry/sentry-go"
 	"github.com/jmoiron/sqlx"
 	"github.com/matrix-org/sliding-sync/sqlutil"
-	"net/http"
 	"time"
 )
 
 // MigrateDeviceIDs performs a one-off DB migration from the old device ids (hash of
 // access token) to the new device ids (actual device ids from the homeserver). This is
 // not backwards compatible. If the migration has already taken place, this function is
-// a no-op.
+// a no-op. whoamiClient is used to look up the device ID for each access token.
 //
-// This code will be removed in a future version of the proxy.
-func MigrateDeviceIDs(destHomeserver, postgresURI, secret string, commit bool) error {
-	whoamiClient := &HTTPClient{
-		Client: &http.Client{
-			Timeout: 5 * time.Minute,
-		},
-		DestinationServer: destHomeserver,
-	}
-	db, err := sqlx.Open("postgres", postgresURI)
+// This runs as a migration in the migrations package.
+func MigrateDeviceIDs(txn *sqlx.Tx, secret string, whoamiClient Client) (err error) {
+	migrated, err := isMigrated(txn)
 	if err != nil {
-		sentry.CaptureException(err)
-		logger.Panic().Err(err).Str("uri", postgresURI).Msg("failed to open SQL DB")
+		return
+	}
+	if migrated {
+		logger.Debug().Msg("MigrateDeviceIDs: migration has already taken place")
+		return nil
 	}
+	logger.Info().Msg("MigrateDeviceIDs: starting")
 
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		logger.Debug().Msgf("MigrateDeviceIDs: took %s", elapsed)
+	}()
 	// Ensure the new table exists.
-	NewTokensTable(db, secret)
-
-	return sqlutil.WithTransaction(db, func(txn *sqlx.Tx) (err error) {
-		migrated, err := isMigrated(txn)
-		if err != nil {
-			return
-		}
-		if migrated {
-			logger.Debug().Msg("MigrateDeviceIDs: migration has already taken place")
-			return nil
-		}
-		logger.Info().Msgf("MigrateDeviceIDs: starting (commit=%t)", commit)
-
-		start := time.Now()
-		defer func() {
-			elapsed := time.Since(start)
-			logger.Debug().Msgf("MigrateDeviceIDs: took %s", elapsed)
-		}()
-		err = alterTables(txn)
-		if err != nil {
-			return
-		}
-
-		err = runMigration(txn, secret, whoamiClient)
-		if err != nil {
-			return
-		}
-		err = finish(txn)
-		if err != nil {
-			return
-		}
+	if _, err = txn.Exec(tokensTableSchema(sqlutil.DialectOf(txn))); err != nil {
+		return
+	}
+	err = alterTables(txn)
+	if err != nil {
+		return
+	}
 
-		s := NewStore(postgresURI, secret)
-		tokens, err := s.TokensTable.TokenForEachDevice(txn)
-		if err != nil {
-			return
-		}
-		logger.Debug().Msgf("Got %d tokens after migration", len(tokens))
+	err = runMigration(txn, secret, whoamiClient)
+	if err != nil {
+		return
+	}
+	err = finish(txn)
+	if err != nil {
+		return
+	}
 
-		if !commit {
-			err = fmt.Errorf("MigrateDeviceIDs: migration succeeded without errors, but commit is false - rolling back anyway")
-		} else {
-			logger.Info().Msg("MigrateDeviceIDs: migration succeeded - committing")
-		}
+	var numTokens int
+	if err = txn.QueryRow(`SELECT count(*) FROM syncv3_sync2_tokens`).Scan(&numTokens); err != nil {
 		return
-	})
+	}
+	logger.Debug().Msgf("Got %d tokens after migration", numTokens)
+	logger.Info().Msg("MigrateDeviceIDs: migration succeeded")
+	return
 }
 
 func isMigrated(txn *sqlx.Tx) (bool, error) {
@@ -85,13 +64,8 @@ func isMigrated(txn *sqlx.Tx) (bool, error) {
 
 	// We're going to detect if the migration has run by testing for the existence of
 	// a column added by the migration. First, check that the table exists.
-	var tableExists bool
-	err := txn.QueryRow(`
-		SELECT EXISTS(
-		    SELECT 1 FROM information_schema.columns
-			WHERE table_name = 'syncv3_txns'
-		);
-	`).Scan(&tableExists)
+	dialect := sqlutil.DialectOf(txn)
+	tableExists, err := dialect.TableExists(txn, "syncv3_txns")
 	if err != nil {
 		return false, fmt.Errorf("isMigrated: %s", err)
 	}
@@ -102,14 +76,7 @@ func isMigrated(txn *sqlx.Tx) (bool, error) {
 		return true, nil
 	}
 
-	var migrated bool
-	err = txn.QueryRow(`
-		SELECT EXISTS(
-		    SELECT 1 FROM information_schema.columns
-			WHERE table_name = 'syncv3_txns' AND column_name = 'device_id'
-		);
-	`).Scan(&migrated)
-
+	migrated, err := dialect.ColumnExists(txn, "syncv3_txns", "device_id")
 	if err != nil {
 		return false, fmt.Errorf("isMigrated: %s", err)
 	}
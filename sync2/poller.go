@@ -44,8 +44,12 @@ type V2DataReceiver interface {
 	UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int)
 	// Set the latest account data for this user.
 	OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) // ping update with types? Can you race when re-querying?
+	// Set the latest presence for users. These are the events in the `presence` section of the v2 response.
+	OnPresence(ctx context.Context, events []json.RawMessage)
 	// Sent when there is a room in the `invite` section of the v2 response.
 	OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) // invitestate in db
+	// Sent when there is a room in the `knock` section of the v2 response.
+	OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) // knockstate in db
 	// Sent when there is a room in the `leave` section of the v2 response.
 	OnLeftRoom(ctx context.Context, userID, roomID string)
 	// Sent when there is a _change_ in E2EE data, not all the time
@@ -58,7 +62,9 @@ type V2DataReceiver interface {
 
 type IPollerMap interface {
 	EnsurePolling(pid PollerID, accessToken, v2since string, isStartup bool, logger zerolog.Logger)
+	SetPresence(pid PollerID, presence string)
 	NumPollers() int
+	IsPolling(pid PollerID) bool
 	Terminate()
 }
 
@@ -69,9 +75,14 @@ type PollerMap struct {
 	pollerMu                 *sync.Mutex
 	Pollers                  map[PollerID]*poller
 	executor                 chan func()
+	priorityExecutor         chan func()
 	executorRunning          bool
 	processHistogramVec      *prometheus.HistogramVec
 	timelineSizeHistogramVec *prometheus.HistogramVec
+	// non-nil if pollers should coalesce timelines for shared rooms
+	coordinator *roomCoordinator
+	// the presence each device has asked to be set
+	presence *presenceTracker
 }
 
 // NewPollerMap makes a new PollerMap. Guarantees that the V2DataReceiver will be called on the same
@@ -100,10 +111,12 @@ type PollerMap struct {
 // NOT to-device messages,or since tokens.
 func NewPollerMap(v2Client Client, enablePrometheus bool) *PollerMap {
 	pm := &PollerMap{
-		v2Client: v2Client,
-		pollerMu: &sync.Mutex{},
-		Pollers:  make(map[PollerID]*poller),
-		executor: make(chan func(), 0),
+		v2Client:         v2Client,
+		pollerMu:         &sync.Mutex{},
+		Pollers:          make(map[PollerID]*poller),
+		executor:         make(chan func(), 0),
+		priorityExecutor: make(chan func(), 0),
+		presence:         newPresenceTracker(),
 	}
 	if enablePrometheus {
 		pm.processHistogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -131,6 +144,13 @@ func (h *PollerMap) SetCallbacks(callbacks V2DataReceiver) {
 	h.callbacks = callbacks
 }
 
+// EnableRoomCoalescing makes pollers coordinate so that only one poller fetches the timeline for
+// each shared room. See roomCoordinator for the trade-offs. Must be called before any pollers
+// are started.
+func (h *PollerMap) EnableRoomCoalescing() {
+	h.coordinator = newRoomCoordinator()
+}
+
 // Terminate all pollers. Useful in tests.
 func (h *PollerMap) Terminate() {
 	h.pollerMu.Lock()
@@ -145,6 +165,15 @@ func (h *PollerMap) Terminate() {
 		prometheus.Unregister(h.timelineSizeHistogramVec)
 	}
 	close(h.executor)
+	close(h.priorityExecutor)
+}
+
+// SetPresence sets the presence this device wants. All pollers for this user will send the most
+// online presence requested by any of the user's devices on their next sync v2 request.
+func (h *PollerMap) SetPresence(pid PollerID, presence string) {
+	if h.presence.Set(pid, presence) {
+		logger.Trace().Str("user", pid.UserID).Str("presence", h.presence.ForUser(pid.UserID)).Msg("PollerMap.SetPresence: presence changed")
+	}
 }
 
 func (h *PollerMap) NumPollers() (count int) {
@@ -158,6 +187,14 @@ func (h *PollerMap) NumPollers() (count int) {
 	return
 }
 
+// IsPolling returns true if there is a poller for this device which has not been terminated.
+func (h *PollerMap) IsPolling(pid PollerID) bool {
+	h.pollerMu.Lock()
+	defer h.pollerMu.Unlock()
+	p, ok := h.Pollers[pid]
+	return ok && !p.terminated.Load()
+}
+
 // EnsurePolling makes sure there is a poller for this device, making one if need be.
 // Blocks until at least 1 sync is done if and only if the poller was just created.
 // This ensures that calls to the database will return data.
@@ -177,10 +214,19 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 		if poller.accessToken != accessToken {
 			logger.Warn().Msg("PollerMap.EnsurePolling: poller already running with different access token")
 		}
+		if !isStartup {
+			// a client is now waiting on this poller, which may have been started in the background
+			poller.priority.Store(true)
+		}
 		h.pollerMu.Unlock()
 		// this existing poller may not have completed the initial sync yet, so we need to make sure
 		// it has before we return.
 		poller.WaitUntilInitialSync()
+		if !isStartup {
+			// the initial sync may have been done before we prioritised the poller, in which case
+			// it will not have stopped prioritising itself.
+			poller.priority.Store(false)
+		}
 		return
 	}
 	// check if we need to wait at all: we don't need to if this user is already syncing on a different device
@@ -203,6 +249,10 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	poller = newPoller(pid, accessToken, h.v2Client, h, logger, !needToWait && !isStartup)
 	poller.processHistogramVec = h.processHistogramVec
 	poller.timelineSizeVec = h.timelineSizeHistogramVec
+	poller.coordinator = h.coordinator
+	poller.presence = h.presence
+	// a client is waiting on this poller, so prioritise it until it has done its initial sync
+	poller.priority.Store(!isStartup)
 	go poller.Poll(v2since)
 	h.Pollers[pid] = poller
 
@@ -214,10 +264,53 @@ func (h *PollerMap) EnsurePolling(pid PollerID, accessToken, v2since string, isS
 	}
 }
 
+// execute runs callbacks from pollers one at a time. Callbacks from priority pollers are always
+// run before callbacks from other pollers.
 func (h *PollerMap) execute() {
-	for fn := range h.executor {
-		fn()
+	for {
+		select {
+		case fn, ok := <-h.priorityExecutor:
+			if !ok {
+				return
+			}
+			fn()
+			continue
+		default:
+		}
+		select {
+		case fn, ok := <-h.priorityExecutor:
+			if !ok {
+				return
+			}
+			fn()
+		case fn, ok := <-h.executor:
+			if !ok {
+				return
+			}
+			fn()
+		}
+	}
+}
+
+// executorFor returns the executor channel to use for callbacks with this context. Pollers which
+// were started because a client is waiting for them use the priority executor until their initial
+// sync has been processed, so they are not stuck behind background pollers at startup.
+func (h *PollerMap) executorFor(ctx context.Context) chan func() {
+	// read the poller's flag directly rather than looking the poller up, as this is called for
+	// every callback and pollerMu is held whilst pollers are created.
+	priority, ok := ctx.Value(priorityContextKey{}).(*atomic.Bool)
+	if ok && priority.Load() {
+		return h.priorityExecutor
 	}
+	return h.executor
+}
+
+type priorityContextKey struct{}
+
+// contextWithPriority returns a context which carries the poller's priority flag, so callbacks can
+// check whether the poller is prioritised without taking any locks.
+func contextWithPriority(ctx context.Context, priority *atomic.Bool) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
 }
 
 func (h *PollerMap) UpdateDeviceSince(ctx context.Context, userID, deviceID, since string) {
@@ -226,7 +319,7 @@ func (h *PollerMap) UpdateDeviceSince(ctx context.Context, userID, deviceID, sin
 func (h *PollerMap) Accumulate(ctx context.Context, userID, deviceID, roomID, prevBatch string, timeline []json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		h.callbacks.Accumulate(ctx, userID, deviceID, roomID, prevBatch, timeline)
 		wg.Done()
 	}
@@ -235,7 +328,7 @@ func (h *PollerMap) Accumulate(ctx context.Context, userID, deviceID, roomID, pr
 func (h *PollerMap) Initialise(ctx context.Context, roomID string, state []json.RawMessage) (result []json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		result = h.callbacks.Initialise(ctx, roomID, state)
 		wg.Done()
 	}
@@ -245,7 +338,7 @@ func (h *PollerMap) Initialise(ctx context.Context, roomID string, state []json.
 func (h *PollerMap) SetTyping(ctx context.Context, roomID string, ephEvent json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		h.callbacks.SetTyping(ctx, roomID, ephEvent)
 		wg.Done()
 	}
@@ -254,17 +347,27 @@ func (h *PollerMap) SetTyping(ctx context.Context, roomID string, ephEvent json.
 func (h *PollerMap) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		h.callbacks.OnInvite(ctx, userID, roomID, inviteState)
 		wg.Done()
 	}
 	wg.Wait()
 }
 
+func (h *PollerMap) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executorFor(ctx) <- func() {
+		h.callbacks.OnKnock(ctx, userID, roomID, knockState)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
 func (h *PollerMap) OnLeftRoom(ctx context.Context, userID, roomID string) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		h.callbacks.OnLeftRoom(ctx, userID, roomID)
 		wg.Done()
 	}
@@ -282,13 +385,15 @@ func (h *PollerMap) OnTerminated(ctx context.Context, userID, deviceID string) {
 }
 
 func (h *PollerMap) OnExpiredToken(ctx context.Context, accessTokenHash, userID, deviceID string) {
+	// this device has logged out, so it no longer has a say in the user's presence
+	h.presence.Remove(PollerID{UserID: userID, DeviceID: deviceID})
 	h.callbacks.OnExpiredToken(ctx, accessTokenHash, userID, deviceID)
 }
 
 func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		h.callbacks.UpdateUnreadCounts(ctx, roomID, userID, highlightCount, notifCount)
 		wg.Done()
 	}
@@ -298,17 +403,27 @@ func (h *PollerMap) UpdateUnreadCounts(ctx context.Context, roomID, userID strin
 func (h *PollerMap) OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		h.callbacks.OnAccountData(ctx, userID, roomID, events)
 		wg.Done()
 	}
 	wg.Wait()
 }
 
+func (h *PollerMap) OnPresence(ctx context.Context, events []json.RawMessage) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.executorFor(ctx) <- func() {
+		h.callbacks.OnPresence(ctx, events)
+		wg.Done()
+	}
+	wg.Wait()
+}
+
 func (h *PollerMap) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	h.executor <- func() {
+	h.executorFor(ctx) <- func() {
 		h.callbacks.OnReceipt(ctx, userID, roomID, ephEventType, ephEvent)
 		wg.Done()
 	}
@@ -340,11 +455,18 @@ type poller struct {
 
 	// flag set to true when poll() returns due to expired access tokens
 	terminated *atomic.Bool
-	wg         *sync.WaitGroup
+	// flag set to true whilst a client is waiting for this poller's initial sync
+	priority *atomic.Bool
+	wg       *sync.WaitGroup
 
 	pollHistogramVec    *prometheus.HistogramVec
 	processHistogramVec *prometheus.HistogramVec
 	timelineSizeVec     *prometheus.HistogramVec
+
+	// non-nil if this poller should coalesce timelines for shared rooms with other pollers
+	coordinator *roomCoordinator
+	// non-nil if this poller should send presence requested via sliding sync
+	presence *presenceTracker
 }
 
 func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataReceiver, logger zerolog.Logger, initialToDeviceOnly bool) *poller {
@@ -357,6 +479,7 @@ func newPoller(pid PollerID, accessToken string, client Client, receiver V2DataR
 		client:              client,
 		receiver:            receiver,
 		terminated:          &atomic.Bool{},
+		priority:            &atomic.Bool{},
 		logger:              logger,
 		wg:                  &wg,
 		initialToDeviceOnly: initialToDeviceOnly,
@@ -394,6 +517,8 @@ func (p *poller) Poll(since string) {
 		})
 	})
 	ctx := sentry.SetHubOnContext(context.Background(), hub)
+	ctx = contextWithPollerID(ctx, PollerID{UserID: p.userID, DeviceID: p.deviceID})
+	ctx = contextWithPriority(ctx, p.priority)
 
 	p.logger.Info().Str("since", since).Msg("Poller: v2 poll loop started")
 	defer func() {
@@ -402,6 +527,10 @@ func (p *poller) Poll(since string) {
 			logger.Error().Str("user", p.userID).Str("device", p.deviceID).Msg(string(debug.Stack()))
 			internal.GetSentryHubFromContextOrDefault(ctx).RecoverWithContext(ctx, panicErr)
 		}
+		if p.coordinator != nil {
+			// let another poller take over the rooms we were leading
+			p.coordinator.RemovePoller(PollerID{UserID: p.userID, DeviceID: p.deviceID})
+		}
 		p.receiver.OnTerminated(ctx, p.userID, p.deviceID)
 	}()
 
@@ -440,9 +569,18 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	if p.terminated.Load() {
 		return fmt.Errorf("poller terminated")
 	}
+	var roomFilter RoomFilter
+	if p.coordinator != nil && s.since != "" {
+		p.backfill(ctx)
+		roomFilter.NotTimelineRooms = p.coordinator.ExcludedTimelineRooms(PollerID{UserID: p.userID, DeviceID: p.deviceID})
+	}
+	var setPresence string
+	if p.presence != nil {
+		setPresence = p.presence.ForUser(p.userID)
+	}
 	start := time.Now()
 	spanCtx, region := internal.StartSpan(ctx, "DoSyncV2")
-	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly)
+	resp, statusCode, err := p.client.DoSyncV2(spanCtx, p.accessToken, s.since, s.firstTime, p.initialToDeviceOnly, roomFilter, setPresence)
 	region.End()
 	p.trackRequestDuration(time.Since(start), s.since == "", s.firstTime)
 	if p.terminated.Load() {
@@ -474,7 +612,9 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 	p.parseToDeviceMessages(ctx, resp)
 	p.parseE2EEData(ctx, resp)
 	p.parseGlobalAccountData(ctx, resp)
+	p.parsePresence(ctx, resp)
 	p.parseRoomsResponse(ctx, resp)
+	p.updateCoordinator(resp)
 
 	wasInitial := s.since == ""
 	wasFirst := s.firstTime
@@ -485,6 +625,7 @@ func (p *poller) poll(ctx context.Context, s *pollLoopState) error {
 
 	if s.firstTime {
 		s.firstTime = false
+		p.priority.Store(false)
 		p.wg.Done()
 	}
 	p.trackProcessDuration(time.Since(start), wasInitial, wasFirst)
@@ -577,6 +718,15 @@ func (p *poller) parseGlobalAccountData(ctx context.Context, res *SyncResponse)
 	p.receiver.OnAccountData(ctx, p.userID, AccountDataGlobalRoom, res.AccountData.Events)
 }
 
+func (p *poller) parsePresence(ctx context.Context, res *SyncResponse) {
+	ctx, task := internal.StartTask(ctx, "parsePresence")
+	defer task.End()
+	if len(res.Presence.Events) == 0 {
+		return
+	}
+	p.receiver.OnPresence(ctx, res.Presence.Events)
+}
+
 func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) {
 	ctx, task := internal.StartTask(ctx, "parseRoomsResponse")
 	defer task.End()
@@ -648,19 +798,73 @@ func (p *poller) parseRoomsResponse(ctx context.Context, res *SyncResponse) {
 	for roomID, roomData := range res.Rooms.Invite {
 		p.receiver.OnInvite(ctx, p.userID, roomID, roomData.InviteState.Events)
 	}
+	for roomID, roomData := range res.Rooms.Knock {
+		p.receiver.OnKnock(ctx, p.userID, roomID, roomData.KnockState.Events)
+	}
 	var l *zerolog.Event
-	if len(res.Rooms.Invite) > 0 || len(res.Rooms.Join) > 0 {
+	if len(res.Rooms.Invite) > 0 || len(res.Rooms.Join) > 0 || len(res.Rooms.Knock) > 0 {
 		l = p.logger.Info()
 	} else {
 		l = p.logger.Debug()
 	}
 	l.Ints(
-		"rooms [invite,join,leave]", []int{len(res.Rooms.Invite), len(res.Rooms.Join), len(res.Rooms.Leave)},
+		"rooms [invite,join,leave,knock]", []int{len(res.Rooms.Invite), len(res.Rooms.Join), len(res.Rooms.Leave), len(res.Rooms.Knock)},
 	).Ints(
 		"storage [states,timelines,typing,receipts]", []int{stateCalls, timelineCalls, typingCalls, receiptCalls},
 	).Int("to_device", len(res.ToDevice.Events)).Msg("Poller: accumulated data")
 }
 
+// updateCoordinator tells the coordinator about rooms we have joined or left, if coalescing is enabled.
+func (p *poller) updateCoordinator(res *SyncResponse) {
+	if p.coordinator == nil {
+		return
+	}
+	pid := PollerID{UserID: p.userID, DeviceID: p.deviceID}
+	p.coordinator.OnSynced(pid, res.NextBatch)
+	if len(res.Rooms.Join) > 0 {
+		joined := make([]string, 0, len(res.Rooms.Join))
+		for roomID := range res.Rooms.Join {
+			joined = append(joined, roomID)
+		}
+		p.coordinator.OnJoinedRooms(pid, joined)
+	}
+	for roomID := range res.Rooms.Leave {
+		p.coordinator.OnLeftRoom(pid, roomID)
+	}
+}
+
+// backfill fetches the timelines of rooms this poller has taken over from another poller, from
+// before the other poller stopped fetching them. Rooms which fail to backfill are retried on the
+// next poll.
+func (p *poller) backfill(ctx context.Context) {
+	ctx, task := internal.StartTask(ctx, "backfill")
+	defer task.End()
+	pid := PollerID{UserID: p.userID, DeviceID: p.deviceID}
+	for since, roomIDs := range p.coordinator.Handoffs(pid) {
+		// isFirst so the request does not wait for new data if nothing has happened in the rooms.
+		// The data outside of these rooms is older than what we already have, so is not requested.
+		// To-device messages are still returned, but are not acknowledged by an older since token.
+		roomFilter := RoomFilter{Rooms: roomIDs, OnlyRooms: true}
+		resp, statusCode, err := p.client.DoSyncV2(ctx, p.accessToken, since, true, false, roomFilter, "")
+		if err != nil {
+			p.logger.Warn().Int("code", statusCode).Err(err).Int("rooms", len(roomIDs)).Msg("Poller: failed to backfill rooms taken over from another poller")
+			continue
+		}
+		// The whole room is processed, not just its timeline: while the room was excluded, this
+		// poller's responses may not have included it at all, so the ephemeral events, room
+		// account data and unread counts here can be newer than what we have.
+		join := make(map[string]SyncV2JoinResponse, len(roomIDs))
+		for _, roomID := range roomIDs {
+			if roomData, ok := resp.Rooms.Join[roomID]; ok {
+				join[roomID] = roomData
+			}
+		}
+		p.parseRoomsResponse(ctx, &SyncResponse{Rooms: SyncRoomsResponse{Join: join}})
+		p.coordinator.OnBackfilled(pid, roomIDs)
+		p.logger.Info().Int("rooms", len(roomIDs)).Int("backfilled", len(join)).Msg("Poller: backfilled rooms taken over from another poller")
+	}
+}
+
 func (p *poller) trackTimelineSize(size int, limited bool) {
 	if p.timelineSizeVec == nil {
 		return
@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,11 +26,7 @@ func TestPollerMapEnsurePolling(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -107,11 +105,7 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	}
 	initialResponse := &SyncResponse{
 		NextBatch: nextSince,
-		Rooms: struct {
-			Join   map[string]SyncV2JoinResponse   `json:"join"`
-			Invite map[string]SyncV2InviteResponse `json:"invite"`
-			Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-		}{
+		Rooms: SyncRoomsResponse{
 			Join: map[string]SyncV2JoinResponse{
 				roomID: {
 					State: EventsResponse{
@@ -195,6 +189,93 @@ func TestPollerMapEnsurePollingIdempotent(t *testing.T) {
 	t.Logf("EnsurePolling unblocked")
 }
 
+// Check that a poller started in the background is prioritised once a client waits on it.
+func TestPollerMapEnsurePollingPrioritisesExistingPoller(t *testing.T) {
+	syncRequests := make(chan string)
+	syncResponses := make(chan *SyncResponse)
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		syncRequests <- since
+		return <-syncResponses, 200, nil
+	})
+	pm := NewPollerMap(client, false)
+	pm.SetCallbacks(accumulator)
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+
+	// start the poller at startup, so it is not prioritised
+	startupUnblocked := make(chan struct{})
+	go func() {
+		pm.EnsurePolling(pid, "access_token", "", true, zerolog.New(os.Stderr))
+		close(startupUnblocked)
+	}()
+	<-syncRequests
+	pm.pollerMu.Lock()
+	poller := pm.Pollers[pid]
+	pm.pollerMu.Unlock()
+	if poller.priority.Load() {
+		t.Fatalf("poller started at startup is prioritised")
+	}
+
+	// a client now waits on the same poller
+	clientUnblocked := make(chan struct{})
+	go func() {
+		pm.EnsurePolling(pid, "access_token", "", false, zerolog.New(os.Stderr))
+		close(clientUnblocked)
+	}()
+	start := time.Now()
+	for !poller.priority.Load() {
+		if time.Since(start) > time.Second {
+			t.Fatalf("poller was not prioritised when a client waited on it")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the initial sync completes, unblocking both and no longer prioritising the poller
+	syncResponses <- &SyncResponse{NextBatch: "next"}
+	for _, ch := range []chan struct{}{startupUnblocked, clientUnblocked} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("EnsurePolling did not unblock after 1s")
+		}
+	}
+	if poller.priority.Load() {
+		t.Fatalf("poller is still prioritised after its initial sync")
+	}
+	poller.Terminate()
+	go func() {
+		for range syncRequests {
+			syncResponses <- &SyncResponse{NextBatch: "next"}
+		}
+	}()
+}
+
+// Check that callbacks pick their executor from the poller's priority flag without waiting for
+// the poller map lock.
+func TestPollerMapExecutorForDoesNotLock(t *testing.T) {
+	pm := NewPollerMap(nil, false)
+	priority := &atomic.Bool{}
+	ctx := contextWithPriority(context.Background(), priority)
+	pm.pollerMu.Lock()
+	defer pm.pollerMu.Unlock()
+	executors := make(chan chan func())
+	go func() {
+		executors <- pm.executorFor(ctx)
+		priority.Store(true)
+		executors <- pm.executorFor(ctx)
+		executors <- pm.executorFor(context.Background())
+	}()
+	for i, want := range []chan func(){pm.executor, pm.priorityExecutor, pm.executor} {
+		select {
+		case got := <-executors:
+			if got != want {
+				t.Errorf("executorFor %d: got the wrong executor", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("executorFor %d blocked on the poller map lock", i)
+		}
+	}
+}
+
 // Check that a call to Poll starts polling and accumulating, and terminates on 401s.
 func TestPollerPollFromNothing(t *testing.T) {
 	nextSince := "next"
@@ -212,11 +293,7 @@ func TestPollerPollFromNothing(t *testing.T) {
 			joinResp.State.Events = roomState
 			return &SyncResponse{
 				NextBatch: nextSince,
-				Rooms: struct {
-					Join   map[string]SyncV2JoinResponse   `json:"join"`
-					Invite map[string]SyncV2InviteResponse `json:"invite"`
-					Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-				}{
+				Rooms: SyncRoomsResponse{
 					Join: map[string]SyncV2JoinResponse{
 						roomID: joinResp,
 					},
@@ -296,11 +373,7 @@ func TestPollerPollFromExisting(t *testing.T) {
 		joinResp.Timeline.Events = roomTimelineResponses[sinceInt]
 		return &SyncResponse{
 			NextBatch: fmt.Sprintf("%d", sinceInt+1),
-			Rooms: struct {
-				Join   map[string]SyncV2JoinResponse   `json:"join"`
-				Invite map[string]SyncV2InviteResponse `json:"invite"`
-				Leave  map[string]SyncV2LeaveResponse  `json:"leave"`
-			}{
+			Rooms: SyncRoomsResponse{
 				Join: map[string]SyncV2JoinResponse{
 					roomID: joinResp,
 				},
@@ -336,6 +409,53 @@ func TestPollerPollFromExisting(t *testing.T) {
 	}
 }
 
+// Tests that rooms taken over from another poller are backfilled from before the handoff, keeping
+// everything in the room and not just its timeline.
+func TestPollerBackfill(t *testing.T) {
+	pid := PollerID{UserID: "@alice:localhost", DeviceID: "FOOBAR"}
+	roomID := "!foo:bar"
+	notifCount := 3
+	accumulator, client := newMocks(func(authHeader, since string) (*SyncResponse, int, error) {
+		if since != "old" {
+			t.Errorf("backfilled from since %q, want old", since)
+		}
+		var joinResp SyncV2JoinResponse
+		joinResp.Timeline.Events = []json.RawMessage{json.RawMessage(`{"event":1}`)}
+		joinResp.Ephemeral.Events = []json.RawMessage{json.RawMessage(`{"type":"m.receipt","content":{}}`)}
+		joinResp.UnreadNotifications.NotificationCount = &notifCount
+		return &SyncResponse{
+			NextBatch: "new",
+			Rooms: SyncRoomsResponse{
+				Join: map[string]SyncV2JoinResponse{
+					roomID: joinResp,
+				},
+			},
+		}, 200, nil
+	})
+	coordinator := newRoomCoordinator()
+	coordinator.OnSynced(pid, "old")
+	coordinator.handoffs[pid] = map[string]int64{roomID: coordinator.clock + 1}
+	poller := newPoller(pid, "Authorization: hello world", client, accumulator, zerolog.New(os.Stderr), false)
+	poller.coordinator = coordinator
+
+	poller.backfill(context.Background())
+	if len(client.roomFilters) != 1 || !reflect.DeepEqual(client.roomFilters[0], RoomFilter{Rooms: []string{roomID}, OnlyRooms: true}) {
+		t.Errorf("backfill used room filters %+v, want only the room", client.roomFilters)
+	}
+	if len(accumulator.timelines[roomID]) != 1 {
+		t.Errorf("did not accumulate backfilled timeline, got %d events want 1", len(accumulator.timelines[roomID]))
+	}
+	if len(accumulator.receipts[roomID]) != 1 {
+		t.Errorf("did not process backfilled receipts, got %d want 1", len(accumulator.receipts[roomID]))
+	}
+	if accumulator.notifCounts[roomID] != notifCount {
+		t.Errorf("did not process backfilled unread counts, got %d want %d", accumulator.notifCounts[roomID], notifCount)
+	}
+	if handoffs := coordinator.Handoffs(pid); len(handoffs) != 0 {
+		t.Errorf("rooms were not marked as backfilled: %v", handoffs)
+	}
+}
+
 // Tests that the poller backs off in 2,4,8,etc second increments to a variety of errors
 func TestPollerBackoff(t *testing.T) {
 	deviceID := "FOOBAR"
@@ -442,10 +562,12 @@ func TestPollerUnblocksIfTerminatedInitially(t *testing.T) {
 }
 
 type mockClient struct {
-	fn func(authHeader, since string) (*SyncResponse, int, error)
+	fn          func(authHeader, since string) (*SyncResponse, int, error)
+	roomFilters []RoomFilter
 }
 
-func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool) (*SyncResponse, int, error) {
+func (c *mockClient) DoSyncV2(ctx context.Context, authHeader, since string, isFirst, toDeviceOnly bool, roomFilter RoomFilter, setPresence string) (*SyncResponse, int, error) {
+	c.roomFilters = append(c.roomFilters, roomFilter)
 	return c.fn(authHeader, since)
 }
 func (c *mockClient) WhoAmI(authHeader string) (string, string, error) {
@@ -455,6 +577,8 @@ func (c *mockClient) WhoAmI(authHeader string) (string, string, error) {
 type mockDataReceiver struct {
 	states          map[string][]json.RawMessage
 	timelines       map[string][]json.RawMessage
+	receipts        map[string][]json.RawMessage
+	notifCounts     map[string]int
 	pollerIDToSince map[PollerID]string
 	incomingProcess chan struct{}
 	unblockProcess  chan struct{}
@@ -484,13 +608,21 @@ func (s *mockDataReceiver) AddToDeviceMessages(ctx context.Context, userID, devi
 }
 
 func (s *mockDataReceiver) UpdateUnreadCounts(ctx context.Context, roomID, userID string, highlightCount, notifCount *int) {
+	if notifCount != nil {
+		s.notifCounts[roomID] = *notifCount
+	}
 }
 func (s *mockDataReceiver) OnAccountData(ctx context.Context, userID, roomID string, events []json.RawMessage) {
 }
+func (s *mockDataReceiver) OnPresence(ctx context.Context, events []json.RawMessage) {
+}
 func (s *mockDataReceiver) OnReceipt(ctx context.Context, userID, roomID, ephEventType string, ephEvent json.RawMessage) {
+	s.receipts[roomID] = append(s.receipts[roomID], ephEvent)
 }
 func (s *mockDataReceiver) OnInvite(ctx context.Context, userID, roomID string, inviteState []json.RawMessage) {
 }
+func (s *mockDataReceiver) OnKnock(ctx context.Context, userID, roomID string, knockState []json.RawMessage) {
+}
 func (s *mockDataReceiver) OnLeftRoom(ctx context.Context, userID, roomID string) {}
 func (s *mockDataReceiver) OnE2EEData(ctx context.Context, userID, deviceID string, otkCounts map[string]int, fallbackKeyTypes []string, deviceListChanges map[string]int) {
 }
@@ -505,6 +637,8 @@ func newMocks(doSyncV2 func(authHeader, since string) (*SyncResponse, int, error
 	accumulator := &mockDataReceiver{
 		states:          make(map[string][]json.RawMessage),
 		timelines:       make(map[string][]json.RawMessage),
+		receipts:        make(map[string][]json.RawMessage),
+		notifCounts:     make(map[string]int),
 		pollerIDToSince: make(map[PollerID]string),
 	}
 	return accumulator, client
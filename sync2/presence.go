@@ -0,0 +1,75 @@
+package sync2
+
+import "sync"
+
+// presenceRank orders the values of `set_presence` from least to most online.
+var presenceRank = map[string]int{
+	"offline":     1,
+	"unavailable": 2,
+	"online":      3,
+}
+
+// IsValidSetPresence returns true if this is a valid value for the v2 `set_presence` parameter.
+func IsValidSetPresence(presence string) bool {
+	_, ok := presenceRank[presence]
+	return ok
+}
+
+// presenceTracker tracks the presence each device has asked to be set via sliding sync requests.
+// As each poller calls /sync independently, the homeserver would see conflicting presence if each
+// poller sent its own device's presence. Instead, all pollers for a user send the most online
+// presence requested by any of the user's devices. Devices which have never asked to set their
+// presence are ignored, and if no device has, no presence is sent so the homeserver default applies.
+type presenceTracker struct {
+	mu *sync.Mutex
+	// user_id -> device_id -> presence
+	userToDevicePresence map[string]map[string]string
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		mu:                   &sync.Mutex{},
+		userToDevicePresence: make(map[string]map[string]string),
+	}
+}
+
+// Set the presence requested by this device. Returns true if the presence for this user changed.
+func (t *presenceTracker) Set(pid PollerID, presence string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	before := t.forUser(pid.UserID)
+	devices := t.userToDevicePresence[pid.UserID]
+	if devices == nil {
+		devices = make(map[string]string)
+		t.userToDevicePresence[pid.UserID] = devices
+	}
+	devices[pid.DeviceID] = presence
+	return t.forUser(pid.UserID) != before
+}
+
+// Remove the presence requested by this device, e.g because it has logged out.
+func (t *presenceTracker) Remove(pid PollerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	devices := t.userToDevicePresence[pid.UserID]
+	delete(devices, pid.DeviceID)
+	if len(devices) == 0 {
+		delete(t.userToDevicePresence, pid.UserID)
+	}
+}
+
+// ForUser returns the presence to send for this user, or "" to send no presence.
+func (t *presenceTracker) ForUser(userID string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.forUser(userID)
+}
+
+func (t *presenceTracker) forUser(userID string) (presence string) {
+	for _, p := range t.userToDevicePresence[userID] {
+		if presenceRank[p] > presenceRank[presence] {
+			presence = p
+		}
+	}
+	return presence
+}
@@ -0,0 +1,58 @@
+package sync2
+
+import "testing"
+
+func TestPresenceTrackerMostOnlineWins(t *testing.T) {
+	alice := "@alice:localhost"
+	phone := PollerID{UserID: alice, DeviceID: "PHONE"}
+	laptop := PollerID{UserID: alice, DeviceID: "LAPTOP"}
+	bob := PollerID{UserID: "@bob:localhost", DeviceID: "BOB"}
+	tracker := newPresenceTracker()
+
+	assertPresence := func(msg, userID, want string) {
+		t.Helper()
+		if got := tracker.ForUser(userID); got != want {
+			t.Errorf("%s: got presence %q want %q", msg, got, want)
+		}
+	}
+	assertPresence("no devices", alice, "")
+
+	if !tracker.Set(phone, "unavailable") {
+		t.Errorf("first Set did not change presence")
+	}
+	assertPresence("phone unavailable", alice, "unavailable")
+
+	if !tracker.Set(laptop, "online") {
+		t.Errorf("Set to more online presence did not change presence")
+	}
+	assertPresence("laptop online", alice, "online")
+
+	if tracker.Set(phone, "offline") {
+		t.Errorf("Set to less online presence on another device changed presence")
+	}
+	assertPresence("phone offline, laptop online", alice, "online")
+
+	// other users are unaffected
+	tracker.Set(bob, "offline")
+	assertPresence("bob", bob.UserID, "offline")
+	assertPresence("alice unaffected by bob", alice, "online")
+
+	// when the laptop logs out, the phone's presence applies
+	tracker.Remove(laptop)
+	assertPresence("laptop removed", alice, "offline")
+	tracker.Remove(phone)
+	assertPresence("all removed", alice, "")
+}
+
+func TestIsValidSetPresence(t *testing.T) {
+	for _, valid := range []string{"online", "unavailable", "offline"} {
+		if !IsValidSetPresence(valid) {
+			t.Errorf("%s should be valid", valid)
+		}
+	}
+	for _, invalid := range []string{"", "busy", "Online"} {
+		if IsValidSetPresence(invalid) {
+			t.Errorf("%s should be invalid", invalid)
+		}
+	}
+}
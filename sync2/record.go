@@ -0,0 +1,170 @@
+package sync2
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+type pollerIDContextKey struct{}
+
+// contextWithPollerID returns a context which remembers which device is making sync v2 requests.
+// Clients can use this to attribute requests to devices without having to look up access tokens.
+func contextWithPollerID(ctx context.Context, pid PollerID) context.Context {
+	return context.WithValue(ctx, pollerIDContextKey{}, pid)
+}
+
+func pollerIDFromContext(ctx context.Context) (PollerID, bool) {
+	pid, ok := ctx.Value(pollerIDContextKey{}).(PollerID)
+	return pid, ok
+}
+
+// RecordedResponse is a single sync v2 response in a recording, along with the device which
+// received it and the since token it was requested with.
+type RecordedResponse struct {
+	UserID   string        `json:"user_id"`
+	DeviceID string        `json:"device_id"`
+	Since    string        `json:"since"`
+	Response *SyncResponse `json:"response"`
+}
+
+// RecordingClient wraps a Client and records every successful sync v2 response into a gzipped
+// stream of newline-delimited JSON RecordedResponse objects. Access tokens are never recorded.
+// Recordings can be loaded with LoadRecording and replayed with a FixtureClient.
+type RecordingClient struct {
+	Client
+	mu *sync.Mutex
+	f  io.Closer
+	gz *gzip.Writer
+}
+
+// NewRecordingClient makes a RecordingClient which appends a new gzip member to the file at path.
+// Concatenated gzip members are read back as a single stream, so a recording can span restarts
+// provided each process called Close.
+func NewRecordingClient(client Client, path string) (*RecordingClient, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("NewRecordingClient: failed to open %s: %w", path, err)
+	}
+	return &RecordingClient{
+		Client: client,
+		mu:     &sync.Mutex{},
+		f:      f,
+		gz:     gzip.NewWriter(f),
+	}, nil
+}
+
+func (c *RecordingClient) DoSyncV2(ctx context.Context, accessToken, since string, isFirst, toDeviceOnly bool, roomFilter RoomFilter, setPresence string) (*SyncResponse, int, error) {
+	res, statusCode, err := c.Client.DoSyncV2(ctx, accessToken, since, isFirst, toDeviceOnly, roomFilter, setPresence)
+	if err != nil || res == nil {
+		return res, statusCode, err
+	}
+	if len(roomFilter.Rooms) > 0 {
+		// backfill requests re-fetch part of a response which has already been recorded
+		return res, statusCode, err
+	}
+	pid, ok := pollerIDFromContext(ctx)
+	if !ok {
+		logger.Warn().Str("since", since).Msg("RecordingClient: no device for sync v2 response, not recording")
+		return res, statusCode, err
+	}
+	if recErr := c.record(RecordedResponse{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Since:    since,
+		Response: res,
+	}); recErr != nil {
+		logger.Err(recErr).Str("user", pid.UserID).Str("device", pid.DeviceID).Msg("RecordingClient: failed to record response")
+	}
+	return res, statusCode, err
+}
+
+func (c *RecordingClient) record(r RecordedResponse) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err = c.gz.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	// flush so the recording is usable even if the process is killed
+	return c.gz.Flush()
+}
+
+// Close finishes the recording. No more responses will be recorded.
+func (c *RecordingClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.gz.Close(); err != nil {
+		return err
+	}
+	return c.f.Close()
+}
+
+// LoadRecording reads all responses in a recording made by a RecordingClient, in the order they
+// were recorded.
+func LoadRecording(path string) ([]RecordedResponse, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRecording: %w", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("LoadRecording: %w", err)
+	}
+	defer gz.Close()
+	var recs []RecordedResponse
+	dec := json.NewDecoder(bufio.NewReader(gz))
+	for {
+		var r RecordedResponse
+		err = dec.Decode(&r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a truncated final line means the process died mid-write: keep what we have.
+			break
+		}
+		if err != nil {
+			return recs, fmt.Errorf("LoadRecording: entry %d: %w", len(recs), err)
+		}
+		recs = append(recs, r)
+	}
+	return recs, nil
+}
+
+// NewFixtureClientFromRecording loads a recording into a FixtureClient. Each recorded device is
+// given a synthetic access token. Returns the since token each device should start polling from.
+func NewFixtureClientFromRecording(path string) (*FixtureClient, map[PollerID]string, error) {
+	recs, err := LoadRecording(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := NewFixtureClient()
+	startSince := make(map[PollerID]string)
+	for _, r := range recs {
+		if r.Response == nil {
+			continue
+		}
+		pid := PollerID{UserID: r.UserID, DeviceID: r.DeviceID}
+		if _, exists := startSince[pid]; !exists {
+			startSince[pid] = r.Since
+			c.AddDevice(FixtureAccessToken(pid), pid)
+		}
+		c.AddResponses(pid, FixtureResponse{
+			Since:    r.Since,
+			Response: *r.Response,
+		})
+	}
+	return c, startSince, nil
+}
+
+// FixtureAccessToken is the synthetic access token for a device loaded from a recording.
+func FixtureAccessToken(pid PollerID) string {
+	return "fixture_" + pid.UserID + "_" + pid.DeviceID
+}
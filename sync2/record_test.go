@@ -0,0 +1,76 @@
+package sync2
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	alice := PollerID{UserID: "@alice:localhost", DeviceID: "ALICE"}
+	bob := PollerID{UserID: "@bob:localhost", DeviceID: "BOB"}
+	upstream := NewFixtureClient()
+	upstream.AddDevice("alice_token", alice)
+	upstream.AddDevice("bob_token", bob)
+	upstream.AddResponses(alice, FixtureResponse{Since: "", Response: SyncResponse{NextBatch: "a1"}})
+	upstream.AddResponses(alice, FixtureResponse{Since: "a1", Response: SyncResponse{NextBatch: "a2"}})
+	upstream.AddResponses(bob, FixtureResponse{Since: "b5", Response: SyncResponse{NextBatch: "b6"}})
+
+	path := filepath.Join(t.TempDir(), "recording.gz")
+	recorder, err := NewRecordingClient(upstream, path)
+	if err != nil {
+		t.Fatalf("NewRecordingClient: %s", err)
+	}
+	aliceCtx := contextWithPollerID(context.Background(), alice)
+	bobCtx := contextWithPollerID(context.Background(), bob)
+	mustSync := func(ctx context.Context, token, since, wantNext string) {
+		t.Helper()
+		res, _, err := recorder.DoSyncV2(ctx, token, since, true, false, RoomFilter{}, "")
+		if err != nil {
+			t.Fatalf("DoSyncV2: %s", err)
+		}
+		if res.NextBatch != wantNext {
+			t.Fatalf("DoSyncV2: got next_batch %s want %s", res.NextBatch, wantNext)
+		}
+	}
+	mustSync(aliceCtx, "alice_token", "", "a1")
+	mustSync(bobCtx, "bob_token", "b5", "b6")
+	mustSync(aliceCtx, "alice_token", "a1", "a2")
+	// requests without a device in the context are not recorded
+	mustSync(context.Background(), "alice_token", "a1", "a2")
+	if err = recorder.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	recs, err := LoadRecording(path)
+	if err != nil {
+		t.Fatalf("LoadRecording: %s", err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("LoadRecording: got %d responses want 3", len(recs))
+	}
+	assertEqual(t, recs[1].UserID, bob.UserID, "recs[1] user_id mismatch")
+	assertEqual(t, recs[1].Since, "b5", "recs[1] since mismatch")
+
+	replay, startSince, err := NewFixtureClientFromRecording(path)
+	if err != nil {
+		t.Fatalf("NewFixtureClientFromRecording: %s", err)
+	}
+	assertEqual(t, startSince[alice], "", "alice start since mismatch")
+	assertEqual(t, startSince[bob], "b5", "bob start since mismatch")
+	res, _, err := replay.DoSyncV2(context.Background(), FixtureAccessToken(alice), "a1", true, false, RoomFilter{}, "")
+	if err != nil {
+		t.Fatalf("DoSyncV2: %s", err)
+	}
+	assertEqual(t, res.NextBatch, "a2", "replayed next_batch mismatch")
+	if replay.NumExhausted() != 0 {
+		t.Fatalf("NumExhausted: got %d want 0", replay.NumExhausted())
+	}
+	replay.DoSyncV2(context.Background(), FixtureAccessToken(alice), "a2", true, false, RoomFilter{}, "")
+	if replay.NumExhausted() != 1 {
+		t.Fatalf("NumExhausted: got %d want 1", replay.NumExhausted())
+	}
+	if !replay.Exhausted(alice) || replay.Exhausted(bob) {
+		t.Fatalf("Exhausted: got alice=%v bob=%v want alice=true bob=false", replay.Exhausted(alice), replay.Exhausted(bob))
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/getsentry/sentry-go"
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"github.com/rs/zerolog"
 )
 
@@ -20,7 +21,7 @@ type Storage struct {
 }
 
 func NewStore(postgresURI, secret string) *Storage {
-	db, err := sqlx.Open("postgres", postgresURI)
+	db, err := sqlutil.Open(postgresURI)
 	if err != nil {
 		sentry.CaptureException(err)
 		// TODO: if we panic(), will sentry have a chance to flush the event?
@@ -8,6 +8,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/matrix-org/sliding-sync/sqlutil"
 	"io"
 	"strings"
 	"time"
@@ -35,15 +36,7 @@ type TokensTable struct {
 
 // NewTokensTable creates the syncv3_sync2_tokens table if it does not already exist.
 func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
-	db.MustExec(`
-	CREATE TABLE IF NOT EXISTS syncv3_sync2_tokens (
-		token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token)
-		token_encrypted TEXT NOT NULL,
-		-- TODO: FK constraints to devices table?
-		user_id TEXT NOT NULL,
-		device_id TEXT NOT NULL,
-		last_seen TIMESTAMP WITH TIME ZONE NOT NULL
-	);`)
+	db.MustExec(tokensTableSchema(sqlutil.DialectOf(db)))
 
 	// derive the key from the secret
 	hash := sha256.New()
@@ -55,6 +48,18 @@ func NewTokensTable(db *sqlx.DB, secret string) *TokensTable {
 	}
 }
 
+func tokensTableSchema(dialect sqlutil.Dialect) string {
+	return `
+	CREATE TABLE IF NOT EXISTS syncv3_sync2_tokens (
+		token_hash TEXT NOT NULL PRIMARY KEY, -- SHA256(access token)
+		token_encrypted TEXT NOT NULL,
+		-- TODO: FK constraints to devices table?
+		user_id TEXT NOT NULL,
+		device_id TEXT NOT NULL,
+		last_seen ` + dialect.TimestampType() + ` NOT NULL
+	);`
+}
+
 func (t *TokensTable) encrypt(token string) string {
 	block, err := aes.NewCipher(t.key256)
 	if err != nil {
@@ -147,15 +152,14 @@ func (t *TokensTable) TokenForEachDevice(txn *sqlx.Tx) (tokens []TokenForPoller,
 		db = t.db
 	}
 
-	// Fetches the most recently seen token for each device, see e.g.
-	// https://www.postgresql.org/docs/11/sql-select.html#SQL-DISTINCT
-	err = sqlx.Select(
-		db,
-		&tokens,
-		`SELECT DISTINCT ON (user_id, device_id) token_encrypted, user_id, device_id, last_seen, since
-		FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id)
-		ORDER BY user_id, device_id, last_seen DESC
-	`)
+	// Fetches the most recently seen token for each device.
+	query := `SELECT token_encrypted, user_id, device_id, last_seen, since FROM (
+			SELECT token_encrypted, user_id, device_id, last_seen, since, ROW_NUMBER() OVER (
+				PARTITION BY user_id, device_id ORDER BY ` + sqlutil.DialectOf(t.db).OrderByTimestamp("last_seen") + ` DESC
+			) AS n FROM syncv3_sync2_tokens JOIN syncv3_sync2_devices USING (user_id, device_id)
+		) AS latest WHERE n = 1 ORDER BY user_id, device_id
+	`
+	err = sqlx.Select(db, &tokens, query)
 	if err != nil {
 		return
 	}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -54,11 +55,13 @@ var logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Output(zerolog.C
 // The purpose of global cache is to store global-level information about all rooms the server is aware of.
 // Global-level information is represented as internal.RoomMetadata and includes things like Heroes, join/invite
 // counts, if the room is encrypted, etc. Basically anything that is the same for all users of the system. This
-// information is populated at startup from the database and then kept up-to-date by hooking into the
-// Dispatcher for new events.
+// information is populated at startup from the database (or on demand, see EnableLazyLoading) and then kept
+// up-to-date by hooking into the Dispatcher for new events.
 type GlobalCache struct {
 	// LoadJoinedRoomsOverride allows tests to mock out the behaviour of LoadJoinedRooms.
 	LoadJoinedRoomsOverride func(userID string) (pos int64, joinedRooms map[string]*internal.RoomMetadata, joinTimings map[string]internal.EventMetadata, latestNIDs map[string]int64, err error)
+	// LoadMetadataOverride allows tests to mock out loading room metadata from the database when lazy loading.
+	LoadMetadataOverride func(roomIDs []string) (map[string]internal.RoomMetadata, error)
 
 	// inserts are done by v2 poll loops, selects are done by v3 request threads
 	// there are lots of overlapping keys as many users (threads) can be joined to the same room (key)
@@ -66,6 +69,23 @@ type GlobalCache struct {
 	roomIDToMetadata   map[string]*internal.RoomMetadata
 	roomIDToMetadataMu *sync.RWMutex
 
+	// If set, room metadata is loaded on demand and roomIDToMetadata is bounded. See EnableLazyLoading.
+	// All fields below are protected by roomIDToMetadataMu.
+	lazy         bool
+	maxRooms     int
+	roomInUse    func(roomID string) bool
+	roomLastUsed map[string]uint64       // room_id -> value of useCounter when the room was last loaded
+	useCounter   uint64                  // incremented on every call to LoadRooms
+	pendingLoads map[string]*pendingLoad // room_id -> in-progress loads from the database
+
+	// set whilst already-processed events are replayed at startup, so database side-effects of
+	// processing them are not repeated.
+	replaying *atomic.Bool
+
+	// the latest presence for each user. Presence is global so is held here rather than per-user.
+	userIDToPresence   map[string]internal.Presence
+	userIDToPresenceMu *sync.RWMutex
+
 	// for loading room state not held in-memory TODO: remove to another struct along with associated functions
 	store *state.Storage
 }
@@ -73,8 +93,11 @@ type GlobalCache struct {
 func NewGlobalCache(store *state.Storage) *GlobalCache {
 	return &GlobalCache{
 		roomIDToMetadataMu: &sync.RWMutex{},
+		replaying:          &atomic.Bool{},
 		store:              store,
 		roomIDToMetadata:   make(map[string]*internal.RoomMetadata),
+		userIDToPresence:   make(map[string]internal.Presence),
+		userIDToPresenceMu: &sync.RWMutex{},
 	}
 }
 
@@ -85,6 +108,9 @@ func (c *GlobalCache) OnRegistered(_ context.Context) error {
 // LoadRooms loads the current room metadata for the given room IDs. Races unless you call this in a dispatcher loop.
 // Always returns copies of the room metadata so ownership can be passed to other threads.
 func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[string]*internal.RoomMetadata {
+	if c.lazy {
+		return c.lazyLoadRooms(ctx, roomIDs)
+	}
 	c.roomIDToMetadataMu.RLock()
 	defer c.roomIDToMetadataMu.RUnlock()
 	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
@@ -99,6 +125,13 @@ func (c *GlobalCache) LoadRooms(ctx context.Context, roomIDs ...string) map[stri
 // and returns rooms in a map. The output map is non-nil and contains exactly the same
 // set of keys as the input map. The values in the input map are completely ignored.
 func (c *GlobalCache) LoadRoomsFromMap(ctx context.Context, joinTimingsByRoomID map[string]internal.EventMetadata) map[string]*internal.RoomMetadata {
+	if c.lazy {
+		roomIDs := make([]string, 0, len(joinTimingsByRoomID))
+		for roomID := range joinTimingsByRoomID {
+			roomIDs = append(roomIDs, roomID)
+		}
+		return c.lazyLoadRooms(ctx, roomIDs)
+	}
 	c.roomIDToMetadataMu.RLock()
 	defer c.roomIDToMetadataMu.RUnlock()
 	result := make(map[string]*internal.RoomMetadata, len(joinTimingsByRoomID))
@@ -246,6 +279,69 @@ func (c *GlobalCache) Startup(roomIDToMetadata map[string]internal.RoomMetadata)
 	return nil
 }
 
+// Snapshot returns a deep copy of the metadata for every room held in memory, suitable for
+// passing to Startup. Typing notifications are not included as they are short-lived, and nor are
+// stub rooms which have not seen any events.
+func (c *GlobalCache) Snapshot() map[string]internal.RoomMetadata {
+	c.roomIDToMetadataMu.RLock()
+	defer c.roomIDToMetadataMu.RUnlock()
+	result := make(map[string]internal.RoomMetadata, len(c.roomIDToMetadata))
+	for roomID, metadata := range c.roomIDToMetadata {
+		if metadata.LastMessageTimestamp <= 1 {
+			continue
+		}
+		m := *c.copyRoom(roomID)
+		m.TypingEvent = nil
+		m.LatestEventsByType = make(map[string]internal.EventMetadata, len(metadata.LatestEventsByType))
+		for evType, em := range metadata.LatestEventsByType {
+			m.LatestEventsByType[evType] = em
+		}
+		m.ChildSpaceRooms = make(map[string]struct{}, len(metadata.ChildSpaceRooms))
+		for childRoomID := range metadata.ChildSpaceRooms {
+			m.ChildSpaceRooms[childRoomID] = struct{}{}
+		}
+		result[roomID] = m
+	}
+	return result
+}
+
+// SetReplaying marks that events passed to OnNewEvent have been processed before, when replaying
+// events at startup.
+func (c *GlobalCache) SetReplaying(replaying bool) {
+	c.replaying.Store(replaying)
+}
+
+// IsLazy returns true if room metadata is loaded on demand. See EnableLazyLoading.
+func (c *GlobalCache) IsLazy() bool {
+	c.roomIDToMetadataMu.RLock()
+	defer c.roomIDToMetadataMu.RUnlock()
+	return c.lazy
+}
+
+// StartupPresence populates the latest presence for each user.
+func (c *GlobalCache) StartupPresence(presence []internal.Presence) {
+	c.userIDToPresenceMu.Lock()
+	defer c.userIDToPresenceMu.Unlock()
+	for _, p := range presence {
+		c.userIDToPresence[p.UserID] = p
+	}
+}
+
+// LoadPresence returns the latest presence for the given users. Users without any known presence
+// are omitted.
+func (c *GlobalCache) LoadPresence(userIDs ...string) []internal.Presence {
+	c.userIDToPresenceMu.RLock()
+	defer c.userIDToPresenceMu.RUnlock()
+	result := make([]internal.Presence, 0, len(userIDs))
+	for _, userID := range userIDs {
+		p, ok := c.userIDToPresence[userID]
+		if ok {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
 // =================================================
 // Listener function called by dispatcher below
 // =================================================
@@ -256,6 +352,14 @@ func (c *GlobalCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEv
 	defer c.roomIDToMetadataMu.Unlock()
 	metadata := c.roomIDToMetadata[roomID]
 	if metadata == nil {
+		if c.lazy {
+			// Typing notifications are not stored in the database, so remember them for any load in
+			// progress. Otherwise, nobody has loaded the room so there is nobody to tell.
+			if pending := c.pendingLoads[roomID]; pending != nil && evType == "m.typing" {
+				pending.typing = ephEvent
+			}
+			return
+		}
 		metadata = internal.NewRoomMetadata(roomID)
 	}
 
@@ -270,16 +374,75 @@ func (c *GlobalCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	// nothing to do but we need it because the Dispatcher demands it.
 }
 
+func (c *GlobalCache) OnPresence(ctx context.Context, presence internal.Presence) {
+	c.userIDToPresenceMu.Lock()
+	defer c.userIDToPresenceMu.Unlock()
+	c.userIDToPresence[presence.UserID] = presence
+}
+
 func (c *GlobalCache) OnNewEvent(
 	ctx context.Context, ed *EventData,
 ) {
+	c.retireInvitesAndKnocks(ctx, ed)
 	// update global state
 	c.roomIDToMetadataMu.Lock()
 	defer c.roomIDToMetadataMu.Unlock()
+	if c.lazy {
+		if pending := c.pendingLoads[ed.RoomID]; pending != nil {
+			pending.events = append(pending.events, ed)
+		}
+		metadata := c.roomIDToMetadata[ed.RoomID]
+		if metadata == nil {
+			// The event is already in the database, so it will be included when this room is next loaded.
+			return
+		}
+		updateMetadata(metadata, ed)
+		return
+	}
 	metadata := c.roomIDToMetadata[ed.RoomID]
 	if metadata == nil {
 		metadata = internal.NewRoomMetadata(ed.RoomID)
 	}
+	updateMetadata(metadata, ed)
+	c.roomIDToMetadata[ed.RoomID] = metadata
+}
+
+// retireInvitesAndKnocks removes outstanding invites and knocks from the database when a user joins
+// the room. This must happen regardless of whether the room is held in memory.
+func (c *GlobalCache) retireInvitesAndKnocks(ctx context.Context, ed *EventData) {
+	if c.replaying.Load() {
+		// done when the event was first processed, and the user may have since been invited again.
+		return
+	}
+	if ed.EventType != "m.room.member" || ed.StateKey == nil || ed.Content.Get("membership").Str != "join" {
+		return
+	}
+	eventJSON := gjson.ParseBytes(ed.Event)
+	if !internal.IsMembershipChange(eventJSON) {
+		return
+	}
+	switch eventJSON.Get("unsigned.prev_content.membership").Str {
+	case "invite":
+		// invite -> join, retire any outstanding invites
+		err := c.store.InvitesTable.RemoveInvite(*ed.StateKey, ed.RoomID)
+		if err != nil {
+			logger.Err(err).Str("user", *ed.StateKey).Str("room", ed.RoomID).Msg("failed to remove accepted invite")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+	case "knock":
+		// knock -> join e.g via a knock_restricted join rule, retire any outstanding knocks
+		err := c.store.KnocksTable.RemoveKnock(*ed.StateKey, ed.RoomID)
+		if err != nil {
+			logger.Err(err).Str("user", *ed.StateKey).Str("room", ed.RoomID).Msg("failed to remove knock")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		}
+	}
+}
+
+// updateMetadata applies the given event to the room metadata. Applying the same event more than
+// once has no further effect, which lets lazily loaded rooms replay events which may already be
+// reflected in the metadata loaded from the database.
+func updateMetadata(metadata *internal.RoomMetadata, ed *EventData) {
 	switch ed.EventType {
 	case "m.room.name":
 		if ed.StateKey != nil && *ed.StateKey == "" {
@@ -334,14 +497,6 @@ func (c *GlobalCache) OnNewEvent(
 					metadata.RemoveHero(*ed.StateKey)
 				}
 
-				if membership == "join" && eventJSON.Get("unsigned.prev_content.membership").Str == "invite" {
-					// invite -> join, retire any outstanding invites
-					err := c.store.InvitesTable.RemoveInvite(*ed.StateKey, ed.RoomID)
-					if err != nil {
-						logger.Err(err).Str("user", *ed.StateKey).Str("room", ed.RoomID).Msg("failed to remove accepted invite")
-						internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-					}
-				}
 			}
 			if len(metadata.Heroes) < 6 && (membership == "join" || membership == "invite") {
 				// try to find the existing hero e.g they changed their display name
@@ -369,5 +524,4 @@ func (c *GlobalCache) OnNewEvent(
 		NID:       ed.NID,
 		Timestamp: ed.Timestamp,
 	}
-	c.roomIDToMetadata[ed.RoomID] = metadata
 }
@@ -0,0 +1,165 @@
+package caches
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// pendingLoad tracks live updates for a room which arrive while its metadata is being loaded from
+// the database, so they can be applied to the loaded metadata before it is cached.
+type pendingLoad struct {
+	numLoads int
+	events   []*EventData
+	typing   json.RawMessage
+}
+
+// EnableLazyLoading makes the cache load room metadata from the database when it is first asked for,
+// rather than for every room in Startup, and hold metadata for at most maxRooms rooms. When over this
+// limit, the least recently loaded rooms for which roomInUse returns false are evicted. Rooms which are
+// in use are never evicted, so the cache can grow beyond maxRooms. Must be called before Startup.
+func (c *GlobalCache) EnableLazyLoading(maxRooms int, roomInUse func(roomID string) bool) {
+	c.roomIDToMetadataMu.Lock()
+	defer c.roomIDToMetadataMu.Unlock()
+	c.lazy = true
+	c.maxRooms = maxRooms
+	c.roomInUse = roomInUse
+	c.roomLastUsed = make(map[string]uint64)
+	c.pendingLoads = make(map[string]*pendingLoad)
+}
+
+// lazyLoadRooms is LoadRooms for a lazily loaded cache. Rooms which are not held in memory are
+// loaded from the database, then updated with any live events which arrived during the load.
+// Replaying these events is safe as updateMetadata is idempotent.
+func (c *GlobalCache) lazyLoadRooms(ctx context.Context, roomIDs []string) map[string]*internal.RoomMetadata {
+	result := make(map[string]*internal.RoomMetadata, len(roomIDs))
+	var missing []string
+	c.roomIDToMetadataMu.Lock()
+	c.useCounter++
+	useCounter := c.useCounter
+	for _, roomID := range roomIDs {
+		if _, ok := c.roomIDToMetadata[roomID]; ok {
+			c.roomLastUsed[roomID] = useCounter
+			result[roomID] = c.copyRoom(roomID)
+			continue
+		}
+		pending := c.pendingLoads[roomID]
+		if pending == nil {
+			pending = &pendingLoad{}
+			c.pendingLoads[roomID] = pending
+		}
+		pending.numLoads++
+		missing = append(missing, roomID)
+	}
+	c.roomIDToMetadataMu.Unlock()
+	if len(missing) == 0 {
+		return result
+	}
+
+	loadMetadata := c.LoadMetadataOverride
+	if loadMetadata == nil {
+		loadMetadata = c.store.MetadataForRooms
+	}
+	loaded, err := loadMetadata(missing)
+	if err != nil {
+		logger.Err(err).Int("num_rooms", len(missing)).Msg("GlobalCache: failed to load room metadata")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+	}
+
+	c.roomIDToMetadataMu.Lock()
+	for _, roomID := range missing {
+		pending := c.pendingLoads[roomID]
+		pending.numLoads--
+		if pending.numLoads == 0 {
+			delete(c.pendingLoads, roomID)
+		}
+		// another load may have cached this room in the meantime, in which case it has been kept
+		// up-to-date since and should be used instead.
+		if _, ok := c.roomIDToMetadata[roomID]; !ok && err == nil {
+			metadata := internal.NewRoomMetadata(roomID)
+			if m, ok := loaded[roomID]; ok {
+				metadata = &m
+				if metadata.LatestEventsByType == nil {
+					metadata.LatestEventsByType = make(map[string]internal.EventMetadata)
+				}
+				if metadata.ChildSpaceRooms == nil {
+					metadata.ChildSpaceRooms = make(map[string]struct{})
+				}
+			}
+			for _, ed := range pending.events {
+				updateMetadata(metadata, ed)
+			}
+			metadata.TypingEvent = pending.typing
+			c.roomIDToMetadata[roomID] = metadata
+		}
+		c.roomLastUsed[roomID] = useCounter
+		result[roomID] = c.copyRoom(roomID)
+	}
+	c.roomIDToMetadataMu.Unlock()
+
+	c.evictRooms()
+	return result
+}
+
+// evictRooms removes the least recently loaded rooms which are not in use until the cache is a
+// tenth below maxRooms, so that evictions are batched rather than done on every load.
+func (c *GlobalCache) evictRooms() {
+	type roomUse struct {
+		roomID   string
+		lastUsed uint64
+	}
+	c.roomIDToMetadataMu.RLock()
+	numRooms := len(c.roomIDToMetadata)
+	if numRooms <= c.maxRooms {
+		c.roomIDToMetadataMu.RUnlock()
+		return
+	}
+	candidates := make([]roomUse, 0, numRooms)
+	for roomID := range c.roomIDToMetadata {
+		candidates = append(candidates, roomUse{roomID, c.roomLastUsed[roomID]})
+	}
+	c.roomIDToMetadataMu.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed < candidates[j].lastUsed
+	})
+	numToEvict := numRooms - (c.maxRooms - c.maxRooms/10)
+	var evict []roomUse
+	// check rooms are in use without holding the lock, as this may call out to other components
+	for _, candidate := range candidates {
+		if len(evict) >= numToEvict {
+			break
+		}
+		if c.roomInUse != nil && c.roomInUse(candidate.roomID) {
+			continue
+		}
+		evict = append(evict, candidate)
+	}
+
+	c.roomIDToMetadataMu.Lock()
+	defer c.roomIDToMetadataMu.Unlock()
+	numEvicted := 0
+	for _, candidate := range evict {
+		if c.roomLastUsed[candidate.roomID] != candidate.lastUsed {
+			continue // loaded again since we looked, so keep it
+		}
+		delete(c.roomIDToMetadata, candidate.roomID)
+		delete(c.roomLastUsed, candidate.roomID)
+		numEvicted++
+	}
+	if len(evict) < numToEvict {
+		logger.Warn().Int("num_rooms", len(c.roomIDToMetadata)).Int("max_rooms", c.maxRooms).Msg(
+			"GlobalCache: too many rooms in use to stay within the limit",
+		)
+	}
+	logger.Debug().Int("evicted", numEvicted).Int("num_rooms", len(c.roomIDToMetadata)).Msg("GlobalCache: evicted rooms")
+}
+
+// NumRooms returns the number of rooms with metadata held in memory.
+func (c *GlobalCache) NumRooms() int {
+	c.roomIDToMetadataMu.RLock()
+	defer c.roomIDToMetadataMu.RUnlock()
+	return len(c.roomIDToMetadata)
+}
@@ -6,10 +6,12 @@ import (
 	"encoding/json"
 	"testing"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/testutils"
+	"github.com/tidwall/gjson"
 )
 
 func TestGlobalCacheLoadState(t *testing.T) {
@@ -233,3 +235,120 @@ func TestGlobalCacheLoadState(t *testing.T) {
 		})
 	}
 }
+
+func TestGlobalCacheLazyLoading(t *testing.T) {
+	ctx := context.Background()
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	roomC := "!c:localhost"
+	empty := ""
+	nameEvent := func(roomID, name string, nid int64) *caches.EventData {
+		return &caches.EventData{
+			RoomID:    roomID,
+			EventType: "m.room.name",
+			StateKey:  &empty,
+			Content:   gjson.Parse(`{"name":"` + name + `"}`),
+			Timestamp: uint64(1000 + nid),
+			NID:       nid,
+		}
+	}
+	// the names stored in the "database"
+	dbNames := map[string]string{
+		roomA: "A",
+		roomB: "B",
+		roomC: "C",
+	}
+	var loaded []string
+	var duringLoad func()
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.LoadMetadataOverride = func(roomIDs []string) (map[string]internal.RoomMetadata, error) {
+		result := make(map[string]internal.RoomMetadata)
+		for _, roomID := range roomIDs {
+			m := internal.NewRoomMetadata(roomID)
+			m.NameEvent = dbNames[roomID]
+			result[roomID] = *m
+		}
+		loaded = append(loaded, roomIDs...)
+		if duringLoad != nil {
+			duringLoad()
+		}
+		return result, nil
+	}
+	inUse := map[string]bool{roomA: true}
+	globalCache.EnableLazyLoading(2, func(roomID string) bool {
+		return inUse[roomID]
+	})
+	assertName := func(roomID, want string) {
+		t.Helper()
+		got := globalCache.LoadRooms(ctx, roomID)[roomID].NameEvent
+		if got != want {
+			t.Errorf("room %s: got name %q want %q", roomID, got, want)
+		}
+	}
+
+	// rooms are loaded once, then kept up-to-date by live events
+	assertName(roomA, "A")
+	assertName(roomA, "A")
+	globalCache.OnNewEvent(ctx, nameEvent(roomA, "A2", 1))
+	assertName(roomA, "A2")
+	if len(loaded) != 1 {
+		t.Fatalf("loaded %v from the database, want only %s", loaded, roomA)
+	}
+
+	// events for rooms which are not loaded are picked up from the database on load
+	globalCache.OnNewEvent(ctx, nameEvent(roomB, "B2", 2))
+	dbNames[roomB] = "B2"
+	assertName(roomB, "B2")
+
+	// events which arrive whilst loading are applied to the loaded metadata
+	duringLoad = func() {
+		globalCache.OnNewEvent(ctx, nameEvent(roomC, "C2", 3))
+	}
+	assertName(roomC, "C2")
+	duringLoad = nil
+
+	// C pushed the cache over its limit. A is the least recently used but is in use, so B is evicted.
+	if n := globalCache.NumRooms(); n != 2 {
+		t.Fatalf("got %d rooms in the cache, want 2", n)
+	}
+	loaded = nil
+	assertName(roomA, "A2")
+	assertName(roomC, "C2")
+	if len(loaded) != 0 {
+		t.Fatalf("loaded %v from the database, want nothing", loaded)
+	}
+	assertName(roomB, "B2")
+	if len(loaded) != 1 || loaded[0] != roomB {
+		t.Fatalf("loaded %v from the database, want only %s", loaded, roomB)
+	}
+}
+
+func TestGlobalCacheSnapshot(t *testing.T) {
+	ctx := context.Background()
+	roomID := "!a:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	metadata := internal.NewRoomMetadata(roomID)
+	metadata.NameEvent = "A"
+	metadata.LastMessageTimestamp = 1000
+	metadata.LatestEventsByType["m.room.name"] = internal.EventMetadata{NID: 1, Timestamp: 1000}
+	if err := globalCache.Startup(map[string]internal.RoomMetadata{roomID: *metadata}); err != nil {
+		t.Fatalf("Startup: %s", err)
+	}
+	globalCache.OnEphemeralEvent(ctx, roomID, json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@alice:localhost"]}}`))
+	// stub rooms which have seen no events are not included
+	globalCache.OnEphemeralEvent(ctx, "!stub:localhost", json.RawMessage(`{"type":"m.typing","content":{"user_ids":[]}}`))
+
+	snapshot := globalCache.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("got %d rooms in the snapshot, want 1", len(snapshot))
+	}
+	got := snapshot[roomID]
+	if got.NameEvent != "A" || got.TypingEvent != nil {
+		t.Fatalf("got unexpected snapshot metadata %+v", got)
+	}
+	// the snapshot does not share maps with the cache
+	got.LatestEventsByType["m.room.message"] = internal.EventMetadata{NID: 2, Timestamp: 2000}
+	if _, exists := globalCache.LoadRooms(ctx, roomID)[roomID].LatestEventsByType["m.room.message"]; exists {
+		t.Fatalf("modifying the snapshot modified the cache")
+	}
+}
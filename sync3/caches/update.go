@@ -38,6 +38,16 @@ func (u *InviteUpdate) Type() string {
 	return fmt.Sprintf("InviteUpdate[%s]", u.RoomID())
 }
 
+// KnockUpdate corresponds to a key-value pair from a v2 sync's `knock` section.
+type KnockUpdate struct {
+	RoomUpdate
+	KnockData InviteData
+}
+
+func (u *KnockUpdate) Type() string {
+	return fmt.Sprintf("KnockUpdate[%s]", u.RoomID())
+}
+
 // LeftRoomUpdate corresponds to a key-value pair from a v2 sync's `leave` section.
 type LeftRoomUpdate struct {
 	RoomUpdate
@@ -98,6 +108,16 @@ func (u *RoomAccountDataUpdate) Type() string {
 	return fmt.Sprintf("RoomAccountDataUpdate[%s] len=%v", u.RoomID(), len(u.AccountData))
 }
 
+// PresenceUpdate represents a change in presence for a user who shares a room with this user,
+// or for this user themselves.
+type PresenceUpdate struct {
+	Presence internal.Presence
+}
+
+func (u *PresenceUpdate) Type() string {
+	return fmt.Sprintf("PresenceUpdate[%s]", u.Presence.UserID)
+}
+
 type DeviceDataUpdate struct {
 	// no data; just wakes up the connection
 	// data comes via sidechannels e.g the database
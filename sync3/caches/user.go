@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/getsentry/sentry-go"
 
@@ -37,10 +38,12 @@ type TransactionIDFetcher interface {
 type UserRoomData struct {
 	IsDM              bool
 	IsInvite          bool
+	IsKnock           bool
 	HasLeft           bool
 	NotificationCount int
 	HighlightCount    int
 	Invite            *InviteData
+	Knock             *InviteData
 
 	// this field is set by LazyLoadTimelines and is per-function call, and is not persisted in-memory.
 	// The zero value of this safe to use (0 latest nid, no prev batch, no timeline).
@@ -66,9 +69,11 @@ func NewUserRoomData() UserRoomData {
 }
 
 // Subset of data from internal.RoomMetadata which we can glean from invite_state.
-// Processed in the same way as joined rooms!
+// Processed in the same way as joined rooms! This is also used for knock_state, which
+// contains the same kind of stripped state as invite_state.
 type InviteData struct {
 	roomID               string
+	isKnock              bool
 	InviteState          []json.RawMessage
 	Heroes               []internal.Hero
 	InviteEvent          *EventData
@@ -139,6 +144,17 @@ func NewInviteData(ctx context.Context, userID, roomID string, inviteState []jso
 	return &id
 }
 
+// NewKnockData makes InviteData from the knock_state of a room we have knocked on. The
+// knock_state includes our own m.room.member knock event.
+func NewKnockData(ctx context.Context, userID, roomID string, knockState []json.RawMessage) *InviteData {
+	id := NewInviteData(ctx, userID, roomID, knockState)
+	if id == nil {
+		return nil
+	}
+	id.isKnock = true
+	return id
+}
+
 func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 	var roomType *string
 	if i.RoomType != "" {
@@ -148,7 +164,9 @@ func (i *InviteData) RoomMetadata() *internal.RoomMetadata {
 	metadata.Heroes = i.Heroes
 	metadata.NameEvent = i.NameEvent
 	metadata.CanonicalAlias = i.CanonicalAlias
-	metadata.InviteCount = 1
+	if !i.isKnock {
+		metadata.InviteCount = 1
+	}
 	metadata.JoinCount = 1
 	metadata.LastMessageTimestamp = i.LastMessageTimestamp
 	metadata.Encrypted = i.Encrypted
@@ -165,19 +183,46 @@ type UserCacheListener interface {
 	OnUpdate(ctx context.Context, up Update)
 }
 
+// notificationHint is a client-calculated notification count for a room, along with the latest
+// count from the homeserver to use once the hint no longer applies.
+type notificationHint struct {
+	highlightCount              int
+	notificationCount           int
+	homeserverHighlightCount    int
+	homeserverNotificationCount int
+}
+
 // Tracks data specific to a given user. Specifically, this is the map of room ID to UserRoomData.
 // This data is user-scoped, not global or connection scoped.
 type UserCache struct {
 	LazyRoomDataOverride func(loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]UserRoomData
-	UserID               string
-	roomToData           map[string]UserRoomData
-	roomToDataMu         *sync.RWMutex
-	listeners            map[int]UserCacheListener
-	listenersMu          *sync.RWMutex
-	id                   int
-	store                *state.Storage
-	globalCache          *GlobalCache
-	txnIDs               TransactionIDFetcher
+	// If set, called instead of Storage.LatestEventsInRooms by LazyLoadTimelines.
+	LatestEventsOverride func(roomIDs []string, loadPos int64, maxTimelineEvents int) (map[string]*state.LatestEvents, error)
+	// If true, evaluate the user's push rules against new events in unencrypted rooms to keep
+	// notification counts up-to-date between unread count updates from the homeserver.
+	EvaluatePushRules bool
+	UserID            string
+	roomToData        map[string]UserRoomData
+	roomToDataMu      *sync.RWMutex
+	listeners         map[int]UserCacheListener
+	listenersMu       *sync.RWMutex
+	id                int
+	store             *state.Storage
+	globalCache       *GlobalCache
+	txnIDs            TransactionIDFetcher
+	pushRules         *internal.PushRules
+	// room ID -> display name of this user in that room, used when evaluating push rules
+	roomToDisplayName map[string]string
+	pushRulesMu       *sync.Mutex
+	// room ID -> client-calculated notification counts, guarded by roomToDataMu. These take
+	// precedence over counts from the homeserver until the user sends a read receipt or a newer hint.
+	roomToHint map[string]notificationHint
+	// recently loaded timelines, shared between this user's connections
+	timelineCache   map[timelineCacheKey]timelineCacheEntry
+	timelineCacheMu *sync.Mutex
+	// recently built room fragments, shared between this user's connections
+	roomFragments   map[roomFragmentKey]*roomFragmentEntry
+	roomFragmentsMu *sync.Mutex
 }
 
 func NewUserCache(userID string, globalCache *GlobalCache, store *state.Storage, txnIDs TransactionIDFetcher) *UserCache {
@@ -190,6 +235,14 @@ func NewUserCache(userID string, globalCache *GlobalCache, store *state.Storage,
 		store:        store,
 		globalCache:  globalCache,
 		txnIDs:       txnIDs,
+
+		roomToDisplayName: make(map[string]string),
+		roomToHint:        make(map[string]notificationHint),
+		pushRulesMu:       &sync.Mutex{},
+		timelineCache:     make(map[timelineCacheKey]timelineCacheEntry),
+		timelineCacheMu:   &sync.Mutex{},
+		roomFragments:     make(map[roomFragmentKey]*roomFragmentEntry),
+		roomFragmentsMu:   &sync.Mutex{},
 	}
 	return uc
 }
@@ -289,17 +342,39 @@ func (c *UserCache) OnRegistered(ctx context.Context) error {
 	return nil
 }
 
-// Load timelines from the database. Uses cached UserRoomData for metadata purposes only.
+// Load timelines from the database, for all rooms at once. Timelines are cached briefly so other
+// connections for this user loading the same rooms at the same position do not hit the database.
+// Uses cached UserRoomData for metadata purposes only.
 func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomIDs []string, maxTimelineEvents int) map[string]UserRoomData {
 	if c.LazyRoomDataOverride != nil {
 		return c.LazyRoomDataOverride(loadPos, roomIDs, maxTimelineEvents)
 	}
 	result := make(map[string]UserRoomData)
-	roomIDToLatestEvents, err := c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents)
-	if err != nil {
-		logger.Err(err).Strs("rooms", roomIDs).Msg("failed to get LatestEventsInRooms")
-		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-		return nil
+	now := time.Now()
+	roomIDToLatestEvents := c.cachedTimelines(now, loadPos, roomIDs, maxTimelineEvents)
+	var missingRoomIDs []string
+	for _, roomID := range roomIDs {
+		if _, ok := roomIDToLatestEvents[roomID]; !ok {
+			missingRoomIDs = append(missingRoomIDs, roomID)
+		}
+	}
+	if len(missingRoomIDs) > 0 {
+		loadLatestEvents := c.LatestEventsOverride
+		if loadLatestEvents == nil {
+			loadLatestEvents = func(roomIDs []string, loadPos int64, maxTimelineEvents int) (map[string]*state.LatestEvents, error) {
+				return c.store.LatestEventsInRooms(c.UserID, roomIDs, loadPos, maxTimelineEvents)
+			}
+		}
+		loaded, err := loadLatestEvents(missingRoomIDs, loadPos, maxTimelineEvents)
+		if err != nil {
+			logger.Err(err).Strs("rooms", missingRoomIDs).Msg("failed to get LatestEventsInRooms")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return nil
+		}
+		c.cacheTimelines(now, loadPos, missingRoomIDs, maxTimelineEvents, loaded)
+		for _, roomID := range missingRoomIDs {
+			roomIDToLatestEvents[roomID] = loaded[roomID]
+		}
 	}
 	c.roomToDataMu.Lock()
 	for _, requestedRoomID := range roomIDs {
@@ -310,6 +385,7 @@ func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomID
 		}
 		if latestEvents != nil {
 			urd.RequestedLatestEvents = *latestEvents
+			urd.RequestedLatestEvents.Timeline = copyEvents(latestEvents.Timeline)
 		}
 		result[requestedRoomID] = urd
 	}
@@ -317,6 +393,31 @@ func (c *UserCache) LazyLoadTimelines(ctx context.Context, loadPos int64, roomID
 	return result
 }
 
+// Rough sizes used when estimating the memory used by a UserCache.
+const (
+	approxUserRoomDataBytes = 256
+	approxMapEntryBytes     = 64
+)
+
+// ApproxSizeBytes returns a rough estimate of the memory used by this cache, for metrics.
+func (c *UserCache) ApproxSizeBytes() int {
+	c.roomToDataMu.RLock()
+	defer c.roomToDataMu.RUnlock()
+	size := 0
+	for _, urd := range c.roomToData {
+		size += approxUserRoomDataBytes + approxMapEntryBytes*(len(urd.Spaces)+len(urd.Tags))
+		for _, id := range []*InviteData{urd.Invite, urd.Knock} {
+			if id == nil {
+				continue
+			}
+			for _, ev := range id.InviteState {
+				size += len(ev)
+			}
+		}
+	}
+	return size + c.timelineCacheSizeBytes() + c.roomFragmentsSizeBytes()
+}
+
 func (c *UserCache) LoadRoomData(roomID string) UserRoomData {
 	c.roomToDataMu.RLock()
 	defer c.roomToDataMu.RUnlock()
@@ -381,6 +482,19 @@ func (c *UserCache) Invites() map[string]UserRoomData {
 	return invites
 }
 
+func (c *UserCache) Knocks() map[string]UserRoomData {
+	c.roomToDataMu.Lock()
+	defer c.roomToDataMu.Unlock()
+	knocks := make(map[string]UserRoomData)
+	for roomID, urd := range c.roomToData {
+		if !urd.IsKnock || urd.Knock == nil {
+			continue
+		}
+		knocks[roomID] = urd
+	}
+	return knocks
+}
+
 // AnnotateWithTransactionIDs should be called just prior to returning events to the client. This
 // will modify the events to insert the correct transaction IDs if needed. This is required because
 // events are globally scoped, so if Alice sends a message, Bob might receive it first on his v2 loop
@@ -446,12 +560,28 @@ func (c *UserCache) OnEphemeralEvent(ctx context.Context, roomID string, ephEven
 }
 
 func (c *UserCache) OnReceipt(ctx context.Context, receipt internal.Receipt) {
+	if receipt.UserID == c.UserID {
+		// the user has read the room, so the homeserver counts are correct again
+		c.roomToDataMu.Lock()
+		hint, ok := c.roomToHint[receipt.RoomID]
+		delete(c.roomToHint, receipt.RoomID)
+		c.roomToDataMu.Unlock()
+		if ok {
+			c.OnUnreadCounts(ctx, receipt.RoomID, &hint.homeserverHighlightCount, &hint.homeserverNotificationCount)
+		}
+	}
 	c.emitOnRoomUpdate(ctx, &ReceiptUpdate{
 		RoomUpdate: c.newRoomUpdate(ctx, receipt.RoomID),
 		Receipt:    receipt,
 	})
 }
 
+func (c *UserCache) OnPresence(ctx context.Context, presence internal.Presence) {
+	c.emitOnUpdate(ctx, &PresenceUpdate{
+		Presence: presence,
+	})
+}
+
 func (c *UserCache) emitOnRoomUpdate(ctx context.Context, update RoomUpdate) {
 	c.listenersMu.RLock()
 	var listeners []UserCacheListener
@@ -477,6 +607,48 @@ func (c *UserCache) emitOnUpdate(ctx context.Context, update Update) {
 }
 
 func (c *UserCache) OnUnreadCounts(ctx context.Context, roomID string, highlightCount, notifCount *int) {
+	c.roomToDataMu.Lock()
+	hint, ok := c.roomToHint[roomID]
+	if ok {
+		// the client's counts take precedence: remember these for when they no longer apply
+		if highlightCount != nil {
+			hint.homeserverHighlightCount = *highlightCount
+		}
+		if notifCount != nil {
+			hint.homeserverNotificationCount = *notifCount
+		}
+		c.roomToHint[roomID] = hint
+	}
+	c.roomToDataMu.Unlock()
+	if ok {
+		return
+	}
+	c.setUnreadCounts(ctx, roomID, highlightCount, notifCount)
+}
+
+// OnNotificationHint sets client-calculated notification counts for an encrypted room, which the
+// homeserver cannot calculate correctly. They take precedence over counts from the homeserver until
+// the user sends a read receipt for the room or a newer hint.
+func (c *UserCache) OnNotificationHint(ctx context.Context, roomID string, highlightCount, notifCount int) {
+	c.roomToDataMu.Lock()
+	hint, ok := c.roomToHint[roomID]
+	if !ok {
+		urd := c.roomToData[roomID]
+		hint.homeserverHighlightCount = urd.HighlightCount
+		hint.homeserverNotificationCount = urd.NotificationCount
+	}
+	hint.highlightCount = highlightCount
+	hint.notificationCount = notifCount
+	c.roomToHint[roomID] = hint
+	urd := c.roomToData[roomID]
+	c.roomToDataMu.Unlock()
+	if urd.HighlightCount == highlightCount && urd.NotificationCount == notifCount {
+		return
+	}
+	c.setUnreadCounts(ctx, roomID, &highlightCount, &notifCount)
+}
+
+func (c *UserCache) setUnreadCounts(ctx context.Context, roomID string, highlightCount, notifCount *int) {
 	data := c.LoadRoomData(roomID)
 	hasCountDecreased := false
 	if highlightCount != nil {
@@ -531,6 +703,16 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 			urd.HighlightCount = 0
 		}
 	}
+	// likewise reset the IsKnock field when the knock is accepted or rejected
+	if urd.IsKnock && eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		urd.IsKnock = eventData.Content.Get("membership").Str == "knock"
+		if !urd.IsKnock {
+			urd.Knock = nil
+		}
+	}
+	if c.EvaluatePushRules {
+		c.evaluatePushRules(ctx, eventData, &urd)
+	}
 	if eventData.EventType == "m.space.child" && eventData.StateKey != nil {
 		// the children for a space we are a part of have changed. Find the room that was affected and update our cache value.
 		childRoomID := *eventData.StateKey
@@ -549,6 +731,68 @@ func (c *UserCache) OnNewEvent(ctx context.Context, eventData *EventData) {
 	c.emitOnRoomUpdate(ctx, roomUpdate)
 }
 
+// evaluatePushRules updates the notification counts in urd based on the user's push rules. This
+// is a fallback to the counts from the homeserver, which will overwrite these values when they
+// arrive in an UnreadCountUpdate. Encrypted rooms are skipped as the content cannot be read.
+func (c *UserCache) evaluatePushRules(ctx context.Context, eventData *EventData, urd *UserRoomData) {
+	if eventData.NID <= 0 || urd.IsInvite || urd.IsKnock || urd.HasLeft {
+		return // not a timeline event or we aren't joined to the room
+	}
+	if eventData.EventType == "m.room.member" && eventData.StateKey != nil && *eventData.StateKey == c.UserID {
+		// our display name may have changed
+		c.pushRulesMu.Lock()
+		delete(c.roomToDisplayName, eventData.RoomID)
+		c.pushRulesMu.Unlock()
+	}
+	if eventData.Sender == c.UserID {
+		// sending an event implicitly marks the room as read
+		urd.NotificationCount = 0
+		urd.HighlightCount = 0
+		return
+	}
+	c.pushRulesMu.Lock()
+	pushRules := c.pushRules
+	c.pushRulesMu.Unlock()
+	if pushRules == nil {
+		return
+	}
+	metadata := c.globalCache.LoadRooms(ctx, eventData.RoomID)[eventData.RoomID]
+	if metadata == nil || metadata.Encrypted {
+		return
+	}
+	notify, highlight := pushRules.Evaluate(eventData.Event, internal.PushRuleContext{
+		RoomMemberCount: eventData.JoinCount,
+		UserDisplayName: func() string {
+			return c.displayName(ctx, eventData.RoomID, eventData.NID)
+		},
+		SenderCanNotify: func(notificationKey string) bool {
+			plEvent := c.globalCache.LoadStateEvent(ctx, eventData.RoomID, eventData.NID, "m.room.power_levels", "")
+			return internal.PowerLevelCanNotify(plEvent, eventData.Sender, notificationKey)
+		},
+	})
+	if notify {
+		urd.NotificationCount++
+	}
+	if highlight {
+		urd.HighlightCount++
+	}
+}
+
+func (c *UserCache) displayName(ctx context.Context, roomID string, loadPos int64) string {
+	c.pushRulesMu.Lock()
+	displayName, ok := c.roomToDisplayName[roomID]
+	c.pushRulesMu.Unlock()
+	if ok {
+		return displayName
+	}
+	memberEvent := c.globalCache.LoadStateEvent(ctx, roomID, loadPos, "m.room.member", c.UserID)
+	displayName = gjson.GetBytes(memberEvent, "content.displayname").Str
+	c.pushRulesMu.Lock()
+	c.roomToDisplayName[roomID] = displayName
+	c.pushRulesMu.Unlock()
+	return displayName
+}
+
 func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEvents []json.RawMessage) {
 	inviteData := NewInviteData(ctx, c.UserID, roomID, inviteStateEvents)
 	if inviteData == nil {
@@ -557,10 +801,12 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = true
+	urd.IsKnock = false
 	urd.HasLeft = false
 	urd.HighlightCount = InvitesAreHighlightsValue
 	urd.IsDM = inviteData.IsDM
 	urd.Invite = inviteData
+	urd.Knock = nil
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
 	c.roomToDataMu.Unlock()
@@ -578,11 +824,41 @@ func (c *UserCache) OnInvite(ctx context.Context, roomID string, inviteStateEven
 	c.emitOnRoomUpdate(ctx, up)
 }
 
+func (c *UserCache) OnKnock(ctx context.Context, roomID string, knockStateEvents []json.RawMessage) {
+	knockData := NewKnockData(ctx, c.UserID, roomID, knockStateEvents)
+	if knockData == nil {
+		return // malformed knock
+	}
+
+	urd := c.LoadRoomData(roomID)
+	urd.IsKnock = true
+	urd.IsInvite = false
+	urd.HasLeft = false
+	urd.Knock = knockData
+	urd.Invite = nil
+	c.roomToDataMu.Lock()
+	c.roomToData[roomID] = urd
+	c.roomToDataMu.Unlock()
+
+	up := &KnockUpdate{
+		RoomUpdate: &roomUpdateCache{
+			roomID: roomID,
+			// do NOT pull from the global cache as the user cannot see the room yet
+			globalRoomData: knockData.RoomMetadata(),
+			userRoomData:   &urd,
+		},
+		KnockData: *knockData,
+	}
+	c.emitOnRoomUpdate(ctx, up)
+}
+
 func (c *UserCache) OnLeftRoom(ctx context.Context, roomID string) {
 	urd := c.LoadRoomData(roomID)
 	urd.IsInvite = false
+	urd.IsKnock = false
 	urd.HasLeft = true
 	urd.Invite = nil
+	urd.Knock = nil
 	urd.HighlightCount = 0
 	c.roomToDataMu.Lock()
 	c.roomToData[roomID] = urd
@@ -633,6 +909,11 @@ func (c *UserCache) OnAccountData(ctx context.Context, datas []state.AccountData
 				c.roomToData[dmRoomID] = u
 			}
 			c.roomToDataMu.Unlock()
+		} else if d.Type == "m.push_rules" && d.RoomID == state.AccountDataGlobalRoom {
+			pushRules := internal.NewPushRulesFromEvent(d.Data)
+			c.pushRulesMu.Lock()
+			c.pushRules = pushRules
+			c.pushRulesMu.Unlock()
 		} else if d.Type == "m.tag" {
 			content := gjson.ParseBytes(d.Data).Get("content.tags")
 			if tagUpdates[d.RoomID] == nil {
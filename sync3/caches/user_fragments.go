@@ -0,0 +1,161 @@
+package caches
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// How long room fragments are kept for. Fragments are loaded at a fixed position so never go
+// stale, but connections quickly move on to later positions, after which they are not reused.
+const roomFragmentTTL = 10 * time.Second
+
+// RoomFragment is the part of an initial room in a sliding sync response which is the same for
+// every connection of a user which loads the room at the same position with the same
+// required_state and timeline limit. Connections fill in everything else, such as the room name,
+// notification counts and transaction IDs.
+type RoomFragment struct {
+	RequiredState []json.RawMessage
+	Timeline      []json.RawMessage
+	PrevBatch     string
+	LatestNID     int64
+	// the senders of the events in Timeline, for lazy loading members
+	TimelineSenders []string
+}
+
+func (f *RoomFragment) copy() *RoomFragment {
+	c := *f
+	// connections modify these slices, e.g by appending lazily loaded members or annotating events
+	// with transaction IDs
+	c.RequiredState = copyEvents(f.RequiredState)
+	c.Timeline = copyEvents(f.Timeline)
+	return &c
+}
+
+func (f *RoomFragment) approxSizeBytes() int {
+	size := approxMapEntryBytes * (1 + len(f.TimelineSenders))
+	for _, events := range [][]json.RawMessage{f.RequiredState, f.Timeline} {
+		for _, ev := range events {
+			size += len(ev)
+		}
+	}
+	return size
+}
+
+type roomFragmentKey struct {
+	roomID        string
+	requiredState string
+	timelineLimit int
+	loadPos       int64
+}
+
+type roomFragmentEntry struct {
+	ready    chan struct{} // closed when the fragment has been loaded
+	fragment *RoomFragment // nil if the fragment failed to load
+	expires  time.Time
+}
+
+func (e *roomFragmentEntry) isReady() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// LoadRoomFragments returns fragments for these rooms, loaded at loadPos with this required_state
+// (in any canonical string form) and timeline limit. Fragments which another of the user's
+// connections has loaded recently, or is loading, are reused. The remaining rooms are passed to
+// load, which may omit rooms it failed to load. The returned fragments are copies, which the
+// caller may modify.
+func (c *UserCache) LoadRoomFragments(
+	roomIDs []string, requiredState string, timelineLimit int, loadPos int64,
+	load func(roomIDs []string) map[string]*RoomFragment,
+) map[string]*RoomFragment {
+	result := make(map[string]*RoomFragment, len(roomIDs))
+	var toLoad []string
+	loading := make(map[string]*roomFragmentEntry)
+	waiting := make(map[string]*roomFragmentEntry)
+	now := time.Now()
+	c.roomFragmentsMu.Lock()
+	for key, entry := range c.roomFragments {
+		if entry.isReady() && !now.Before(entry.expires) {
+			delete(c.roomFragments, key)
+		}
+	}
+	for _, roomID := range roomIDs {
+		key := roomFragmentKey{roomID, requiredState, timelineLimit, loadPos}
+		if entry, ok := c.roomFragments[key]; ok {
+			waiting[roomID] = entry
+			continue
+		}
+		entry := &roomFragmentEntry{ready: make(chan struct{})}
+		c.roomFragments[key] = entry
+		loading[roomID] = entry
+		toLoad = append(toLoad, roomID)
+	}
+	c.roomFragmentsMu.Unlock()
+
+	if len(toLoad) > 0 {
+		loaded := c.loadRoomFragments(toLoad, requiredState, timelineLimit, loadPos, loading, load)
+		for roomID, fragment := range loaded {
+			result[roomID] = fragment.copy()
+		}
+	}
+
+	// wait for fragments being loaded by other connections
+	var failed []string
+	for roomID, entry := range waiting {
+		<-entry.ready
+		if entry.fragment == nil {
+			failed = append(failed, roomID)
+			continue
+		}
+		result[roomID] = entry.fragment.copy()
+	}
+	if len(failed) > 0 {
+		for roomID, fragment := range load(failed) {
+			result[roomID] = fragment
+		}
+	}
+	return result
+}
+
+// loadRoomFragments calls load and stores the fragments in these entries, marking them as ready
+// even if load panics so that other connections do not wait forever.
+func (c *UserCache) loadRoomFragments(
+	roomIDs []string, requiredState string, timelineLimit int, loadPos int64, entries map[string]*roomFragmentEntry,
+	load func(roomIDs []string) map[string]*RoomFragment,
+) (loaded map[string]*RoomFragment) {
+	defer func() {
+		c.roomFragmentsMu.Lock()
+		defer c.roomFragmentsMu.Unlock()
+		expires := time.Now().Add(roomFragmentTTL)
+		for _, roomID := range roomIDs {
+			entry := entries[roomID]
+			entry.fragment = loaded[roomID]
+			entry.expires = expires
+			if entry.fragment == nil {
+				// don't cache failures, so the next connection tries again
+				key := roomFragmentKey{roomID, requiredState, timelineLimit, loadPos}
+				if c.roomFragments[key] == entry {
+					delete(c.roomFragments, key)
+				}
+			}
+			close(entry.ready)
+		}
+	}()
+	return load(roomIDs)
+}
+
+func (c *UserCache) roomFragmentsSizeBytes() int {
+	c.roomFragmentsMu.Lock()
+	defer c.roomFragmentsMu.Unlock()
+	size := 0
+	for _, entry := range c.roomFragments {
+		if entry.isReady() && entry.fragment != nil {
+			size += entry.fragment.approxSizeBytes()
+		}
+	}
+	return size
+}
@@ -5,8 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
@@ -123,3 +127,316 @@ func convertIDTxnToEventStub(roomToEventIDs map[string][][2]string) map[string][
 	}
 	return result
 }
+
+func TestUserCacheEvaluatesPushRules(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	plainRoomID := "!plain:localhost"
+	encryptedRoomID := "!encrypted:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		plainRoomID: {
+			RoomID:               plainRoomID,
+			LastMessageTimestamp: 123,
+		},
+		encryptedRoomID: {
+			RoomID:               encryptedRoomID,
+			LastMessageTimestamp: 123,
+			Encrypted:            true,
+		},
+	})
+	uc := caches.NewUserCache(userID, globalCache, nil, &txnIDFetcher{})
+	uc.EvaluatePushRules = true
+	uc.OnAccountData(ctx, []state.AccountData{
+		{
+			UserID: userID,
+			RoomID: state.AccountDataGlobalRoom,
+			Type:   "m.push_rules",
+			Data: json.RawMessage(`{"type":"m.push_rules","content":{"global":{
+				"content":[{"rule_id":"ping","enabled":true,"pattern":"ping","actions":["notify",{"set_tweak":"highlight"}]}],
+				"underride":[{"rule_id":".m.rule.message","enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.message"}],"actions":["notify"]}]
+			}}}`),
+		},
+	})
+	newEvent := func(roomID, sender, body string, nid int64) *caches.EventData {
+		ev := json.RawMessage(fmt.Sprintf(`{"type":"m.room.message","room_id":"%s","sender":"%s","content":{"msgtype":"m.text","body":"%s"}}`, roomID, sender, body))
+		return &caches.EventData{
+			Event:     ev,
+			RoomID:    roomID,
+			EventType: "m.room.message",
+			Sender:    sender,
+			NID:       nid,
+			JoinCount: 3,
+		}
+	}
+	assertCounts := func(roomID string, wantHighlight, wantNotif int) {
+		t.Helper()
+		urd := uc.LoadRoomData(roomID)
+		if urd.HighlightCount != wantHighlight || urd.NotificationCount != wantNotif {
+			t.Errorf("%s: got highlight=%d notif=%d, want highlight=%d notif=%d", roomID, urd.HighlightCount, urd.NotificationCount, wantHighlight, wantNotif)
+		}
+	}
+
+	uc.OnNewEvent(ctx, newEvent(plainRoomID, "@bob:localhost", "hello", 1))
+	uc.OnNewEvent(ctx, newEvent(plainRoomID, "@bob:localhost", "ping!", 2))
+	assertCounts(plainRoomID, 1, 2)
+
+	// encrypted rooms are left alone
+	uc.OnNewEvent(ctx, newEvent(encryptedRoomID, "@bob:localhost", "ping", 3))
+	assertCounts(encryptedRoomID, 0, 0)
+
+	// counts from the homeserver take precedence
+	zero := 0
+	uc.OnUnreadCounts(ctx, plainRoomID, &zero, &zero)
+	assertCounts(plainRoomID, 0, 0)
+	uc.OnNewEvent(ctx, newEvent(plainRoomID, "@bob:localhost", "hello again", 4))
+	assertCounts(plainRoomID, 0, 1)
+
+	// sending a message resets the counts
+	uc.OnNewEvent(ctx, newEvent(plainRoomID, userID, "hi bob", 5))
+	assertCounts(plainRoomID, 0, 0)
+}
+
+type roomUpdateRecorder struct {
+	updates []caches.RoomUpdate
+}
+
+func (r *roomUpdateRecorder) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
+	r.updates = append(r.updates, up)
+}
+func (r *roomUpdateRecorder) OnUpdate(ctx context.Context, up caches.Update) {}
+
+func TestUserCacheKnocks(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomID := "!knock:localhost"
+	knockState := []json.RawMessage{
+		json.RawMessage(`{"type":"m.room.name","state_key":"","sender":"@bob:localhost","content":{"name":"Knock Knock"}}`),
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"%s","origin_server_ts":123,"content":{"membership":"knock"}}`, userID, userID)),
+	}
+	uc := caches.NewUserCache(userID, caches.NewGlobalCache(nil), nil, &txnIDFetcher{})
+	recorder := &roomUpdateRecorder{}
+	uc.Subsribe(recorder)
+
+	uc.OnKnock(ctx, roomID, knockState)
+	if len(recorder.updates) != 1 {
+		t.Fatalf("got %d updates, want 1", len(recorder.updates))
+	}
+	knockUpdate, ok := recorder.updates[0].(*caches.KnockUpdate)
+	if !ok {
+		t.Fatalf("got update %T, want *caches.KnockUpdate", recorder.updates[0])
+	}
+	metadata := knockUpdate.GlobalRoomMetadata()
+	if metadata.NameEvent != "Knock Knock" || metadata.LastMessageTimestamp != 123 || metadata.InviteCount != 0 {
+		t.Errorf("unexpected knock metadata: %+v", metadata)
+	}
+	knocks := uc.Knocks()
+	if urd, ok := knocks[roomID]; !ok || !urd.IsKnock || urd.IsInvite || urd.HighlightCount != 0 {
+		t.Fatalf("knock not tracked correctly: %+v", knocks)
+	}
+
+	// accepting the knock invites the user
+	uc.OnInvite(ctx, roomID, []json.RawMessage{
+		json.RawMessage(fmt.Sprintf(`{"type":"m.room.member","state_key":"%s","sender":"@bob:localhost","origin_server_ts":456,"content":{"membership":"invite"}}`, userID)),
+	})
+	if len(uc.Knocks()) != 0 || len(uc.Invites()) != 1 {
+		t.Fatalf("accepted knock did not become an invite: knocks=%v invites=%v", uc.Knocks(), uc.Invites())
+	}
+
+	// rejecting the knock removes it
+	uc.OnKnock(ctx, roomID, knockState)
+	if len(uc.Knocks()) != 1 || len(uc.Invites()) != 0 {
+		t.Fatalf("knock not tracked: knocks=%v invites=%v", uc.Knocks(), uc.Invites())
+	}
+	uc.OnLeftRoom(ctx, roomID)
+	if urd := uc.LoadRoomData(roomID); urd.IsKnock || urd.Knock != nil || !urd.HasLeft {
+		t.Fatalf("rejected knock was not retired: %+v", urd)
+	}
+}
+
+// Test that timelines loaded by LazyLoadTimelines are reused for the same rooms, load position and
+// limit, and that annotating a loaded timeline does not modify the cached copy.
+func TestUserCacheLazyLoadTimelinesCaches(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	eventA := json.RawMessage(`{"event_id":"$a","type":"m.room.message","content":{"body":"a"}}`)
+	uc := caches.NewUserCache(userID, nil, nil, &txnIDFetcher{
+		data: map[string]string{"$a": "txn_a"},
+	})
+	var loadedRoomIDs [][]string
+	uc.LatestEventsOverride = func(roomIDs []string, loadPos int64, maxTimelineEvents int) (map[string]*state.LatestEvents, error) {
+		loadedRoomIDs = append(loadedRoomIDs, roomIDs)
+		result := make(map[string]*state.LatestEvents)
+		for _, roomID := range roomIDs {
+			if roomID == roomA { // the user cannot see any events in room B
+				result[roomID] = &state.LatestEvents{
+					Timeline:  []json.RawMessage{eventA},
+					LatestNID: loadPos,
+				}
+			}
+		}
+		return result, nil
+	}
+
+	got := uc.LazyLoadTimelines(ctx, 10, []string{roomA, roomB}, 5)
+	assertLoaded := func(want [][]string) {
+		t.Helper()
+		if !reflect.DeepEqual(loadedRoomIDs, want) {
+			t.Fatalf("loaded rooms %v want %v", loadedRoomIDs, want)
+		}
+	}
+	assertLoaded([][]string{{roomA, roomB}})
+	if len(got[roomA].RequestedLatestEvents.Timeline) != 1 || len(got[roomB].RequestedLatestEvents.Timeline) != 0 {
+		t.Fatalf("got wrong timelines: %+v", got)
+	}
+	// annotating the timeline must not leak the transaction ID into the cache
+	uc.AnnotateWithTransactionIDs(ctx, userID, "DEVICE", map[string][]json.RawMessage{
+		roomA: got[roomA].RequestedLatestEvents.Timeline,
+	})
+
+	// same position and limit: served from the cache, including for room B which had no events
+	got = uc.LazyLoadTimelines(ctx, 10, []string{roomA, roomB}, 5)
+	assertLoaded([][]string{{roomA, roomB}})
+	if !reflect.DeepEqual(got[roomA].RequestedLatestEvents.Timeline, []json.RawMessage{eventA}) {
+		t.Fatalf("cached timeline was modified: %s", got[roomA].RequestedLatestEvents.Timeline)
+	}
+
+	// a different position or limit is loaded from the database
+	uc.LazyLoadTimelines(ctx, 11, []string{roomA}, 5)
+	assertLoaded([][]string{{roomA, roomB}, {roomA}})
+	uc.LazyLoadTimelines(ctx, 10, []string{roomA}, 1)
+	assertLoaded([][]string{{roomA, roomB}, {roomA}, {roomA}})
+}
+
+func TestUserCacheLoadRoomFragments(t *testing.T) {
+	roomA := "!a:localhost"
+	roomB := "!b:localhost"
+	eventA := json.RawMessage(`{"event_id":"$a","type":"m.room.message"}`)
+	uc := caches.NewUserCache("@alice:localhost", nil, nil, &txnIDFetcher{})
+	var mu sync.Mutex
+	var loadedRoomIDs [][]string
+	release := make(chan struct{})
+	load := func(roomIDs []string) map[string]*caches.RoomFragment {
+		mu.Lock()
+		loadedRoomIDs = append(loadedRoomIDs, roomIDs)
+		mu.Unlock()
+		<-release
+		result := make(map[string]*caches.RoomFragment)
+		for _, roomID := range roomIDs {
+			if roomID == roomA { // room B fails to load
+				result[roomID] = &caches.RoomFragment{
+					Timeline:  []json.RawMessage{eventA},
+					LatestNID: 10,
+				}
+			}
+		}
+		return result
+	}
+	assertLoaded := func(want [][]string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(loadedRoomIDs, want) {
+			t.Fatalf("loaded rooms %v want %v", loadedRoomIDs, want)
+		}
+	}
+
+	// two connections load room A at the same time: it is only loaded once
+	results := make([]map[string]*caches.RoomFragment, 2)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0] = uc.LoadRoomFragments([]string{roomA, roomB}, `{}`, 5, 10, load)
+	}()
+	// wait for the first load to start, so the second connection waits on it
+	for {
+		mu.Lock()
+		started := len(loadedRoomIDs) > 0
+		mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[1] = uc.LoadRoomFragments([]string{roomA}, `{}`, 5, 10, load)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assertLoaded([][]string{{roomA, roomB}})
+	for i, result := range results {
+		if len(result) != 1 || !reflect.DeepEqual(result[roomA].Timeline, []json.RawMessage{eventA}) {
+			t.Fatalf("result %d: got %+v", i, result)
+		}
+	}
+	// the returned fragments are copies
+	results[0][roomA].Timeline[0] = json.RawMessage(`{}`)
+	if !reflect.DeepEqual(results[1][roomA].Timeline, []json.RawMessage{eventA}) {
+		t.Fatalf("modifying one fragment modified another: %s", results[1][roomA].Timeline)
+	}
+
+	// room A is now cached, room B failed so is loaded again
+	got := uc.LoadRoomFragments([]string{roomA, roomB}, `{}`, 5, 10, load)
+	assertLoaded([][]string{{roomA, roomB}, {roomB}})
+	if !reflect.DeepEqual(got[roomA].Timeline, []json.RawMessage{eventA}) {
+		t.Fatalf("cached fragment was modified: %s", got[roomA].Timeline)
+	}
+
+	// a different required state, timeline limit or position is loaded again
+	uc.LoadRoomFragments([]string{roomA}, `{"lazy":true}`, 5, 10, load)
+	uc.LoadRoomFragments([]string{roomA}, `{}`, 1, 10, load)
+	uc.LoadRoomFragments([]string{roomA}, `{}`, 5, 11, load)
+	assertLoaded([][]string{{roomA, roomB}, {roomB}, {roomA}, {roomA}, {roomA}})
+}
+
+func TestUserCacheNotificationHints(t *testing.T) {
+	ctx := context.Background()
+	userID := "@alice:localhost"
+	roomID := "!encrypted:localhost"
+	globalCache := caches.NewGlobalCache(nil)
+	globalCache.Startup(map[string]internal.RoomMetadata{
+		roomID: {
+			RoomID:               roomID,
+			LastMessageTimestamp: 123,
+			Encrypted:            true,
+		},
+	})
+	uc := caches.NewUserCache(userID, globalCache, nil, &txnIDFetcher{})
+	assertCounts := func(wantHighlight, wantNotif int) {
+		t.Helper()
+		urd := uc.LoadRoomData(roomID)
+		if urd.HighlightCount != wantHighlight || urd.NotificationCount != wantNotif {
+			t.Errorf("got highlight=%d notif=%d, want highlight=%d notif=%d", urd.HighlightCount, urd.NotificationCount, wantHighlight, wantNotif)
+		}
+	}
+	setCounts := func(highlight, notif int) {
+		uc.OnUnreadCounts(ctx, roomID, &highlight, &notif)
+	}
+
+	setCounts(0, 5)
+	assertCounts(0, 5)
+
+	// hints take precedence over counts from the homeserver
+	uc.OnNotificationHint(ctx, roomID, 1, 2)
+	assertCounts(1, 2)
+	setCounts(0, 6)
+	assertCounts(1, 2)
+
+	// until a newer hint
+	uc.OnNotificationHint(ctx, roomID, 0, 3)
+	assertCounts(0, 3)
+
+	// or until the user reads the room, when the latest homeserver counts apply again
+	uc.OnReceipt(ctx, internal.Receipt{RoomID: roomID, EventID: "$a", UserID: "@bob:localhost"})
+	assertCounts(0, 3)
+	uc.OnReceipt(ctx, internal.Receipt{RoomID: roomID, EventID: "$a", UserID: userID})
+	assertCounts(0, 6)
+	setCounts(0, 0)
+	assertCounts(0, 0)
+}
@@ -0,0 +1,81 @@
+package caches
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/state"
+)
+
+// How long timelines loaded by LazyLoadTimelines are cached for. Connections for the same user often
+// load the same rooms at the same position at around the same time, e.g several devices doing initial
+// syncs after a restart or a client retrying a request, so this saves repeating the same queries.
+const timelineCacheTTL = 10 * time.Second
+
+type timelineCacheKey struct {
+	roomID  string
+	loadPos int64
+	limit   int
+}
+
+type timelineCacheEntry struct {
+	latestEvents *state.LatestEvents // nil if the user cannot see any events in the room
+	expires      time.Time
+}
+
+// cachedTimelines returns the cached timelines for these rooms. Rooms which are not cached are
+// omitted from the result.
+func (c *UserCache) cachedTimelines(now time.Time, loadPos int64, roomIDs []string, limit int) map[string]*state.LatestEvents {
+	c.timelineCacheMu.Lock()
+	defer c.timelineCacheMu.Unlock()
+	result := make(map[string]*state.LatestEvents, len(roomIDs))
+	for _, roomID := range roomIDs {
+		entry, ok := c.timelineCache[timelineCacheKey{roomID, loadPos, limit}]
+		if ok && now.Before(entry.expires) {
+			result[roomID] = entry.latestEvents
+		}
+	}
+	return result
+}
+
+// cacheTimelines caches the timelines loaded for these rooms, and removes expired timelines.
+func (c *UserCache) cacheTimelines(now time.Time, loadPos int64, roomIDs []string, limit int, loaded map[string]*state.LatestEvents) {
+	c.timelineCacheMu.Lock()
+	defer c.timelineCacheMu.Unlock()
+	for key, entry := range c.timelineCache {
+		if !now.Before(entry.expires) {
+			delete(c.timelineCache, key)
+		}
+	}
+	for _, roomID := range roomIDs {
+		c.timelineCache[timelineCacheKey{roomID, loadPos, limit}] = timelineCacheEntry{
+			latestEvents: loaded[roomID],
+			expires:      now.Add(timelineCacheTTL),
+		}
+	}
+}
+
+func (c *UserCache) timelineCacheSizeBytes() int {
+	c.timelineCacheMu.Lock()
+	defer c.timelineCacheMu.Unlock()
+	size := 0
+	for _, entry := range c.timelineCache {
+		size += approxMapEntryBytes
+		if entry.latestEvents == nil {
+			continue
+		}
+		for _, ev := range entry.latestEvents.Timeline {
+			size += len(ev)
+		}
+	}
+	return size
+}
+
+// copyEvents copies a slice of cached events, as callers append to it or replace events in it e.g
+// with AnnotateWithTransactionIDs, and cached events are shared between connections.
+func copyEvents(events []json.RawMessage) []json.RawMessage {
+	if events == nil {
+		return nil
+	}
+	return append(make([]json.RawMessage, 0, len(events)), events...)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -34,6 +35,9 @@ type ConnHandler interface {
 	OnUpdate(ctx context.Context, update caches.Update)
 	Destroy()
 	Alive() bool
+	// ApproxSizeBytes returns a rough estimate of the memory used by this handler. Must be safe to
+	// call concurrently with the other functions.
+	ApproxSizeBytes() int
 }
 
 // Conn is an abstraction of a long-poll connection. It automatically handles the position values
@@ -56,6 +60,9 @@ type Conn struct {
 	// - Everything after that is new and unseen, and the first element is the one we want to return.
 	serverResponses []Response
 	lastPos         int64
+	// the approximate size of serverResponses, updated after each request
+	serverResponsesSizeBytes atomic.Int64
+	createdAt                time.Time
 
 	// ensure only 1 incoming request is handled per connection
 	mu                         *sync.Mutex
@@ -69,6 +76,7 @@ func NewConn(connID ConnID, h ConnHandler) *Conn {
 		handler:                    h,
 		mu:                         &sync.Mutex{},
 		cancelOutstandingRequestMu: &sync.Mutex{},
+		createdAt:                  time.Now(),
 	}
 }
 
@@ -76,6 +84,21 @@ func (c *Conn) Alive() bool {
 	return c.handler.Alive()
 }
 
+// ApproxSizeBytes returns a rough estimate of the memory used by this connection, including the
+// responses buffered for retransmission.
+func (c *Conn) ApproxSizeBytes() int64 {
+	return c.serverResponsesSizeBytes.Load() + int64(c.handler.ApproxSizeBytes())
+}
+
+// updateSizeBytes recalculates the size of the buffered responses. Must hold mu.
+func (c *Conn) updateSizeBytes() {
+	size := 0
+	for i := range c.serverResponses {
+		size += c.serverResponses[i].ApproxSizeBytes()
+	}
+	c.serverResponsesSizeBytes.Store(int64(size))
+}
+
 func (c *Conn) OnUpdate(ctx context.Context, update caches.Update) {
 	c.handler.OnUpdate(ctx, update)
 }
@@ -175,6 +198,7 @@ func (c *Conn) OnIncomingRequest(ctx context.Context, req *Request) (resp *Respo
 		}
 	}
 	c.serverResponses = c.serverResponses[delIndex+1:] // slice out the first delIndex+1 elements
+	defer c.updateSizeBytes()
 
 	defer func() {
 		l := logger.Trace().Int("num_res_acks", delIndex+1).Bool("is_retransmit", isRetransmit).Bool("is_first", isFirstRequest).Bool("is_same", isSameRequest).Int64("pos", req.pos).Str("user", c.UserID)
@@ -24,6 +24,7 @@ func (c *connHandlerMock) UserID() string {
 }
 func (c *connHandlerMock) Destroy()                                           {}
 func (c *connHandlerMock) Alive() bool                                        { return true }
+func (c *connHandlerMock) ApproxSizeBytes() int                               { return 0 }
 func (c *connHandlerMock) OnUpdate(ctx context.Context, update caches.Update) {}
 
 // Test that Conn can send and receive requests based on positions
@@ -1,6 +1,7 @@
 package sync3
 
 import (
+	"sort"
 	"sync"
 	"time"
 
@@ -95,6 +96,76 @@ func (m *ConnMap) CreateConn(cid ConnID, newConnHandler func() ConnHandler) (*Co
 	return conn, true
 }
 
+// UserHasConns returns true if this user has at least one connection.
+func (m *ConnMap) UserHasConns(userID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.userIDToConn[userID]) > 0
+}
+
+// ConnMemoryUsage is the result of ConnMap.EnforceMemoryLimits.
+type ConnMemoryUsage struct {
+	// The approximate memory used by all connections, after any were expired.
+	TotalBytes int64
+	// The number of connections expired for exceeding the per-connection limit
+	NumExpiredForConnLimit int
+	// The number of connections expired to bring the total under the global limit
+	NumExpiredForTotalLimit int
+}
+
+// EnforceMemoryLimits expires connections which use more than maxConnBytes, then expires the
+// largest connections, oldest first, until the total is at most maxTotalBytes. Zero disables a
+// limit. Clients of expired connections will be told their session has expired on their next request.
+func (m *ConnMap) EnforceMemoryLimits(maxConnBytes, maxTotalBytes int64) ConnMemoryUsage {
+	type connSize struct {
+		conn *Conn
+		size int64
+	}
+	m.mu.Lock()
+	conns := make([]connSize, 0, len(m.connIDToConn))
+	for _, conn := range m.connIDToConn {
+		conns = append(conns, connSize{conn, conn.ApproxSizeBytes()})
+	}
+	m.mu.Unlock()
+
+	var usage ConnMemoryUsage
+	var expire []*Conn
+	remaining := conns[:0]
+	for _, cs := range conns {
+		if maxConnBytes > 0 && cs.size > maxConnBytes {
+			logger.Warn().Str("conn", cs.conn.ConnID.String()).Int64("size", cs.size).Msg("expiring connection over memory limit")
+			expire = append(expire, cs.conn)
+			usage.NumExpiredForConnLimit++
+			continue
+		}
+		usage.TotalBytes += cs.size
+		remaining = append(remaining, cs)
+	}
+	if maxTotalBytes > 0 && usage.TotalBytes > maxTotalBytes {
+		sort.Slice(remaining, func(i, j int) bool {
+			if remaining[i].size != remaining[j].size {
+				return remaining[i].size > remaining[j].size
+			}
+			return remaining[i].conn.createdAt.Before(remaining[j].conn.createdAt)
+		})
+		for _, cs := range remaining {
+			if usage.TotalBytes <= maxTotalBytes {
+				break
+			}
+			logger.Warn().Str("conn", cs.conn.ConnID.String()).Int64("size", cs.size).Int64("total", usage.TotalBytes).Msg(
+				"expiring connection, total memory limit exceeded",
+			)
+			expire = append(expire, cs.conn)
+			usage.TotalBytes -= cs.size
+			usage.NumExpiredForTotalLimit++
+		}
+	}
+	for _, conn := range expire {
+		m.cache.Remove(conn.ConnID.String()) // this will fire TTL callbacks which calls closeConn
+	}
+	return usage
+}
+
 func (m *ConnMap) CloseConnsForDevice(userID, deviceID string) {
 	logger.Trace().Str("user", userID).Str("device", deviceID).Msg("closing connections due to CloseConn()")
 	// gather open connections for this user|device
@@ -0,0 +1,106 @@
+package sync3
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type sizedConnHandlerMock struct {
+	connHandlerMock
+	sizeBytes int
+}
+
+func (c *sizedConnHandlerMock) ApproxSizeBytes() int { return c.sizeBytes }
+
+func TestConnMapEnforceMemoryLimits(t *testing.T) {
+	testCases := []struct {
+		name          string
+		sizes         []int // in creation order
+		maxConnBytes  int64
+		maxTotalBytes int64
+		wantExpired   []int // indexes into sizes
+		wantUsage     ConnMemoryUsage
+	}{
+		{
+			name:      "no limits",
+			sizes:     []int{100, 200, 300},
+			wantUsage: ConnMemoryUsage{TotalBytes: 600},
+		},
+		{
+			name:         "per-connection limit",
+			sizes:        []int{100, 200, 300},
+			maxConnBytes: 150,
+			wantExpired:  []int{1, 2},
+			wantUsage:    ConnMemoryUsage{TotalBytes: 100, NumExpiredForConnLimit: 2},
+		},
+		{
+			name:          "total limit expires largest first",
+			sizes:         []int{100, 300, 200},
+			maxTotalBytes: 350,
+			wantExpired:   []int{1},
+			wantUsage:     ConnMemoryUsage{TotalBytes: 300, NumExpiredForTotalLimit: 1},
+		},
+		{
+			name:          "total limit expires oldest first when sizes are equal",
+			sizes:         []int{200, 200, 200},
+			maxTotalBytes: 450,
+			wantExpired:   []int{0},
+			wantUsage:     ConnMemoryUsage{TotalBytes: 400, NumExpiredForTotalLimit: 1},
+		},
+		{
+			name:          "both limits",
+			sizes:         []int{100, 500, 200, 300},
+			maxConnBytes:  400,
+			maxTotalBytes: 350,
+			wantExpired:   []int{1, 3},
+			wantUsage:     ConnMemoryUsage{TotalBytes: 300, NumExpiredForConnLimit: 1, NumExpiredForTotalLimit: 1},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cm := NewConnMap()
+			defer cm.Teardown()
+			var cids []ConnID
+			for i, size := range tc.sizes {
+				cid := ConnID{UserID: "@alice:localhost", DeviceID: fmt.Sprintf("DEVICE_%d", i)}
+				conn, _ := cm.CreateConn(cid, func() ConnHandler {
+					return &sizedConnHandlerMock{sizeBytes: size}
+				})
+				// make sure creation times are distinct
+				conn.createdAt = time.Unix(int64(i), 0)
+				cids = append(cids, cid)
+			}
+			usage := cm.EnforceMemoryLimits(tc.maxConnBytes, tc.maxTotalBytes)
+			if usage != tc.wantUsage {
+				t.Errorf("got usage %+v want %+v", usage, tc.wantUsage)
+			}
+			expired := make(map[int]bool)
+			for _, i := range tc.wantExpired {
+				expired[i] = true
+			}
+			for i, cid := range cids {
+				gotExpired := cm.Conn(cid) == nil
+				if gotExpired != expired[i] {
+					t.Errorf("conn %d: got expired=%v want %v", i, gotExpired, expired[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResponseApproxSizeBytes(t *testing.T) {
+	empty := (&Response{}).ApproxSizeBytes()
+	event := json.RawMessage(`{"type":"m.room.message","content":{"body":"` + string(make([]byte, 1000)) + `"}}`)
+	withEvent := (&Response{
+		Rooms: map[string]Room{
+			"!a:localhost": {
+				Timeline: []json.RawMessage{event},
+			},
+		},
+	}).ApproxSizeBytes()
+	if withEvent-empty < len(event) {
+		t.Errorf("response with event is %d bytes larger than an empty response, want at least %d", withEvent-empty, len(event))
+	}
+}
@@ -24,6 +24,7 @@ type Receiver interface {
 	OnNewEvent(ctx context.Context, event *caches.EventData)
 	OnReceipt(ctx context.Context, receipt internal.Receipt)
 	OnEphemeralEvent(ctx context.Context, roomID string, ephEvent json.RawMessage)
+	OnPresence(ctx context.Context, presence internal.Presence)
 	// OnRegistered is called after a successful call to Dispatcher.Register
 	OnRegistered(ctx context.Context) error
 }
@@ -47,6 +48,18 @@ func (d *Dispatcher) IsUserJoined(userID, roomID string) bool {
 	return d.jrt.IsUserJoined(userID, roomID)
 }
 
+// AnyJoinedUser returns true if any user joined to the room matches the filter.
+func (d *Dispatcher) AnyJoinedUser(roomID string, filter func(userID string) bool) bool {
+	// check users without holding the tracker lock, as the filter may take locks of its own
+	userIDs, _ := d.jrt.JoinedUsersForRoom(roomID, nil)
+	for _, userID := range userIDs {
+		if userID != DispatcherAllUsers && filter(userID) {
+			return true
+		}
+	}
+	return false
+}
+
 // Load joined members into the dispatcher.
 // MUST BE CALLED BEFORE V2 POLL LOOPS START.
 func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
@@ -55,6 +68,18 @@ func (d *Dispatcher) Startup(roomToJoinedUsers map[string][]string) error {
 	return nil
 }
 
+// StartupFromCheckpoint loads joined and invited members, as returned by Snapshot, into the dispatcher.
+// MUST BE CALLED BEFORE V2 POLL LOOPS START.
+func (d *Dispatcher) StartupFromCheckpoint(roomToJoinedUsers, roomToInvitedUsers map[string][]string) {
+	d.jrt.Startup(roomToJoinedUsers)
+	d.jrt.StartupInvited(roomToInvitedUsers)
+}
+
+// Snapshot returns a copy of the joined and invited members of every room.
+func (d *Dispatcher) Snapshot() (roomToJoinedUsers, roomToInvitedUsers map[string][]string) {
+	return d.jrt.Snapshot()
+}
+
 func (d *Dispatcher) Unregister(userID string) {
 	d.userToReceiverMu.Lock()
 	defer d.userToReceiverMu.Unlock()
@@ -241,6 +266,49 @@ func (d *Dispatcher) OnReceipt(ctx context.Context, receipt internal.Receipt) {
 	}
 }
 
+// JoinedUsersForRoom returns the users joined to this room.
+func (d *Dispatcher) JoinedUsersForRoom(roomID string) []string {
+	userIDs, _ := d.jrt.JoinedUsersForRoom(roomID, func(userID string) bool {
+		return userID != DispatcherAllUsers
+	})
+	return userIDs
+}
+
+func (d *Dispatcher) OnPresence(ctx context.Context, presence internal.Presence) {
+	// Presence is only visible to the user themselves and users who share a room with them. There
+	// are usually far fewer users with receivers than members of the user's rooms, so only check
+	// whether the users with receivers share a room. The tracker is queried without holding
+	// userToReceiverMu, as JoinedUsersForRoom filters take the locks in the opposite order.
+	d.userToReceiverMu.RLock()
+	candidateUserIDs := make([]string, 0, len(d.userToReceiver))
+	for userID := range d.userToReceiver {
+		if userID != DispatcherAllUsers { // safety guard to prevent dupe global callbacks
+			candidateUserIDs = append(candidateUserIDs, userID)
+		}
+	}
+	d.userToReceiverMu.RUnlock()
+	notifyUserIDs := d.jrt.UsersSharingRoomsWith(presence.UserID, candidateUserIDs)
+	notifyUserIDs = append(notifyUserIDs, presence.UserID)
+
+	d.userToReceiverMu.RLock()
+	defer d.userToReceiverMu.RUnlock()
+
+	// global listeners (invoke before per-user listeners so caches can update)
+	listener := d.userToReceiver[DispatcherAllUsers]
+	if listener != nil {
+		listener.OnPresence(ctx, presence)
+	}
+
+	// poke user caches OnPresence which then pokes ConnState
+	for _, userID := range notifyUserIDs {
+		l := d.userToReceiver[userID]
+		if l == nil {
+			continue
+		}
+		l.OnPresence(ctx, presence)
+	}
+}
+
 func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData, userIDs []string, targetUser string, shouldForceInitial bool, membership string) {
 	internal.Logf(ctx, "dispatcher", "%s: notify %d users (nid=%d,join_count=%d)", ed.RoomID, len(userIDs), ed.NID, ed.JoinCount)
 	// invoke listeners
@@ -273,7 +341,8 @@ func (d *Dispatcher) notifyListeners(ctx context.Context, ed *caches.EventData,
 		// not normal event codepaths. We need the separate code path to ensure invite stripped state
 		// is sent to the conn and not live data. Hence, if we get the invite event early from a different
 		// connection, do not send it to the target, as they must wait for the invite on their poller.
-		if membership != "invite" {
+		// The same applies to knocks, which come down the knocker's poller and trigger OnKnock.
+		if membership != "invite" && membership != "knock" {
 			if shouldForceInitial {
 				ed.ForceInitial = true
 			}
@@ -3,6 +3,9 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"math"
+	"strconv"
+
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
@@ -11,23 +14,93 @@ import (
 // Client created request params
 type AccountDataRequest struct {
 	Core
+	// If set, only return account data with these event types.
+	Types []string `json:"types"`
+	// Never return account data with these event types.
+	NotTypes []string `json:"not_types"`
+	// The max number of global account data events per response. 0 means no limit. If there are
+	// more events, the response will include a `next_batch` token to use as `since`.
+	Limit *int `json:"limit"`
+	// The `next_batch` from a previous response, to fetch the next page of global account data.
+	Since *string `json:"since"`
+
+	// the since token we last returned a page of global account data for
+	servedSince string
 }
 
 func (r *AccountDataRequest) Name() string {
 	return "AccountDataRequest"
 }
 
+func (r *AccountDataRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*AccountDataRequest)
+	if next.Types != nil {
+		r.Types = next.Types
+	}
+	if next.NotTypes != nil {
+		r.NotTypes = next.NotTypes
+	}
+	if next.Limit != nil {
+		r.Limit = next.Limit
+	}
+	if next.Since != nil {
+		r.Since = next.Since
+	}
+}
+
+// since returns the since token, or "" to fetch the first page.
+func (r *AccountDataRequest) since() string {
+	if r.Since == nil {
+		return ""
+	}
+	return *r.Since
+}
+
+// typeAllowed returns true if account data of this event type passes the type filters.
+func (r *AccountDataRequest) typeAllowed(evType string) bool {
+	for _, t := range r.NotTypes {
+		if t == evType {
+			return false
+		}
+	}
+	if len(r.Types) == 0 {
+		return true
+	}
+	for _, t := range r.Types {
+		if t == evType {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *AccountDataRequest) filter(events []state.AccountData) []state.AccountData {
+	if len(r.Types) == 0 && len(r.NotTypes) == 0 {
+		return events
+	}
+	filtered := make([]state.AccountData, 0, len(events))
+	for _, ev := range events {
+		if r.typeAllowed(ev.Type) {
+			filtered = append(filtered, ev)
+		}
+	}
+	return filtered
+}
+
 // Server response
 type AccountDataResponse struct {
 	Global []json.RawMessage            `json:"global,omitempty"`
 	Rooms  map[string][]json.RawMessage `json:"rooms,omitempty"`
+	// Set if there is more global account data to fetch.
+	NextBatch string `json:"next_batch,omitempty"`
 }
 
 func (r *AccountDataResponse) HasData(isInitial bool) bool {
 	if isInitial {
 		return true
 	}
-	return len(r.Rooms) > 0 || len(r.Global) > 0
+	return len(r.Rooms) > 0 || len(r.Global) > 0 || r.NextBatch != ""
 }
 
 func accountEventsAsJSON(events []state.AccountData) []json.RawMessage {
@@ -43,10 +116,12 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 	roomToMsgs := map[string][]json.RawMessage{}
 	switch update := up.(type) {
 	case *caches.AccountDataUpdate:
-		globalMsgs = accountEventsAsJSON(update.AccountData)
+		globalMsgs = accountEventsAsJSON(r.filter(update.AccountData))
 	case *caches.RoomAccountDataUpdate:
 		if r.RoomInScope(update.RoomID(), extCtx) {
-			roomToMsgs[update.RoomID()] = accountEventsAsJSON(update.AccountData)
+			if roomAccountData := r.filter(update.AccountData); len(roomAccountData) > 0 {
+				roomToMsgs[update.RoomID()] = accountEventsAsJSON(roomAccountData)
+			}
 		}
 	case caches.RoomUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
@@ -59,6 +134,7 @@ func (r *AccountDataRequest) AppendLive(ctx context.Context, res *Response, extC
 				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.RoomID()).Msg("failed to fetch room account data")
 				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 			} else {
+				roomAccountData = r.filter(roomAccountData)
 				if len(roomAccountData) > 0 { // else we can end up with `null` not `[]`
 					roomToMsgs[update.RoomID()] = accountEventsAsJSON(roomAccountData)
 				}
@@ -100,22 +176,50 @@ func (r *AccountDataRequest) ProcessInitial(ctx context.Context, res *Response,
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		} else {
 			extRes.Rooms = make(map[string][]json.RawMessage)
-			for _, ad := range roomsAccountData {
+			for _, ad := range r.filter(roomsAccountData) {
 				extRes.Rooms[ad.RoomID] = append(extRes.Rooms[ad.RoomID], ad.Data)
 			}
 		}
 	}
-	// global account data is only sent on the first connection, then we live stream
-	if extCtx.IsInitial {
-		globalAccountData, err := extCtx.Store.AccountDatas(extCtx.UserID)
+	// global account data is only sent on the first connection, then we live stream. If the
+	// client is paginating, send the next page whenever they give us a new since token.
+	if extCtx.IsInitial || r.since() != r.servedSince {
+		r.processGlobalPage(ctx, extRes, extCtx)
+	}
+	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 || extRes.NextBatch != "" {
+		res.AccountData = extRes
+	}
+}
+
+func (r *AccountDataRequest) processGlobalPage(ctx context.Context, extRes *AccountDataResponse, extCtx Context) {
+	l := logger.With().Str("user", extCtx.UserID).Logger()
+	since := r.since()
+	var from int64
+	if since != "" {
+		var err error
+		from, err = strconv.ParseInt(since, 10, 64)
 		if err != nil {
-			logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch global account data")
+			l.Err(err).Str("since", since).Msg("invalid since value")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-		} else {
-			extRes.Global = accountEventsAsJSON(globalAccountData)
+			return
 		}
 	}
-	if len(extRes.Rooms) > 0 || len(extRes.Global) > 0 {
-		res.AccountData = extRes
+	pageSize := intValue(r.Limit)
+	limit := math.MaxInt32
+	if pageSize > 0 {
+		// fetch one more so we know if there is another page
+		limit = pageSize + 1
+	}
+	globalAccountData, err := extCtx.Store.GlobalAccountDataPage(extCtx.UserID, from, limit, r.Types, r.NotTypes)
+	if err != nil {
+		l.Err(err).Msg("failed to fetch global account data")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	r.servedSince = since
+	if pageSize > 0 && len(globalAccountData) > pageSize {
+		globalAccountData = globalAccountData[:pageSize]
+		extRes.NextBatch = strconv.FormatInt(globalAccountData[len(globalAccountData)-1].ID, 10)
 	}
+	extRes.Global = accountEventsAsJSON(globalAccountData)
 }
@@ -105,3 +105,55 @@ func TestLiveAccountDataAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.AccountData.Global, wantGlobalAccountData)
 	}
 }
+
+func TestLiveAccountDataTypeFilters(t *testing.T) {
+	boolTrue := true
+	ext := &AccountDataRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	ext.ApplyDelta(&AccountDataRequest{
+		Types:    []string{"m.direct", "com.example.settings"},
+		NotTypes: []string{"com.example.settings"},
+	})
+	var res Response
+	ext.AppendLive(ctx, &res, Context{}, &caches.AccountDataUpdate{
+		AccountData: []state.AccountData{
+			{Type: "m.direct", Data: []byte(`{"type":"m.direct"}`)},
+			{Type: "com.example.settings", Data: []byte(`{"type":"com.example.settings"}`)},
+			{Type: "m.push_rules", Data: []byte(`{"type":"m.push_rules"}`)},
+		},
+	})
+	ext.AppendLive(ctx, &res, Context{}, &caches.RoomAccountDataUpdate{
+		RoomUpdate: &dummyRoomUpdate{
+			roomID: roomA,
+			globalMetadata: &internal.RoomMetadata{
+				RoomID: roomA,
+			},
+		},
+		AccountData: []state.AccountData{
+			{Type: "m.tag", Data: []byte(`{"type":"m.tag"}`)},
+		},
+	})
+	want := &AccountDataResponse{
+		Global: []json.RawMessage{[]byte(`{"type":"m.direct"}`)},
+		Rooms:  map[string][]json.RawMessage{},
+	}
+	if !reflect.DeepEqual(res.AccountData, want) {
+		t.Fatalf("got %+v want %+v", res.AccountData, want)
+	}
+
+	// filters are sticky
+	limit := 5
+	ext.ApplyDelta(&AccountDataRequest{Limit: &limit})
+	if len(ext.Types) != 2 || len(ext.NotTypes) != 1 || intValue(ext.Limit) != 5 {
+		t.Fatalf("ApplyDelta did not keep sticky fields: %+v", ext)
+	}
+	// an explicit 0 removes the limit
+	noLimit := 0
+	ext.ApplyDelta(&AccountDataRequest{Limit: &noLimit})
+	if ext.Limit == nil || *ext.Limit != 0 {
+		t.Fatalf("ApplyDelta did not reset the limit: %+v", ext)
+	}
+}
@@ -0,0 +1,274 @@
+package extensions
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+// The MSC3401 state event type for group call membership
+const callMemberEventType = "m.call.member"
+
+// Client created request params
+type CallsRequest struct {
+	Core
+
+	// the call state the client has been told about, room_id -> state. Rooms without an active call
+	// are not present.
+	known map[string]CallState
+	// the rooms in scope which have had their call state loaded on this connection
+	checked map[string]struct{}
+	// the active m.call.member events in checked rooms, room_id -> state_key -> sender. Live
+	// events update this, so the call state can be worked out without loading the room state.
+	memberships map[string]map[string]string
+}
+
+func (r *CallsRequest) Name() string {
+	return "CallsRequest"
+}
+
+// Server response
+type CallsResponse struct {
+	Rooms map[string]CallState `json:"rooms,omitempty"`
+}
+
+// CallState is the call state for a single room.
+type CallState struct {
+	// True if there is a call in progress in this room.
+	Active bool `json:"active"`
+	// The user IDs of the call participants, sorted.
+	Members []string `json:"members,omitempty"`
+}
+
+func (s CallState) equals(other CallState) bool {
+	if s.Active != other.Active || len(s.Members) != len(other.Members) {
+		return false
+	}
+	for i := range s.Members {
+		if s.Members[i] != other.Members[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *CallsResponse) HasData(isInitial bool) bool {
+	return len(r.Rooms) > 0
+}
+
+// roomInScope returns true if the room is in any of the client's lists, not just the visible ranges,
+// or is explicitly subscribed to. The core `lists` and `rooms` fields narrow this as usual.
+func (r *CallsRequest) roomInScope(roomID string, extCtx Context) bool {
+	for _, roomInScope := range r.Rooms {
+		if roomInScope == roomID {
+			return true
+		}
+	}
+	var inLists []string
+	if extCtx.ListsForRoom != nil {
+		inLists = extCtx.ListsForRoom(roomID)
+	}
+	if r.Lists == nil && r.Rooms == nil {
+		_, subscribed := extCtx.RoomSubscriptions[roomID]
+		return subscribed || len(inLists) > 0
+	}
+	for _, inList := range inLists {
+		for _, shouldProcessList := range r.Lists {
+			if inList == shouldProcessList {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *CallsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.RoomEventUpdate)
+	if !ok || update.EventData.EventType != callMemberEventType || update.EventData.StateKey == nil {
+		return
+	}
+	roomID := update.RoomID()
+	if !r.roomInScope(roomID, extCtx) {
+		// reload the call state if this room comes back into scope
+		r.forget(roomID)
+		return
+	}
+	if _, checked := r.checked[roomID]; !checked {
+		// the room has come into scope since this request started
+		r.loadCallStates(ctx, res, extCtx, []string{roomID}, update.EventData.NID)
+		return
+	}
+	r.setMembership(roomID, *update.EventData.StateKey, gjson.ParseBytes(update.EventData.Event), time.Now())
+	r.setCallState(res, roomID, r.callState(roomID))
+}
+
+// forget drops what is known about this room's call members, so they are reloaded if needed.
+func (r *CallsRequest) forget(roomID string) {
+	delete(r.checked, roomID)
+	delete(r.memberships, roomID)
+}
+
+// setMembership updates the active call members of a checked room with this m.call.member event.
+func (r *CallsRequest) setMembership(roomID, stateKey string, ev gjson.Result, now time.Time) {
+	if !callMemberActive(ev, now) {
+		delete(r.memberships[roomID], stateKey)
+		return
+	}
+	if r.memberships[roomID] == nil {
+		r.memberships[roomID] = make(map[string]string)
+	}
+	r.memberships[roomID][stateKey] = ev.Get("sender").Str
+}
+
+// callState works out the call state of a checked room from its active call members.
+func (r *CallsRequest) callState(roomID string) CallState {
+	members := make(map[string]struct{}, len(r.memberships[roomID]))
+	for _, sender := range r.memberships[roomID] {
+		members[sender] = struct{}{}
+	}
+	return callStateFromMembers(members)
+}
+
+func (r *CallsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	if extCtx.IsInitial || r.checked == nil {
+		r.reset()
+	}
+	// forget rooms which have left scope, so we recheck them if they come back
+	for roomID := range r.checked {
+		if !r.roomInScope(roomID, extCtx) {
+			r.forget(roomID)
+		}
+	}
+	candidates := make(map[string]struct{}, len(extCtx.RoomIDsInLists))
+	for roomID := range extCtx.RoomIDsInLists {
+		candidates[roomID] = struct{}{}
+	}
+	for roomID := range extCtx.RoomSubscriptions {
+		candidates[roomID] = struct{}{}
+	}
+	for _, roomID := range r.Rooms {
+		candidates[roomID] = struct{}{}
+	}
+	var roomIDs []string
+	for roomID := range candidates {
+		if _, checked := r.checked[roomID]; !checked && r.roomInScope(roomID, extCtx) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	if len(roomIDs) == 0 {
+		return
+	}
+	pos, err := extCtx.Store.LatestEventNID()
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to load latest event NID")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	r.loadCallStates(ctx, res, extCtx, roomIDs, pos)
+}
+
+// loadCallStates loads the current call state for these rooms and adds any which differ from what
+// the client knows to the response.
+func (r *CallsRequest) loadCallStates(ctx context.Context, res *Response, extCtx Context, roomIDs []string, pos int64) {
+	roomToEvents, err := extCtx.Store.RoomStateAfterEventPosition(ctx, roomIDs, pos, map[string][]string{
+		callMemberEventType: nil,
+	})
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Strs("rooms", roomIDs).Msg("failed to load call state")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	if r.known == nil {
+		r.reset()
+	}
+	now := time.Now()
+	for _, roomID := range roomIDs {
+		r.checked[roomID] = struct{}{}
+		delete(r.memberships, roomID)
+		for _, ev := range roomToEvents[roomID] {
+			r.setMembership(roomID, ev.StateKey, gjson.ParseBytes(ev.JSON), now)
+		}
+		r.setCallState(res, roomID, r.callState(roomID))
+	}
+}
+
+func (r *CallsRequest) reset() {
+	r.known = make(map[string]CallState)
+	r.checked = make(map[string]struct{})
+	r.memberships = make(map[string]map[string]string)
+}
+
+func (r *CallsRequest) setCallState(res *Response, roomID string, callState CallState) {
+	if callState.equals(r.known[roomID]) {
+		return
+	}
+	if callState.Active {
+		r.known[roomID] = callState
+	} else {
+		delete(r.known, roomID)
+	}
+	if res.Calls == nil {
+		res.Calls = &CallsResponse{
+			Rooms: make(map[string]CallState),
+		}
+	}
+	res.Calls.Rooms[roomID] = callState
+}
+
+// CallStateFromEvents works out the call state from a room's current m.call.member state events.
+// Both the legacy per-user format (with `m.calls`) and the per-device format are supported. Expired
+// memberships are ignored, though nothing is sent when a membership expires without a new event.
+func CallStateFromEvents(events []gjson.Result, now time.Time) CallState {
+	members := make(map[string]struct{})
+	for _, ev := range events {
+		if callMemberActive(ev, now) {
+			members[ev.Get("sender").Str] = struct{}{}
+		}
+	}
+	return callStateFromMembers(members)
+}
+
+func callStateFromMembers(members map[string]struct{}) CallState {
+	if len(members) == 0 {
+		return CallState{}
+	}
+	callState := CallState{
+		Active:  true,
+		Members: make([]string, 0, len(members)),
+	}
+	for userID := range members {
+		callState.Members = append(callState.Members, userID)
+	}
+	sort.Strings(callState.Members)
+	return callState
+}
+
+func callMemberActive(ev gjson.Result, now time.Time) bool {
+	content := ev.Get("content")
+	if !content.IsObject() || len(content.Map()) == 0 {
+		// an empty m.call.member event means the member left the call
+		return false
+	}
+	nowMs := now.UnixMilli()
+	if calls := content.Get(`m\.calls`); calls.Exists() {
+		// legacy format: active if any device in any call hasn't expired
+		for _, call := range calls.Array() {
+			for _, device := range call.Get(`m\.devices`).Array() {
+				expiresTS := device.Get("expires_ts")
+				if !expiresTS.Exists() || expiresTS.Int() > nowMs {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	// per-device format: `expires` is relative to the event's origin_server_ts
+	if expires := content.Get("expires"); expires.Exists() {
+		return ev.Get("origin_server_ts").Int()+expires.Int() > nowMs
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package extensions
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+func TestCallStateFromEvents(t *testing.T) {
+	now := time.UnixMilli(1000000)
+	testCases := []struct {
+		name   string
+		events []string
+		want   CallState
+	}{
+		{
+			name: "no events",
+			want: CallState{},
+		},
+		{
+			name: "left members are ignored",
+			events: []string{
+				`{"type":"m.call.member","state_key":"@alice:localhost","sender":"@alice:localhost","content":{}}`,
+				`{"type":"m.call.member","state_key":"@bob:localhost","sender":"@bob:localhost","content":{"m.calls":[]}}`,
+			},
+			want: CallState{},
+		},
+		{
+			name: "legacy format with expiry",
+			events: []string{
+				`{"type":"m.call.member","state_key":"@alice:localhost","sender":"@alice:localhost","content":{"m.calls":[{"m.call_id":"","m.devices":[{"device_id":"A","expires_ts":999999}]}]}}`,
+				`{"type":"m.call.member","state_key":"@bob:localhost","sender":"@bob:localhost","content":{"m.calls":[{"m.call_id":"","m.devices":[{"device_id":"B","expires_ts":1000001}]}]}}`,
+			},
+			want: CallState{Active: true, Members: []string{"@bob:localhost"}},
+		},
+		{
+			name: "per-device format, deduplicated by user and sorted",
+			events: []string{
+				`{"type":"m.call.member","state_key":"_@charlie:localhost_C1","sender":"@charlie:localhost","origin_server_ts":0,"content":{"application":"m.call","call_id":"","device_id":"C1"}}`,
+				`{"type":"m.call.member","state_key":"_@charlie:localhost_C2","sender":"@charlie:localhost","origin_server_ts":0,"content":{"application":"m.call","call_id":"","device_id":"C2"}}`,
+				`{"type":"m.call.member","state_key":"_@bob:localhost_B","sender":"@bob:localhost","origin_server_ts":900000,"content":{"application":"m.call","call_id":"","device_id":"B","expires":200000}}`,
+				`{"type":"m.call.member","state_key":"_@alice:localhost_A","sender":"@alice:localhost","origin_server_ts":900000,"content":{"application":"m.call","call_id":"","device_id":"A","expires":50000}}`,
+			},
+			want: CallState{Active: true, Members: []string{"@bob:localhost", "@charlie:localhost"}},
+		},
+	}
+	for _, tc := range testCases {
+		events := make([]gjson.Result, len(tc.events))
+		for i := range tc.events {
+			events[i] = gjson.Parse(tc.events[i])
+		}
+		got := CallStateFromEvents(events, now)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCallsOnlySendsChanges(t *testing.T) {
+	boolTrue := true
+	ext := &CallsRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+		known:   make(map[string]CallState),
+		checked: make(map[string]struct{}),
+	}
+	active := CallState{Active: true, Members: []string{"@alice:localhost"}}
+
+	var res Response
+	ext.setCallState(&res, roomA, CallState{})
+	if res.Calls != nil {
+		t.Fatalf("inactive call was sent when the client knows of no call: %+v", res.Calls)
+	}
+	ext.setCallState(&res, roomA, active)
+	if !res.HasData(false) || !reflect.DeepEqual(res.Calls.Rooms[roomA], active) {
+		t.Fatalf("active call was not sent: %+v", res.Calls)
+	}
+
+	res = Response{}
+	ext.setCallState(&res, roomA, CallState{Active: true, Members: []string{"@alice:localhost"}})
+	if res.Calls != nil {
+		t.Fatalf("unchanged call was sent: %+v", res.Calls)
+	}
+	ext.setCallState(&res, roomA, CallState{})
+	if res.Calls == nil || res.Calls.Rooms[roomA].Active {
+		t.Fatalf("ended call was not sent: %+v", res.Calls)
+	}
+}
+
+func TestCallsRoomInScope(t *testing.T) {
+	roomZ := "!z:localhost"
+	roomIDsInLists := map[string][]string{roomA: {"a"}, roomB: {"b"}}
+	extCtx := Context{
+		ListsForRoom: func(roomID string) []string {
+			return roomIDsInLists[roomID]
+		},
+		RoomSubscriptions: map[string]struct{}{roomC: {}},
+	}
+	testCases := []struct {
+		name string
+		req  CallsRequest
+		want map[string]bool
+	}{
+		{
+			name: "all lists and subscriptions by default",
+			req:  CallsRequest{},
+			want: map[string]bool{roomA: true, roomB: true, roomC: true, roomZ: false},
+		},
+		{
+			name: "lists only",
+			req:  CallsRequest{Core: Core{Lists: []string{"a"}}},
+			want: map[string]bool{roomA: true, roomB: false, roomC: false, roomZ: false},
+		},
+		{
+			name: "rooms only",
+			req:  CallsRequest{Core: Core{Rooms: []string{roomZ}}},
+			want: map[string]bool{roomA: false, roomB: false, roomC: false, roomZ: true},
+		},
+	}
+	for _, tc := range testCases {
+		for roomID, want := range tc.want {
+			if got := tc.req.roomInScope(roomID, extCtx); got != want {
+				t.Errorf("%s: roomInScope(%s) got %v want %v", tc.name, roomID, got, want)
+			}
+		}
+	}
+}
+
+func TestCallsLiveMembershipChanges(t *testing.T) {
+	boolTrue := true
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	ext := &CallsRequest{Core: Core{Enabled: &boolTrue}}
+	ext.reset()
+	// the room has already been loaded, so live events must not hit the database
+	ext.checked[roomA] = struct{}{}
+	extCtx := Context{
+		RoomSubscriptions: map[string]struct{}{roomA: {}},
+	}
+	newUpdate := func(sender, stateKey, content string) *caches.RoomEventUpdate {
+		return &caches.RoomEventUpdate{
+			RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+			EventData: &caches.EventData{
+				Event:     json.RawMessage(`{"type":"m.call.member","sender":"` + sender + `","state_key":"` + stateKey + `","content":` + content + `}`),
+				RoomID:    roomA,
+				EventType: callMemberEventType,
+				StateKey:  &stateKey,
+			},
+		}
+	}
+	joined := `{"application":"m.call","call_id":"","device_id":"DEVICE"}`
+	testCases := []struct {
+		name   string
+		update *caches.RoomEventUpdate
+		want   *CallState
+	}{
+		{
+			name:   "alice joins from one device",
+			update: newUpdate(alice, "_"+alice+"_A", joined),
+			want:   &CallState{Active: true, Members: []string{alice}},
+		},
+		{
+			name:   "alice joins from another device",
+			update: newUpdate(alice, "_"+alice+"_B", joined),
+		},
+		{
+			name:   "bob joins",
+			update: newUpdate(bob, "_"+bob+"_A", joined),
+			want:   &CallState{Active: true, Members: []string{alice, bob}},
+		},
+		{
+			name:   "alice leaves from one device",
+			update: newUpdate(alice, "_"+alice+"_A", `{}`),
+		},
+		{
+			name:   "alice leaves from her other device",
+			update: newUpdate(alice, "_"+alice+"_B", `{}`),
+			want:   &CallState{Active: true, Members: []string{bob}},
+		},
+		{
+			name:   "bob leaves",
+			update: newUpdate(bob, "_"+bob+"_A", `{}`),
+			want:   &CallState{},
+		},
+	}
+	for _, tc := range testCases {
+		var res Response
+		ext.AppendLive(ctx, &res, extCtx, tc.update)
+		if tc.want == nil {
+			if res.Calls != nil {
+				t.Errorf("%s: unexpected call state %+v", tc.name, res.Calls)
+			}
+			continue
+		}
+		if res.Calls == nil || !reflect.DeepEqual(res.Calls.Rooms[roomA], *tc.want) {
+			t.Errorf("%s: got %+v want %+v", tc.name, res.Calls, *tc.want)
+		}
+	}
+}
@@ -2,11 +2,16 @@ package extensions
 
 import (
 	"context"
+	"strconv"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
+// The max number of device list changes returned per response. Connections without a since token
+// start from the oldest stored change, which can be days of changes, so they are returned in pages.
+const maxDeviceListChangesPerResponse = 500
+
 // Fetcher used by the E2EE extension
 type E2EEFetcher interface {
 	DeviceData(context context.Context, userID, deviceID string, isInitial bool) *internal.DeviceData
@@ -15,17 +20,34 @@ type E2EEFetcher interface {
 // Client created request params
 type E2EERequest struct {
 	Core
+	// The `next_batch` from a previous response. Only device list changes after this position are
+	// returned.
+	Since string `json:"since"`
+
+	// The position of the device list changes last sent on this connection, used as an implicit
+	// since token for clients which do not send one.
+	lastSentPos int64
 }
 
 func (r *E2EERequest) Name() string {
 	return "E2EERequest"
 }
 
+func (r *E2EERequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*E2EERequest)
+	if next.Since != "" {
+		r.Since = next.Since
+	}
+}
+
 // Server response
 type E2EEResponse struct {
 	OTKCounts        map[string]int  `json:"device_one_time_keys_count,omitempty"`
 	DeviceLists      *E2EEDeviceList `json:"device_lists,omitempty"`
 	FallbackKeyTypes []string        `json:"device_unused_fallback_key_types,omitempty"`
+	// The position to send as `since` in the next request.
+	NextBatch string `json:"next_batch,omitempty"`
 }
 
 type E2EEDeviceList struct {
@@ -57,26 +79,26 @@ func (r *E2EERequest) AppendLive(ctx context.Context, res *Response, extCtx Cont
 func (r *E2EERequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
 	//  pull OTK counts and changed/left from device data
 	dd := extCtx.E2EEFetcher.DeviceData(ctx, extCtx.UserID, extCtx.DeviceID, extCtx.IsInitial)
-	if dd == nil {
-		return // unknown device?
-	}
 	extRes := &E2EEResponse{}
 	hasUpdates := false
-	if dd.FallbackKeyTypes != nil && (dd.FallbackKeysChanged() || extCtx.IsInitial) {
+	if dd != nil && dd.FallbackKeyTypes != nil && (dd.FallbackKeysChanged() || extCtx.IsInitial) {
 		extRes.FallbackKeyTypes = dd.FallbackKeyTypes
 		hasUpdates = true
 	}
-	if dd.OTKCounts != nil && (dd.OTKCountChanged() || extCtx.IsInitial) {
+	if dd != nil && dd.OTKCounts != nil && (dd.OTKCountChanged() || extCtx.IsInitial) {
 		extRes.OTKCounts = dd.OTKCounts
 		hasUpdates = true
 	}
-	changed, left := internal.DeviceListChangesArrays(dd.DeviceLists.Sent)
-	if len(changed) > 0 || len(left) > 0 {
-		extRes.DeviceLists = &E2EEDeviceList{
-			Changed: changed,
-			Left:    left,
+	if deviceListChanges, upTo, ok := r.deviceListChanges(ctx, extCtx); ok {
+		extRes.NextBatch = strconv.FormatInt(upTo, 10)
+		changed, left := internal.DeviceListChangesArrays(deviceListChanges)
+		if len(changed) > 0 || len(left) > 0 {
+			extRes.DeviceLists = &E2EEDeviceList{
+				Changed: changed,
+				Left:    left,
+			}
+			hasUpdates = true
 		}
-		hasUpdates = true
 	}
 	if !hasUpdates {
 		return
@@ -84,3 +106,32 @@ func (r *E2EERequest) ProcessInitial(ctx context.Context, res *Response, extCtx
 	// doesn't need aggregation as we just replace from the db
 	res.E2EE = extRes
 }
+
+// deviceListChanges returns the device list changes the client has not yet received. Clients which
+// send a since token can have any number of connections, as each request says exactly what it has
+// received. Otherwise, we assume that the client received everything sent on this connection if it
+// makes another request, as the response would have been resent if the request was retried.
+// Changes are never deleted here, as other connections for this device may not have received them:
+// they are deleted once they are old instead. At most maxDeviceListChangesPerResponse changes are
+// returned, and the rest are returned on the next request.
+func (r *E2EERequest) deviceListChanges(ctx context.Context, extCtx Context) (deviceListChanges map[string]int, upTo int64, ok bool) {
+	l := logger.With().Str("user", extCtx.UserID).Str("device", extCtx.DeviceID).Logger()
+	from := r.lastSentPos
+	if r.Since != "" {
+		var err error
+		from, err = strconv.ParseInt(r.Since, 10, 64)
+		if err != nil {
+			l.Err(err).Str("since", r.Since).Msg("invalid since value")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return nil, 0, false
+		}
+	}
+	deviceListChanges, upTo, err := extCtx.Store.DeviceListTable.Select(extCtx.UserID, extCtx.DeviceID, from, maxDeviceListChangesPerResponse)
+	if err != nil {
+		l.Err(err).Int64("from", from).Msg("cannot query device list changes")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return nil, 0, false
+	}
+	r.lastSentPos = upTo
+	return deviceListChanges, upTo, true
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"os"
 	"reflect"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -144,11 +145,14 @@ type Request struct {
 	AccountData *AccountDataRequest `json:"account_data"`
 	Typing      *TypingRequest      `json:"typing"`
 	Receipts    *ReceiptsRequest    `json:"receipts"`
+	Presence    *PresenceRequest    `json:"presence"`
+	KeyStatus   *KeyStatusRequest   `json:"key_status"`
+	Calls       *CallsRequest       `json:"calls"`
 }
 
 func (r *Request) fields() []GenericRequest {
 	return []GenericRequest{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Presence, r.KeyStatus, r.Calls,
 	}
 }
 
@@ -159,6 +163,9 @@ func (r *Request) setFields(fields []GenericRequest) {
 	r.AccountData = fields[2].(*AccountDataRequest)
 	r.Typing = fields[3].(*TypingRequest)
 	r.Receipts = fields[4].(*ReceiptsRequest)
+	r.Presence = fields[5].(*PresenceRequest)
+	r.KeyStatus = fields[6].(*KeyStatusRequest)
+	r.Calls = fields[7].(*CallsRequest)
 }
 
 func (r Request) EnabledExtensions() (exts []GenericRequest) {
@@ -211,14 +218,26 @@ type Response struct {
 	AccountData *AccountDataResponse `json:"account_data,omitempty"`
 	Typing      *TypingResponse      `json:"typing,omitempty"`
 	Receipts    *ReceiptsResponse    `json:"receipts,omitempty"`
+	Presence    *PresenceResponse    `json:"presence,omitempty"`
+	KeyStatus   *KeyStatusResponse   `json:"key_status,omitempty"`
+	Calls       *CallsResponse       `json:"calls,omitempty"`
 }
 
 func (r Response) fields() []GenericResponse {
 	return []GenericResponse{
-		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts,
+		r.ToDevice, r.E2EE, r.AccountData, r.Typing, r.Receipts, r.Presence, r.KeyStatus, r.Calls,
 	}
 }
 
+// WakeAt returns the time at which HasData may become true without any further updates, or the
+// zero time if there is no such time. This is used by extensions which hold back live updates.
+func (r Response) WakeAt() time.Time {
+	if r.Typing != nil && len(r.Typing.Rooms) > 0 {
+		return r.Typing.readyAt
+	}
+	return time.Time{}
+}
+
 func (r Response) HasData(isInitial bool) bool {
 	fields := r.fields()
 	for _, f := range fields {
@@ -253,6 +272,16 @@ type Context struct {
 	// enclose those sliding windows. Values should be nonnil and nonempty, and may
 	// contain multiple list names.
 	RoomIDsToLists map[string][]string
+	// Like RoomIDsToLists, but keys are the room IDs of all rooms in at least one list,
+	// regardless of whether they are visible in a sliding window. This is expensive to build
+	// for users with many rooms, so it is only set for ProcessInitial when the calls extension
+	// is enabled. Use ListsForRoom to look up a single room.
+	RoomIDsInLists map[string][]string
+	// ListsForRoom returns the names of the lists which include this room, regardless of
+	// whether it is visible in a sliding window.
+	ListsForRoom func(roomID string) []string
+	// The set of room IDs the connection has room subscriptions for.
+	RoomSubscriptions map[string]struct{}
 }
 
 type HandlerInterface interface {
@@ -261,9 +290,10 @@ type HandlerInterface interface {
 }
 
 type Handler struct {
-	Store       *state.Storage
-	E2EEFetcher E2EEFetcher
-	GlobalCache *caches.GlobalCache
+	Store           *state.Storage
+	E2EEFetcher     E2EEFetcher
+	PresenceFetcher PresenceFetcher
+	GlobalCache     *caches.GlobalCache
 }
 
 func (h *Handler) HandleLiveUpdate(ctx context.Context, update caches.Update, req Request, res *Response, extCtx Context) {
@@ -292,3 +322,11 @@ func (h *Handler) Handle(ctx context.Context, req Request, extCtx Context) (res
 func isNil(v interface{}) bool {
 	return v == nil || (reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil())
 }
+
+// intValue returns the value of an optional number, or 0 if it was not specified.
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
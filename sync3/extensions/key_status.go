@@ -0,0 +1,110 @@
+package extensions
+
+import (
+	"context"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync2"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+// The secret storage types for the private cross-signing keys. These are re-uploaded whenever the
+// cross-signing keys are reset.
+var crossSigningAccountDataTypes = []string{
+	"m.cross_signing.master",
+	"m.cross_signing.self_signing",
+	"m.cross_signing.user_signing",
+}
+
+// The secret storage type for the key backup key, which changes when the backup version changes
+const keyBackupAccountDataType = "m.megolm_backup.v1"
+
+// Client created request params
+type KeyStatusRequest struct {
+	Core
+
+	// the content of the watched account data last seen on this connection, keyed on type. Nil
+	// until loaded on the first request.
+	accountData map[string]string
+}
+
+func (r *KeyStatusRequest) Name() string {
+	return "KeyStatusRequest"
+}
+
+// Server response
+type KeyStatusResponse struct {
+	// True if the user's cross-signing keys may have changed, so the client should re-query them.
+	CrossSigningChanged bool `json:"cross_signing_changed,omitempty"`
+	// True if the user's server-side key backup may have changed, so the client should re-query
+	// the backup version.
+	KeyBackupChanged bool `json:"key_backup_changed,omitempty"`
+}
+
+func (r *KeyStatusResponse) HasData(isInitial bool) bool {
+	return r.CrossSigningChanged || r.KeyBackupChanged
+}
+
+// Key status is not room-scoped, so the `lists` and `rooms` fields are ignored. Changes are only
+// reported when the content of the account data differs from what this connection last saw, so
+// clients re-uploading the same keys do not trigger a re-query.
+func (r *KeyStatusRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.AccountDataUpdate)
+	if !ok {
+		return
+	}
+	if r.accountData == nil {
+		r.accountData = make(map[string]string)
+	}
+	for _, ad := range update.AccountData {
+		crossSigning := isCrossSigningAccountDataType(ad.Type)
+		if !crossSigning && ad.Type != keyBackupAccountDataType {
+			continue
+		}
+		content := gjson.GetBytes(ad.Data, "content").Raw
+		if prev, exists := r.accountData[ad.Type]; exists && prev == content {
+			continue
+		}
+		r.accountData[ad.Type] = content
+		r.setResponse(res, crossSigning, !crossSigning)
+	}
+}
+
+// ProcessInitial loads the watched account data the first time it is called on a connection, so
+// later updates can be compared against it. Nothing is reported: a new connection has no earlier
+// keys to compare against, and the client will query its keys on startup anyway.
+func (r *KeyStatusRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	if r.accountData != nil {
+		return
+	}
+	types := append([]string{keyBackupAccountDataType}, crossSigningAccountDataTypes...)
+	accountData, err := extCtx.Store.AccountData(extCtx.UserID, sync2.AccountDataGlobalRoom, types)
+	if err != nil {
+		logger.Err(err).Str("user", extCtx.UserID).Msg("failed to fetch key account data")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	r.accountData = make(map[string]string, len(accountData))
+	for _, ad := range accountData {
+		r.accountData[ad.Type] = gjson.GetBytes(ad.Data, "content").Raw
+	}
+}
+
+func (r *KeyStatusRequest) setResponse(res *Response, crossSigningChanged, keyBackupChanged bool) {
+	if res.KeyStatus == nil {
+		res.KeyStatus = &KeyStatusResponse{}
+	}
+	// aggregate: once changed, it stays changed for this response
+	res.KeyStatus.CrossSigningChanged = res.KeyStatus.CrossSigningChanged || crossSigningChanged
+	res.KeyStatus.KeyBackupChanged = res.KeyStatus.KeyBackupChanged || keyBackupChanged
+}
+
+func isCrossSigningAccountDataType(evType string) bool {
+	for _, t := range crossSigningAccountDataTypes {
+		if t == evType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package extensions
+
+import (
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+func TestKeyStatusLiveAccountData(t *testing.T) {
+	boolTrue := true
+	ext := &KeyStatusRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+		// as if loaded by ProcessInitial
+		accountData: map[string]string{
+			"m.cross_signing.master": `{"encrypted":{"a":1}}`,
+		},
+	}
+	adUpdate := func(evType, content string) *caches.AccountDataUpdate {
+		return &caches.AccountDataUpdate{
+			AccountData: []state.AccountData{
+				{Type: evType, Data: []byte(`{"type":"` + evType + `","content":` + content + `}`)},
+			},
+		}
+	}
+	var res Response
+	ext.AppendLive(ctx, &res, Context{}, adUpdate("m.direct", `{}`))
+	if res.KeyStatus != nil {
+		t.Fatalf("unrelated account data set key status: %+v", res.KeyStatus)
+	}
+	// re-uploading the same keys is not a change
+	ext.AppendLive(ctx, &res, Context{}, adUpdate("m.cross_signing.master", `{"encrypted":{"a":1}}`))
+	if res.KeyStatus != nil {
+		t.Fatalf("unchanged cross-signing account data set key status: %+v", res.KeyStatus)
+	}
+	ext.AppendLive(ctx, &res, Context{}, adUpdate("m.cross_signing.master", `{"encrypted":{"a":2}}`))
+	if res.KeyStatus == nil || !res.KeyStatus.CrossSigningChanged || res.KeyStatus.KeyBackupChanged {
+		t.Fatalf("changed cross-signing account data: got %+v", res.KeyStatus)
+	}
+	// account data not seen before is a change
+	ext.AppendLive(ctx, &res, Context{}, adUpdate("m.megolm_backup.v1", `{"encrypted":{"b":1}}`))
+	if !res.KeyStatus.CrossSigningChanged || !res.KeyStatus.KeyBackupChanged {
+		t.Fatalf("changes were not aggregated: got %+v", res.KeyStatus)
+	}
+	if !res.HasData(false) {
+		t.Fatalf("response should have data")
+	}
+
+	// the new content is remembered
+	res = Response{}
+	ext.AppendLive(ctx, &res, Context{}, adUpdate("m.cross_signing.master", `{"encrypted":{"a":2}}`))
+	ext.AppendLive(ctx, &res, Context{}, adUpdate("m.megolm_backup.v1", `{"encrypted":{"b":1}}`))
+	if res.KeyStatus != nil {
+		t.Fatalf("repeated account data set key status: %+v", res.KeyStatus)
+	}
+}
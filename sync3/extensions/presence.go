@@ -0,0 +1,128 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// Fetcher used by the presence extension
+type PresenceFetcher interface {
+	// VisiblePresence returns the latest presence of this user and the users joined to these rooms.
+	VisiblePresence(ctx context.Context, userID string, roomIDs []string) []internal.Presence
+}
+
+// The number of presence events in the initial response if the client does not specify a limit.
+const defaultPresenceLimit = 100
+
+// Client created request params
+type PresenceRequest struct {
+	Core
+	// The max number of presence events in the initial response, including the user's own
+	// presence. The most recently active users are returned first. Defaults to 100.
+	Limit *int `json:"limit"`
+}
+
+func (r *PresenceRequest) Name() string {
+	return "PresenceRequest"
+}
+
+func (r *PresenceRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*PresenceRequest)
+	if next.Limit != nil {
+		r.Limit = next.Limit
+	}
+}
+
+// Server response
+type PresenceResponse struct {
+	// m.presence events, at most one per user
+	Events []json.RawMessage `json:"events,omitempty"`
+}
+
+func (r *PresenceResponse) HasData(isInitial bool) bool {
+	if isInitial {
+		return true
+	}
+	return len(r.Events) > 0
+}
+
+// Live presence is not room-scoped, so the `lists` and `rooms` fields are ignored. The Dispatcher only
+// sends presence updates for users who share a room with this user.
+func (r *PresenceRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
+	update, ok := up.(*caches.PresenceUpdate)
+	if !ok {
+		return
+	}
+	ev := update.Presence.Event(time.Now())
+	if res.Presence == nil {
+		res.Presence = &PresenceResponse{}
+	}
+	// aggregate presence: a newer update for the same user replaces the old one
+	for i, existing := range res.Presence.Events {
+		var sender struct {
+			Sender string `json:"sender"`
+		}
+		if err := json.Unmarshal(existing, &sender); err == nil && sender.Sender == update.Presence.UserID {
+			res.Presence.Events[i] = ev
+			return
+		}
+	}
+	res.Presence.Events = append(res.Presence.Events, ev)
+}
+
+// ProcessInitial returns the presence of the user and the users joined to the rooms in this response
+// which are in scope, up to the limit.
+func (r *PresenceRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	// incremental syncs get presence changes via AppendLive
+	if !extCtx.IsInitial {
+		return
+	}
+	roomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
+	for roomID := range extCtx.RoomIDToTimeline {
+		if r.RoomInScope(roomID, extCtx) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	presence := extCtx.PresenceFetcher.VisiblePresence(ctx, extCtx.UserID, roomIDs)
+	if len(presence) == 0 {
+		return // don't add a presence extension, no data!
+	}
+	limit := intValue(r.Limit)
+	if limit <= 0 {
+		limit = defaultPresenceLimit
+	}
+	if len(presence) > limit {
+		// keep the user's own presence, then the most recently active users
+		sort.Slice(presence, func(i, j int) bool {
+			a, b := presence[i], presence[j]
+			if (a.UserID == extCtx.UserID) != (b.UserID == extCtx.UserID) {
+				return a.UserID == extCtx.UserID
+			}
+			if a.CurrentlyActive != b.CurrentlyActive {
+				return a.CurrentlyActive
+			}
+			if a.LastActiveTS != b.LastActiveTS {
+				return a.LastActiveTS > b.LastActiveTS
+			}
+			return a.UserID < b.UserID
+		})
+		presence = presence[:limit]
+	}
+	sort.Slice(presence, func(i, j int) bool {
+		return presence[i].UserID < presence[j].UserID
+	})
+	now := time.Now()
+	events := make([]json.RawMessage, len(presence))
+	for i := range presence {
+		events[i] = presence[i].Event(now)
+	}
+	res.Presence = &PresenceResponse{
+		Events: events,
+	}
+}
@@ -0,0 +1,147 @@
+package extensions
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+)
+
+type dummyPresenceFetcher struct {
+	presence []internal.Presence
+	roomIDs  []string
+}
+
+func (f *dummyPresenceFetcher) VisiblePresence(ctx context.Context, userID string, roomIDs []string) []internal.Presence {
+	f.roomIDs = roomIDs
+	// return a copy, as the caller sorts it
+	return append([]internal.Presence(nil), f.presence...)
+}
+
+// Test that aggregation works, which is hard to assert in integration tests
+func TestLivePresenceAggregation(t *testing.T) {
+	boolTrue := true
+	ext := &PresenceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	var res Response
+	var extCtx Context
+	ctx := context.Background()
+	ext.AppendLive(ctx, &res, extCtx, &caches.PresenceUpdate{
+		Presence: internal.Presence{UserID: "@alice:localhost", Presence: "online"},
+	})
+	ext.AppendLive(ctx, &res, extCtx, &caches.PresenceUpdate{
+		Presence: internal.Presence{UserID: "@bob:localhost", Presence: "online"},
+	})
+	ext.AppendLive(ctx, &res, extCtx, &caches.PresenceUpdate{
+		Presence: internal.Presence{UserID: "@alice:localhost", Presence: "offline"},
+	})
+	// non-presence updates are ignored
+	ext.AppendLive(ctx, &res, extCtx, &caches.AccountDataUpdate{})
+	assertPresence(t, res.Presence, map[string]string{
+		"@alice:localhost": "offline",
+		"@bob:localhost":   "online",
+	})
+}
+
+func TestInitialPresence(t *testing.T) {
+	boolTrue := true
+	ext := &PresenceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+		},
+	}
+	extCtx := Context{
+		Handler: &Handler{
+			PresenceFetcher: &dummyPresenceFetcher{
+				presence: []internal.Presence{
+					{UserID: "@bob:localhost", Presence: "unavailable"},
+					{UserID: "@alice:localhost", Presence: "online"},
+				},
+			},
+		},
+		UserID: "@alice:localhost",
+	}
+
+	// incremental syncs don't get a snapshot of presence
+	var res Response
+	ext.ProcessInitial(context.Background(), &res, extCtx)
+	if res.Presence != nil {
+		t.Fatalf("got presence on incremental sync: %+v", res.Presence)
+	}
+
+	extCtx.IsInitial = true
+	ext.ProcessInitial(context.Background(), &res, extCtx)
+	assertPresence(t, res.Presence, map[string]string{
+		"@alice:localhost": "online",
+		"@bob:localhost":   "unavailable",
+	})
+}
+
+func TestInitialPresenceScopeAndLimit(t *testing.T) {
+	boolTrue := true
+	limit := 3
+	ext := &PresenceRequest{
+		Core: Core{
+			Enabled: &boolTrue,
+			Lists:   []string{"a"},
+		},
+		Limit: &limit,
+	}
+	fetcher := &dummyPresenceFetcher{
+		presence: []internal.Presence{
+			{UserID: "@bob:localhost", Presence: "online", LastActiveTS: 100},
+			{UserID: "@charlie:localhost", Presence: "online", LastActiveTS: 300},
+			{UserID: "@doris:localhost", Presence: "unavailable", LastActiveTS: 200},
+			{UserID: "@eve:localhost", Presence: "online", CurrentlyActive: true},
+			{UserID: "@alice:localhost", Presence: "offline"},
+		},
+	}
+	extCtx := Context{
+		Handler: &Handler{
+			PresenceFetcher: fetcher,
+		},
+		UserID:    "@alice:localhost",
+		IsInitial: true,
+		RoomIDToTimeline: map[string][]string{
+			"!in-list:localhost":     nil,
+			"!not-in-list:localhost": nil,
+		},
+		RoomIDsToLists: map[string][]string{
+			"!in-list:localhost":     {"a"},
+			"!not-in-list:localhost": {"b"},
+		},
+	}
+	var res Response
+	ext.ProcessInitial(context.Background(), &res, extCtx)
+	if len(fetcher.roomIDs) != 1 || fetcher.roomIDs[0] != "!in-list:localhost" {
+		t.Errorf("fetched presence for rooms %v, want [!in-list:localhost]", fetcher.roomIDs)
+	}
+	// the user's own presence, then the most recently active users
+	assertPresence(t, res.Presence, map[string]string{
+		"@alice:localhost":   "offline",
+		"@eve:localhost":     "online",
+		"@charlie:localhost": "online",
+	})
+}
+
+func assertPresence(t *testing.T, res *PresenceResponse, want map[string]string) {
+	t.Helper()
+	if res == nil {
+		t.Fatalf("no presence response")
+	}
+	if len(res.Events) != len(want) {
+		t.Fatalf("got %d presence events, want %d", len(res.Events), len(want))
+	}
+	for _, ev := range res.Events {
+		parsed := gjson.ParseBytes(ev)
+		sender := parsed.Get("sender").Str
+		if got := parsed.Get("content.presence").Str; got != want[sender] {
+			t.Errorf("%s: got presence %s want %s", sender, got, want[sender])
+		}
+	}
+}
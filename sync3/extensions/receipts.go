@@ -3,6 +3,7 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"sort"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/state"
@@ -12,86 +13,244 @@ import (
 // Client created request params
 type ReceiptsRequest struct {
 	Core
+	// If true, only return the user's own receipts.
+	OnlyOwn *bool `json:"only_own"`
+	// If true, only return live receipts from other users for events in the returned timeline.
+	// The user's own receipts are always returned.
+	OnlyTimeline *bool `json:"only_timeline"`
+	// If true, threaded receipts are returned in `threads` grouped by thread ID, rather than in `rooms`.
+	GroupByThread *bool `json:"group_by_thread"`
+	// The max number of receipts to return per room. The user's own receipts are always included,
+	// then the most recent receipts from other users. 0 means no limit.
+	Limit *int `json:"limit"`
+
+	// room_id -> the most recent timeline event IDs sent on this connection, oldest first. Used to
+	// filter live receipts when only_timeline is set, as the receipt may be for an event which was
+	// sent in an earlier response.
+	sentTimelines map[string][]string
 }
 
+// The max number of timeline event IDs remembered per room for only_timeline.
+const maxSentTimelineEventIDs = 50
+
 func (r *ReceiptsRequest) Name() string {
 	return "ReceiptsRequest"
 }
 
+func (r *ReceiptsRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*ReceiptsRequest)
+	if next.OnlyOwn != nil {
+		r.OnlyOwn = next.OnlyOwn
+	}
+	if next.OnlyTimeline != nil {
+		r.OnlyTimeline = next.OnlyTimeline
+	}
+	if next.GroupByThread != nil {
+		r.GroupByThread = next.GroupByThread
+	}
+	if next.Limit != nil {
+		r.Limit = next.Limit
+	}
+}
+
 // Server response
 type ReceiptsResponse struct {
 	// room_id -> m.receipt ephemeral event
 	Rooms map[string]json.RawMessage `json:"rooms,omitempty"`
+	// room_id -> thread_id -> m.receipt ephemeral event. Only set if group_by_thread is enabled.
+	Threads map[string]map[string]json.RawMessage `json:"threads,omitempty"`
 }
 
 func (r *ReceiptsResponse) HasData(isInitial bool) bool {
 	if isInitial {
 		return true
 	}
-	return len(r.Rooms) > 0
+	return len(r.Rooms) > 0 || len(r.Threads) > 0
+}
+
+// receiptsForRoom unpacks the receipts already in the response for this room.
+func (r *ReceiptsResponse) receiptsForRoom(roomID string) ([]internal.Receipt, error) {
+	edus := make([]json.RawMessage, 0, 1+len(r.Threads[roomID]))
+	if r.Rooms[roomID] != nil {
+		edus = append(edus, r.Rooms[roomID])
+	}
+	for _, edu := range r.Threads[roomID] {
+		edus = append(edus, edu)
+	}
+	var receipts []internal.Receipt
+	for _, edu := range edus {
+		pub, priv, err := state.UnpackReceiptsFromEDU(roomID, edu)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, pub...)
+		receipts = append(receipts, priv...)
+	}
+	return receipts, nil
+}
+
+// rememberTimelines records that these timeline events are being sent to the client.
+func (r *ReceiptsRequest) rememberTimelines(roomIDToTimeline map[string][]string) {
+	for roomID, timeline := range roomIDToTimeline {
+		if r.sentTimelines == nil {
+			r.sentTimelines = make(map[string][]string)
+		}
+		sent := r.sentTimelines[roomID]
+		for _, eventID := range timeline {
+			if !containsString(sent, eventID) {
+				sent = append(sent, eventID)
+			}
+		}
+		if len(sent) > maxSentTimelineEventIDs {
+			sent = append([]string(nil), sent[len(sent)-maxSentTimelineEventIDs:]...)
+		}
+		r.sentTimelines[roomID] = sent
+	}
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
 }
 
 func (r *ReceiptsRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
 	switch update := up.(type) {
+	case *caches.RoomEventUpdate:
+		if isTrue(r.OnlyTimeline) {
+			r.rememberTimelines(map[string][]string{
+				update.RoomID(): extCtx.RoomIDToTimeline[update.RoomID()],
+			})
+		}
 	case *caches.ReceiptUpdate:
 		if !r.RoomInScope(update.RoomID(), extCtx) {
 			break
 		}
+		isOwn := update.Receipt.UserID == extCtx.UserID
+		if isTrue(r.OnlyOwn) && !isOwn {
+			break
+		}
+		if isTrue(r.OnlyTimeline) && !isOwn &&
+			!containsString(extCtx.RoomIDToTimeline[update.RoomID()], update.Receipt.EventID) &&
+			!containsString(r.sentTimelines[update.RoomID()], update.Receipt.EventID) {
+			break
+		}
 
 		// a live receipt event happened, send this back
 		if res.Receipts == nil {
-			edu, err := state.PackReceiptsIntoEDU([]internal.Receipt{update.Receipt})
-			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into new edu")
-				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-				return
-			}
 			res.Receipts = &ReceiptsResponse{
-				Rooms: map[string]json.RawMessage{
-					update.RoomID(): edu,
-				},
-			}
-		} else if res.Receipts.Rooms[update.RoomID()] == nil {
-			// we have receipts already, but not for this room
-			edu, err := state.PackReceiptsIntoEDU([]internal.Receipt{update.Receipt})
-			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
-				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-				return
-			}
-			res.Receipts.Rooms[update.RoomID()] = edu
-		} else {
-			// we have receipts already for this room.
-			// aggregate receipts: we need to unpack then repack annoyingly.
-			pub, priv, err := state.UnpackReceiptsFromEDU(update.RoomID(), res.Receipts.Rooms[update.RoomID()])
-			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
-				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-				return
+				Rooms: make(map[string]json.RawMessage),
 			}
-			receipts := append(pub, priv...)
-			// add the live one
-			receipts = append(receipts, update.Receipt)
-			edu, err := state.PackReceiptsIntoEDU(receipts)
-			if err != nil {
-				logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
-				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
-				return
-			}
-			res.Receipts.Rooms[update.RoomID()] = edu
 		}
+		// aggregate receipts: we need to unpack then repack annoyingly.
+		receipts, err := res.Receipts.receiptsForRoom(update.RoomID())
+		if err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to unpack receipts from edu")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+		// add the live one
+		receipts = append(receipts, update.Receipt)
+		if err = r.setRoomReceipts(res.Receipts, extCtx.UserID, update.RoomID(), receipts); err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Str("room", update.Receipt.RoomID).Msg("failed to pack receipt into edu")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			return
+		}
+	}
+}
+
+// setRoomReceipts replaces the receipts for this room in the response, applying the limit and
+// grouping threaded receipts if requested.
+func (r *ReceiptsRequest) setRoomReceipts(res *ReceiptsResponse, userID, roomID string, receipts []internal.Receipt) error {
+	receipts = r.limit(userID, receipts)
+	delete(res.Rooms, roomID)
+	delete(res.Threads, roomID)
+	if len(receipts) == 0 {
+		return nil
+	}
+	if !isTrue(r.GroupByThread) {
+		edu, err := state.PackReceiptsIntoEDU(receipts)
+		if err != nil {
+			return err
+		}
+		res.Rooms[roomID] = edu
+		return nil
+	}
+	// "main" and "" are both receipts on the main timeline
+	byThread := make(map[string][]internal.Receipt)
+	for _, rec := range receipts {
+		threadID := rec.ThreadID
+		if threadID == "main" {
+			threadID = ""
+		}
+		byThread[threadID] = append(byThread[threadID], rec)
 	}
+	for threadID, threadReceipts := range byThread {
+		edu, err := state.PackReceiptsIntoEDU(threadReceipts)
+		if err != nil {
+			return err
+		}
+		if threadID == "" {
+			res.Rooms[roomID] = edu
+			continue
+		}
+		if res.Threads == nil {
+			res.Threads = make(map[string]map[string]json.RawMessage)
+		}
+		if res.Threads[roomID] == nil {
+			res.Threads[roomID] = make(map[string]json.RawMessage)
+		}
+		res.Threads[roomID][threadID] = edu
+	}
+	return nil
+}
+
+// limit returns at most r.Limit receipts, always including the user's own receipts then the most
+// recent receipts from other users.
+func (r *ReceiptsRequest) limit(userID string, receipts []internal.Receipt) []internal.Receipt {
+	limit := intValue(r.Limit)
+	if limit <= 0 || len(receipts) <= limit {
+		return receipts
+	}
+	sorted := make([]internal.Receipt, len(receipts))
+	copy(sorted, receipts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		iOwn := sorted[i].UserID == userID
+		jOwn := sorted[j].UserID == userID
+		if iOwn != jOwn {
+			return iOwn
+		}
+		return sorted[i].TS > sorted[j].TS
+	})
+	for limit < len(sorted) && sorted[limit].UserID == userID {
+		limit++ // never drop our own receipts
+	}
+	return sorted[:limit]
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
+	if isTrue(r.OnlyTimeline) {
+		r.rememberTimelines(extCtx.RoomIDToTimeline)
+	}
 	// grab receipts for all timelines for all the rooms we're going to return
-	rooms := make(map[string]json.RawMessage)
 	interestedRoomIDs := make([]string, 0, len(extCtx.RoomIDToTimeline))
 	otherReceipts := make(map[string][]internal.Receipt)
 	for roomID, timeline := range extCtx.RoomIDToTimeline {
 		if !r.RoomInScope(roomID, extCtx) {
 			continue
 		}
+		interestedRoomIDs = append(interestedRoomIDs, roomID)
+		if isTrue(r.OnlyOwn) {
+			continue
+		}
 		receipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForEvents(roomID, timeline)
 		if err != nil {
 			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to SelectReceiptsForEvents")
@@ -99,7 +258,6 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 			continue
 		}
 		otherReceipts[roomID] = receipts
-		interestedRoomIDs = append(interestedRoomIDs, roomID)
 	}
 	// single shot query to pull out our own receipts for these rooms to always include our own receipts
 	ownReceipts, err := extCtx.Store.ReceiptTable.SelectReceiptsForUser(interestedRoomIDs, extCtx.UserID)
@@ -114,16 +272,17 @@ func (r *ReceiptsRequest) ProcessInitial(ctx context.Context, res *Response, ext
 		otherReceipts[roomID] = append(otherReceipts[roomID], ownRecs...)
 	}
 
+	extRes := &ReceiptsResponse{
+		Rooms: make(map[string]json.RawMessage),
+	}
 	for roomID, receipts := range otherReceipts {
-		if len(receipts) == 0 {
-			continue
+		if err = r.setRoomReceipts(extRes, extCtx.UserID, roomID, receipts); err != nil {
+			logger.Err(err).Str("user", extCtx.UserID).Str("room", roomID).Msg("failed to pack receipts into edu")
+			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
-		rooms[roomID], _ = state.PackReceiptsIntoEDU(receipts)
 	}
 
-	if len(rooms) > 0 {
-		res.Receipts = &ReceiptsResponse{
-			Rooms: rooms,
-		}
+	if len(extRes.Rooms) > 0 || len(extRes.Threads) > 0 {
+		res.Receipts = extRes
 	}
 }
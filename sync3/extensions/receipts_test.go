@@ -74,3 +74,114 @@ func TestLiveReceiptsAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.Receipts.Rooms, want)
 	}
 }
+
+func TestLiveReceiptsFiltering(t *testing.T) {
+	boolTrue := true
+	alice := "@alice:localhost"
+	newUpdate := func(userID, eventID, threadID string, ts int64) *caches.ReceiptUpdate {
+		return &caches.ReceiptUpdate{
+			Receipt: internal.Receipt{
+				RoomID:   roomA,
+				EventID:  eventID,
+				UserID:   userID,
+				TS:       ts,
+				ThreadID: threadID,
+			},
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomA,
+			},
+		}
+	}
+	extCtx := Context{
+		UserID: alice,
+		RoomIDToTimeline: map[string][]string{
+			roomA: {"$timeline"},
+		},
+	}
+	mustPack := func(receipts ...internal.Receipt) json.RawMessage {
+		edu, err := state.PackReceiptsIntoEDU(receipts)
+		assertNoError(t, err)
+		return edu
+	}
+
+	// only_own
+	ext := &ReceiptsRequest{Core: Core{Enabled: &boolTrue}, OnlyOwn: &boolTrue}
+	var res Response
+	other := newUpdate("@bob:localhost", "$timeline", "", 1)
+	own := newUpdate(alice, "$old", "", 2)
+	ext.AppendLive(ctx, &res, extCtx, other)
+	ext.AppendLive(ctx, &res, extCtx, own)
+	want := map[string]json.RawMessage{roomA: mustPack(own.Receipt)}
+	if !reflect.DeepEqual(res.Receipts.Rooms, want) {
+		t.Fatalf("only_own: got %+v\nwant %+v", res.Receipts.Rooms, want)
+	}
+
+	// only_timeline
+	ext = &ReceiptsRequest{Core: Core{Enabled: &boolTrue}, OnlyTimeline: &boolTrue}
+	res = Response{}
+	outsideTimeline := newUpdate("@bob:localhost", "$old", "", 3)
+	ext.AppendLive(ctx, &res, extCtx, outsideTimeline)
+	ext.AppendLive(ctx, &res, extCtx, other)
+	ext.AppendLive(ctx, &res, extCtx, own)
+	want = map[string]json.RawMessage{roomA: mustPack(other.Receipt, own.Receipt)}
+	if !reflect.DeepEqual(res.Receipts.Rooms, want) {
+		t.Fatalf("only_timeline: got %+v\nwant %+v", res.Receipts.Rooms, want)
+	}
+
+	// only_timeline includes receipts for events sent in earlier responses
+	ext = &ReceiptsRequest{Core: Core{Enabled: &boolTrue}, OnlyTimeline: &boolTrue}
+	res = Response{}
+	ext.AppendLive(ctx, &res, extCtx, &caches.RoomEventUpdate{
+		RoomUpdate: &dummyRoomUpdate{roomID: roomA},
+		EventData:  &caches.EventData{RoomID: roomA},
+	})
+	res = Response{}
+	nextCtx := Context{UserID: alice}
+	ext.AppendLive(ctx, &res, nextCtx, outsideTimeline)
+	ext.AppendLive(ctx, &res, nextCtx, other)
+	want = map[string]json.RawMessage{roomA: mustPack(other.Receipt)}
+	if res.Receipts == nil || !reflect.DeepEqual(res.Receipts.Rooms, want) {
+		t.Fatalf("only_timeline earlier response: got %+v\nwant %+v", res.Receipts, want)
+	}
+
+	// group_by_thread
+	ext = &ReceiptsRequest{Core: Core{Enabled: &boolTrue}, GroupByThread: &boolTrue}
+	res = Response{}
+	mainThread := newUpdate("@bob:localhost", "$timeline", "main", 4)
+	threaded := newUpdate("@charlie:localhost", "$reply", "$thread", 5)
+	ext.AppendLive(ctx, &res, extCtx, mainThread)
+	ext.AppendLive(ctx, &res, extCtx, threaded)
+	ext.AppendLive(ctx, &res, extCtx, own)
+	want = map[string]json.RawMessage{roomA: mustPack(mainThread.Receipt, own.Receipt)}
+	if !reflect.DeepEqual(res.Receipts.Rooms, want) {
+		t.Fatalf("group_by_thread rooms: got %+v\nwant %+v", res.Receipts.Rooms, want)
+	}
+	wantThreads := map[string]map[string]json.RawMessage{roomA: {"$thread": mustPack(threaded.Receipt)}}
+	if !reflect.DeepEqual(res.Receipts.Threads, wantThreads) {
+		t.Fatalf("group_by_thread threads: got %+v\nwant %+v", res.Receipts.Threads, wantThreads)
+	}
+
+	// limit keeps our own receipts then the most recent
+	two := 2
+	ext = &ReceiptsRequest{Core: Core{Enabled: &boolTrue}, Limit: &two}
+	res = Response{}
+	ext.AppendLive(ctx, &res, extCtx, own)
+	ext.AppendLive(ctx, &res, extCtx, threaded)
+	ext.AppendLive(ctx, &res, extCtx, other)
+	ext.AppendLive(ctx, &res, extCtx, mainThread)
+	want = map[string]json.RawMessage{roomA: mustPack(own.Receipt, threaded.Receipt)}
+	if !reflect.DeepEqual(res.Receipts.Rooms, want) {
+		t.Fatalf("limit: got %+v\nwant %+v", res.Receipts.Rooms, want)
+	}
+
+	// the limit is kept when omitted, and can be removed by setting it to 0
+	ext.ApplyDelta(&ReceiptsRequest{})
+	if intValue(ext.Limit) != 2 {
+		t.Fatalf("limit was not kept: got %d", intValue(ext.Limit))
+	}
+	zero := 0
+	ext.ApplyDelta(&ReceiptsRequest{Limit: &zero})
+	if got := ext.limit(alice, []internal.Receipt{own.Receipt, threaded.Receipt, other.Receipt}); len(got) != 3 {
+		t.Fatalf("limit was not removed: got %d receipts", len(got))
+	}
+}
@@ -3,29 +3,57 @@ package extensions
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // Client created request params
 type TypingRequest struct {
 	Core
+	// If set, live typing changes are held for this long before waking up the connection, so
+	// multiple changes are sent in a single response.
+	CoalesceMs *int `json:"coalesce_ms"`
+	// If true, only send typing notifications for rooms in a list's visible ranges or which are
+	// explicitly subscribed to.
+	OnlyVisible *bool `json:"only_visible"`
+	// The max number of typing user IDs to send per room. 0 means no limit.
+	MaxUsers *int `json:"max_users"`
 }
 
 func (r *TypingRequest) Name() string {
 	return "TypingRequest"
 }
 
+func (r *TypingRequest) ApplyDelta(gnext GenericRequest) {
+	r.Core.ApplyDelta(gnext)
+	next := gnext.(*TypingRequest)
+	if next.CoalesceMs != nil {
+		r.CoalesceMs = next.CoalesceMs
+	}
+	if next.OnlyVisible != nil {
+		r.OnlyVisible = next.OnlyVisible
+	}
+	if next.MaxUsers != nil {
+		r.MaxUsers = next.MaxUsers
+	}
+}
+
 // Server response
 type TypingResponse struct {
 	Rooms map[string]json.RawMessage `json:"rooms,omitempty"`
+
+	// live typing changes are not sent until this time, if set
+	readyAt time.Time
 }
 
 func (r *TypingResponse) HasData(isInitial bool) bool {
 	if isInitial {
 		return true
 	}
-	return len(r.Rooms) > 0
+	return len(r.Rooms) > 0 && !time.Now().Before(r.readyAt)
 }
 
 func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Context, up caches.Update) {
@@ -53,7 +81,7 @@ func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Co
 	}
 
 	// We've found a typing event. Ignore it if the client doesn't want to know about it.
-	if !r.RoomInScope(roomID, extCtx) {
+	if !r.RoomInScope(roomID, extCtx) || !r.roomVisible(roomID, extCtx) {
 		return
 	}
 
@@ -62,7 +90,53 @@ func (r *TypingRequest) AppendLive(ctx context.Context, res *Response, extCtx Co
 			Rooms: make(map[string]json.RawMessage),
 		}
 	}
-	res.Typing.Rooms[roomID] = typingEvent
+	if len(res.Typing.Rooms) == 0 && intValue(r.CoalesceMs) > 0 {
+		// start the coalescing window from the first typing change
+		res.Typing.readyAt = time.Now().Add(time.Duration(*r.CoalesceMs) * time.Millisecond)
+	}
+	res.Typing.Rooms[roomID] = r.limitUsers(typingEvent)
+}
+
+// roomVisible returns true if the room is in a list's visible ranges or is explicitly subscribed
+// to, or if the client hasn't asked for only visible rooms.
+func (r *TypingRequest) roomVisible(roomID string, extCtx Context) bool {
+	if r.OnlyVisible == nil || !*r.OnlyVisible {
+		return true
+	}
+	if len(extCtx.RoomIDsToLists[roomID]) > 0 {
+		return true
+	}
+	if _, ok := extCtx.RoomSubscriptions[roomID]; ok {
+		return true
+	}
+	for _, subscribedRoomID := range r.Rooms {
+		if subscribedRoomID == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// limitUsers truncates the user IDs in the typing event to at most MaxUsers.
+func (r *TypingRequest) limitUsers(typingEvent json.RawMessage) json.RawMessage {
+	maxUsers := intValue(r.MaxUsers)
+	if maxUsers <= 0 {
+		return typingEvent
+	}
+	userIDs := gjson.GetBytes(typingEvent, "content.user_ids").Array()
+	if len(userIDs) <= maxUsers {
+		return typingEvent
+	}
+	limited := make([]string, maxUsers)
+	for i := range limited {
+		limited[i] = userIDs[i].Str
+	}
+	ev, err := sjson.SetBytes(typingEvent, "content.user_ids", limited)
+	if err != nil {
+		logger.Err(err).Msg("failed to limit typing users")
+		return typingEvent
+	}
+	return ev
 }
 
 func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCtx Context) {
@@ -83,7 +157,7 @@ func (r *TypingRequest) ProcessInitial(ctx context.Context, res *Response, extCt
 			continue
 		}
 
-		rooms[roomID] = meta.TypingEvent
+		rooms[roomID] = r.limitUsers(meta.TypingEvent)
 	}
 	if len(rooms) == 0 {
 		return // don't add a typing extension, no data!
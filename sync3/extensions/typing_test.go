@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync3/caches"
@@ -86,3 +87,76 @@ func TestLiveTypingAggregation(t *testing.T) {
 		t.Fatalf("got  %+v\nwant %+v", res.Typing.Rooms, want)
 	}
 }
+
+func TestLiveTypingOptions(t *testing.T) {
+	boolTrue := true
+	newUpdate := func(roomID, typingEvent string) *caches.TypingUpdate {
+		return &caches.TypingUpdate{
+			RoomUpdate: &dummyRoomUpdate{
+				roomID: roomID,
+				globalMetadata: &internal.RoomMetadata{
+					RoomID:      roomID,
+					TypingEvent: json.RawMessage(typingEvent),
+				},
+			},
+		}
+	}
+	typingA := newUpdate(roomA, `{"type":"m.typing","content":{"user_ids":["@alice:localhost","@bob:localhost","@charlie:localhost"]}}`)
+	typingB := newUpdate(roomB, `{"type":"m.typing","content":{"user_ids":["@bob:localhost"]}}`)
+	typingC := newUpdate(roomC, `{"type":"m.typing","content":{"user_ids":["@charlie:localhost"]}}`)
+
+	// only_visible drops rooms outside lists' visible ranges unless they are subscribed to
+	maxUsers := 2
+	ext := &TypingRequest{Core: Core{Enabled: &boolTrue}, OnlyVisible: &boolTrue, MaxUsers: &maxUsers}
+	extCtx := Context{
+		RoomIDsToLists:    map[string][]string{roomA: {"list"}},
+		RoomSubscriptions: map[string]struct{}{roomB: {}},
+	}
+	var res Response
+	ext.AppendLive(ctx, &res, extCtx, typingA)
+	ext.AppendLive(ctx, &res, extCtx, typingB)
+	ext.AppendLive(ctx, &res, extCtx, typingC)
+	want := map[string]json.RawMessage{
+		roomA: json.RawMessage(`{"type":"m.typing","content":{"user_ids":["@alice:localhost","@bob:localhost"]}}`),
+		roomB: typingB.GlobalRoomMetadata().TypingEvent,
+	}
+	if !reflect.DeepEqual(res.Typing.Rooms, want) {
+		t.Fatalf("got  %s\nwant %s", res.Typing.Rooms, want)
+	}
+	if !res.HasData(false) {
+		t.Fatalf("response should have data when not coalescing")
+	}
+
+	// coalesce_ms holds back live typing changes until the window has passed
+	coalesceMs := 50
+	ext = &TypingRequest{Core: Core{Enabled: &boolTrue}, CoalesceMs: &coalesceMs}
+	res = Response{}
+	ext.AppendLive(ctx, &res, Context{}, typingA)
+	wakeAt := res.WakeAt()
+	if wakeAt.IsZero() {
+		t.Fatalf("WakeAt should be set when coalescing")
+	}
+	if res.HasData(false) {
+		t.Fatalf("response should not have data within the coalescing window")
+	}
+	ext.AppendLive(ctx, &res, Context{}, typingB)
+	if !res.WakeAt().Equal(wakeAt) {
+		t.Fatalf("WakeAt should not be extended by later changes: got %v want %v", res.WakeAt(), wakeAt)
+	}
+	time.Sleep(time.Until(wakeAt))
+	if !res.HasData(false) {
+		t.Fatalf("response should have data after the coalescing window")
+	}
+	if len(res.Typing.Rooms) != 2 {
+		t.Fatalf("expected 2 coalesced rooms, got %v", res.Typing.Rooms)
+	}
+
+	// an explicit 0 turns coalescing off again
+	noCoalesce := 0
+	ext.ApplyDelta(&TypingRequest{CoalesceMs: &noCoalesce})
+	res = Response{}
+	ext.AppendLive(ctx, &res, Context{}, typingA)
+	if !res.WakeAt().IsZero() || !res.HasData(false) {
+		t.Fatalf("response should not be held back once coalescing is turned off")
+	}
+}
@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+)
+
+const (
+	// If more events than this have been stored since the checkpoint, it is quicker to build a global
+	// snapshot from scratch than to replay them all.
+	maxCheckpointReplayEvents = 1000000
+	// How many events to load from the database at a time when replaying.
+	checkpointReplayBatchSize = 1000
+)
+
+// SetCheckpointInterval configures how often the in-memory global state is checkpointed to the
+// database, for use by StartupFromCheckpoint. Zero disables checkpointing. Must be called before Listen.
+func (h *SyncLiveHandler) SetCheckpointInterval(interval time.Duration) {
+	h.checkpointInterval = interval
+}
+
+// StartupFromCheckpoint is an alternative to Startup which loads the most recent checkpoint from the
+// database, then processes the events stored since it was taken. Returns false without changing
+// any state if there is no usable checkpoint, in which case the caller should call Startup.
+// Returns an error if the checkpoint was partially loaded.
+func (h *SyncLiveHandler) StartupFromCheckpoint() (bool, error) {
+	cp, err := h.Storage.CheckpointTable.Select()
+	if err != nil {
+		logger.Err(err).Msg("StartupFromCheckpoint: failed to load checkpoint")
+		return false, nil
+	}
+	if cp == nil {
+		logger.Info().Msg("StartupFromCheckpoint: no checkpoint found")
+		return false, nil
+	}
+	if cp.GlobalMetadata == nil && !h.GlobalCache.IsLazy() {
+		logger.Info().Msg("StartupFromCheckpoint: checkpoint has no room metadata")
+		return false, nil
+	}
+	latestNID, err := h.Storage.LatestEventNID()
+	if err != nil {
+		logger.Err(err).Msg("StartupFromCheckpoint: failed to select latest NID")
+		return false, nil
+	}
+	if latestNID-cp.ReplayFromNID > maxCheckpointReplayEvents {
+		logger.Info().Int64("checkpoint_nid", cp.EventNID).Int64("latest_nid", latestNID).Msg(
+			"StartupFromCheckpoint: checkpoint is too old",
+		)
+		return false, nil
+	}
+	presence, err := h.Storage.PresenceTable.SelectAll()
+	if err != nil {
+		logger.Err(err).Msg("StartupFromCheckpoint: failed to select presence")
+		return false, nil
+	}
+
+	h.Dispatcher.StartupFromCheckpoint(cp.AllJoinedMembers, cp.AllInvitedMembers)
+	h.Dispatcher.Register(context.Background(), sync3.DispatcherAllUsers, h.GlobalCache)
+	if cp.GlobalMetadata != nil && !h.GlobalCache.IsLazy() {
+		if err := h.GlobalCache.Startup(cp.GlobalMetadata); err != nil {
+			return false, fmt.Errorf("failed to populate global cache: %s", err)
+		}
+	}
+	h.GlobalCache.StartupPresence(presence)
+
+	// process events stored since the checkpoint, as if they had just arrived
+	ctx := context.Background()
+	from := cp.ReplayFromNID
+	numReplayed := 0
+	h.latestDispatchedNID = cp.EventNID
+	h.GlobalCache.SetReplaying(true)
+	defer h.GlobalCache.SetReplaying(false)
+	// State blocks are only stored the first time a room is seen, so rooms in the checkpoint
+	// already reflect theirs. Other rooms' state blocks are dispatched like Initialise does,
+	// before the room's first timeline event.
+	knownRooms := make(map[string]struct{}, len(cp.AllJoinedMembers)+len(cp.AllInvitedMembers)+len(cp.GlobalMetadata))
+	for _, rooms := range []map[string][]string{cp.AllJoinedMembers, cp.AllInvitedMembers} {
+		for roomID := range rooms {
+			knownRooms[roomID] = struct{}{}
+		}
+	}
+	for roomID := range cp.GlobalMetadata {
+		knownRooms[roomID] = struct{}{}
+	}
+	stateBlocks := make(map[string][]json.RawMessage)
+	dispatchStateBlock := func(roomID string) {
+		if stateBlock, ok := stateBlocks[roomID]; ok {
+			h.Dispatcher.OnNewInitialRoomState(ctx, roomID, stateBlock)
+			delete(stateBlocks, roomID)
+		}
+	}
+	for {
+		events, err := h.Storage.EventsTable.SelectEventsAfter(from, checkpointReplayBatchSize)
+		if err != nil {
+			return false, fmt.Errorf("failed to select events after checkpoint: %s", err)
+		}
+		for _, ev := range events {
+			from = ev.NID
+			if ev.IsState {
+				if _, known := knownRooms[ev.RoomID]; !known {
+					stateBlocks[ev.RoomID] = append(stateBlocks[ev.RoomID], ev.JSON)
+				}
+				continue
+			}
+			dispatchStateBlock(ev.RoomID)
+			h.Dispatcher.OnNewEvent(ctx, ev.RoomID, ev.JSON, ev.NID)
+		}
+		numReplayed += len(events)
+		if len(events) < checkpointReplayBatchSize {
+			break
+		}
+	}
+	for roomID := range stateBlocks {
+		dispatchStateBlock(roomID)
+	}
+	if from > h.latestDispatchedNID {
+		h.latestDispatchedNID = from
+	}
+	h.prevCheckpointNID = h.latestDispatchedNID
+	logger.Info().Int64("checkpoint_nid", cp.EventNID).Int("replayed", numReplayed).Int("rooms", len(cp.AllJoinedMembers)).Msg(
+		"started up from checkpoint",
+	)
+	return true, nil
+}
+
+// runCheckpointer periodically writes a checkpoint until Teardown is called.
+func (h *SyncLiveHandler) runCheckpointer() {
+	defer internal.ReportPanicsToSentry()
+	ticker := time.NewTicker(h.checkpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stopCheckpointer:
+			return
+		case <-ticker.C:
+			if err := h.writeCheckpoint(); err != nil {
+				logger.Err(err).Msg("failed to write checkpoint")
+				internal.GetSentryHubFromContextOrDefault(context.Background()).CaptureException(err)
+			}
+		}
+	}
+}
+
+// writeCheckpoint copies the global state and stores it in the database. Events are not dispatched
+// whilst the state is being copied, so that it is consistent with latestDispatchedNID.
+func (h *SyncLiveHandler) writeCheckpoint() error {
+	start := time.Now()
+	h.dispatchMu.Lock()
+	cp := state.Checkpoint{
+		EventNID:      h.latestDispatchedNID,
+		ReplayFromNID: h.prevCheckpointNID,
+	}
+	cp.AllJoinedMembers, cp.AllInvitedMembers = h.Dispatcher.Snapshot()
+	if !h.GlobalCache.IsLazy() {
+		cp.GlobalMetadata = h.GlobalCache.Snapshot()
+	}
+	h.dispatchMu.Unlock()
+	copyDuration := time.Since(start)
+	if cp.EventNID == 0 {
+		return nil // nothing to checkpoint yet
+	}
+	if err := h.Storage.CheckpointTable.Upsert(&cp); err != nil {
+		return err
+	}
+	h.prevCheckpointNID = cp.EventNID
+	logger.Info().Int64("nid", cp.EventNID).Dur("copy_duration", copyDuration).Dur("duration", time.Since(start)).Msg(
+		"wrote checkpoint",
+	)
+	return nil
+}
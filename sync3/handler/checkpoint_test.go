@@ -0,0 +1,193 @@
+package handler
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/pubsub"
+	"github.com/matrix-org/sliding-sync/state"
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+func newCheckpointHandler(store *state.Storage) *SyncLiveHandler {
+	return &SyncLiveHandler{
+		Storage:     store,
+		Dispatcher:  sync3.NewDispatcher(),
+		GlobalCache: caches.NewGlobalCache(store),
+	}
+}
+
+// Test that starting up from a checkpoint then replaying the events stored since gives the same
+// global state as building it from the database.
+func TestStartupFromCheckpoint(t *testing.T) {
+	alice := "@TestStartupFromCheckpoint_alice:localhost"
+	bob := "@TestStartupFromCheckpoint_bob:localhost"
+	charlie := "@TestStartupFromCheckpoint_charlie:localhost"
+	roomA := "!TestStartupFromCheckpoint_a:localhost"
+	roomB := "!TestStartupFromCheckpoint_b:localhost"
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	initialise := func(roomID string, stateBlock ...json.RawMessage) {
+		t.Helper()
+		if _, err := store.Initialise(roomID, stateBlock); err != nil {
+			t.Fatalf("Initialise: %s", err)
+		}
+	}
+	accumulate := func(roomID string, timeline ...json.RawMessage) {
+		t.Helper()
+		if _, _, err := store.Accumulate(roomID, "", timeline); err != nil {
+			t.Fatalf("Accumulate: %s", err)
+		}
+	}
+
+	initialise(roomA,
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	)
+	accumulate(roomA, testutils.NewMessageEvent(t, alice, "before checkpoint"))
+
+	h := newCheckpointHandler(store)
+	snapshot, err := store.GlobalSnapshot()
+	assertNoError(t, err)
+	assertNoError(t, h.Startup(&snapshot))
+	assertNoError(t, h.writeCheckpoint())
+
+	// events after the checkpoint: an existing room changes, and a new room is seen with a state block
+	accumulate(roomA,
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.name", "", alice, map[string]interface{}{"name": "Room A"}),
+		testutils.NewStateEvent(t, "m.room.member", charlie, alice, map[string]interface{}{"membership": "invite"}),
+	)
+	initialise(roomB,
+		testutils.NewStateEvent(t, "m.room.create", "", bob, map[string]interface{}{"creator": bob}),
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.canonical_alias", "", bob, map[string]interface{}{"alias": "#b:localhost"}),
+	)
+	accumulate(roomB,
+		testutils.NewJoinEvent(t, alice),
+		testutils.NewMessageEvent(t, bob, "after checkpoint"),
+	)
+
+	restarted := newCheckpointHandler(store)
+	ok, err := restarted.StartupFromCheckpoint()
+	assertNoError(t, err)
+	if !ok {
+		t.Fatalf("StartupFromCheckpoint did not use the checkpoint")
+	}
+	want, err := store.GlobalSnapshot()
+	assertNoError(t, err)
+	gotJoined, _ := restarted.Dispatcher.Snapshot()
+	if !reflect.DeepEqual(sortedMembers(gotJoined), sortedMembers(want.AllJoinedMembers)) {
+		t.Errorf("joined members: got %v want %v", gotJoined, want.AllJoinedMembers)
+	}
+	// state block events are dispatched without NIDs, as Initialise does
+	for _, evType := range []string{"m.room.create", "m.room.canonical_alias"} {
+		latest := want.GlobalMetadata[roomB].LatestEventsByType[evType]
+		latest.NID = 0
+		want.GlobalMetadata[roomB].LatestEventsByType[evType] = latest
+	}
+	got := restarted.GlobalCache.Snapshot()
+	if len(got) != len(want.GlobalMetadata) {
+		t.Fatalf("got metadata for %d rooms, want %d", len(got), len(want.GlobalMetadata))
+	}
+	for roomID, wantMetadata := range want.GlobalMetadata {
+		gotMetadata := got[roomID]
+		// heroes are ordered differently when built from the database
+		for _, heroes := range [][]internal.Hero{gotMetadata.Heroes, wantMetadata.Heroes} {
+			sort.Slice(heroes, func(i, j int) bool {
+				return heroes[i].ID < heroes[j].ID
+			})
+		}
+		if !reflect.DeepEqual(gotMetadata, wantMetadata) {
+			t.Errorf("room %s metadata:\ngot  %+v\nwant %+v", roomID, gotMetadata, wantMetadata)
+		}
+	}
+}
+
+// Test that events which are already reflected in the checkpoint can be replayed without changing
+// the counts and heroes derived from them. Checkpoints replay from the previous checkpoint, so
+// events are routinely replayed twice.
+func TestStartupFromCheckpointReplaysOverlappingEvents(t *testing.T) {
+	alice := "@TestStartupFromCheckpointReplaysOverlappingEvents_alice:localhost"
+	bob := "@TestStartupFromCheckpointReplaysOverlappingEvents_bob:localhost"
+	charlie := "@TestStartupFromCheckpointReplaysOverlappingEvents_charlie:localhost"
+	roomID := "!TestStartupFromCheckpointReplaysOverlappingEvents:localhost"
+	store := state.NewStorage(postgresConnectionString)
+	defer store.Teardown()
+	_, err := store.Initialise(roomID, []json.RawMessage{
+		testutils.NewStateEvent(t, "m.room.create", "", alice, map[string]interface{}{"creator": alice}),
+		testutils.NewJoinEvent(t, alice),
+	})
+	assertNoError(t, err)
+
+	h := newCheckpointHandler(store)
+	snapshot, err := store.GlobalSnapshot()
+	assertNoError(t, err)
+	assertNoError(t, h.Startup(&snapshot))
+	assertNoError(t, h.writeCheckpoint())
+
+	// these events are dispatched before the next checkpoint, which replays from the previous one
+	_, latestNIDs, err := store.Accumulate(roomID, "", []json.RawMessage{
+		testutils.NewJoinEvent(t, bob),
+		testutils.NewStateEvent(t, "m.room.member", charlie, alice, map[string]interface{}{"membership": "invite"}),
+	})
+	assertNoError(t, err)
+	h.Accumulate(&pubsub.V2Accumulate{RoomID: roomID, EventNIDs: latestNIDs})
+	assertNoError(t, h.writeCheckpoint())
+	cp, err := store.CheckpointTable.Select()
+	assertNoError(t, err)
+	if cp.ReplayFromNID >= latestNIDs[0] {
+		t.Fatalf("checkpoint replays from %d, want an overlap with the events from %d", cp.ReplayFromNID, latestNIDs[0])
+	}
+	want := h.GlobalCache.Snapshot()[roomID]
+
+	restarted := newCheckpointHandler(store)
+	ok, err := restarted.StartupFromCheckpoint()
+	assertNoError(t, err)
+	if !ok {
+		t.Fatalf("StartupFromCheckpoint did not use the checkpoint")
+	}
+	got := restarted.GlobalCache.Snapshot()[roomID]
+	if got.JoinCount != 2 || got.JoinCount != want.JoinCount {
+		t.Errorf("join count: got %d want %d", got.JoinCount, want.JoinCount)
+	}
+	if got.InviteCount != 1 || got.InviteCount != want.InviteCount {
+		t.Errorf("invite count: got %d want %d", got.InviteCount, want.InviteCount)
+	}
+	for _, heroes := range [][]internal.Hero{got.Heroes, want.Heroes} {
+		sort.Slice(heroes, func(i, j int) bool {
+			return heroes[i].ID < heroes[j].ID
+		})
+	}
+	if !reflect.DeepEqual(got.Heroes, want.Heroes) {
+		t.Errorf("heroes: got %+v want %+v", got.Heroes, want.Heroes)
+	}
+	gotJoined, gotInvited := restarted.Dispatcher.Snapshot()
+	wantJoined, wantInvited := h.Dispatcher.Snapshot()
+	if !reflect.DeepEqual(sortedMembers(gotJoined), sortedMembers(wantJoined)) {
+		t.Errorf("joined members: got %v want %v", gotJoined, wantJoined)
+	}
+	if !reflect.DeepEqual(sortedMembers(gotInvited), sortedMembers(wantInvited)) {
+		t.Errorf("invited members: got %v want %v", gotInvited, wantInvited)
+	}
+}
+
+// sortedMembers sorts the members of each room, which are in map iteration order when snapshotted.
+func sortedMembers(roomToMembers map[string][]string) map[string][]string {
+	for _, members := range roomToMembers {
+		sort.Strings(members)
+	}
+	return roomToMembers
+}
+
+func assertNoError(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("got error: %s", err)
+	}
+}
@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+)
+
+// How often connection memory usage is checked against the limits.
+const connMemoryCheckInterval = 10 * time.Second
+
+// SetConnMemoryLimits configures the approximate memory, in bytes, which a single connection and all
+// connections together may use. Connections over the limit are expired, and clients must start a new
+// connection. Zero disables a limit. Must be called before Listen.
+func (h *SyncLiveHandler) SetConnMemoryLimits(maxConnBytes, maxTotalBytes int64) {
+	h.maxConnBytes = maxConnBytes
+	h.maxTotalConnBytes = maxTotalBytes
+}
+
+// runConnMemoryLimiter periodically enforces connection memory limits and updates connection memory
+// metrics until Teardown is called.
+func (h *SyncLiveHandler) runConnMemoryLimiter() {
+	defer internal.ReportPanicsToSentry()
+	ticker := time.NewTicker(connMemoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stopConnMemoryLimiter:
+			return
+		case <-ticker.C:
+			h.enforceConnMemoryLimits()
+		}
+	}
+}
+
+func (h *SyncLiveHandler) enforceConnMemoryLimits() {
+	usage := h.ConnMap.EnforceMemoryLimits(h.maxConnBytes, h.maxTotalConnBytes)
+	if usage.NumExpiredForConnLimit > 0 || usage.NumExpiredForTotalLimit > 0 {
+		logger.Info().Int("conn_limit", usage.NumExpiredForConnLimit).Int("total_limit", usage.NumExpiredForTotalLimit).Int64(
+			"total_bytes", usage.TotalBytes,
+		).Msg("expired connections over memory limits")
+	}
+	if h.connsSizeBytes != nil {
+		h.connsSizeBytes.Set(float64(usage.TotalBytes))
+		h.memoryExpiredConns.WithLabelValues("conn").Add(float64(usage.NumExpiredForConnLimit))
+		h.memoryExpiredConns.WithLabelValues("total").Add(float64(usage.NumExpiredForTotalLimit))
+	}
+	h.updateMetrics()
+}
@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -53,6 +54,9 @@ type ConnState struct {
 
 	extensionsHandler   extensions.HandlerInterface
 	processHistogramVec *prometheus.HistogramVec
+
+	// the approximate size of the lists and subscriptions, updated after each request
+	sizeBytes atomic.Int64
 }
 
 func NewConnState(
@@ -151,6 +155,19 @@ func (s *ConnState) load(ctx context.Context, req *sync3.Request) error {
 			LastInterestedEventTimestamps: inviteTimestampsByList,
 		})
 	}
+	knocks := s.userCache.Knocks()
+	for _, urd := range knocks {
+		metadata := urd.Knock.RoomMetadata()
+		knockTimestampsByList := make(map[string]uint64, len(req.Lists))
+		for listKey := range req.Lists {
+			knockTimestampsByList[listKey] = metadata.LastMessageTimestamp
+		}
+		rooms = append(rooms, sync3.RoomConnMetadata{
+			RoomMetadata:                  *metadata,
+			UserRoomData:                  urd,
+			LastInterestedEventTimestamps: knockTimestampsByList,
+		})
+	}
 
 	for _, r := range rooms {
 		s.lists.SetRoom(r)
@@ -193,6 +210,8 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 		internal.Logf(reqCtx, "connstate", "list[%v] prev_empty=%v curr=%v", key, l.Prev == nil, listData)
 	}
 
+	s.applyNotificationHints(reqCtx, req.NotificationHints)
+
 	// work out which rooms we'll return data for and add their relevant subscriptions to the builder
 	// for it to mix together
 	builder := NewRoomsBuilder()
@@ -210,11 +229,19 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	// Handle extensions AFTER processing lists as extensions may need to know which rooms the client
 	// is being notified about (e.g. for room account data)
 	extCtx, region := internal.StartSpan(reqCtx, "extensions")
+	var roomIDsInLists map[string][]string
+	if calls := s.muxedReq.Extensions.Calls; calls != nil && extensions.ExtensionEnabled(calls) {
+		// only the calls extension needs every room in the lists
+		roomIDsInLists = s.lists.ListsByRoomIDs()
+	}
 	response.Extensions = s.extensionsHandler.Handle(extCtx, s.muxedReq.Extensions, extensions.Context{
-		UserID:           s.userID,
-		DeviceID:         s.deviceID,
-		RoomIDToTimeline: response.RoomIDsToTimelineEventIDs(),
-		IsInitial:        isInitial,
+		UserID:            s.userID,
+		DeviceID:          s.deviceID,
+		RoomIDToTimeline:  response.RoomIDsToTimelineEventIDs(),
+		IsInitial:         isInitial,
+		RoomIDsInLists:    roomIDsInLists,
+		ListsForRoom:      s.lists.ListsForRoom,
+		RoomSubscriptions: s.subscribedRoomIDs(),
 	})
 	region.End()
 
@@ -244,6 +271,7 @@ func (s *ConnState) onIncomingRequest(reqCtx context.Context, req *sync3.Request
 	if response.Extensions.Typing != nil && response.Extensions.Typing.HasData(isInitial) {
 		s.lazyLoadTypingMembers(reqCtx, response)
 	}
+	s.updateSizeBytes()
 	return response, nil
 }
 
@@ -522,30 +550,22 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	ctx, span := internal.StartSpan(ctx, "getInitialRoomData")
 	defer span.End()
 	rooms := make(map[string]sync3.Room, len(roomIDs))
-	// We want to grab the user room data and the room metadata for each room ID. We use the globally
-	// highest NID we've seen to act as an anchor for the request. This anchor does not guarantee that
-	// events returned here have already been seen - the position is not globally ordered - so because
-	// room A has a position of 6 and B has 7 (so the highest is 7) does not mean that this connection
-	// has seen 6, as concurrent room updates cause A and B to race. This is why we then go through the
-	// response to this call to assign new load positions for each room.
-	roomIDToUserRoomData := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
 	roomMetadatas := s.globalCache.LoadRooms(ctx, roomIDs...)
+	rsm := roomSub.RequiredStateMap(s.userID)
+	// The timeline and required state only depend on the load position and the subscription, so are
+	// shared with this user's other connections, which often load the same rooms for the same update.
+	fragments := s.userCache.LoadRoomFragments(
+		roomIDs, roomSub.RequiredStateKey(), int(roomSub.TimelineLimit), s.anchorLoadPosition,
+		func(roomIDs []string) map[string]*caches.RoomFragment {
+			return s.loadRoomFragments(ctx, roomSub, rsm, roomIDs)
+		},
+	)
 	// prepare lazy loading data structures, txn IDs
-	roomToUsersInTimeline := make(map[string][]string, len(roomIDToUserRoomData))
-	roomToTimeline := make(map[string][]json.RawMessage)
-	for roomID, urd := range roomIDToUserRoomData {
-		set := make(map[string]struct{})
-		for _, ev := range urd.RequestedLatestEvents.Timeline {
-			set[gjson.GetBytes(ev, "sender").Str] = struct{}{}
-		}
-		userIDs := make([]string, len(set))
-		i := 0
-		for userID := range set {
-			userIDs[i] = userID
-			i++
-		}
-		roomToUsersInTimeline[roomID] = userIDs
-		roomToTimeline[roomID] = urd.RequestedLatestEvents.Timeline
+	roomToUsersInTimeline := make(map[string][]string, len(fragments))
+	roomToTimeline := make(map[string][]json.RawMessage, len(fragments))
+	for roomID, fragment := range fragments {
+		roomToUsersInTimeline[roomID] = fragment.TimelineSenders
+		roomToTimeline[roomID] = fragment.Timeline
 		// remember what we just loaded so if we see these events down the live stream we know to ignore them.
 		// This means that requesting a direct room subscription causes the connection to jump ahead to whatever
 		// is in the database at the time of the call, rather than gradually converging by consuming live data.
@@ -553,36 +573,33 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 		// room state is also pinned to the load position here, else you could see weird things in individual
 		// responses such as an updated room.name without the associated m.room.name event (though this will
 		// come through on the next request -> it converges to the right state so it isn't critical).
-		s.loadPositions[roomID] = urd.RequestedLatestEvents.LatestNID
+		s.loadPositions[roomID] = fragment.LatestNID
 	}
 	roomToTimeline = s.userCache.AnnotateWithTransactionIDs(ctx, s.userID, s.deviceID, roomToTimeline)
-	rsm := roomSub.RequiredStateMap(s.userID)
-	// by reusing the same global load position anchor here, we can be sure that the state returned here
-	// matches the timeline we loaded earlier - the race conditions happen around pubsub updates and not
-	// the events table itself, so whatever position is picked based on this anchor is immutable.
-	roomIDToState := s.globalCache.LoadRoomState(ctx, roomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
-	if roomIDToState == nil { // e.g no required_state
-		roomIDToState = make(map[string][]json.RawMessage)
-	}
 	for _, roomID := range roomIDs {
-		userRoomData, ok := roomIDToUserRoomData[roomID]
+		userRoomData := s.userCache.LoadRoomData(roomID)
+		fragment, ok := fragments[roomID]
 		if !ok {
-			userRoomData = caches.NewUserRoomData()
+			fragment = &caches.RoomFragment{}
 		}
 		metadata := roomMetadatas[roomID]
-		var inviteState []json.RawMessage
+		var inviteState, knockState []json.RawMessage
 		// handle invites specially as we do not want to leak additional data beyond the invite_state and if
 		// we happen to have this room in the global cache we will do.
 		// Furthermore, rooms the proxy have been invited to for the first time ever will not be in the global cache yet,
 		// which will cause errors below when we try calling functions on a nil metadata.
+		// The same is true of knocks and their knock_state.
 		if userRoomData.IsInvite {
 			metadata = userRoomData.Invite.RoomMetadata()
 			inviteState = userRoomData.Invite.InviteState
+		} else if userRoomData.IsKnock {
+			metadata = userRoomData.Knock.RoomMetadata()
+			knockState = userRoomData.Knock.InviteState
 		}
 		metadata.RemoveHero(s.userID)
 		var requiredState []json.RawMessage
-		if !userRoomData.IsInvite {
-			requiredState = roomIDToState[roomID]
+		if !userRoomData.IsInvite && !userRoomData.IsKnock {
+			requiredState = fragment.RequiredState
 			if requiredState == nil {
 				requiredState = make([]json.RawMessage, 0)
 			}
@@ -594,11 +611,12 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 			Timeline:          roomToTimeline[roomID],
 			RequiredState:     requiredState,
 			InviteState:       inviteState,
+			KnockState:        knockState,
 			Initial:           true,
 			IsDM:              userRoomData.IsDM,
 			JoinedCount:       metadata.JoinCount,
 			InvitedCount:      metadata.InviteCount,
-			PrevBatch:         userRoomData.RequestedLatestEvents.PrevBatch,
+			PrevBatch:         fragment.PrevBatch,
 		}
 	}
 
@@ -610,6 +628,48 @@ func (s *ConnState) getInitialRoomData(ctx context.Context, roomSub sync3.RoomSu
 	return rooms
 }
 
+// loadRoomFragments loads the timeline and required state for these rooms from the database.
+func (s *ConnState) loadRoomFragments(
+	ctx context.Context, roomSub sync3.RoomSubscription, rsm *internal.RequiredStateMap, roomIDs []string,
+) map[string]*caches.RoomFragment {
+	// We want to grab the user room data and the room metadata for each room ID. We use the globally
+	// highest NID we've seen to act as an anchor for the request. This anchor does not guarantee that
+	// events returned here have already been seen - the position is not globally ordered - so because
+	// room A has a position of 6 and B has 7 (so the highest is 7) does not mean that this connection
+	// has seen 6, as concurrent room updates cause A and B to race. This is why we then go through the
+	// response to this call to assign new load positions for each room.
+	roomIDToUserRoomData := s.userCache.LazyLoadTimelines(ctx, s.anchorLoadPosition, roomIDs, int(roomSub.TimelineLimit))
+	fragments := make(map[string]*caches.RoomFragment, len(roomIDToUserRoomData))
+	roomToUsersInTimeline := make(map[string][]string, len(roomIDToUserRoomData))
+	for roomID, urd := range roomIDToUserRoomData {
+		set := make(map[string]struct{})
+		for _, ev := range urd.RequestedLatestEvents.Timeline {
+			set[gjson.GetBytes(ev, "sender").Str] = struct{}{}
+		}
+		userIDs := make([]string, len(set))
+		i := 0
+		for userID := range set {
+			userIDs[i] = userID
+			i++
+		}
+		roomToUsersInTimeline[roomID] = userIDs
+		fragments[roomID] = &caches.RoomFragment{
+			Timeline:        urd.RequestedLatestEvents.Timeline,
+			PrevBatch:       urd.RequestedLatestEvents.PrevBatch,
+			LatestNID:       urd.RequestedLatestEvents.LatestNID,
+			TimelineSenders: userIDs,
+		}
+	}
+	// by reusing the same global load position anchor here, we can be sure that the state returned here
+	// matches the timeline we loaded earlier - the race conditions happen around pubsub updates and not
+	// the events table itself, so whatever position is picked based on this anchor is immutable.
+	roomIDToState := s.globalCache.LoadRoomState(ctx, roomIDs, s.anchorLoadPosition, rsm, roomToUsersInTimeline)
+	for roomID, fragment := range fragments {
+		fragment.RequiredState = roomIDToState[roomID]
+	}
+	return fragments
+}
+
 func (s *ConnState) trackProcessDuration(dur time.Duration, isInitial bool) {
 	if s.processHistogramVec == nil {
 		return
@@ -630,6 +690,31 @@ func (s *ConnState) Alive() bool {
 	return !s.live.bufferFull
 }
 
+// Rough size of an entry in the load positions or room subscriptions maps.
+const approxMapEntryBytes = 64
+
+// ApproxSizeBytes returns a rough estimate of the memory used by this connection's lists,
+// subscriptions and buffered live updates. Safe to call from any goroutine.
+func (s *ConnState) ApproxSizeBytes() int {
+	return int(s.sizeBytes.Load() + s.live.bufferedBytes.Load())
+}
+
+// updateSizeBytes recalculates the size of the lists and subscriptions. Must be called whilst
+// handling a request, as these are not safe to read concurrently.
+func (s *ConnState) updateSizeBytes() {
+	size := s.lists.ApproxSizeBytes() + approxMapEntryBytes*(len(s.loadPositions)+len(s.roomSubscriptions))
+	s.sizeBytes.Store(int64(size))
+}
+
+// subscribedRoomIDs returns the set of room IDs with room subscriptions on this connection.
+func (s *ConnState) subscribedRoomIDs() map[string]struct{} {
+	roomIDs := make(map[string]struct{}, len(s.roomSubscriptions))
+	for roomID := range s.roomSubscriptions {
+		roomIDs[roomID] = struct{}{}
+	}
+	return roomIDs
+}
+
 func (s *ConnState) UserID() string {
 	return s.userID
 }
@@ -638,6 +723,29 @@ func (s *ConnState) OnUpdate(ctx context.Context, up caches.Update) {
 	s.live.onUpdate(up)
 }
 
+// applyNotificationHints sets client-calculated notification counts on the user cache, so all
+// connections for this user see them. Hints are only accepted for encrypted rooms the user is
+// joined to, as the homeserver counts are authoritative for unencrypted rooms.
+func (s *ConnState) applyNotificationHints(ctx context.Context, hints map[string]sync3.NotificationHint) {
+	if len(hints) == 0 {
+		return
+	}
+	roomIDs := make([]string, 0, len(hints))
+	for roomID := range hints {
+		if s.joinChecker.IsUserJoined(s.userID, roomID) {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	rooms := s.globalCache.LoadRooms(ctx, roomIDs...)
+	for _, roomID := range roomIDs {
+		if rooms[roomID] == nil || !rooms[roomID].Encrypted {
+			continue
+		}
+		hint := hints[roomID]
+		s.userCache.OnNotificationHint(ctx, roomID, hint.HighlightCount, hint.NotificationCount)
+	}
+}
+
 // Called by the user cache when updates arrive
 func (s *ConnState) OnRoomUpdate(ctx context.Context, up caches.RoomUpdate) {
 	switch update := up.(type) {
@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"sync/atomic"
 	"time"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -25,6 +26,19 @@ type connStateLive struct {
 	// saying the client is dead and clean up the conn.
 	updates    chan caches.Update
 	bufferFull bool
+	// the approximate size of the updates in the channel
+	bufferedBytes atomic.Int64
+}
+
+// Rough size of a buffered update, not including any event it holds.
+const approxUpdateBytes = 128
+
+func approxUpdateSizeBytes(up caches.Update) int64 {
+	size := approxUpdateBytes
+	if roomEventUpdate, ok := up.(*caches.RoomEventUpdate); ok && roomEventUpdate.EventData != nil {
+		size += len(roomEventUpdate.EventData.Event)
+	}
+	return int64(size)
 }
 
 // Called when there is an update from the user cache. This callback fires when the server gets a new event and determines this connection MAY be
@@ -34,9 +48,13 @@ func (s *connStateLive) onUpdate(up caches.Update) {
 	if s.bufferFull {
 		return
 	}
+	size := approxUpdateSizeBytes(up)
+	// count the update before sending it, else it may be consumed and subtracted first
+	s.bufferedBytes.Add(size)
 	select {
 	case s.updates <- up:
 	case <-time.After(BufferWaitTime):
+		s.bufferedBytes.Add(-size)
 		logger.Warn().Interface("update", up).Str("user", s.userID).Msg(
 			"cannot send update to connection, buffer exceeded. Destroying connection.",
 		)
@@ -69,6 +87,11 @@ func (s *connStateLive) liveUpdate(
 			log.Trace().Str("time_waited", timeWaited.String()).Msg("liveUpdate: timed out")
 			return
 		}
+		// extensions may be holding back data until a certain time e.g typing coalescing
+		var wakeUp <-chan time.Time
+		if wakeAt := response.Extensions.WakeAt(); !wakeAt.IsZero() && time.Until(wakeAt) < timeLeftToWait {
+			wakeUp = time.After(time.Until(wakeAt))
+		}
 		log.Trace().Str("dur", timeLeftToWait.String()).Msg("liveUpdate: no response data yet; blocking")
 		select {
 		case <-ctx.Done(): // client has given up
@@ -79,29 +102,39 @@ func (s *connStateLive) liveUpdate(
 			log.Trace().Msg("liveUpdate: timed out")
 			internal.Logf(ctx, "liveUpdate", "timed out after %v", timeLeftToWait)
 			return
+		case <-wakeUp: // extensions have data ready to send
+			log.Trace().Msg("liveUpdate: extensions woke up")
+			internal.Logf(ctx, "liveUpdate", "extensions woke up")
 		case update := <-s.updates:
 			internal.Logf(ctx, "liveUpdate", "process live update")
+			s.bufferedBytes.Add(-approxUpdateSizeBytes(update))
 
 			s.processLiveUpdate(ctx, update, response)
 			// pass event to extensions AFTER processing
 			roomIDsToLists := s.lists.ListsByVisibleRoomIDs(s.muxedReq.Lists)
+			subscribedRoomIDs := s.subscribedRoomIDs()
 			s.extensionsHandler.HandleLiveUpdate(ctx, update, ex, &response.Extensions, extensions.Context{
-				IsInitial:        false,
-				RoomIDToTimeline: response.RoomIDsToTimelineEventIDs(),
-				UserID:           s.userID,
-				DeviceID:         s.deviceID,
-				RoomIDsToLists:   roomIDsToLists,
+				IsInitial:         false,
+				RoomIDToTimeline:  response.RoomIDsToTimelineEventIDs(),
+				UserID:            s.userID,
+				DeviceID:          s.deviceID,
+				RoomIDsToLists:    roomIDsToLists,
+				ListsForRoom:      s.lists.ListsForRoom,
+				RoomSubscriptions: subscribedRoomIDs,
 			})
 			// if there's more updates and we don't have lots stacked up already, go ahead and process another
 			for len(s.updates) > 0 && response.ListOps() < 50 {
 				update = <-s.updates
+				s.bufferedBytes.Add(-approxUpdateSizeBytes(update))
 				s.processLiveUpdate(ctx, update, response)
 				s.extensionsHandler.HandleLiveUpdate(ctx, update, ex, &response.Extensions, extensions.Context{
-					IsInitial:        false,
-					RoomIDToTimeline: response.RoomIDsToTimelineEventIDs(),
-					UserID:           s.userID,
-					DeviceID:         s.deviceID,
-					RoomIDsToLists:   roomIDsToLists,
+					IsInitial:         false,
+					RoomIDToTimeline:  response.RoomIDsToTimelineEventIDs(),
+					UserID:            s.userID,
+					DeviceID:          s.deviceID,
+					RoomIDsToLists:    roomIDsToLists,
+					ListsForRoom:      s.lists.ListsForRoom,
+					RoomSubscriptions: subscribedRoomIDs,
 				})
 			}
 		}
@@ -339,7 +372,6 @@ func (s *connStateLive) resort(
 	listOp sync3.ListOp,
 ) (ops []sync3.ResponseOp, didUpdate bool) {
 	if reqList.ShouldGetAllRooms() {
-		// no need to sort this list as we get all rooms
 		// no need to calculate ops as we get all rooms
 		// no need to send initial state for some rooms as we already sent initial state for all rooms
 		if listOp == sync3.ListOpAdd {
@@ -350,6 +382,13 @@ func (s *connStateLive) resort(
 		} else if listOp == sync3.ListOpDel {
 			intList.Remove(roomID)
 		}
+		// keep the list sorted in case ranges are requested later: this is cheap as only this room moves
+		if listOp != sync3.ListOpDel && len(reqList.Sort) > 0 {
+			if err := intList.Reposition(roomID, reqList.Sort); err != nil {
+				logger.Err(err).Str("room", roomID).Msg("cannot sort list")
+				internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+			}
+		}
 		return nil, true
 	}
 
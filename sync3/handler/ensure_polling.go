@@ -29,7 +29,9 @@ type EnsurePoller struct {
 	mu *sync.Mutex
 	// pendingPolls tracks the status of pollers that we are waiting to start.
 	pendingPolls map[sync2.PollerID]pendingInfo
-	notifier     pubsub.Notifier
+	// presence tracks the last presence each device asked to be set, so we only notify changes.
+	presence map[sync2.PollerID]string
+	notifier pubsub.Notifier
 }
 
 func NewEnsurePoller(notifier pubsub.Notifier) *EnsurePoller {
@@ -37,6 +39,7 @@ func NewEnsurePoller(notifier pubsub.Notifier) *EnsurePoller {
 		chanName:     pubsub.ChanV3,
 		mu:           &sync.Mutex{},
 		pendingPolls: make(map[sync2.PollerID]pendingInfo),
+		presence:     make(map[sync2.PollerID]string),
 		notifier:     notifier,
 	}
 }
@@ -88,6 +91,24 @@ func (p *EnsurePoller) EnsurePolling(ctx context.Context, pid sync2.PollerID, to
 	r2.End()
 }
 
+// SetPresence asks the poller for this device to set the user's presence. The presence must be a
+// valid v2 `set_presence` value. Does nothing if the device has already asked for this presence.
+func (p *EnsurePoller) SetPresence(ctx context.Context, pid sync2.PollerID, presence string) {
+	p.mu.Lock()
+	if p.presence[pid] == presence {
+		p.mu.Unlock()
+		return
+	}
+	p.presence[pid] = presence
+	p.mu.Unlock()
+	internal.Logf(ctx, "SetPresence", "user %s device %s set presence %s", pid.UserID, pid.DeviceID, presence)
+	p.notifier.Notify(p.chanName, &pubsub.V3SetPresence{
+		UserID:   pid.UserID,
+		DeviceID: pid.DeviceID,
+		Presence: presence,
+	})
+}
+
 func (p *EnsurePoller) OnInitialSyncComplete(payload *pubsub.V2InitialSyncComplete) {
 	log := logger.With().Str("user", payload.UserID).Str("device", payload.DeviceID).Logger()
 	log.Trace().Msg("OnInitialSyncComplete: got payload")
@@ -124,6 +145,7 @@ func (p *EnsurePoller) OnExpiredToken(payload *pubsub.V2ExpiredToken) {
 	pid := sync2.PollerID{UserID: payload.UserID, DeviceID: payload.DeviceID}
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	delete(p.presence, pid)
 	pending, exists := p.pendingPolls[pid]
 	if !exists {
 		// We weren't tracking the state of this poller, so we have nothing to clean up.
@@ -56,11 +56,41 @@ type SyncLiveHandler struct {
 	userCaches *sync.Map // map[user_id]*UserCache
 	Dispatcher *sync3.Dispatcher
 
+	// user caches are evicted when the user has had no connections for this long. 0 disables eviction.
+	userCacheIdleTTL  time.Duration
+	userCacheMu       sync.Mutex           // protects userCacheLastUsed and serialises evictions
+	userCacheLastUsed map[string]time.Time // user_id -> last time the cache was used
+	stopEvictor       chan struct{}
+
+	// the global state is periodically checkpointed to the database. 0 disables checkpointing.
+	checkpointInterval  time.Duration
+	stopCheckpointer    chan struct{}
+	dispatchMu          sync.Mutex // held whilst dispatching events, protects latestDispatchedNID
+	latestDispatchedNID int64
+	// the EventNID of the previous checkpoint, or of the state loaded on startup
+	prevCheckpointNID int64
+
+	// connections using more memory than these limits are expired. 0 disables a limit.
+	maxConnBytes          int64
+	maxTotalConnBytes     int64
+	stopConnMemoryLimiter chan struct{}
+
 	GlobalCache            *caches.GlobalCache
 	maxPendingEventUpdates int
 
-	numConns prometheus.Gauge
-	histVec  *prometheus.HistogramVec
+	rateLimits  RateLimits
+	userLimiter *RateLimiter
+	ipLimiter   *RateLimiter
+
+	evaluatePushRules bool
+
+	numConns            prometheus.Gauge
+	numUserCaches       prometheus.Gauge
+	userCachesSizeBytes prometheus.Gauge
+	histVec             *prometheus.HistogramVec
+	rateLimitedVec      *prometheus.CounterVec
+	connsSizeBytes      prometheus.Gauge
+	memoryExpiredConns  *prometheus.CounterVec
 }
 
 func NewSync3Handler(
@@ -74,14 +104,19 @@ func NewSync3Handler(
 		V2Store:                storev2,
 		ConnMap:                sync3.NewConnMap(),
 		userCaches:             &sync.Map{},
+		userCacheLastUsed:      make(map[string]time.Time),
+		stopEvictor:            make(chan struct{}),
+		stopCheckpointer:       make(chan struct{}),
+		stopConnMemoryLimiter:  make(chan struct{}),
 		Dispatcher:             sync3.NewDispatcher(),
 		GlobalCache:            caches.NewGlobalCache(store),
 		maxPendingEventUpdates: maxPendingEventUpdates,
 	}
 	sh.Extensions = &extensions.Handler{
-		Store:       store,
-		E2EEFetcher: sh,
-		GlobalCache: sh.GlobalCache,
+		Store:           store,
+		E2EEFetcher:     sh,
+		PresenceFetcher: sh,
+		GlobalCache:     sh.GlobalCache,
 	}
 
 	if enablePrometheus {
@@ -104,9 +139,34 @@ func (h *SyncLiveHandler) Startup(storeSnapshot *state.StartupSnapshot) error {
 	if err := h.GlobalCache.Startup(storeSnapshot.GlobalMetadata); err != nil {
 		return fmt.Errorf("failed to populate global cache: %s", err)
 	}
+	h.GlobalCache.StartupPresence(storeSnapshot.Presence)
+	h.latestDispatchedNID = storeSnapshot.LatestNID
+	h.prevCheckpointNID = storeSnapshot.LatestNID
 	return nil
 }
 
+// SetRateLimits configures per-user and per-IP rate limiting of requests.
+func (h *SyncLiveHandler) SetRateLimits(rl RateLimits) {
+	h.rateLimits = rl
+	h.userLimiter = NewRateLimiter(rl.UserRequestsPerSec, rl.UserBurst)
+	h.ipLimiter = NewRateLimiter(rl.IPRequestsPerSec, rl.IPBurst)
+}
+
+// SetMaxCachedRooms makes the global cache load room metadata from the database on demand rather than
+// all at once at startup, holding metadata for roughly maxRooms rooms. Rooms which a connected user is
+// joined to are never evicted. Must be called before Startup.
+func (h *SyncLiveHandler) SetMaxCachedRooms(maxRooms int) {
+	h.GlobalCache.EnableLazyLoading(maxRooms, func(roomID string) bool {
+		return h.Dispatcher.AnyJoinedUser(roomID, h.ConnMap.UserHasConns)
+	})
+}
+
+// SetEvaluatePushRules configures whether user caches evaluate push rules to calculate notification
+// counts for unencrypted rooms, rather than waiting for counts from the homeserver.
+func (h *SyncLiveHandler) SetEvaluatePushRules(enabled bool) {
+	h.evaluatePushRules = enabled
+}
+
 // Listen starts all consumers
 func (h *SyncLiveHandler) Listen() {
 	go func() {
@@ -117,6 +177,15 @@ func (h *SyncLiveHandler) Listen() {
 			sentry.CaptureException(err)
 		}
 	}()
+	if h.userCacheIdleTTL > 0 || h.numUserCaches != nil {
+		go h.runUserCacheEvictor()
+	}
+	if h.checkpointInterval > 0 {
+		go h.runCheckpointer()
+	}
+	if h.maxConnBytes > 0 || h.maxTotalConnBytes > 0 || h.connsSizeBytes != nil {
+		go h.runConnMemoryLimiter()
+	}
 }
 
 // used in tests to close postgres connections
@@ -126,12 +195,26 @@ func (h *SyncLiveHandler) Teardown() {
 	h.V2Sub.Teardown()
 	h.EnsurePoller.Teardown()
 	h.ConnMap.Teardown()
+	close(h.stopEvictor)
+	close(h.stopCheckpointer)
+	close(h.stopConnMemoryLimiter)
 	if h.numConns != nil {
 		prometheus.Unregister(h.numConns)
 	}
+	if h.numUserCaches != nil {
+		prometheus.Unregister(h.numUserCaches)
+		prometheus.Unregister(h.userCachesSizeBytes)
+	}
 	if h.histVec != nil {
 		prometheus.Unregister(h.histVec)
 	}
+	if h.rateLimitedVec != nil {
+		prometheus.Unregister(h.rateLimitedVec)
+	}
+	if h.connsSizeBytes != nil {
+		prometheus.Unregister(h.connsSizeBytes)
+		prometheus.Unregister(h.memoryExpiredConns)
+	}
 }
 
 func (h *SyncLiveHandler) updateMetrics() {
@@ -148,6 +231,18 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Name:      "num_active_conns",
 		Help:      "Number of active sliding sync connections.",
 	})
+	h.numUserCaches = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "num_user_caches",
+		Help:      "Number of user caches held in memory.",
+	})
+	h.userCachesSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "user_caches_size_bytes",
+		Help:      "Approximate memory used by user caches, in bytes.",
+	})
 	h.histVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "sliding_sync",
 		Subsystem: "api",
@@ -155,8 +250,43 @@ func (h *SyncLiveHandler) addPrometheusMetrics() {
 		Help:      "Time taken in seconds for the sliding sync response to calculated, excludes long polling",
 		Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
 	}, []string{"initial"})
+	h.rateLimitedVec = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "num_rate_limited",
+		Help:      "Number of sliding sync requests rejected due to rate limiting.",
+	}, []string{"limit"})
+	h.connsSizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "conns_size_bytes",
+		Help:      "Approximate memory used by sliding sync connections, in bytes.",
+	})
+	h.memoryExpiredConns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "sliding_sync",
+		Subsystem: "api",
+		Name:      "num_memory_expired_conns",
+		Help:      "Number of sliding sync connections expired for exceeding a memory limit.",
+	}, []string{"limit"})
 	prometheus.MustRegister(h.numConns)
+	prometheus.MustRegister(h.numUserCaches)
+	prometheus.MustRegister(h.userCachesSizeBytes)
 	prometheus.MustRegister(h.histVec)
+	prometheus.MustRegister(h.rateLimitedVec)
+	prometheus.MustRegister(h.connsSizeBytes)
+	prometheus.MustRegister(h.memoryExpiredConns)
+}
+
+// checkRateLimit returns a HandlerError if the key has exceeded the limiter's rate.
+func (h *SyncLiveHandler) checkRateLimit(limiter *RateLimiter, limit, key string) *internal.HandlerError {
+	ok, retryAfter := limiter.Allow(key, time.Now())
+	if ok {
+		return nil
+	}
+	if h.rateLimitedVec != nil {
+		h.rateLimitedVec.WithLabelValues(limit).Inc()
+	}
+	return internal.RateLimitedError(retryAfter)
 }
 
 func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -183,6 +313,10 @@ func (h *SyncLiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 // Entry point for sync v3
 func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error {
+	if herr := h.checkRateLimit(h.ipLimiter, "ip", h.rateLimits.clientIP(req)); herr != nil {
+		hlog.FromRequest(req).Warn().Int64("retry_after_ms", herr.RetryAfterMs).Msg("rate limited by IP")
+		return herr
+	}
 	var requestBody sync3.Request
 	if req.ContentLength != 0 {
 		defer req.Body.Close()
@@ -213,6 +347,14 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 		}
 	}
 
+	setPresence := req.URL.Query().Get("set_presence")
+	if setPresence != "" && !sync2.IsValidSetPresence(setPresence) {
+		return &internal.HandlerError{
+			StatusCode: 400,
+			Err:        fmt.Errorf("invalid set_presence: %s", setPresence),
+		}
+	}
+
 	logErrorOrWarning := func(msg string, herr *internal.HandlerError) {
 		if herr.StatusCode >= 500 {
 			hlog.FromRequest(req).Err(herr).Msg(msg)
@@ -233,6 +375,9 @@ func (h *SyncLiveHandler) serve(w http.ResponseWriter, req *http.Request) error
 	}
 	requestBody.SetPos(cpos)
 	internal.SetRequestContextUserID(req.Context(), conn.UserID)
+	if setPresence != "" {
+		h.EnsurePoller.SetPresence(req.Context(), sync2.PollerID{UserID: conn.UserID, DeviceID: conn.DeviceID}, setPresence)
+	}
 	log := hlog.FromRequest(req).With().Str("user", conn.UserID).Int64("pos", cpos).Logger()
 
 	var timeout int
@@ -336,6 +481,11 @@ func (h *SyncLiveHandler) setupConnection(req *http.Request, syncReq *sync3.Requ
 	log := hlog.FromRequest(req).With().Str("user", token.UserID).Str("device", token.DeviceID).Logger()
 	internal.Logf(taskCtx, "setupConnection", "identified access token as user=%s device=%s", token.UserID, token.DeviceID)
 
+	if herr := h.checkRateLimit(h.userLimiter, "user", token.UserID); herr != nil {
+		log.Warn().Int64("retry_after_ms", herr.RetryAfterMs).Msg("rate limited by user")
+		return nil, herr
+	}
+
 	// Record the fact that we've recieved a request from this token
 	err = h.V2Store.TokensTable.MaybeUpdateLastSeen(token, time.Now())
 	if err != nil {
@@ -459,17 +609,22 @@ func (h *SyncLiveHandler) CacheForUser(userID string) *caches.UserCache {
 //   - stores the struct so it will not be recreated in the future, and
 //   - registers the cache with the Dispatcher.
 //
+// Caches may be evicted when the user has been idle for a while (see SetUserCacheIdleTTL), in which
+// case they are transparently rebuilt here.
+//
 // Some extra initialisation takes place in caches.UserCache.OnRegister.
 // TODO: the calls to uc.OnBlahBlah etc can be moved into NewUserCache, now that the
 //
 //	UserCache holds a reference to the storage layer.
 func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
+	h.touchUserCache(userID, time.Now())
 	// bail if we already have a cache
 	c, ok := h.userCaches.Load(userID)
 	if ok {
 		return c.(*caches.UserCache), nil
 	}
 	uc := caches.NewUserCache(userID, h.GlobalCache, h.Storage, h)
+	uc.EvaluatePushRules = h.evaluatePushRules
 	// select all non-zero highlight or notif counts and set them, as this is less costly than looping every room/user pair
 	err := h.Storage.UnreadTable.SelectAllNonZeroCountsForUser(userID, func(roomID string, highlightCount, notificationCount int) {
 		uc.OnUnreadCounts(context.Background(), roomID, &highlightCount, &notificationCount)
@@ -486,6 +641,16 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnAccountData(context.Background(), []state.AccountData{directEvent[0]})
 	}
 
+	if h.evaluatePushRules {
+		pushRulesEvent, err := h.Storage.AccountData(userID, sync2.AccountDataGlobalRoom, []string{"m.push_rules"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load push rules: %s", err)
+		}
+		if len(pushRulesEvent) == 1 {
+			uc.OnAccountData(context.Background(), []state.AccountData{pushRulesEvent[0]})
+		}
+	}
+
 	// select all room tag account data and set it
 	tagEvents, err := h.Storage.RoomAccountDatasWithType(userID, "m.tag")
 	if err != nil {
@@ -504,6 +669,15 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 		uc.OnInvite(context.Background(), roomID, inviteState)
 	}
 
+	// select outstanding knocks
+	knocks, err := h.Storage.KnocksTable.SelectAllKnocksForUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outstanding knocks for user: %s", err)
+	}
+	for roomID, knockState := range knocks {
+		uc.OnKnock(context.Background(), roomID, knockState)
+	}
+
 	// use LoadOrStore here else we can race as 2 brand new /sync conns can both get to this point
 	// at the same time
 	actualUC, loaded := h.userCaches.LoadOrStore(userID, uc)
@@ -519,45 +693,39 @@ func (h *SyncLiveHandler) userCache(userID string) (*caches.UserCache, error) {
 	return uc, nil
 }
 
+// Implements PresenceFetcher
+func (h *SyncLiveHandler) VisiblePresence(ctx context.Context, userID string, roomIDs []string) []internal.Presence {
+	userIDs := []string{userID}
+	seen := map[string]struct{}{userID: {}}
+	for _, roomID := range roomIDs {
+		// presence is only visible to users who share a room
+		if !h.Dispatcher.IsUserJoined(userID, roomID) {
+			continue
+		}
+		for _, member := range h.Dispatcher.JoinedUsersForRoom(roomID) {
+			if _, ok := seen[member]; ok {
+				continue
+			}
+			seen[member] = struct{}{}
+			userIDs = append(userIDs, member)
+		}
+	}
+	return h.GlobalCache.LoadPresence(userIDs...)
+}
+
 // Implements E2EEFetcher
 // DeviceData returns the latest device data for this user. isInitial should be set if this is for
 // an initial /sync request.
 func (h *SyncLiveHandler) DeviceData(ctx context.Context, userID, deviceID string, isInitial bool) *internal.DeviceData {
-	// We have 2 sources of DeviceData:
-	// - pubsub updates stored in deviceDataMap
-	// - the database itself
-	// Most of the time we would like to pull from deviceDataMap and ignore the database entirely,
-	// however in most cases we need to do a database hit to atomically swap device lists over. Why?
-	//
-	// changed|left are much more important and special because:
-	//
-	// - sync v2 only sends deltas, rather than all of them unlike otk counts and fallback key types
-	// - we MUST guarantee that we send this to the client, as missing a user in `changed` can result in us having the wrong
-	//   device lists for that user resulting in encryption breaking when the client encrypts for known devices.
-	// - we MUST NOT continually send the same device list changes on each subsequent request i.e we need to delete them
-	//
-	// We accumulate device list deltas on the v2 poller side, upserting into the database and sending pubsub notifs for.
-	// The accumulated deltas are stored in DeviceData.DeviceLists.New
-	// To guarantee we send this to the client, we need to consider a few failure modes:
-	// - The response is lost and the request is retried to this proxy -> ConnMap caches will get it.
-	// - The response is lost and the client doesn't retry until the connection expires. They then retry ->
-	//   ConnMap cache miss, sends HTTP 400 due to invalid ?pos=
-	// - The response is received and the client sends the next request -> do not send deltas.
-
-	// To handle the case where responses are lost, we just need to see if this is an initial request
-	// and if so, return a "Read-Only" snapshot of the last sent device list changes. This means we may send
-	// duplicate device list changes if the response did in fact get to the client and the next request hit a
-	// new proxy, but that's better than losing updates. In this scenario, we do not delete any data.
-	// To ensure we delete device list updates over time, we now want to swap what was New to Sent and then
-	// send Sent. That means we forget what was originally in Sent and New is empty. We need to read and swap
-	// atomically else the v2 poller may insert a new update after the read but before the swap (DELETE on New)
-	// To ensure atomicity, we need to do this in a txn.
-	// Atomically move New to Sent so New is now empty and what was originally in Sent is forgotten.
+	// OTK counts and fallback key types are only sent when they change, which is tracked via the
+	// changed bits. On initial requests we send them regardless, so we don't reset the changed bits
+	// in case the response is lost. Device list changes are not part of DeviceData: they are an
+	// append-only stream in the DeviceListTable which the E2EE extension consumes via since tokens.
 	shouldSwap := !isInitial
 
 	dd, err := h.Storage.DeviceDataTable.Select(userID, deviceID, shouldSwap)
 	if err != nil {
-		logger.Err(err).Str("user", userID).Msg("failed to SelectAndSwap device data")
+		logger.Err(err).Str("user", userID).Msg("failed to select device data")
 		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		return nil
 	}
@@ -593,9 +761,14 @@ func (h *SyncLiveHandler) Accumulate(p *pubsub.V2Accumulate) {
 		return
 	}
 	internal.Logf(ctx, "room", fmt.Sprintf("%s: %d events", p.RoomID, len(events)))
+	h.dispatchMu.Lock()
+	defer h.dispatchMu.Unlock()
 	// we have new events, notify active connections
 	for i := range events {
 		h.Dispatcher.OnNewEvent(ctx, p.RoomID, events[i], p.EventNIDs[i])
+		if p.EventNIDs[i] > h.latestDispatchedNID {
+			h.latestDispatchedNID = p.EventNIDs[i]
+		}
 	}
 }
 
@@ -617,6 +790,8 @@ func (h *SyncLiveHandler) Initialise(p *pubsub.V2Initialise) {
 		return
 	}
 	// we have new state, notify caches
+	h.dispatchMu.Lock()
+	defer h.dispatchMu.Unlock()
 	h.Dispatcher.OnNewInitialRoomState(ctx, p.RoomID, state)
 }
 
@@ -666,6 +841,22 @@ func (h *SyncLiveHandler) OnInvite(p *pubsub.V2InviteRoom) {
 	userCache.(*caches.UserCache).OnInvite(ctx, p.RoomID, inviteState)
 }
 
+func (h *SyncLiveHandler) OnKnock(p *pubsub.V2KnockRoom) {
+	ctx, task := internal.StartTask(context.Background(), "OnKnock")
+	defer task.End()
+	userCache, ok := h.userCaches.Load(p.UserID)
+	if !ok {
+		return
+	}
+	knockState, err := h.Storage.KnocksTable.SelectKnockState(p.UserID, p.RoomID)
+	if err != nil {
+		logger.Err(err).Str("user", p.UserID).Str("room", p.RoomID).Msg("failed to get knock state")
+		internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
+		return
+	}
+	userCache.(*caches.UserCache).OnKnock(ctx, p.RoomID, knockState)
+}
+
 func (h *SyncLiveHandler) OnLeftRoom(p *pubsub.V2LeaveRoom) {
 	ctx, task := internal.StartTask(context.Background(), "OnLeftRoom")
 	defer task.End()
@@ -720,6 +911,14 @@ func (h *SyncLiveHandler) OnTyping(p *pubsub.V2Typing) {
 	h.Dispatcher.OnEphemeralEvent(ctx, p.RoomID, p.EphemeralEvent)
 }
 
+func (h *SyncLiveHandler) OnPresence(p *pubsub.V2Presence) {
+	ctx, task := internal.StartTask(context.Background(), "OnPresence")
+	defer task.End()
+	for _, presence := range p.Presence {
+		h.Dispatcher.OnPresence(ctx, presence)
+	}
+}
+
 func (h *SyncLiveHandler) OnAccountData(p *pubsub.V2AccountData) {
 	ctx, task := internal.StartTask(context.Background(), "OnAccountData")
 	defer task.End()
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+// The longest time between checks for idle user caches.
+const maxUserCacheEvictionInterval = time.Minute
+
+// SetUserCacheIdleTTL configures how long a user cache is kept after the user has no connections.
+// Idle caches are unregistered from the dispatcher and dropped, and rebuilt from the database on
+// the user's next request. Zero disables eviction. Must be called before Listen.
+func (h *SyncLiveHandler) SetUserCacheIdleTTL(ttl time.Duration) {
+	h.userCacheIdleTTL = ttl
+}
+
+// touchUserCache marks this user's cache as in use. Must be called before loading the cache from
+// userCaches, so it cannot be evicted between loading it and creating a connection.
+func (h *SyncLiveHandler) touchUserCache(userID string, now time.Time) {
+	h.userCacheMu.Lock()
+	defer h.userCacheMu.Unlock()
+	h.userCacheLastUsed[userID] = now
+}
+
+// runUserCacheEvictor periodically evicts idle user caches and updates user cache metrics until
+// Teardown is called.
+func (h *SyncLiveHandler) runUserCacheEvictor() {
+	defer internal.ReportPanicsToSentry()
+	interval := h.userCacheIdleTTL
+	if interval <= 0 || interval > maxUserCacheEvictionInterval {
+		interval = maxUserCacheEvictionInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stopEvictor:
+			return
+		case now := <-ticker.C:
+			h.evictIdleUserCaches(now)
+		}
+	}
+}
+
+// evictIdleUserCaches removes user caches for users who have not had a connection for at least
+// userCacheIdleTTL, if set. Returns the number of caches evicted.
+func (h *SyncLiveHandler) evictIdleUserCaches(now time.Time) int {
+	h.userCacheMu.Lock()
+	defer h.userCacheMu.Unlock()
+	numEvicted := 0
+	numCaches := 0
+	sizeBytes := 0
+	h.userCaches.Range(func(key, value any) bool {
+		userID := key.(string)
+		if h.ConnMap.UserHasConns(userID) {
+			h.userCacheLastUsed[userID] = now
+		} else if h.userCacheIdleTTL > 0 && now.Sub(h.userCacheLastUsed[userID]) >= h.userCacheIdleTTL {
+			h.Dispatcher.Unregister(userID)
+			h.userCaches.Delete(userID)
+			delete(h.userCacheLastUsed, userID)
+			numEvicted++
+			return true
+		}
+		numCaches++
+		sizeBytes += value.(*caches.UserCache).ApproxSizeBytes()
+		return true
+	})
+	if numEvicted > 0 {
+		logger.Info().Int("evicted", numEvicted).Int("remaining", numCaches).Msg("evicted idle user caches")
+	}
+	if h.numUserCaches != nil {
+		h.numUserCaches.Set(float64(numCaches))
+		h.userCachesSizeBytes.Set(float64(sizeBytes))
+	}
+	return numEvicted
+}
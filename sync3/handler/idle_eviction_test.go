@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
+)
+
+type idleConnHandler struct{}
+
+func (h *idleConnHandler) OnIncomingRequest(ctx context.Context, cid sync3.ConnID, req *sync3.Request, isInitial bool) (*sync3.Response, error) {
+	return &sync3.Response{}, nil
+}
+func (h *idleConnHandler) OnUpdate(ctx context.Context, update caches.Update) {}
+func (h *idleConnHandler) Destroy()                                           {}
+func (h *idleConnHandler) Alive() bool                                        { return true }
+func (h *idleConnHandler) ApproxSizeBytes() int                               { return 0 }
+
+func TestEvictIdleUserCaches(t *testing.T) {
+	alice := "@alice:localhost"
+	bob := "@bob:localhost"
+	h := &SyncLiveHandler{
+		ConnMap:           sync3.NewConnMap(),
+		Dispatcher:        sync3.NewDispatcher(),
+		userCaches:        &sync.Map{},
+		userCacheLastUsed: make(map[string]time.Time),
+		userCacheIdleTTL:  time.Minute,
+	}
+	defer h.ConnMap.Teardown()
+	globalCache := caches.NewGlobalCache(nil)
+	start := time.Now()
+	for _, userID := range []string{alice, bob} {
+		h.touchUserCache(userID, start)
+		h.userCaches.Store(userID, caches.NewUserCache(userID, globalCache, nil, nil))
+	}
+	// alice has a connection, bob does not
+	h.ConnMap.CreateConn(sync3.ConnID{UserID: alice, DeviceID: "A"}, func() sync3.ConnHandler {
+		return &idleConnHandler{}
+	})
+
+	if evicted := h.evictIdleUserCaches(start.Add(30 * time.Second)); evicted != 0 {
+		t.Fatalf("evicted %d caches before the TTL", evicted)
+	}
+	if evicted := h.evictIdleUserCaches(start.Add(time.Minute)); evicted != 1 {
+		t.Fatalf("evicted %d caches, want 1", evicted)
+	}
+	if h.CacheForUser(bob) != nil {
+		t.Fatalf("idle cache for bob was not evicted")
+	}
+	if h.CacheForUser(alice) == nil {
+		t.Fatalf("cache for alice was evicted despite having a connection")
+	}
+
+	// once alice's connection closes, her cache is kept for the TTL from when it was last seen in use
+	h.ConnMap.CloseConnsForDevice(alice, "A")
+	// connections are closed asynchronously
+	for i := 0; h.ConnMap.UserHasConns(alice); i++ {
+		if i > 100 {
+			t.Fatalf("connection for alice was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if evicted := h.evictIdleUserCaches(start.Add(90 * time.Second)); evicted != 0 {
+		t.Fatalf("evicted %d caches before the TTL", evicted)
+	}
+	if evicted := h.evictIdleUserCaches(start.Add(2 * time.Minute)); evicted != 1 {
+		t.Fatalf("evicted %d caches, want 1", evicted)
+	}
+	if h.CacheForUser(alice) != nil {
+		t.Fatalf("idle cache for alice was not evicted")
+	}
+
+	// disabling eviction keeps caches forever
+	h.userCacheIdleTTL = 0
+	h.touchUserCache(bob, start)
+	h.userCaches.Store(bob, caches.NewUserCache(bob, globalCache, nil, nil))
+	if evicted := h.evictIdleUserCaches(start.Add(time.Hour)); evicted != 0 {
+		t.Fatalf("evicted %d caches with eviction disabled", evicted)
+	}
+}
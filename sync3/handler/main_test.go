@@ -0,0 +1,16 @@
+package handler
+
+import (
+	"os"
+	"testing"
+
+	"github.com/matrix-org/sliding-sync/testutils"
+)
+
+var postgresConnectionString = "user=xxxxx dbname=syncv3_test sslmode=disable"
+
+func TestMain(m *testing.M) {
+	postgresConnectionString = testutils.PrepareDBConnectionString()
+	exitCode := m.Run()
+	os.Exit(exitCode)
+}
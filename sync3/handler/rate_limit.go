@@ -0,0 +1,130 @@
+package handler
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimits configures rate limiting of sliding sync requests. A zero rate disables that limit.
+type RateLimits struct {
+	// The sustained number of requests per second allowed for each user, across all their devices.
+	UserRequestsPerSec float64
+	// The number of requests a user can make in a burst above the sustained rate.
+	UserBurst int
+	// The sustained number of requests per second allowed for each client IP.
+	IPRequestsPerSec float64
+	// The number of requests an IP can make in a burst above the sustained rate.
+	IPBurst int
+	// The number of reverse proxies in front of the proxy which append to X-Forwarded-For. If
+	// positive, the client IP is the X-Forwarded-For entry this many entries from the right, as
+	// entries to the left of it could have been set by the client. Only set this when the proxy is
+	// behind reverse proxies which append to this header, else clients can spoof their IP.
+	TrustedProxies int
+}
+
+// clientIP returns the IP address of the client making this request.
+func (rl RateLimits) clientIP(req *http.Request) string {
+	if rl.TrustedProxies > 0 {
+		var ips []string
+		for _, xff := range req.Header.Values("X-Forwarded-For") {
+			for _, ip := range strings.Split(xff, ",") {
+				if ip = strings.TrimSpace(ip); ip != "" {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		if len(ips) > 0 {
+			// If there are fewer entries than trusted proxies, they were all set by trusted proxies
+			// and the leftmost is the client.
+			i := len(ips) - rl.TrustedProxies
+			if i < 0 {
+				i = 0
+			}
+			return ips[i]
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter is a token bucket rate limiter keyed by an arbitrary string, e.g a user ID.
+// Each key has a bucket of up to `burst` tokens which refills at `rate` tokens per second, and
+// each request consumes one token.
+type RateLimiter struct {
+	rate      float64
+	burst     float64
+	mu        *sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter makes a new RateLimiter. Returns nil if rate is not positive, which allows all
+// requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		mu:      &sync.Mutex{},
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow returns true if a request for this key is allowed at this time. If it isn't, returns how
+// long the caller should wait before retrying.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maybeSweep(now)
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{
+			tokens:  l.burst,
+			updated: now,
+		}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// maybeSweep removes buckets which would have refilled completely, as they are indistinguishable
+// from new buckets. This stops the map growing forever. Must be called with the lock held.
+func (l *RateLimiter) maybeSweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	refillTime := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= refillTime {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurstThenRefills(t *testing.T) {
+	l := NewRateLimiter(2, 3) // 2 req/s, burst of 3
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("@alice:localhost", now); !ok {
+			t.Fatalf("request %d: got rate limited within burst", i)
+		}
+	}
+	ok, wait := l.Allow("@alice:localhost", now)
+	if ok {
+		t.Fatalf("request beyond burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Fatalf("got retry after %v want 500ms", wait)
+	}
+	// other keys are unaffected
+	if ok, _ := l.Allow("@bob:localhost", now); !ok {
+		t.Fatalf("different key got rate limited")
+	}
+	// after waiting, one more token is available
+	now = now.Add(wait)
+	if ok, _ := l.Allow("@alice:localhost", now); !ok {
+		t.Fatalf("request after waiting was rate limited")
+	}
+	if ok, _ := l.Allow("@alice:localhost", now); ok {
+		t.Fatalf("second request after waiting was allowed")
+	}
+}
+
+func TestRateLimiterSweepsIdleBuckets(t *testing.T) {
+	l := NewRateLimiter(1, 1)
+	now := time.Now()
+	l.Allow("a", now)
+	l.Allow("b", now.Add(time.Minute))
+	// the sweep at now+2m should remove both buckets, then re-add "c"
+	l.Allow("c", now.Add(2*time.Minute))
+	if len(l.buckets) != 1 {
+		t.Fatalf("got %d buckets want 1", len(l.buckets))
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	l := NewRateLimiter(0, 10)
+	if l != nil {
+		t.Fatalf("NewRateLimiter with zero rate should return nil")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow("a", time.Now()); !ok {
+			t.Fatalf("nil limiter rate limited a request")
+		}
+	}
+}
+
+func TestRateLimitsClientIP(t *testing.T) {
+	testCases := []struct {
+		name           string
+		trustedProxies int
+		remote         string
+		xff            []string
+		want           string
+	}{
+		{name: "remote addr", remote: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "ipv6 remote addr", remote: "[::1]:1234", want: "::1"},
+		{name: "untrusted XFF ignored", remote: "10.0.0.1:1234", xff: []string{"1.2.3.4"}, want: "10.0.0.1"},
+		{name: "trusted XFF", trustedProxies: 1, remote: "10.0.0.1:1234", xff: []string{"1.2.3.4"}, want: "1.2.3.4"},
+		{name: "trusted XFF ignores spoofed entries", trustedProxies: 1, remote: "10.0.0.1:1234", xff: []string{"6.6.6.6, 1.2.3.4"}, want: "1.2.3.4"},
+		{name: "trusted XFF with 2 proxies", trustedProxies: 2, remote: "10.0.0.1:1234", xff: []string{"6.6.6.6, 1.2.3.4, 10.0.0.2"}, want: "1.2.3.4"},
+		{name: "trusted XFF over multiple headers", trustedProxies: 2, remote: "10.0.0.1:1234", xff: []string{"6.6.6.6, 1.2.3.4", "10.0.0.2"}, want: "1.2.3.4"},
+		{name: "trusted XFF with fewer entries than proxies", trustedProxies: 3, remote: "10.0.0.1:1234", xff: []string{"1.2.3.4, 10.0.0.2"}, want: "1.2.3.4"},
+		{name: "trusted XFF missing", trustedProxies: 1, remote: "10.0.0.1:1234", want: "10.0.0.1"},
+	}
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("POST", "http://localhost", nil)
+		req.RemoteAddr = tc.remote
+		for _, xff := range tc.xff {
+			req.Header.Add("X-Forwarded-For", xff)
+		}
+		got := RateLimits{TrustedProxies: tc.trustedProxies}.clientIP(req)
+		if got != tc.want {
+			t.Errorf("%s: got %s want %s", tc.name, got, tc.want)
+		}
+	}
+}
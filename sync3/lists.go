@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 )
 
 type OverwriteVal bool
@@ -55,6 +56,27 @@ func NewInternalRequestLists() *InternalRequestLists {
 	}
 }
 
+// ApproxSizeBytes returns a rough estimate of the memory used by these lists.
+func (s *InternalRequestLists) ApproxSizeBytes() int {
+	size := 0
+	for _, r := range s.allRooms {
+		size += approxRoomConnMetadataBytes + approxListEntryBytes*(len(r.Heroes)+len(r.LatestEventsByType)+
+			len(r.ChildSpaceRooms)+len(r.LastInterestedEventTimestamps)+len(r.Spaces)+len(r.Tags))
+		for _, id := range []*caches.InviteData{r.Invite, r.Knock} {
+			if id == nil {
+				continue
+			}
+			for _, ev := range id.InviteState {
+				size += len(ev)
+			}
+		}
+	}
+	for _, list := range s.lists {
+		size += approxListEntryBytes * int(list.Len())
+	}
+	return size
+}
+
 func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 	existing, exists := s.allRooms[r.RoomID]
 	if exists {
@@ -104,7 +126,7 @@ func (s *InternalRequestLists) SetRoom(r RoomConnMetadata) (delta RoomDelta) {
 	s.allRooms[r.RoomID] = &r
 
 	for listKey, list := range s.lists {
-		_, alreadyExists := list.roomIDToIndex[r.RoomID]
+		_, alreadyExists := list.roomIDToNode[r.RoomID]
 		shouldExist := list.filter.Include(&r, s)
 		if shouldExist && r.HasLeft {
 			shouldExist = false
@@ -206,6 +228,38 @@ func (s *InternalRequestLists) ListsByVisibleRoomIDs(muxedReqLists map[string]Re
 	return listsByRoomIDs
 }
 
+// ListsByRoomIDs builds a map from room IDs to a slice of list names, like ListsByVisibleRoomIDs,
+// but includes every room in each list rather than only those in the sliding windows.
+//
+// The returned map is a copy, i.e. is safe to modify by the caller.
+func (s *InternalRequestLists) ListsByRoomIDs() map[string][]string {
+	listsByRoomIDs := make(map[string][]string, len(s.allRooms))
+	for listKey, list := range s.lists {
+		if list.SortableRooms == nil {
+			continue
+		}
+		for _, roomID := range list.RoomIDs() {
+			listsByRoomIDs[roomID] = append(listsByRoomIDs[roomID], listKey)
+		}
+	}
+	return listsByRoomIDs
+}
+
+// ListsForRoom returns the names of the lists which include this room, whether or not it is in the
+// sliding windows. Unlike ListsByRoomIDs, this does not need to look at every room.
+func (s *InternalRequestLists) ListsForRoom(roomID string) []string {
+	var listKeys []string
+	for listKey, list := range s.lists {
+		if list.SortableRooms == nil {
+			continue
+		}
+		if _, ok := list.IndexOf(roomID); ok {
+			listKeys = append(listKeys, listKey)
+		}
+	}
+	return listKeys
+}
+
 // Assign a new list at the given key. If Overwrite, any existing list is replaced. If DoNotOverwrite, the existing
 // list is returned if one exists, else a new list is created. Returns the list and true if the list was overwritten.
 func (s *InternalRequestLists) AssignList(ctx context.Context, listKey string, filters *RequestFilters, sort []string, shouldOverwrite OverwriteVal) (*FilteredSortableRooms, bool) {
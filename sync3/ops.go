@@ -9,6 +9,7 @@ type List interface {
 	IndexOf(roomID string) (int, bool)
 	Len() int64
 	Sort(sortBy []string) error
+	Reposition(roomID string, sortBy []string) error
 	Add(roomID string) bool
 	Remove(roomID string) int
 	Get(index int) string
@@ -48,7 +49,7 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 		wasInsideRange = false // can't be inside the range if this is a new room
 		list.Add(roomID)
 		// this should only move exactly 1 room at most as this is called for every single update
-		if err := list.Sort(reqList.Sort); err != nil {
+		if err := list.Reposition(roomID, reqList.Sort); err != nil {
 			logger.Err(err).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
@@ -66,7 +67,7 @@ func CalculateListOps(ctx context.Context, reqList *RequestList, list List, room
 		}
 	case ListOpChange:
 		// this should only move exactly 1 room at most as this is called for every single update
-		if err := list.Sort(reqList.Sort); err != nil {
+		if err := list.Reposition(roomID, reqList.Sort); err != nil {
 			logger.Err(err).Msg("cannot sort list")
 			internal.GetSentryHubFromContextOrDefault(ctx).CaptureException(err)
 		}
@@ -808,6 +808,9 @@ func (s *stringList) Sort(sortBy []string) error {
 	}
 	return nil
 }
+func (s *stringList) Reposition(roomID string, sortBy []string) error {
+	return s.Sort(sortBy)
+}
 func (s *stringList) Add(roomID string) bool {
 	_, ok := s.roomIDToIndex[roomID]
 	if ok {
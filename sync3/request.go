@@ -33,6 +33,9 @@ type Request struct {
 	RoomSubscriptions map[string]RoomSubscription `json:"room_subscriptions"`
 	UnsubscribeRooms  []string                    `json:"unsubscribe_rooms"`
 	Extensions        extensions.Request          `json:"extensions"`
+	// Notification counts calculated by the client for encrypted rooms, which the homeserver cannot
+	// calculate correctly. Not sticky.
+	NotificationHints map[string]NotificationHint `json:"notification_hints,omitempty"`
 
 	// set via query params or inferred
 	pos          int64
@@ -46,9 +49,21 @@ func (r *Request) Validate() error {
 	if len(r.TxnID) > 64 {
 		return fmt.Errorf("txn_id is too long: %d > 64", len(r.TxnID))
 	}
+	for roomID, hint := range r.NotificationHints {
+		if hint.HighlightCount < 0 || hint.NotificationCount < 0 {
+			return fmt.Errorf("notification_hints for %s has a negative count", roomID)
+		}
+	}
 	return nil
 }
 
+// NotificationHint is a client-calculated notification count for a room, typically after
+// decrypting events and evaluating push rules against them.
+type NotificationHint struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
+}
+
 type RequestList struct {
 	RoomSubscription
 	Ranges          SliceRanges     `json:"ranges"`
@@ -475,6 +490,7 @@ type RequestFilters struct {
 	IsDM           *bool     `json:"is_dm"`
 	IsEncrypted    *bool     `json:"is_encrypted"`
 	IsInvite       *bool     `json:"is_invite"`
+	IsKnock        *bool     `json:"is_knock"`
 	IsTombstoned   *bool     `json:"is_tombstoned"` // deprecated
 	RoomTypes      []*string `json:"room_types"`
 	NotRoomTypes   []*string `json:"not_room_types"`
@@ -491,7 +507,7 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 		// should we exclude this room? If we have _joined_ the successor room then yes because
 		// this room must therefore be old, else no.
 		nextRoom := finder.ReadOnlyRoom(*r.UpgradedRoomID)
-		if nextRoom != nil && !nextRoom.HasLeft && !nextRoom.IsInvite {
+		if nextRoom != nil && !nextRoom.HasLeft && !nextRoom.IsInvite && !nextRoom.IsKnock {
 			return false
 		}
 	}
@@ -507,6 +523,9 @@ func (rf *RequestFilters) Include(r *RoomConnMetadata, finder RoomFinder) bool {
 	if rf.IsInvite != nil && *rf.IsInvite != r.IsInvite {
 		return false
 	}
+	if rf.IsKnock != nil && *rf.IsKnock != r.IsKnock {
+		return false
+	}
 	if rf.RoomNameFilter != "" && !strings.Contains(strings.ToLower(internal.CalculateRoomName(&r.RoomMetadata, 5)), strings.ToLower(rf.RoomNameFilter)) {
 		return false
 	}
@@ -567,6 +586,13 @@ func (rs RoomSubscription) RequiredStateChanged(other RoomSubscription) bool {
 	return false
 }
 
+// RequiredStateKey returns a string which is the same for subscriptions with the same required_state,
+// in the same order.
+func (rs RoomSubscription) RequiredStateKey() string {
+	key, _ := json.Marshal(rs.RequiredState)
+	return string(key)
+}
+
 func (rs RoomSubscription) LazyLoadMembers() bool {
 	for _, tuple := range rs.RequiredState {
 		if tuple[0] == "m.room.member" && tuple[1] == StateKeyLazy {
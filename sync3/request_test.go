@@ -1131,3 +1131,22 @@ func jsonEqual(t *testing.T, name string, got, want interface{}) {
 func listPtr(l RequestList) *RequestList {
 	return &l
 }
+
+func TestRequestValidateNotificationHints(t *testing.T) {
+	valid := Request{
+		NotificationHints: map[string]NotificationHint{
+			"!a:localhost": {HighlightCount: 1, NotificationCount: 2},
+		},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Validate returned error for valid hints: %s", err)
+	}
+	invalid := Request{
+		NotificationHints: map[string]NotificationHint{
+			"!a:localhost": {HighlightCount: -1},
+		},
+	}
+	if err := invalid.Validate(); err == nil {
+		t.Fatalf("Validate returned no error for negative hints")
+	}
+}
@@ -46,6 +46,39 @@ func (r *Response) ListOps() int {
 	return num
 }
 
+// Rough sizes used when estimating the memory used by responses and lists.
+const (
+	approxResponseBytes         = 256
+	approxRoomBytes             = 256
+	approxListEntryBytes        = 64
+	approxRoomConnMetadataBytes = 512
+)
+
+// ApproxSizeBytes returns a rough estimate of the memory used by this response. Events account for
+// most of the size of a response so are counted precisely, whereas everything else is estimated.
+func (r *Response) ApproxSizeBytes() int {
+	size := approxResponseBytes
+	for _, list := range r.Lists {
+		for _, op := range list.Ops {
+			size += approxListEntryBytes * (1 + len(op.IncludedRoomIDs()))
+		}
+	}
+	for _, room := range r.Rooms {
+		size += approxRoomBytes
+		for _, events := range [][]json.RawMessage{room.RequiredState, room.Timeline, room.InviteState, room.KnockState} {
+			for _, ev := range events {
+				size += len(ev)
+			}
+		}
+	}
+	// extensions hold arbitrary data e.g to-device messages, so measure them properly
+	if r.Extensions.HasData(false) {
+		ext, _ := json.Marshal(r.Extensions)
+		size += len(ext)
+	}
+	return size
+}
+
 func (r *Response) RoomIDsToTimelineEventIDs() map[string][]string {
 	includedRoomIDs := make(map[string][]string)
 	for roomID := range r.Rooms {
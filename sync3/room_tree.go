@@ -0,0 +1,197 @@
+package sync3
+
+import (
+	"math/rand"
+)
+
+// roomNode is a node in a roomTree.
+type roomNode struct {
+	roomID   string
+	priority uint32
+	size     int // number of nodes in the subtree rooted at this node
+	left     *roomNode
+	right    *roomNode
+	parent   *roomNode
+}
+
+func nodeSize(n *roomNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// update recalculates the size of this node and points its children back at it. Must be called
+// whenever a child is replaced.
+func (n *roomNode) update() {
+	n.size = 1 + nodeSize(n.left) + nodeSize(n.right)
+	if n.left != nil {
+		n.left.parent = n
+	}
+	if n.right != nil {
+		n.right.parent = n
+	}
+}
+
+// roomTree is an ordered sequence of rooms, stored as a treap keyed on position rather than on
+// any property of the room. Rooms can be inserted and removed at any position, and the position
+// of a room found, in O(log n) expected time. The tree does not know how rooms are sorted:
+// callers decide where rooms go, by descending the tree from the root.
+type roomTree struct {
+	root *roomNode
+}
+
+// newRoomTree creates a tree holding these rooms in this order, in O(n) time. Returns the tree and
+// its nodes, in the same order as roomIDs.
+func newRoomTree(roomIDs []string) (roomTree, []*roomNode) {
+	nodes := make([]*roomNode, len(roomIDs))
+	// build a cartesian tree: nodes in order with heap ordered priorities. The stack holds the
+	// right spine of the tree built so far.
+	var stack []*roomNode
+	for i, roomID := range roomIDs {
+		n := &roomNode{roomID: roomID, priority: rand.Uint32(), size: 1}
+		nodes[i] = n
+		var last *roomNode
+		for len(stack) > 0 && stack[len(stack)-1].priority < n.priority {
+			last = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		}
+		n.left = last
+		if len(stack) > 0 {
+			stack[len(stack)-1].right = n
+		}
+		stack = append(stack, n)
+	}
+	if len(stack) == 0 {
+		return roomTree{}, nodes
+	}
+	t := roomTree{root: stack[0]}
+	fixSizes(t.root)
+	t.root.parent = nil
+	return t, nodes
+}
+
+// fixSizes recalculates sizes and parents for every node in this subtree.
+func fixSizes(n *roomNode) {
+	if n == nil {
+		return
+	}
+	fixSizes(n.left)
+	fixSizes(n.right)
+	n.update()
+}
+
+func (t *roomTree) len() int {
+	return nodeSize(t.root)
+}
+
+// at returns the node at this position. The position must be within the tree.
+func (t *roomTree) at(index int) *roomNode {
+	n := t.root
+	for n != nil {
+		leftSize := nodeSize(n.left)
+		if index < leftSize {
+			n = n.left
+		} else if index == leftSize {
+			return n
+		} else {
+			index -= leftSize + 1
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// rank returns the position of this node in the tree.
+func (t *roomTree) rank(n *roomNode) int {
+	r := nodeSize(n.left)
+	for n.parent != nil {
+		if n == n.parent.right {
+			r += nodeSize(n.parent.left) + 1
+		}
+		n = n.parent
+	}
+	return r
+}
+
+// insert adds this node at this position, shifting nodes at or after it along by one.
+func (t *roomTree) insert(index int, n *roomNode) {
+	n.left, n.right, n.parent = nil, nil, nil
+	n.size = 1
+	l, r := split(t.root, index)
+	t.root = merge(merge(l, n), r)
+	t.root.parent = nil
+}
+
+// remove removes this node from the tree.
+func (t *roomTree) remove(n *roomNode) {
+	l, r := split(t.root, t.rank(n))
+	_, r = split(r, 1)
+	t.root = merge(l, r)
+	if t.root != nil {
+		t.root.parent = nil
+	}
+}
+
+// roomIDs returns the room IDs at positions [i, j) in order.
+func (t *roomTree) roomIDs(i, j int) []string {
+	if i >= j {
+		return []string{}
+	}
+	roomIDs := make([]string, 0, j-i)
+	for n := t.at(i); n != nil && len(roomIDs) < j-i; n = next(n) {
+		roomIDs = append(roomIDs, n.roomID)
+	}
+	return roomIDs
+}
+
+// next returns the node after this one in the tree, or nil if this is the last node.
+func next(n *roomNode) *roomNode {
+	if n.right != nil {
+		n = n.right
+		for n.left != nil {
+			n = n.left
+		}
+		return n
+	}
+	for n.parent != nil && n == n.parent.right {
+		n = n.parent
+	}
+	return n.parent
+}
+
+// split splits this subtree into the first k nodes and the rest. The parent pointers of the
+// returned roots are not reset.
+func split(n *roomNode, k int) (*roomNode, *roomNode) {
+	if n == nil {
+		return nil, nil
+	}
+	if nodeSize(n.left) >= k {
+		l, r := split(n.left, k)
+		n.left = r
+		n.update()
+		return l, n
+	}
+	l, r := split(n.right, k-nodeSize(n.left)-1)
+	n.right = l
+	n.update()
+	return n, r
+}
+
+// merge joins two subtrees, where every node in a comes before every node in b.
+func merge(a, b *roomNode) *roomNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = merge(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = merge(a, b.left)
+	b.update()
+	return b
+}
@@ -2,6 +2,7 @@ package sync3
 
 import (
 	"fmt"
+	"math/rand"
 	"sort"
 
 	"github.com/matrix-org/sliding-sync/internal"
@@ -11,131 +12,206 @@ type RoomFinder interface {
 	ReadOnlyRoom(roomID string) *RoomConnMetadata
 }
 
-// SortableRooms represents a list of rooms which can be sorted and updated. Maintains mappings of
-// room IDs to current index positions after sorting.
+// SortableRooms represents a list of rooms which can be sorted and updated. Rooms are held in a
+// tree so that rooms can be added, removed and moved, and their index positions found, in O(log n)
+// time. Once sorted, moving a single room with Reposition is much cheaper than sorting every room.
 type SortableRooms struct {
-	finder        RoomFinder
-	listKey       string
-	roomIDs       []string
-	roomIDToIndex map[string]int // room_id -> index in rooms
+	finder       RoomFinder
+	listKey      string
+	tree         roomTree
+	roomIDToNode map[string]*roomNode
+
+	// the sort order and comparators from the last call to Sort
+	sortBy      []string
+	comparators []func(ri, rj *RoomConnMetadata) int
+	// rooms which have been added since the last call to Sort but have not been sorted into place
+	unsorted map[string]struct{}
 }
 
 func NewSortableRooms(finder RoomFinder, listKey string, rooms []string) *SortableRooms {
-	return &SortableRooms{
-		roomIDs:       rooms,
-		finder:        finder,
-		listKey:       listKey,
-		roomIDToIndex: make(map[string]int),
+	s := &SortableRooms{
+		finder:       finder,
+		listKey:      listKey,
+		roomIDToNode: make(map[string]*roomNode, len(rooms)),
+		unsorted:     make(map[string]struct{}),
+	}
+	s.setRoomIDs(rooms)
+	return s
+}
+
+// setRoomIDs replaces the contents of the list with these rooms, in this order.
+func (s *SortableRooms) setRoomIDs(roomIDs []string) {
+	var nodes []*roomNode
+	s.tree, nodes = newRoomTree(roomIDs)
+	s.roomIDToNode = make(map[string]*roomNode, len(roomIDs))
+	for _, n := range nodes {
+		s.roomIDToNode[n.roomID] = n
 	}
 }
 
 func (s *SortableRooms) IndexOf(roomID string) (int, bool) {
-	index, ok := s.roomIDToIndex[roomID]
-	return index, ok
+	n, ok := s.roomIDToNode[roomID]
+	if !ok {
+		return 0, false
+	}
+	return s.tree.rank(n), true
 }
 
 func (s *SortableRooms) RoomIDs() []string {
-	roomIDs := make([]string, len(s.roomIDs))
-	for i := range s.roomIDs {
-		roomIDs[i] = s.roomIDs[i]
-	}
-	return roomIDs
+	return s.tree.roomIDs(0, s.tree.len())
 }
 
-// Add a room to the list. Returns true if the room was added.
+// Add a room to the end of the list. Returns true if the room was added. Call Reposition to move
+// it into sorted position.
 func (s *SortableRooms) Add(roomID string) bool {
-	_, exists := s.roomIDToIndex[roomID]
+	_, exists := s.roomIDToNode[roomID]
 	if exists {
 		return false
 	}
-	s.roomIDs = append(s.roomIDs, roomID)
-	s.roomIDToIndex[roomID] = len(s.roomIDs) - 1
+	n := &roomNode{roomID: roomID, priority: rand.Uint32()}
+	s.tree.insert(s.tree.len(), n)
+	s.roomIDToNode[roomID] = n
+	s.unsorted[roomID] = struct{}{}
 	return true
 }
 
 func (s *SortableRooms) Get(index int) string {
 	// TODO: find a way to plumb a context into this assert
-	internal.Assert(fmt.Sprintf("index is within len(rooms) %v < %v", index, len(s.roomIDs)), index < len(s.roomIDs))
-	return s.roomIDs[index]
+	internal.Assert(fmt.Sprintf("index is within len(rooms) %v < %v", index, s.tree.len()), index < s.tree.len())
+	return s.tree.at(index).roomID
 }
 
 func (s *SortableRooms) Remove(roomID string) int {
-	index, ok := s.roomIDToIndex[roomID]
+	n, ok := s.roomIDToNode[roomID]
 	if !ok {
 		return -1
 	}
-	delete(s.roomIDToIndex, roomID)
-	// splice out index
-	s.roomIDs = append(s.roomIDs[:index], s.roomIDs[index+1:]...)
-	// re-update the map
-	for i := index; i < len(s.roomIDs); i++ {
-		s.roomIDToIndex[s.roomIDs[i]] = i
-	}
+	index := s.tree.rank(n)
+	s.tree.remove(n)
+	delete(s.roomIDToNode, roomID)
+	delete(s.unsorted, roomID)
 	return index
 }
 
 func (s *SortableRooms) Len() int64 {
-	return int64(len(s.roomIDs))
+	return int64(s.tree.len())
 }
 func (s *SortableRooms) Subslice(i, j int64) Subslicer {
 	// TODO: find a way to plumb a context.Context through to this assert
-	internal.Assert("i < j and are within len(rooms)", i < j && i < int64(len(s.roomIDs)) && j <= int64(len(s.roomIDs)))
-	return &SortableRooms{
-		roomIDs:       s.roomIDs[i:j],
-		roomIDToIndex: s.roomIDToIndex,
-	}
+	internal.Assert("i < j and are within len(rooms)", i < j && i < s.Len() && j <= s.Len())
+	return NewSortableRooms(s.finder, s.listKey, s.tree.roomIDs(int(i), int(j)))
 }
 
+// Sort every room in the list. Rooms which compare equal keep their existing order.
 func (s *SortableRooms) Sort(sortBy []string) error {
 	// TODO: find a way to plumb a context into this assert
 	internal.Assert("sortBy is not empty", len(sortBy) != 0)
-	comparators := []func(i, j int) int{}
+	comparators := []func(ri, rj *RoomConnMetadata) int{}
 	for _, sort := range sortBy {
 		switch sort {
 		case SortByHighlightCount:
-			comparators = append(comparators, s.comparatorSortByHighlightCount)
+			comparators = append(comparators, comparatorSortByHighlightCount)
 		case SortByNotificationCount:
-			comparators = append(comparators, s.comparatorSortByNotificationCount)
+			comparators = append(comparators, comparatorSortByNotificationCount)
 		case SortByName:
-			comparators = append(comparators, s.comparatorSortByName)
+			comparators = append(comparators, comparatorSortByName)
 		case SortByRecency:
 			comparators = append(comparators, s.comparatorSortByRecency)
 		case SortByNotificationLevel:
-			comparators = append(comparators, s.comparatorSortByNotificationLevel)
+			comparators = append(comparators, comparatorSortByNotificationLevel)
 		default:
 			return fmt.Errorf("unknown sort order: %s", sort)
 		}
 	}
-	sort.SliceStable(s.roomIDs, func(i, j int) bool {
-		for _, fn := range comparators {
-			val := fn(i, j)
-			if val == 1 {
-				return true
-			} else if val == -1 {
-				return false
-			}
-			// continue to next comparator as these are equal
-		}
-		// the two items are identical
-		return false
+	s.sortBy = append([]string(nil), sortBy...)
+	s.comparators = comparators
+
+	roomIDs := s.RoomIDs()
+	sort.SliceStable(roomIDs, func(i, j int) bool {
+		return s.less(roomIDs[i], roomIDs[j])
 	})
-	for i := range s.roomIDs {
-		s.roomIDToIndex[s.roomIDs[i]] = i
-	}
+	s.setRoomIDs(roomIDs)
+	s.unsorted = make(map[string]struct{})
+	return nil
+}
 
+// Reposition moves a single room, which has just been added or whose sort keys have changed, to
+// its sorted position. This is equivalent to calling Sort, provided no other room has changed since
+// the list was last sorted by sortBy, but only takes O(log n) time. Falls back to calling Sort if
+// the list is not sorted by sortBy.
+func (s *SortableRooms) Reposition(roomID string, sortBy []string) error {
+	n, ok := s.roomIDToNode[roomID]
+	delete(s.unsorted, roomID)
+	if !ok || len(s.unsorted) > 0 || !equalStrings(s.sortBy, sortBy) {
+		return s.Sort(sortBy)
+	}
+	index := s.tree.rank(n)
+	movesBefore := index > 0 && s.less(roomID, s.tree.at(index-1).roomID)
+	movesAfter := index < s.tree.len()-1 && s.less(s.tree.at(index+1).roomID, roomID)
+	if !movesBefore && !movesAfter {
+		return nil // already in the right place
+	}
+	s.tree.remove(n)
+	// A stable sort keeps rooms which compare equal in their existing order. Rooms equal to this one
+	// are all before it if it moves towards the start of the list, so it goes after them, and vice versa.
+	var newIndex int
+	if movesBefore {
+		newIndex = s.searchTree(func(other string) bool { return s.less(roomID, other) })
+	} else {
+		newIndex = s.searchTree(func(other string) bool { return !s.less(other, roomID) })
+	}
+	s.tree.insert(newIndex, n)
 	return nil
 }
 
-// Comparator functions: -1 = false, +1 = true, 0 = match
+// searchTree returns the index of the first room for which fn returns true. fn must be false for
+// every room before that index and true for every room after it.
+func (s *SortableRooms) searchTree(fn func(roomID string) bool) int {
+	index := 0
+	n := s.tree.root
+	for n != nil {
+		if fn(n.roomID) {
+			n = n.left
+		} else {
+			index += nodeSize(n.left) + 1
+			n = n.right
+		}
+	}
+	return index
+}
 
-func (s *SortableRooms) resolveRooms(i, j int) (ri, rj *RoomConnMetadata) {
-	ri = s.finder.ReadOnlyRoom(s.roomIDs[i])
-	rj = s.finder.ReadOnlyRoom(s.roomIDs[j])
-	return
+// less returns true if room i should be sorted before room j.
+func (s *SortableRooms) less(i, j string) bool {
+	ri := s.finder.ReadOnlyRoom(i)
+	rj := s.finder.ReadOnlyRoom(j)
+	for _, fn := range s.comparators {
+		val := fn(ri, rj)
+		if val == 1 {
+			return true
+		} else if val == -1 {
+			return false
+		}
+		// continue to next comparator as these are equal
+	}
+	// the two items are identical
+	return false
 }
 
-func (s *SortableRooms) comparatorSortByName(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Comparator functions: -1 = false, +1 = true, 0 = match
+
+func comparatorSortByName(ri, rj *RoomConnMetadata) int {
 	if ri.CanonicalisedName == rj.CanonicalisedName {
 		return 0
 	}
@@ -145,8 +221,7 @@ func (s *SortableRooms) comparatorSortByName(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func (s *SortableRooms) comparatorSortByRecency(ri, rj *RoomConnMetadata) int {
 	tsRi := ri.GetLastInterestedEventTimestamp(s.listKey)
 	tsRj := rj.GetLastInterestedEventTimestamp(s.listKey)
 	if tsRi == tsRj {
@@ -158,8 +233,7 @@ func (s *SortableRooms) comparatorSortByRecency(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func comparatorSortByHighlightCount(ri, rj *RoomConnMetadata) int {
 	if ri.HighlightCount == rj.HighlightCount {
 		return 0
 	}
@@ -169,8 +243,7 @@ func (s *SortableRooms) comparatorSortByHighlightCount(i, j int) int {
 	return -1
 }
 
-func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func comparatorSortByNotificationLevel(ri, rj *RoomConnMetadata) int {
 	// highlight rooms come first
 	if ri.HighlightCount > 0 && rj.HighlightCount > 0 {
 		return 0
@@ -202,8 +275,7 @@ func (s *SortableRooms) comparatorSortByNotificationLevel(i, j int) int {
 	return 0
 }
 
-func (s *SortableRooms) comparatorSortByNotificationCount(i, j int) int {
-	ri, rj := s.resolveRooms(i, j)
+func comparatorSortByNotificationCount(ri, rj *RoomConnMetadata) int {
 	if ri.NotificationCount == rj.NotificationCount {
 		return 0
 	}
@@ -1,6 +1,8 @@
 package sync3
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
@@ -99,10 +101,7 @@ func TestSortBySingleOperation(t *testing.T) {
 	sr := NewSortableRooms(f, listKey, f.roomIDs)
 	for sortBy, wantOrder := range wantMap {
 		sr.Sort(strings.Split(sortBy, " "))
-		var gotRoomIDs []string
-		for i := range sr.roomIDs {
-			gotRoomIDs = append(gotRoomIDs, sr.roomIDs[i])
-		}
+		gotRoomIDs := sr.RoomIDs()
 		for i := range wantOrder {
 			if wantOrder[i] != gotRoomIDs[i] {
 				t.Errorf("Sort: %s got %v want %v", sortBy, gotRoomIDs, wantOrder)
@@ -188,10 +187,7 @@ func TestSortByMultipleOperations(t *testing.T) {
 	sr := NewSortableRooms(f, listKey, f.roomIDs)
 	for _, tc := range testCases {
 		sr.Sort(tc.SortBy)
-		var gotRoomIDs []string
-		for i := range sr.roomIDs {
-			gotRoomIDs = append(gotRoomIDs, sr.roomIDs[i])
-		}
+		gotRoomIDs := sr.RoomIDs()
 		for i := range tc.WantRooms {
 			if tc.WantRooms[i] != gotRoomIDs[i] {
 				t.Errorf("Sort: %v got %v want %v", tc.SortBy, gotRoomIDs, tc.WantRooms)
@@ -365,10 +361,7 @@ func TestSortByNotificationLevel(t *testing.T) {
 	if err := sr.Sort([]string{SortByNotificationLevel, SortByRecency}); err != nil {
 		t.Fatalf("Sort: %s", err)
 	}
-	var gotRoomIDs []string
-	for i := range sr.roomIDs {
-		gotRoomIDs = append(gotRoomIDs, sr.roomIDs[i])
-	}
+	gotRoomIDs := sr.RoomIDs()
 	// we expect the rooms to be grouped in this order:
 	// HIGHLIGHT COUNT > 0
 	// ENCRYPTED, NOTIF COUNT > 0
@@ -387,3 +380,84 @@ func TestSortByNotificationLevel(t *testing.T) {
 		t.Errorf("want: %v", wantRoomIDs)
 	}
 }
+
+// Test that moving rooms one at a time with Reposition gives the same order as sorting every room.
+func TestSortableRoomsReposition(t *testing.T) {
+	const listKey = "my_list"
+	rng := rand.New(rand.NewSource(42))
+	randomRoom := func(roomID string) *RoomConnMetadata {
+		// use small ranges of values so that lots of rooms compare equal
+		return &RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    roomID,
+				Encrypted: rng.Intn(2) == 0,
+			},
+			UserRoomData: caches.UserRoomData{
+				HighlightCount:    rng.Intn(2),
+				NotificationCount: rng.Intn(3),
+				CanonicalisedName: fmt.Sprintf("room %d", rng.Intn(20)),
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: uint64(rng.Intn(50))},
+		}
+	}
+	for _, sortBy := range [][]string{
+		{SortByRecency},
+		{SortByName},
+		{SortByNotificationLevel, SortByRecency},
+		{SortByHighlightCount, SortByNotificationCount, SortByName},
+	} {
+		var rooms []*RoomConnMetadata
+		for i := 0; i < 100; i++ {
+			rooms = append(rooms, randomRoom(fmt.Sprintf("!%d:localhost", i)))
+		}
+		f := newFinder(rooms)
+		sr := NewSortableRooms(f, listKey, f.roomIDs)
+		if err := sr.Sort(sortBy); err != nil {
+			t.Fatalf("Sort: %s", err)
+		}
+		nextRoomID := len(rooms)
+		for i := 0; i < 1000; i++ {
+			roomIDs := sr.RoomIDs()
+			switch rng.Intn(4) {
+			case 0: // add a room
+				roomID := fmt.Sprintf("!%d:localhost", nextRoomID)
+				nextRoomID++
+				f.rooms[roomID] = randomRoom(roomID)
+				sr.Add(roomID)
+				roomIDs = append(roomIDs, roomID)
+				if err := sr.Reposition(roomID, sortBy); err != nil {
+					t.Fatalf("Reposition: %s", err)
+				}
+			case 1: // remove a room
+				index := rng.Intn(len(roomIDs))
+				if got := sr.Remove(roomIDs[index]); got != index {
+					t.Fatalf("Remove: got index %d want %d", got, index)
+				}
+				roomIDs = append(roomIDs[:index], roomIDs[index+1:]...)
+			default: // change a room
+				roomID := roomIDs[rng.Intn(len(roomIDs))]
+				f.rooms[roomID] = randomRoom(roomID)
+				if err := sr.Reposition(roomID, sortBy); err != nil {
+					t.Fatalf("Reposition: %s", err)
+				}
+			}
+			want := NewSortableRooms(f, listKey, roomIDs)
+			if err := want.Sort(sortBy); err != nil {
+				t.Fatalf("Sort: %s", err)
+			}
+			wantRoomIDs := want.RoomIDs()
+			gotRoomIDs := sr.RoomIDs()
+			if !reflect.DeepEqual(gotRoomIDs, wantRoomIDs) {
+				t.Fatalf("%v: after %d operations got %v want %v", sortBy, i, gotRoomIDs, wantRoomIDs)
+			}
+			for j, roomID := range wantRoomIDs {
+				if index, ok := sr.IndexOf(roomID); !ok || index != j {
+					t.Fatalf("%v: IndexOf(%s) got %v,%v want %v", sortBy, roomID, index, ok, j)
+				}
+				if got := sr.Get(j); got != roomID {
+					t.Fatalf("%v: Get(%d) got %v want %v", sortBy, j, got, roomID)
+				}
+			}
+		}
+	}
+}
@@ -53,6 +53,42 @@ func (t *JoinedRoomsTracker) Startup(roomToJoinedUsers map[string][]string) {
 	}
 }
 
+// StartupInvited sets up the invited users for each room. Like Startup, this isn't safe to call
+// with live traffic.
+func (t *JoinedRoomsTracker) StartupInvited(roomToInvitedUsers map[string][]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for roomID, userIDs := range roomToInvitedUsers {
+		users := make(set, len(userIDs))
+		for _, u := range userIDs {
+			users[u] = struct{}{}
+		}
+		t.roomIDToInvitedUsers[roomID] = users
+	}
+}
+
+// Snapshot returns a copy of the joined and invited users for each room, in the form accepted by
+// Startup and StartupInvited.
+func (t *JoinedRoomsTracker) Snapshot() (roomToJoinedUsers, roomToInvitedUsers map[string][]string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	toSlices := func(m map[string]set) map[string][]string {
+		result := make(map[string][]string, len(m))
+		for roomID, users := range m {
+			if len(users) == 0 {
+				continue
+			}
+			userIDs := make([]string, 0, len(users))
+			for u := range users {
+				userIDs = append(userIDs, u)
+			}
+			result[roomID] = userIDs
+		}
+		return result
+	}
+	return toSlices(t.roomIDToJoinedUsers), toSlices(t.roomIDToInvitedUsers)
+}
+
 func (t *JoinedRoomsTracker) IsUserJoined(userID, roomID string) bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
@@ -166,6 +202,40 @@ func (t *JoinedRoomsTracker) JoinedUsersForRoom(roomID string, filter func(userI
 	return matchedUserIDs, n
 }
 
+// UsersSharingRoomsWith returns the users in candidateUserIDs who are joined to at least one room
+// that the given user is joined to. The given user is not included. This only looks at the rooms of
+// the candidates, so is cheap for a few candidates even if the user's rooms have many members.
+func (t *JoinedRoomsTracker) UsersSharingRoomsWith(userID string, candidateUserIDs []string) (matchedUserIDs []string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rooms := t.userIDToJoinedRooms[userID]
+	if len(rooms) == 0 {
+		return nil
+	}
+	for _, otherUserID := range candidateUserIDs {
+		if otherUserID == userID {
+			continue
+		}
+		if sharesRoom(rooms, t.userIDToJoinedRooms[otherUserID]) {
+			matchedUserIDs = append(matchedUserIDs, otherUserID)
+		}
+	}
+	return matchedUserIDs
+}
+
+// sharesRoom returns true if these sets of rooms have a room in common.
+func sharesRoom(a, b set) bool {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	for roomID := range a {
+		if _, ok := b[roomID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *JoinedRoomsTracker) UsersInvitedToRoom(userIDs []string, roomID string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -83,6 +83,23 @@ func TestTrackerStartup(t *testing.T) {
 	assertInt(t, jrt.NumInvitedUsersForRoom(roomC), 0)
 }
 
+func TestTrackerUsersSharingRoomsWith(t *testing.T) {
+	jrt := NewJoinedRoomsTracker()
+	jrt.Startup(map[string][]string{
+		"!a": {"@alice", "@bob"},
+		"!b": {"@alice", "@bob", "@charlie"},
+		"!c": {"@doris"},
+	})
+	everyone := []string{"@alice", "@bob", "@charlie", "@doris", "@unknown"}
+	assertEqualSlices(t, "alice", jrt.UsersSharingRoomsWith("@alice", everyone), []string{"@bob", "@charlie"})
+	assertEqualSlices(t, "charlie", jrt.UsersSharingRoomsWith("@charlie", everyone), []string{"@alice", "@bob"})
+	assertEqualSlices(t, "doris", jrt.UsersSharingRoomsWith("@doris", everyone), nil)
+	assertEqualSlices(t, "unknown", jrt.UsersSharingRoomsWith("@unknown", everyone), nil)
+	assertEqualSlices(t, "candidates", jrt.UsersSharingRoomsWith("@alice", []string{"@charlie", "@doris"}), []string{"@charlie"})
+	jrt.UserLeftRoom("@charlie", "!b")
+	assertEqualSlices(t, "alice after charlie left", jrt.UsersSharingRoomsWith("@alice", everyone), []string{"@bob"})
+}
+
 func assertBool(t *testing.T, msg string, got, want bool) {
 	t.Helper()
 	if got != want {
@@ -110,3 +127,29 @@ func assertEqualSlices(t *testing.T, name string, got, want []string) {
 		}
 	}
 }
+
+func TestTrackerSnapshot(t *testing.T) {
+	jrt := NewJoinedRoomsTracker()
+	jrt.UserJoinedRoom("alice", "room1")
+	jrt.UserJoinedRoom("bob", "room1")
+	jrt.UserJoinedRoom("bob", "room2")
+	jrt.UserLeftRoom("bob", "room2")
+	jrt.UsersInvitedToRoom([]string{"charlie"}, "room1")
+	joined, invited := jrt.Snapshot()
+	if len(joined) != 1 {
+		t.Fatalf("got joined rooms %v, want only room1", joined)
+	}
+	assertEqualSlices(t, "joined", joined["room1"], []string{"alice", "bob"})
+	if len(invited) != 1 {
+		t.Fatalf("got invited rooms %v, want only room1", invited)
+	}
+	assertEqualSlices(t, "invited", invited["room1"], []string{"charlie"})
+
+	// a tracker started up from the snapshot has the same state
+	jrt2 := NewJoinedRoomsTracker()
+	jrt2.Startup(joined)
+	jrt2.StartupInvited(invited)
+	assertEqualSlices(t, "", jrt2.JoinedRoomsForUser("bob"), []string{"room1"})
+	assertEqualSlices(t, "", joinedUsersForRoom(jrt2, "room1"), []string{"alice", "bob"})
+	assertInt(t, jrt2.NumInvitedUsersForRoom("room1"), 1)
+}
@@ -3,11 +3,14 @@ package syncv3
 import (
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"testing"
 	"time"
 
+	"github.com/matrix-org/sliding-sync/internal"
 	"github.com/matrix-org/sliding-sync/sync2"
 	"github.com/matrix-org/sliding-sync/sync3"
+	"github.com/matrix-org/sliding-sync/sync3/caches"
 	"github.com/matrix-org/sliding-sync/testutils"
 	"github.com/rs/zerolog"
 )
@@ -99,3 +102,66 @@ func benchNumV2Rooms(numRooms int, b *testing.B) {
 		})
 	}
 }
+
+type benchRoomFinder map[string]*sync3.RoomConnMetadata
+
+func (f benchRoomFinder) ReadOnlyRoom(roomID string) *sync3.RoomConnMetadata {
+	return f[roomID]
+}
+
+// The purpose of this benchmark is to compare the cost of moving a single room in a sorted list, as
+// happens for every new event, against re-sorting the whole list. Moving a room should grow with
+// O(log n) in the number of rooms, whereas sorting grows with O(n log n).
+func BenchmarkSortableRoomsMoveRoom(b *testing.B) {
+	for _, numRooms := range []int{1000, 5000, 10000} {
+		n := numRooms
+		b.Run(fmt.Sprintf("reposition_num_rooms_%d", n), func(b *testing.B) {
+			benchSortableRoomsMoveRoom(n, b, func(list *sync3.SortableRooms, roomID string, sortBy []string) error {
+				return list.Reposition(roomID, sortBy)
+			})
+		})
+		b.Run(fmt.Sprintf("sort_num_rooms_%d", n), func(b *testing.B) {
+			benchSortableRoomsMoveRoom(n, b, func(list *sync3.SortableRooms, roomID string, sortBy []string) error {
+				return list.Sort(sortBy)
+			})
+		})
+	}
+}
+
+func benchSortableRoomsMoveRoom(numRooms int, b *testing.B, moveRoom func(list *sync3.SortableRooms, roomID string, sortBy []string) error) {
+	const listKey = "a"
+	sortBy := []string{sync3.SortByNotificationLevel, sync3.SortByRecency}
+	finder := make(benchRoomFinder, numRooms)
+	roomIDs := make([]string, numRooms)
+	for i := 0; i < numRooms; i++ {
+		roomIDs[i] = fmt.Sprintf("!benchSortableRooms_%d:localhost", i)
+		finder[roomIDs[i]] = &sync3.RoomConnMetadata{
+			RoomMetadata: internal.RoomMetadata{
+				RoomID:    roomIDs[i],
+				Encrypted: i%2 == 0,
+			},
+			UserRoomData: caches.UserRoomData{
+				NotificationCount: i % 3,
+			},
+			LastInterestedEventTimestamps: map[string]uint64{listKey: uint64(i)},
+		}
+	}
+	list := sync3.NewSortableRooms(finder, listKey, roomIDs)
+	if err := list.Sort(sortBy); err != nil {
+		b.Fatalf("Sort: %s", err)
+	}
+	rng := rand.New(rand.NewSource(42))
+	ts := uint64(numRooms)
+
+	b.ResetTimer() // don't count setup code
+
+	for n := 0; n < b.N; n++ {
+		// a new event arrives in a random room, moving it to the top of its notification level
+		roomID := roomIDs[rng.Intn(numRooms)]
+		ts++
+		finder[roomID].LastInterestedEventTimestamps[listKey] = ts
+		if err := moveRoom(list, roomID, sortBy); err != nil {
+			b.Fatalf("failed to move room: %s", err)
+		}
+	}
+}
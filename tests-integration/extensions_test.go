@@ -2,6 +2,7 @@ package syncv3
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -195,6 +196,186 @@ func TestExtensionE2EE(t *testing.T) {
 	}
 }
 
+// Checks that device list changes acknowledged on one connection are still sent on another
+// connection for the same device which has not received them.
+func TestExtensionE2EEDeviceListsMultipleConnections(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	v2.addAccount(t, alice, aliceToken)
+	wantChanged := []string{"bob"}
+	v2.queueResponse(alice, sync2.SyncResponse{
+		DeviceLists: struct {
+			Changed []string `json:"changed,omitempty"`
+			Left    []string `json:"left,omitempty"`
+		}{
+			Changed: wantChanged,
+		},
+	})
+	e2eeRequest := func(connID, since string) sync3.Request {
+		return sync3.Request{
+			ConnID: connID,
+			Extensions: extensions.Request{
+				E2EE: &extensions.E2EERequest{
+					Core:  extensions.Core{Enabled: &boolTrue},
+					Since: since,
+				},
+			},
+		}
+	}
+
+	// connection A receives and acknowledges the changes, both explicitly and implicitly
+	res := v3.mustDoV3Request(t, aliceToken, e2eeRequest("A", ""))
+	m.MatchResponse(t, res, m.MatchDeviceLists(wantChanged, []string{}))
+	req := e2eeRequest("A", res.Extensions.E2EE.NextBatch)
+	req.SetTimeoutMSecs(100)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	m.MatchResponse(t, res, m.MatchNoE2EEExtension())
+
+	// connection B has not received them yet
+	res = v3.mustDoV3Request(t, aliceToken, e2eeRequest("B", ""))
+	m.MatchResponse(t, res, m.MatchDeviceLists(wantChanged, []string{}))
+}
+
+// Checks that a connection without a since token receives a backlog of device list changes over
+// several responses rather than all at once.
+func TestExtensionE2EEDeviceListsPaginated(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	v2.addAccount(t, alice, aliceToken)
+	var wantChanged []string
+	for i := 0; i < 1200; i++ {
+		wantChanged = append(wantChanged, fmt.Sprintf("@user%d:localhost", i))
+	}
+	v2.queueResponse(alice, sync2.SyncResponse{
+		DeviceLists: struct {
+			Changed []string `json:"changed,omitempty"`
+			Left    []string `json:"left,omitempty"`
+		}{
+			Changed: wantChanged,
+		},
+	})
+
+	gotChanged := make(map[string]struct{})
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Extensions: extensions.Request{
+			E2EE: &extensions.E2EERequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+		},
+	})
+	for numResponses := 1; ; numResponses++ {
+		if res.Extensions.E2EE == nil || res.Extensions.E2EE.DeviceLists == nil {
+			break
+		}
+		if numResponses == 1 && len(res.Extensions.E2EE.DeviceLists.Changed) == len(wantChanged) {
+			t.Fatalf("all %d device list changes were returned at once", len(wantChanged))
+		}
+		for _, userID := range res.Extensions.E2EE.DeviceLists.Changed {
+			if _, exists := gotChanged[userID]; exists {
+				t.Fatalf("device list change for %s was returned twice", userID)
+			}
+			gotChanged[userID] = struct{}{}
+		}
+		if numResponses > len(wantChanged) {
+			t.Fatalf("device list changes were not paginated forwards")
+		}
+		req := sync3.Request{
+			Extensions: extensions.Request{
+				E2EE: &extensions.E2EERequest{
+					Since: res.Extensions.E2EE.NextBatch,
+				},
+			},
+		}
+		req.SetTimeoutMSecs(100)
+		res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	}
+	if len(gotChanged) != len(wantChanged) {
+		t.Errorf("got %d device list changes, want %d", len(gotChanged), len(wantChanged))
+	}
+}
+
+// Checks that the key_status extension only reports changes when the user's cross-signing account
+// data actually changes, and not when their own device list changes (e.g a new device logging in).
+func TestExtensionKeyStatusAccountData(t *testing.T) {
+	pqString := testutils.PrepareDBConnectionString()
+	v2 := runTestV2Server(t)
+	v3 := runTestServer(t, v2, pqString)
+	defer v2.close()
+	defer v3.close()
+	masterKey := func(key string) json.RawMessage {
+		return testutils.NewAccountData(t, "m.cross_signing.master", map[string]interface{}{
+			"encrypted": map[string]interface{}{"key": key},
+		})
+	}
+	v2.addAccount(t, alice, aliceToken)
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{masterKey("A")},
+		},
+		DeviceLists: struct {
+			Changed []string `json:"changed,omitempty"`
+			Left    []string `json:"left,omitempty"`
+		}{
+			Changed: []string{alice},
+		},
+	})
+
+	// a new connection has nothing to compare against, so reports nothing
+	res := v3.mustDoV3Request(t, aliceToken, sync3.Request{
+		Extensions: extensions.Request{
+			KeyStatus: &extensions.KeyStatusRequest{
+				Core: extensions.Core{Enabled: &boolTrue},
+			},
+		},
+	})
+	if res.Extensions.KeyStatus != nil {
+		t.Fatalf("key_status reported changes on a new connection: %+v", res.Extensions.KeyStatus)
+	}
+	req := sync3.Request{}
+	req.SetTimeoutMSecs(100)
+
+	// alice logging in on another device, and re-uploading the same keys, are not changes
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{masterKey("A")},
+		},
+		DeviceLists: struct {
+			Changed []string `json:"changed,omitempty"`
+			Left    []string `json:"left,omitempty"`
+		}{
+			Changed: []string{alice},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if res.Extensions.KeyStatus != nil {
+		t.Fatalf("key_status reported unchanged keys: %+v", res.Extensions.KeyStatus)
+	}
+
+	// resetting cross-signing is reported
+	v2.queueResponse(alice, sync2.SyncResponse{
+		AccountData: sync2.EventsResponse{
+			Events: []json.RawMessage{masterKey("B")},
+		},
+	})
+	v2.waitUntilEmpty(t, alice)
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if res.Extensions.KeyStatus == nil || !res.Extensions.KeyStatus.CrossSigningChanged || res.Extensions.KeyStatus.KeyBackupChanged {
+		t.Fatalf("key_status did not report cross-signing changes: %+v", res.Extensions.KeyStatus)
+	}
+	// but only once
+	res = v3.mustDoV3RequestWithPos(t, aliceToken, res.Pos, req)
+	if res.Extensions.KeyStatus != nil {
+		t.Fatalf("key_status reported changes twice: %+v", res.Extensions.KeyStatus)
+	}
+}
+
 // Checks that to-device messages are passed from v2 to v3
 // 1: check that a fresh sync returns to-device messages
 // 2: repeating the fresh sync request returns the same messages (not deleted)
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 )
 
 var Quiet = false
@@ -34,7 +35,27 @@ func currentUser() string {
 	return user.Username
 }
 
+// prepareSQLiteConnectionString returns a connection string for an empty SQLite database.
+func prepareSQLiteConnectionString() string {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("syncv3_test_%d.db", os.Getpid()))
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			panic(err)
+		}
+	}
+	return "sqlite:" + path
+}
+
+// useSQLite returns true if tests should run against SQLite rather than Postgres. Postgres is the
+// default, so SQLite must be asked for with SYNCV3_TEST_DB=sqlite.
+func useSQLite() bool {
+	return os.Getenv("SYNCV3_TEST_DB") == "sqlite"
+}
+
 func PrepareDBConnectionString() (connStr string) {
+	if useSQLite() {
+		return prepareSQLiteConnectionString()
+	}
 	// Required vars: user and db
 	// We'll try to infer from the local env if they are missing
 	user := os.Getenv("POSTGRES_USER")
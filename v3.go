@@ -13,6 +13,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/sliding-sync/internal"
+	"github.com/matrix-org/sliding-sync/migrations"
 	"github.com/matrix-org/sliding-sync/pubsub"
 	"github.com/matrix-org/sliding-sync/state"
 	"github.com/matrix-org/sliding-sync/sync2"
@@ -40,6 +41,43 @@ type Opts struct {
 
 	DBMaxConns        int
 	DBConnMaxIdleTime time.Duration
+
+	// If non-zero, a new or empty events table is partitioned by room ID into this many partitions. An
+	// existing table which holds events is only partitioned by 'syncv3 migrate partition-events'.
+	EventPartitions int
+
+	// If true, pollers coordinate so that only one poller fetches the timeline of each shared room.
+	// Reduces load on the homeserver and database, at the cost of some fidelity: see sync2.PollerMap.EnableRoomCoalescing.
+	CoalesceSharedRooms bool
+
+	// Per-user and per-IP rate limits for sliding sync requests. Zero values disable rate limiting.
+	RateLimits handler.RateLimits
+
+	// If true, evaluate push rules in the proxy to calculate notification counts for unencrypted
+	// rooms as new events arrive. Counts from the homeserver still take precedence.
+	EvaluatePushRules bool
+
+	// How long to keep a user's cache in memory after they have no connections. Zero keeps caches forever.
+	UserCacheIdleTTL time.Duration
+
+	// If non-zero, room metadata is loaded from the database on demand rather than all at once at
+	// startup, and metadata for roughly this many rooms is kept in memory. Rooms which a connected
+	// user is joined to are always kept.
+	MaxCachedRooms int
+
+	// How often to checkpoint the in-memory global state to the database. On startup, the latest
+	// checkpoint is loaded and only events stored after it are processed, which is much faster
+	// than building the state from every room in the database. Zero disables checkpoints.
+	CheckpointInterval time.Duration
+
+	// The approximate memory, in bytes, which a single connection and all connections together may
+	// use. Connections over a limit are expired, largest first. Zero disables a limit.
+	MaxConnMemoryBytes      int64
+	MaxTotalConnMemoryBytes int64
+
+	// The client used to talk to the upstream homeserver. If unset, uses a standard CS API
+	// sync2.HTTPClient pointed at the destination homeserver.
+	V2Client sync2.Client
 }
 
 type server struct {
@@ -71,13 +109,29 @@ func allowCORS(next http.Handler) http.HandlerFunc {
 // Setup the proxy
 func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Handler, http.Handler) {
 	// Setup shared DB and HTTP client
-	v2Client := &sync2.HTTPClient{
-		Client: &http.Client{
-			Timeout: 5 * time.Minute,
-		},
-		DestinationServer: destHomeserver,
+	v2Client := opts.V2Client
+	if v2Client == nil {
+		v2Client = &sync2.HTTPClient{
+			Client: &http.Client{
+				Timeout: 5 * time.Minute,
+			},
+			DestinationServer: destHomeserver,
+		}
 	}
-	store := state.NewStorage(postgresURI)
+	// Migrate the database before tables are created with the current schema. Use the configured
+	// client, so that fixture and replay runs never contact a real homeserver.
+	err := migrations.Up(postgresURI, migrations.Config{
+		Secret:          secret,
+		WhoAmIClient:    v2Client,
+		EventPartitions: opts.EventPartitions,
+	})
+	if err != nil {
+		sentry.CaptureException(err)
+		logger.Panic().Err(err).Msg("failed to migrate database")
+	}
+	store := state.NewStorageWithOptions(postgresURI, state.StorageOptions{
+		EventPartitions: opts.EventPartitions,
+	})
 	storev2 := sync2.NewStore(postgresURI, secret)
 	for _, db := range []*sqlx.DB{store.DB, storev2.DB} {
 		if opts.DBMaxConns > 0 {
@@ -101,6 +155,9 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	pubSub := pubsub.NewPubSub(bufferSize)
 
 	pMap := sync2.NewPollerMap(v2Client, opts.AddPrometheusMetrics)
+	if opts.CoalesceSharedRooms {
+		pMap.EnableRoomCoalescing()
+	}
 	// create v2 handler
 	h2, err := handler2.NewHandler(pMap, storev2, store, pubSub, pubSub, opts.AddPrometheusMetrics)
 	if err != nil {
@@ -113,12 +170,34 @@ func Setup(destHomeserver, postgresURI, secret string, opts Opts) (*handler2.Han
 	if err != nil {
 		panic(err)
 	}
-	storeSnapshot, err := store.GlobalSnapshot()
-	if err != nil {
-		panic(err)
+	h3.SetRateLimits(opts.RateLimits)
+	h3.SetEvaluatePushRules(opts.EvaluatePushRules)
+	h3.SetUserCacheIdleTTL(opts.UserCacheIdleTTL)
+	h3.SetCheckpointInterval(opts.CheckpointInterval)
+	h3.SetConnMemoryLimits(opts.MaxConnMemoryBytes, opts.MaxTotalConnMemoryBytes)
+	if opts.MaxCachedRooms > 0 {
+		h3.SetMaxCachedRooms(opts.MaxCachedRooms)
+	}
+	restored := false
+	if opts.CheckpointInterval > 0 {
+		restored, err = h3.StartupFromCheckpoint()
+		if err != nil {
+			panic(err)
+		}
+	}
+	if !restored {
+		var storeSnapshot state.StartupSnapshot
+		if opts.MaxCachedRooms > 0 {
+			storeSnapshot, err = store.GlobalSnapshotWithoutMetadata()
+		} else {
+			storeSnapshot, err = store.GlobalSnapshot()
+		}
+		if err != nil {
+			panic(err)
+		}
+		logger.Info().Msg("retrieved global snapshot from database")
+		h3.Startup(&storeSnapshot)
 	}
-	logger.Info().Msg("retrieved global snapshot from database")
-	h3.Startup(&storeSnapshot)
 
 	// begin consuming from these positions
 	h2.Listen()